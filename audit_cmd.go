@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aix3/fileserver/server"
+)
+
+const auditUsage = `usage: fileserver audit <command> [flags]
+
+Check and search the audit log written with -audit-log.
+
+commands:
+  verify -file <log>
+  query  -file <log> [-path /dir] [-user name] [-since time] [-until time]
+`
+
+// auditCommand runs "fileserver audit ..." and returns the exit code.
+func auditCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, auditUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("audit "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "audit log, as passed to -audit-log")
+
+	var run func() error
+	switch args[0] {
+	case "verify":
+		run = func() error {
+			return verifyAudit(stdout, *file)
+		}
+	case "query":
+		var q auditQuery
+		flags.StringVar(&q.path, "path", "", "only entries for this path or below it, including moves and copies to it")
+		flags.StringVar(&q.user, "user", "", "only entries of this user")
+		since := flags.String("since", "", `only entries at or after this time, as RFC 3339 or "2006-01-02"`)
+		until := flags.String("until", "", `only entries before this time, as RFC 3339 or "2006-01-02"`)
+		run = func() error {
+			var err error
+			if q.since, err = parseAuditTime("since", *since); err != nil {
+				return err
+			}
+			if q.until, err = parseAuditTime("until", *until); err != nil {
+				return err
+			}
+			return queryAudit(stdout, *file, q)
+		}
+	default:
+		fmt.Fprint(stderr, auditUsage)
+		return 2
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(stderr, "-file is required")
+		return 2
+	}
+	if err := run(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func verifyAudit(stdout io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries := 0
+	head, err := server.ReadAuditLog(f, func(int, *server.AuditEntry) error {
+		entries++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	fmt.Fprintf(stdout, "OK: %d entries, last hash %s\n", entries, head)
+	return nil
+}
+
+type auditQuery struct {
+	path         string
+	user         string
+	since, until time.Time
+}
+
+func (q auditQuery) match(e *server.AuditEntry) bool {
+	if q.user != "" && e.User != q.user {
+		return false
+	}
+	if !q.since.IsZero() && e.Time.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !e.Time.Before(q.until) {
+		return false
+	}
+	if q.path != "" {
+		dir := "/" + strings.Trim(q.path, "/")
+		under := func(p string) bool {
+			return p != "" && (dir == "/" || p == dir || strings.HasPrefix(p, dir+"/"))
+		}
+		return under(e.Path) || under(e.To)
+	}
+	return true
+}
+
+// queryAudit prints the matching entries, one JSON object per line. The
+// chain is checked along the way.
+func queryAudit(stdout io.Writer, file string, q auditQuery) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(stdout)
+	_, err = server.ReadAuditLog(f, func(_ int, e *server.AuditEntry) error {
+		if !q.match(e) {
+			return nil
+		}
+		return enc.Encode(e)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+func parseAuditTime(name, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf(`invalid -%s %q, want RFC 3339 or "2006-01-02"`, name, s)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aix3/fileserver/server"
+)
+
+func Test_auditCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := server.OpenAuditLog(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &server.FSHandler{Basedir: t.TempDir(), Audit: audit}
+	for _, req := range []struct{ user, method, target string }{
+		{"alice", http.MethodPut, "/docs/a.txt"},
+		{"bob", http.MethodPut, "/docs/b.txt"},
+		{"alice", http.MethodPut, "/other.txt"},
+		{"bob", http.MethodPost, "/other.txt?action=move&to=/docs/moved.txt"},
+	} {
+		r := httptest.NewRequest(req.method, req.target, strings.NewReader("x"))
+		r.SetBasicAuth(req.user, "secret")
+		h := &server.AuthHandler{Username: req.user, Password: "secret", Next: fs}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	audit.Close()
+
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := auditCommand(args, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	if code, out, stderr := run("verify", "-file", file); code != 0 || !strings.HasPrefix(out, "OK: 4 entries, last hash ") {
+		t.Fatalf("verify = %d %q %s", code, out, stderr)
+	}
+
+	count := func(out string) int { return strings.Count(out, "\n") }
+	if code, out, _ := run("query", "-file", file, "-user", "alice"); code != 0 || count(out) != 2 {
+		t.Errorf("query -user alice = %d\n%s", code, out)
+	}
+	if code, out, _ := run("query", "-file", file, "-path", "/docs"); code != 0 || count(out) != 3 || !strings.Contains(out, `"to":"/docs/moved.txt"`) {
+		t.Errorf("query -path /docs = %d\n%s", code, out)
+	}
+	if code, out, _ := run("query", "-file", file, "-since", "2000-01-01", "-until", "2001-01-01"); code != 0 || out != "" {
+		t.Errorf("query old range = %d\n%s", code, out)
+	}
+	if code, _, _ := run("query", "-file", file, "-since", "yesterday"); code != 1 {
+		t.Errorf("query with bad -since = %d, want 1", code)
+	}
+	if code, _, _ := run("verify"); code != 2 {
+		t.Errorf("verify without -file = %d, want 2", code)
+	}
+
+	b, _ := os.ReadFile(file)
+	os.WriteFile(file, bytes.Replace(b, []byte(`"user":"bob"`), []byte(`"user":"eve"`), 1), 0600)
+	if code, _, stderr := run("verify", "-file", file); code != 1 || !strings.Contains(stderr, "line 3: chain broken") {
+		t.Fatalf("verify of tampered log = %d %s", code, stderr)
+	}
+}
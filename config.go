@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Every flag is also an option of the -config file, under the flag's name,
+// and a FILESERVER_* environment variable, so new flags need no extra work
+// here. Flags given on the command line win over the environment, which wins
+// over the file.
+
+// envPrefix starts the environment variable of every option.
+const envPrefix = "FILESERVER_"
+
+// cliOnlyFlags cannot be set in the config file itself.
+var cliOnlyFlags = []string{"config", "print-config"}
+
+// secretFlags are redacted by -print-config.
+var secretFlags = []string{"auth", "oidc-client-secret", "s3-keys"}
+
+// listFlag is a flag that may be repeated, such as -mount. In the config
+// file it takes a list with one item per flag, and in its environment
+// variable items separated by ";".
+type listFlag interface {
+	flag.Value
+	isList()
+}
+
+func isListFlag(f *flag.Flag) bool {
+	_, ok := f.Value.(listFlag)
+	return ok
+}
+
+// envName returns the environment variable of the flag name, e.g.
+// FILESERVER_TLS_CERT for "tls-cert".
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadConfig parses args into flags and fills in the options not given
+// there from the environment and then from the -config file.
+func loadConfig(flags *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(envName(f.Name))
+		if err != nil || !ok || set[f.Name] {
+			return
+		}
+		items := []string{value}
+		if isListFlag(f) {
+			items = strings.Split(value, ";")
+		}
+		for _, item := range items {
+			if setErr := setOption(flags, f.Name, item); setErr != nil && err == nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+			}
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return err
+	}
+
+	path := flags.Lookup("config").Value.String()
+	if path == "" {
+		return nil
+	}
+	values, err := readConfigFile(flags, path)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if set[name] {
+			continue
+		}
+		for _, value := range values[name] {
+			if err := setOption(flags, name, value); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setOption sets the flag name to value, explaining what was expected if
+// value does not parse.
+func setOption(flags *flag.FlagSet, name, value string) error {
+	if err := flags.Set(name, value); err != nil {
+		return fmt.Errorf("want %s, got %q", optionType(flags.Lookup(name)), value)
+	}
+	return nil
+}
+
+func optionType(f *flag.Flag) string {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "a valid value"
+	}
+	switch getter.Get().(type) {
+	case bool:
+		return "true or false"
+	case int, int64, uint, uint64:
+		return "an integer"
+	case float64:
+		return "a number"
+	case time.Duration:
+		return `a duration such as "90s" or "12h"`
+	default:
+		return "a string"
+	}
+}
+
+// readConfigFile reads the YAML or TOML file at path, by its extension, and
+// returns the values of its options, one for every time the flag is given.
+// Sections are joined to the names in
+// them with "-", so "tls: {cert: x}" is the same as "tls-cert: x".
+func readConfigFile(flags *flag.FlagSet, path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, fmt.Errorf("%s: unknown config format, want a .yaml, .yml or .toml file", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := map[string][]string{}
+	if err := flattenConfig(flags, "", doc, values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+func flattenConfig(flags *flag.FlagSet, prefix string, doc map[string]any, values map[string][]string) error {
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		section, isSection := doc[key].(map[string]any)
+		f := flags.Lookup(name)
+		if f == nil {
+			if isSection {
+				if err := flattenConfig(flags, name, section, values); err != nil {
+					return err
+				}
+				continue
+			}
+			return unknownOption(flags, name)
+		}
+		if slices.Contains(cliOnlyFlags, name) {
+			return fmt.Errorf("%s: cannot be set in the config file", name)
+		}
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("%s: set more than once", name)
+		}
+		items := []any{doc[key]}
+		if list, ok := doc[key].([]any); ok && isListFlag(f) {
+			items = list
+		}
+		for _, item := range items {
+			value, err := configValue(item)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			values[name] = append(values[name], value)
+		}
+	}
+	return nil
+}
+
+// configValue turns a value of the config file into a flag value. Lists
+// become comma-separated, and maps comma-separated "key:value" pairs, such
+// as the access keys of -s3-keys.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			if _, nested := item.([]any); nested {
+				return "", errors.New("lists of lists are not supported")
+			}
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			s, err := configValue(v[key])
+			if err != nil {
+				return "", err
+			}
+			pairs[i] = key + ":" + s
+		}
+		return strings.Join(pairs, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// unknownOption is the error for an option no flag is named after, with the
+// closest flag name as a suggestion.
+func unknownOption(flags *flag.FlagSet, name string) error {
+	best, bestDistance := "", 4
+	flags.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	if best != "" {
+		return fmt.Errorf("unknown option %q, did you mean %q?", name, best)
+	}
+	return fmt.Errorf("unknown option %q, see -help for the options", name)
+}
+
+// editDistance returns the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// printConfig writes the options in effect as a config file, in TOML if
+// format is ".toml" and YAML otherwise. Secrets are redacted.
+func printConfig(w io.Writer, flags *flag.FlagSet, format string) error {
+	doc := map[string]any{}
+	flags.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(cliOnlyFlags, f.Name) {
+			return
+		}
+		var value any = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if v != "" && slices.Contains(secretFlags, f.Name) {
+				value = "REDACTED"
+			}
+		}
+		doc[f.Name] = value
+	})
+	if strings.ToLower(format) == ".toml" {
+		return toml.NewEncoder(w).Encode(doc)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOptions struct {
+	port        int
+	basedir     string
+	certFile    string
+	allowDelete bool
+	sessionTTL  time.Duration
+	readRate    float64
+	proxies     string
+	s3Keys      string
+	auth        string
+	mounts      mountFlags
+}
+
+func newTestFlags() (*flag.FlagSet, *testOptions) {
+	o := &testOptions{}
+	flags := flag.NewFlagSet("fileserver", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.String("config", "", "")
+	flags.Bool("print-config", false, "")
+	flags.IntVar(&o.port, "port", 8880, "")
+	flags.StringVar(&o.basedir, "basedir", ".", "")
+	flags.StringVar(&o.certFile, "tls-cert", "", "")
+	flags.BoolVar(&o.allowDelete, "allow-delete", false, "")
+	flags.DurationVar(&o.sessionTTL, "session-ttl", 12*time.Hour, "")
+	flags.Float64Var(&o.readRate, "rate-read", 0, "")
+	flags.StringVar(&o.proxies, "trusted-proxies", "", "")
+	flags.StringVar(&o.s3Keys, "s3-keys", "", "")
+	flags.StringVar(&o.auth, "auth", "", "")
+	flags.Var(&o.mounts, "mount", "")
+	return flags, o
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func noEnv(string) (string, bool) { return "", false }
+
+func Test_loadConfig_formats(t *testing.T) {
+	files := map[string]string{
+		"fileserver.yaml": `
+port: 8443
+basedir: /srv/files
+allow_delete: true
+session-ttl: 90m
+rate-read: 2.5
+tls:
+  cert: /etc/fileserver/cert.pem
+trusted-proxies: [10.0.0.0/8, "::1"]
+s3-keys:
+  AKID: s3cr3t
+mount:
+  - /builds=/srv/builds,ro
+  - /docs=/mnt/docs
+`,
+		"fileserver.toml": `
+port = 8443
+basedir = "/srv/files"
+allow-delete = true
+session-ttl = "90m"
+rate-read = 2.5
+trusted-proxies = ["10.0.0.0/8", "::1"]
+mount = ["/builds=/srv/builds,ro", "/docs=/mnt/docs"]
+
+[tls]
+cert = "/etc/fileserver/cert.pem"
+
+[s3-keys]
+AKID = "s3cr3t"
+`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			flags, o := newTestFlags()
+			if err := loadConfig(flags, []string{"-config", writeConfig(t, name, content)}, noEnv); err != nil {
+				t.Fatal(err)
+			}
+			want := testOptions{
+				port:        8443,
+				basedir:     "/srv/files",
+				certFile:    "/etc/fileserver/cert.pem",
+				allowDelete: true,
+				sessionTTL:  90 * time.Minute,
+				readRate:    2.5,
+				proxies:     "10.0.0.0/8,::1",
+				s3Keys:      "AKID:s3cr3t",
+			}
+			if !slices.Equal(o.mounts, mountFlags{"/builds=/srv/builds,ro", "/docs=/mnt/docs"}) {
+				t.Fatalf("mounts = %q", o.mounts)
+			}
+			o.mounts = nil
+			if !reflect.DeepEqual(*o, want) {
+				t.Fatalf("options = %+v, want %+v", *o, want)
+			}
+		})
+	}
+}
+
+func Test_loadConfig_precedence(t *testing.T) {
+	path := writeConfig(t, "fileserver.yaml", "port: 1\nbasedir: /file\nallow-delete: true\n")
+	env := map[string]string{
+		"FILESERVER_CONFIG":  path,
+		"FILESERVER_PORT":    "2",
+		"FILESERVER_BASEDIR": "/env",
+		"FILESERVER_MOUNT":   "/a=/srv/a;/b=/srv/b,ro",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	flags, o := newTestFlags()
+	if err := loadConfig(flags, []string{"-port", "3"}, lookupEnv); err != nil {
+		t.Fatal(err)
+	}
+	if o.port != 3 || o.basedir != "/env" || !o.allowDelete {
+		t.Fatalf("port %d basedir %q allow-delete %v, want flag, environment and file values", o.port, o.basedir, o.allowDelete)
+	}
+	if !slices.Equal(o.mounts, mountFlags{"/a=/srv/a", "/b=/srv/b,ro"}) {
+		t.Fatalf("mounts = %q", o.mounts)
+	}
+}
+
+func Test_loadConfig_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     string
+		want    string
+	}{
+		{"typo", "c.yaml", "alow-delete: true\n", "", `unknown option "alow-delete", did you mean "allow-delete"?`},
+		{"unknown", "c.yaml", "colour: blue\n", "", `unknown option "colour", see -help`},
+		{"unknown in section", "c.toml", "[tls]\nkye = \"k.pem\"\n", "", `unknown option "tls-kye"`},
+		{"bad int", "c.yaml", "port: http\n", "", `port: want an integer, got "http"`},
+		{"bad duration", "c.toml", "session-ttl = 3600\n", "", `session-ttl: want a duration such as "90s" or "12h", got "3600"`},
+		{"twice", "c.yaml", "tls-cert: a\ntls:\n  cert: b\n", "", "tls-cert: set more than once"},
+		{"config in config", "c.yaml", "config: other.yaml\n", "", "config: cannot be set in the config file"},
+		{"syntax", "c.yaml", "port: [\n", "", "c.yaml: yaml:"},
+		{"duplicate key", "c.yaml", "port: 1\nport: 2\n", "", "already defined"},
+		{"format", "c.json", "{}", "", "want a .yaml, .yml or .toml file"},
+		{"env", "c.yaml", "", "FILESERVER_ALLOW_DELETE", `FILESERVER_ALLOW_DELETE: want true or false, got "sometimes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupEnv := func(name string) (string, bool) {
+				if name == tt.env {
+					return "sometimes", true
+				}
+				return "", false
+			}
+			flags, _ := newTestFlags()
+			err := loadConfig(flags, []string{"-config", writeConfig(t, tt.file, tt.content)}, lookupEnv)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func Test_printConfig(t *testing.T) {
+	flags, _ := newTestFlags()
+	args := []string{"-port", "9000", "-session-ttl", "1h", "-auth", "admin:secret", "-s3-keys", "AKID:s3cr3t"}
+	if err := loadConfig(flags, args, noEnv); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := printConfig(&out, flags, ".yaml"); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{"port: 9000\n", "session-ttl: 1h0m0s\n", "allow-delete: false\n", "auth: REDACTED\n", "tls-cert: \"\"\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("YAML config missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "secret") || strings.Contains(got, "s3cr3t") || strings.Contains(got, "print-config") {
+		t.Errorf("YAML config leaks secrets or command line options:\n%s", got)
+	}
+
+	// The printed config loads back to the same options.
+	path := writeConfig(t, "printed.yaml", got)
+	reloaded, o := newTestFlags()
+	if err := loadConfig(reloaded, []string{"-config", path}, noEnv); err != nil {
+		t.Fatal(err)
+	}
+	if o.port != 9000 || o.sessionTTL != time.Hour {
+		t.Errorf("reloaded port %d session-ttl %v", o.port, o.sessionTTL)
+	}
+
+	out.Reset()
+	if err := printConfig(&out, flags, ".toml"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "port = 9000\n") {
+		t.Errorf("TOML config:\n%s", out.String())
+	}
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/debug"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aix3/fileserver/server"
 )
@@ -16,10 +25,65 @@ type config struct {
 	basedir       string
 	certFile      string
 	keyFile       string
+	clientCAFile  string
+	clientAuth    string
+	clientUser    string
 	username      string
 	password      string
+	usersFile     string
+	tokensFile    string
+	aclFile       string
+	oidcIssuer    string
+	oidcClientID  string
+	oidcSecret    string
+	oidcRedirect  string
+	oidcScopes    string
+	oidcUserClaim string
+	oidcGroups    string
+	sessionTTL    time.Duration
+	sessionIdle   time.Duration
+	maxFailures   int
+	lockout       time.Duration
+	proxies       string
+	readRate      float64
+	readBurst     int
+	writeRate     float64
+	writeBurst    int
 	authWriteOnly bool
 	allowDelete   bool
+	tusMaxSize    int64
+	tusExpiration time.Duration
+	webdavPrefix  string
+	mounts        mountFlags
+	s3Keys        map[string]string
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+
+	metricsPath   string
+	metricsListen string
+
+	accessLog        string
+	accessLogFormat  string
+	accessLogLevel   string
+	accessLogMaxSize int
+	accessLogBackups int
+
+	auditLog     string
+	webhooksFile string
+
+	events      bool
+	eventsWatch bool
+
+	trash        bool
+	trashMaxAge  time.Duration
+	trashMaxSize int
+
+	versions       int
+	versionsMaxAge time.Duration
 }
 
 var defaultConfig = config{
@@ -27,27 +91,144 @@ var defaultConfig = config{
 	basedir:       ".",
 	certFile:      "",
 	keyFile:       "",
+	clientCAFile:  "",
+	clientAuth:    "request",
+	clientUser:    "cn",
 	username:      "",
 	password:      "",
+	usersFile:     "",
+	tokensFile:    "",
+	aclFile:       "",
+	oidcIssuer:    "",
+	oidcClientID:  "",
+	oidcSecret:    "",
+	oidcRedirect:  "",
+	oidcScopes:    "profile,email",
+	oidcUserClaim: "sub",
+	oidcGroups:    "",
+	sessionTTL:    12 * time.Hour,
+	sessionIdle:   time.Hour,
+	maxFailures:   5,
+	lockout:       15 * time.Minute,
+	proxies:       "",
+	readRate:      0,
+	readBurst:     100,
+	writeRate:     0,
+	writeBurst:    20,
 	authWriteOnly: true,
 	allowDelete:   false,
+	tusMaxSize:    0,
+	tusExpiration: 24 * time.Hour,
+	webdavPrefix:  "",
+
+	readHeaderTimeout: 10 * time.Second,
+	readTimeout:       0,
+	writeTimeout:      0,
+	idleTimeout:       2 * time.Minute,
+	shutdownTimeout:   30 * time.Second,
+
+	metricsPath:   "/metrics",
+	metricsListen: "",
+
+	accessLog:        "",
+	accessLogFormat:  "combined",
+	accessLogLevel:   "info",
+	accessLogMaxSize: 100,
+	accessLogBackups: 5,
+
+	auditLog:     "",
+	webhooksFile: "",
+
+	events:      true,
+	eventsWatch: false,
+
+	trash:        false,
+	trashMaxAge:  30 * 24 * time.Hour,
+	trashMaxSize: 0,
+
+	versions:       0,
+	versionsMaxAge: 0,
 }
 
 var (
 	flagAuth      string
 	flagAuthScope string
+	flagS3Keys    string
+	flagConfig    string
+	flagPrint     bool
 )
 
 func init() {
+	flag.StringVar(&flagConfig, "config", "", "YAML or TOML file of options named like these flags; environment variables FILESERVER_<FLAG> and flags override it")
+	flag.BoolVar(&flagPrint, "print-config", false, "print the options in effect, secrets redacted, and exit")
+
 	flag.IntVar(&defaultConfig.port, "port", defaultConfig.port, "which port to listen on")
 	flag.StringVar(&defaultConfig.basedir, "basedir", defaultConfig.basedir, "which directory to serve on")
 	flag.StringVar(&defaultConfig.certFile, "tls-cert", defaultConfig.certFile, "TLS cert file location")
 	flag.StringVar(&defaultConfig.keyFile, "tls-key", defaultConfig.keyFile, "TLS key file location")
+	flag.StringVar(&defaultConfig.clientCAFile, "tls-client-ca", defaultConfig.clientCAFile, "PEM bundle of CAs for verifying TLS client certificates. Empty disables client certificates")
+	flag.StringVar(&defaultConfig.clientAuth, "tls-client-auth", defaultConfig.clientAuth, `with -tls-client-ca: "request" = clients may present a certificate; "require" = clients without a valid certificate are refused`)
+	flag.StringVar(&defaultConfig.clientUser, "tls-client-user", defaultConfig.clientUser, `with -tls-client-ca: certificate field used as username: "cn", "email", "dns" or "uri"`)
 
 	flag.StringVar(&flagAuth, "auth", "", `HTTP Basic credentials as "username:password" (password may contain ":"). Empty disables Basic auth`)
-	flag.StringVar(&flagAuthScope, "auth-scope", "write", `with -auth: "write" = only mutations need Basic Auth (default); "all" = every request needs Basic Auth`)
+	flag.StringVar(&defaultConfig.usersFile, "users-file", defaultConfig.usersFile, "htpasswd-style file of Basic Auth users (bcrypt, argon2 or SHA-512-crypt hashes), reloaded on change or SIGHUP")
+	flag.StringVar(&defaultConfig.tokensFile, "tokens-file", defaultConfig.tokensFile, `file of API tokens accepted as "Authorization: Bearer", managed with "fileserver token", reloaded on change or SIGHUP`)
+	flag.StringVar(&defaultConfig.oidcIssuer, "oidc-issuer", defaultConfig.oidcIssuer, "OpenID Connect issuer URL for logging in to the web UI. Empty disables OIDC login")
+	flag.StringVar(&defaultConfig.oidcClientID, "oidc-client-id", defaultConfig.oidcClientID, "with -oidc-issuer: client ID registered with the provider")
+	flag.StringVar(&defaultConfig.oidcSecret, "oidc-client-secret", defaultConfig.oidcSecret, "with -oidc-issuer: client secret, empty for public clients")
+	flag.StringVar(&defaultConfig.oidcRedirect, "oidc-redirect-url", defaultConfig.oidcRedirect, `with -oidc-issuer: absolute URL of "/_auth/callback" registered with the provider`)
+	flag.StringVar(&defaultConfig.oidcScopes, "oidc-scopes", defaultConfig.oidcScopes, `with -oidc-issuer: comma-separated scopes requested in addition to "openid"`)
+	flag.StringVar(&defaultConfig.oidcUserClaim, "oidc-username-claim", defaultConfig.oidcUserClaim, "with -oidc-issuer: ID token claim used as username")
+	flag.StringVar(&defaultConfig.oidcGroups, "oidc-groups-claim", defaultConfig.oidcGroups, "with -oidc-issuer: ID token claim listing the user's groups for -acl-file. Empty ignores groups")
+	flag.DurationVar(&defaultConfig.sessionTTL, "session-ttl", defaultConfig.sessionTTL, "how long a web UI login lasts at most")
+	flag.DurationVar(&defaultConfig.sessionIdle, "session-idle", defaultConfig.sessionIdle, "how long a web UI login lasts without any request")
+	flag.IntVar(&defaultConfig.maxFailures, "auth-max-failures", defaultConfig.maxFailures, "failed logins per client address or username before further attempts are locked out, with the lockout doubling on every failure")
+	flag.DurationVar(&defaultConfig.lockout, "auth-lockout", defaultConfig.lockout, "longest lockout after failed logins")
+	flag.StringVar(&flagAuthScope, "auth-scope", "write", `with -auth, -users-file, -tokens-file or -oidc-issuer: "write" = only mutations need credentials (default); "all" = every request needs credentials`)
 
 	flag.BoolVar(&defaultConfig.allowDelete, "allow-delete", defaultConfig.allowDelete, "enable file/directory deletion")
+	flag.StringVar(&defaultConfig.aclFile, "acl-file", defaultConfig.aclFile, "file of per-path access rules for users and groups, reloaded on change or SIGHUP")
+
+	flag.Int64Var(&defaultConfig.tusMaxSize, "tus-max-size", defaultConfig.tusMaxSize, "maximum size in bytes of a resumable (tus) upload, 0 for unlimited")
+	flag.DurationVar(&defaultConfig.tusExpiration, "tus-expiration", defaultConfig.tusExpiration, "how long an unfinished resumable (tus) upload is kept after its last write")
+
+	flag.StringVar(&defaultConfig.webdavPrefix, "webdav-prefix", defaultConfig.webdavPrefix, `URL prefix to serve WebDAV on (e.g. "/dav"). Empty disables WebDAV`)
+	flag.Var(&defaultConfig.mounts, "mount", `serve another directory at a URL prefix, as "/prefix=/dir" followed by any of ",ro", ",delete" and ",auth=write" or ",auth=all"; may be repeated`)
+	flag.StringVar(&defaultConfig.proxies, "trusted-proxies", defaultConfig.proxies, `comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For header gives the client address`)
+	flag.Float64Var(&defaultConfig.readRate, "rate-read", defaultConfig.readRate, "reads per second allowed per client address, 0 for unlimited")
+	flag.IntVar(&defaultConfig.readBurst, "rate-read-burst", defaultConfig.readBurst, "with -rate-read: reads a client may make at once")
+	flag.Float64Var(&defaultConfig.writeRate, "rate-write", defaultConfig.writeRate, "writes per second allowed per client address, 0 for unlimited")
+	flag.IntVar(&defaultConfig.writeBurst, "rate-write-burst", defaultConfig.writeBurst, "with -rate-write: writes a client may make at once")
+
+	flag.StringVar(&flagS3Keys, "s3-keys", "", `comma-separated "accesskey:secretkey" pairs accepted by the S3 API. Empty disables the S3 API`)
+
+	flag.DurationVar(&defaultConfig.readHeaderTimeout, "read-header-timeout", defaultConfig.readHeaderTimeout, "how long a client may take to send the headers of a request, 0 for no limit")
+	flag.DurationVar(&defaultConfig.readTimeout, "read-timeout", defaultConfig.readTimeout, "how long a client may take to send a whole request, including uploads, 0 for no limit")
+	flag.DurationVar(&defaultConfig.writeTimeout, "write-timeout", defaultConfig.writeTimeout, "how long writing a response, including downloads, may take, 0 for no limit")
+	flag.DurationVar(&defaultConfig.idleTimeout, "idle-timeout", defaultConfig.idleTimeout, "how long an idle keep-alive connection is kept open")
+	flag.DurationVar(&defaultConfig.shutdownTimeout, "shutdown-timeout", defaultConfig.shutdownTimeout, "on SIGINT or SIGTERM, how long to wait for requests in progress before aborting them")
+
+	flag.StringVar(&defaultConfig.metricsPath, "metrics-path", defaultConfig.metricsPath, "URL path of the Prometheus metrics. Empty disables metrics")
+	flag.StringVar(&defaultConfig.metricsListen, "metrics-listen", defaultConfig.metricsListen, `separate address to serve the metrics on (e.g. "127.0.0.1:9100"). Empty serves them on -port`)
+
+	flag.StringVar(&defaultConfig.accessLog, "access-log", defaultConfig.accessLog, "file to write the access log to. Empty writes it to stderr")
+	flag.StringVar(&defaultConfig.accessLogFormat, "access-log-format", defaultConfig.accessLogFormat, `access log format: "combined" (Apache Combined Log Format) or "json"`)
+	flag.StringVar(&defaultConfig.accessLogLevel, "access-log-level", defaultConfig.accessLogLevel, `lowest level of the requests logged: "info" for all, "warn" for 4xx and 5xx, "error" for 5xx`)
+	flag.IntVar(&defaultConfig.accessLogMaxSize, "access-log-max-size", defaultConfig.accessLogMaxSize, "with -access-log: rotate the file once it grows past this many MiB, 0 to never rotate")
+	flag.IntVar(&defaultConfig.accessLogBackups, "access-log-backups", defaultConfig.accessLogBackups, "with -access-log: how many rotated files to keep")
+
+	flag.StringVar(&defaultConfig.auditLog, "audit-log", defaultConfig.auditLog, `append-only file recording uploads, new directories, deletes, moves and copies, see "fileserver audit"`)
+	flag.StringVar(&defaultConfig.webhooksFile, "webhooks-file", defaultConfig.webhooksFile, "file of webhooks to notify of uploads, new directories, deletes, moves and copies")
+
+	flag.BoolVar(&defaultConfig.events, "events", defaultConfig.events, "stream file changes to the web UI at /_events, so that listings update live")
+	flag.BoolVar(&defaultConfig.eventsWatch, "events-watch", defaultConfig.eventsWatch, "with -events: also stream the changes made directly on disk, watching every directory with inotify")
+
+	flag.BoolVar(&defaultConfig.trash, "trash", defaultConfig.trash, "with -allow-delete: move deleted files and directories into a hidden .trash directory, from which they can be restored")
+	flag.DurationVar(&defaultConfig.trashMaxAge, "trash-max-age", defaultConfig.trashMaxAge, "with -trash: purge deleted entries after this long, 0 to keep them until purged by hand")
+	flag.IntVar(&defaultConfig.trashMaxSize, "trash-max-size", defaultConfig.trashMaxSize, "with -trash: purge the oldest deleted entries once the trash of a directory grows past this many MiB, 0 for no limit")
+
+	flag.IntVar(&defaultConfig.versions, "versions", defaultConfig.versions, "keep up to this many previous versions of each file replaced by an upload. 0 keeps any number if -versions-max-age is set, or disables versioning")
+	flag.DurationVar(&defaultConfig.versionsMaxAge, "versions-max-age", defaultConfig.versionsMaxAge, "keep previous versions of files replaced by an upload for this long. 0 keeps them regardless of age if -versions is set, or disables versioning")
 }
 
 func applyAuthFlags() {
@@ -67,6 +248,8 @@ func applyAuthFlags() {
 		}
 		defaultConfig.username = user
 		defaultConfig.password = pass
+	}
+	if auth != "" || defaultConfig.usersFile != "" || defaultConfig.tokensFile != "" || defaultConfig.clientCAFile != "" || defaultConfig.oidcIssuer != "" {
 		switch strings.ToLower(scope) {
 		case "write":
 			defaultConfig.authWriteOnly = true
@@ -78,6 +261,388 @@ func applyAuthFlags() {
 	}
 }
 
+// reloadable is a file-backed setting that can be watched and reloaded.
+type reloadable interface {
+	Reload() error
+	Watch() error
+}
+
+// onHangup lists the reload functions called on SIGHUP.
+var onHangup []func() error
+
+// watch keeps a file-backed setting up to date: the file is watched for
+// changes and reloaded on SIGHUP.
+func watch(file string, r reloadable) {
+	if err := r.Watch(); err != nil {
+		log.Printf("Watch %q error %v, reload with SIGHUP instead", file, err)
+	}
+	onHangup = append(onHangup, r.Reload)
+}
+
+func handleHangup() {
+	if len(onHangup) == 0 {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			for _, reload := range onHangup {
+				if err := reload(); err != nil {
+					log.Printf("Reload error %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func loadUsers() *server.Users {
+	if defaultConfig.usersFile == "" {
+		return nil
+	}
+	users, err := server.LoadUsers(defaultConfig.usersFile)
+	if err != nil {
+		log.Fatalf("-users-file: %v", err)
+	}
+	watch(defaultConfig.usersFile, users)
+	return users
+}
+
+func loadAudit() *server.AuditLog {
+	if defaultConfig.auditLog == "" {
+		return nil
+	}
+	audit, err := server.OpenAuditLog(defaultConfig.auditLog)
+	if err != nil {
+		log.Fatalf("-audit-log: %v", err)
+	}
+	return audit
+}
+
+func loadWebhooks() *server.Webhooks {
+	if defaultConfig.webhooksFile == "" {
+		return nil
+	}
+	webhooks, err := server.LoadWebhooks(defaultConfig.webhooksFile, defaultConfig.basedir)
+	if err != nil {
+		log.Fatalf("-webhooks-file: %v", err)
+	}
+	watch(defaultConfig.webhooksFile, webhooks)
+	go webhooks.Run(context.Background())
+	return webhooks
+}
+
+func loadTrash() *server.Trash {
+	if !defaultConfig.trash {
+		return nil
+	}
+	if !defaultConfig.allowDelete {
+		log.Fatal("-trash: requires -allow-delete")
+	}
+	if defaultConfig.trashMaxAge < 0 {
+		log.Fatalf("-trash-max-age: want 0 or more, got %v", defaultConfig.trashMaxAge)
+	}
+	if defaultConfig.trashMaxSize < 0 {
+		log.Fatalf("-trash-max-size: want 0 or more, got %d", defaultConfig.trashMaxSize)
+	}
+	return &server.Trash{MaxAge: defaultConfig.trashMaxAge, MaxSize: int64(defaultConfig.trashMaxSize) << 20}
+}
+
+func loadVersions() *server.Versions {
+	if defaultConfig.versions < 0 {
+		log.Fatalf("-versions: want 0 or more, got %d", defaultConfig.versions)
+	}
+	if defaultConfig.versionsMaxAge < 0 {
+		log.Fatalf("-versions-max-age: want 0 or more, got %v", defaultConfig.versionsMaxAge)
+	}
+	if defaultConfig.versions == 0 && defaultConfig.versionsMaxAge == 0 {
+		return nil
+	}
+	return &server.Versions{Keep: defaultConfig.versions, MaxAge: defaultConfig.versionsMaxAge}
+}
+
+func loadEvents() *server.Events {
+	if !defaultConfig.events {
+		return nil
+	}
+	return &server.Events{}
+}
+
+// watchEvents streams the changes made on disk in dirs, if enabled.
+func watchEvents(events *server.Events, dirs []*server.FSHandler) {
+	if events == nil || !defaultConfig.eventsWatch {
+		return
+	}
+	for _, fs := range dirs {
+		if err := events.Watch(fs); err != nil {
+			log.Printf("Watch %q error %v, changes made on disk are not streamed", fs.Basedir, err)
+		}
+	}
+}
+
+func loadTokens() *server.Tokens {
+	if defaultConfig.tokensFile == "" {
+		return nil
+	}
+	tokens, err := server.LoadTokens(defaultConfig.tokensFile)
+	if err != nil {
+		log.Fatalf("-tokens-file: %v", err)
+	}
+	watch(defaultConfig.tokensFile, tokens)
+	return tokens
+}
+
+func loadACL() *server.ACL {
+	if defaultConfig.aclFile == "" {
+		return nil
+	}
+	acl, err := server.LoadACL(defaultConfig.aclFile)
+	if err != nil {
+		log.Fatalf("-acl-file: %v", err)
+	}
+	watch(defaultConfig.aclFile, acl)
+	return acl
+}
+
+// clientTLSConfig returns the TLS config for client certificates and the
+// certificate field that names their user, or nil if they are disabled.
+func clientTLSConfig() (*tls.Config, server.CertMapping) {
+	if defaultConfig.clientCAFile == "" {
+		return nil, ""
+	}
+	if defaultConfig.certFile == "" || defaultConfig.keyFile == "" {
+		log.Fatal("-tls-client-ca: requires -tls-cert and -tls-key")
+	}
+	var auth tls.ClientAuthType
+	switch strings.ToLower(strings.TrimSpace(defaultConfig.clientAuth)) {
+	case "request":
+		auth = tls.VerifyClientCertIfGiven
+	case "require":
+		auth = tls.RequireAndVerifyClientCert
+	default:
+		log.Fatalf(`-tls-client-auth: want "request" or "require", got %q`, defaultConfig.clientAuth)
+	}
+	mapping, err := server.ParseCertMapping(strings.ToLower(strings.TrimSpace(defaultConfig.clientUser)))
+	if err != nil {
+		log.Fatalf("-tls-client-user: %v", err)
+	}
+	config, err := server.ClientAuthTLSConfig(defaultConfig.clientCAFile, auth)
+	if err != nil {
+		log.Fatalf("-tls-client-ca: %v", err)
+	}
+	return config, mapping
+}
+
+// oidcLogin returns the OIDC login of the web UI, or nil if it is disabled.
+func oidcLogin(sessions *server.Sessions) *server.OIDCHandler {
+	if defaultConfig.oidcIssuer == "" {
+		return nil
+	}
+	if defaultConfig.oidcClientID == "" || defaultConfig.oidcRedirect == "" {
+		log.Fatal("-oidc-issuer: requires -oidc-client-id and -oidc-redirect-url")
+	}
+	// Not nil, so that an empty -oidc-scopes requests "openid" only.
+	scopes := []string{}
+	for _, scope := range strings.Split(defaultConfig.oidcScopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return &server.OIDCHandler{
+		Issuer:        defaultConfig.oidcIssuer,
+		ClientID:      defaultConfig.oidcClientID,
+		ClientSecret:  defaultConfig.oidcSecret,
+		RedirectURL:   defaultConfig.oidcRedirect,
+		Scopes:        scopes,
+		UsernameClaim: defaultConfig.oidcUserClaim,
+		GroupsClaim:   defaultConfig.oidcGroups,
+		Sessions:      sessions,
+	}
+}
+
+// limits returns the handler that finds client addresses and limits their
+// request rates in front of next.
+func limits(next http.Handler) *server.LimitHandler {
+	proxies, err := server.ParseTrustedProxies(defaultConfig.proxies)
+	if err != nil {
+		log.Fatalf("-trusted-proxies: %v", err)
+	}
+	rateLimit := func(name string, perSecond float64, burst int) *server.RateLimit {
+		if perSecond <= 0 {
+			return nil
+		}
+		if burst < 1 {
+			log.Fatalf("-%s-burst: must be at least 1", name)
+		}
+		return &server.RateLimit{Rate: perSecond, Burst: burst}
+	}
+	return &server.LimitHandler{
+		Proxies: proxies,
+		Reads:   rateLimit("rate-read", defaultConfig.readRate, defaultConfig.readBurst),
+		Writes:  rateLimit("rate-write", defaultConfig.writeRate, defaultConfig.writeBurst),
+		Next:    next,
+	}
+}
+
+func accessLog(next http.Handler) *server.AccessLogHandler {
+	format, err := server.ParseAccessLogFormat(defaultConfig.accessLogFormat)
+	if err != nil {
+		log.Fatalf("-access-log-format: %v", err)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(defaultConfig.accessLogLevel)); err != nil {
+		log.Fatalf(`-access-log-level: want "info", "warn" or "error", got %q`, defaultConfig.accessLogLevel)
+	}
+	h := &server.AccessLogHandler{Format: format, Level: level, Next: next}
+	if defaultConfig.accessLog == "" {
+		return h
+	}
+	if defaultConfig.accessLogMaxSize < 0 || defaultConfig.accessLogBackups < 0 {
+		log.Fatal("-access-log-max-size, -access-log-backups: must not be negative")
+	}
+	file := &server.LogFile{
+		Path:    defaultConfig.accessLog,
+		MaxSize: int64(defaultConfig.accessLogMaxSize) << 20,
+		Backups: defaultConfig.accessLogBackups,
+	}
+	if err := file.Reopen(); err != nil {
+		log.Fatalf("-access-log: %v", err)
+	}
+	// Reopened on SIGHUP for rotation by an external tool.
+	onHangup = append(onHangup, file.Reopen)
+	h.Out = file
+	return h
+}
+
+func applyS3Flags() {
+	keys := strings.TrimSpace(flagS3Keys)
+	if keys == "" {
+		return
+	}
+	defaultConfig.s3Keys = map[string]string{}
+	for _, pair := range strings.Split(keys, ",") {
+		access, secret, err := parseAuthPair(strings.TrimSpace(pair))
+		if err != nil || access == "" || secret == "" {
+			log.Fatal(`-s3-keys: expected comma-separated "accesskey:secretkey" pairs`)
+		}
+		defaultConfig.s3Keys[access] = secret
+	}
+}
+
+// mountFlags collects the repeated -mount flags.
+type mountFlags []string
+
+func (m *mountFlags) String() string {
+	return strings.Join(*m, " ")
+}
+
+func (m *mountFlags) Set(s string) error {
+	*m = append(*m, s)
+	return nil
+}
+
+func (m *mountFlags) Get() any {
+	return []string(*m)
+}
+
+func (m *mountFlags) isList() {}
+
+// loadMounts returns the directories to serve besides -basedir. Each has its
+// own upload, UI and file handlers; share links, WebDAV and S3 only cover
+// -basedir.
+func loadMounts(acl *server.ACL, login, authEnabled bool) []*server.Mount {
+	var mounts []*server.Mount
+	seen := map[string]bool{}
+	for _, spec := range defaultConfig.mounts {
+		prefix, options, _ := strings.Cut(spec, ",")
+		prefix, dir, ok := strings.Cut(prefix, "=")
+		name := strings.TrimPrefix(prefix, "/")
+		if !ok || dir == "" || !strings.HasPrefix(prefix, "/") || name == "" || strings.Contains(name, "/") {
+			log.Fatalf(`-mount: want "/prefix=/dir[,option...]", got %q`, spec)
+		}
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			log.Fatalf(`-mount: prefix %q is reserved, it must not start with "." or "_"`, prefix)
+		}
+		if dav := strings.TrimSpace(defaultConfig.webdavPrefix); dav != "" && strings.Split(strings.TrimPrefix(dav, "/"), "/")[0] == name {
+			log.Fatalf("-mount: prefix %q clashes with -webdav-prefix", prefix)
+		}
+		if seen[name] {
+			log.Fatalf("-mount: prefix %q mounted twice", prefix)
+		}
+		seen[name] = true
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Fatalf("-mount %s: %q is not a directory", prefix, dir)
+		}
+
+		fs := &server.FSHandler{Basedir: dir, ACL: acl, Prefix: prefix}
+		m := &server.Mount{Fs: fs}
+		for _, option := range strings.Split(options, ",") {
+			switch option = strings.TrimSpace(option); {
+			case option == "":
+			case option == "ro":
+				fs.ReadOnly = true
+			case option == "delete":
+				fs.AllowDelete = true
+			case strings.HasPrefix(option, "auth="):
+				scope, err := server.ParseAuthScope(strings.TrimPrefix(option, "auth="))
+				if err != nil {
+					log.Fatalf("-mount %s: auth: %v", prefix, err)
+				}
+				if scope == server.AuthAll && !authEnabled {
+					log.Fatalf("-mount %s: auth=all requires -auth, -users-file, -tokens-file, -tls-client-ca or -oidc-issuer", prefix)
+				}
+				m.Auth = scope
+			default:
+				log.Fatalf(`-mount %s: unknown option %q, want "ro", "delete" or "auth=write|all"`, prefix, option)
+			}
+		}
+		if fs.ReadOnly && fs.AllowDelete {
+			log.Fatalf(`-mount %s: "ro" and "delete" exclude each other`, prefix)
+		}
+		if err := fs.RemoveTempFiles(); err != nil {
+			log.Printf("Remove stale temp files of %s error %v", prefix, err)
+		}
+		m.Next = server.NewCompHandler(
+			&server.TusHandler{Fs: fs, MaxSize: defaultConfig.tusMaxSize, Expiration: defaultConfig.tusExpiration},
+			&server.UIHandler{Fs: fs, Login: login},
+			fs,
+		)
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+// serveMetrics serves the metrics of dirs at -metrics-path, on mux or on a
+// listener of its own with -metrics-listen.
+func serveMetrics(mux *http.ServeMux, metrics *server.Metrics, dirs []*server.FSHandler) {
+	path := strings.TrimSpace(defaultConfig.metricsPath)
+	if path == "" {
+		return
+	}
+	if !strings.HasPrefix(path, "/") || path == "/" || strings.ContainsAny(path, "{} ") {
+		log.Fatalf(`-metrics-path: want a path like "/metrics", got %q`, path)
+	}
+	handler := &server.MetricsHandler{Metrics: metrics, Fs: dirs}
+	if defaultConfig.metricsListen == "" {
+		mux.Handle(path, handler)
+		return
+	}
+
+	ln, err := net.Listen("tcp", defaultConfig.metricsListen)
+	if err != nil {
+		log.Fatalf("-metrics-listen: %v", err)
+	}
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle(path, handler)
+	srv := &http.Server{Handler: metricsMux, ReadHeaderTimeout: defaultConfig.readHeaderTimeout}
+	fmt.Println("Serve metrics on", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			log.Printf("Serve metrics error %v", err)
+		}
+	}()
+}
+
 // parseAuthPair splits on the first ":" only so the password may contain colons.
 func parseAuthPair(s string) (user, pass string, err error) {
 	i := strings.IndexByte(s, ':')
@@ -88,26 +653,137 @@ func parseAuthPair(s string) (user, pass string, err error) {
 }
 
 func main() {
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		os.Exit(tokenCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(auditCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	if err := loadConfig(flag.CommandLine, os.Args[1:], os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
 	applyAuthFlags()
+	applyS3Flags()
+	if flagPrint {
+		if err := printConfig(os.Stdout, flag.CommandLine, filepath.Ext(flagConfig)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	tlsConfig, certMapping := clientTLSConfig()
+	// Sessions are signed with a random key, so they end on restart.
+	sessions := &server.Sessions{TTL: defaultConfig.sessionTTL, IdleTimeout: defaultConfig.sessionIdle}
+	oidc := oidcLogin(sessions)
+	loginForm := defaultConfig.username != "" || defaultConfig.usersFile != ""
+
+	authEnabled := defaultConfig.username != "" || defaultConfig.usersFile != "" || defaultConfig.tokensFile != "" || certMapping != "" || oidc != nil
 
 	mux := http.NewServeMux()
 
+	acl := loadACL()
+	metrics := &server.Metrics{}
+	audit := loadAudit()
+	webhooks := loadWebhooks()
+	events := loadEvents()
+	trash := loadTrash()
+	versions := loadVersions()
+	mounts := loadMounts(acl, oidc != nil || loginForm, authEnabled)
 	fs := &server.FSHandler{
 		Basedir:     defaultConfig.basedir,
 		AllowDelete: defaultConfig.allowDelete,
+		ACL:         acl,
+		Mounts:      mounts,
+		Metrics:     metrics,
+		Audit:       audit,
+		Webhooks:    webhooks,
+		Events:      events,
+		Trash:       trash,
+		Versions:    versions,
+	}
+	dirs := []*server.FSHandler{fs}
+	for _, m := range mounts {
+		m.Fs.Metrics = metrics
+		m.Fs.Audit = audit
+		m.Fs.Webhooks = webhooks
+		m.Fs.Events = events
+		m.Fs.Trash = trash
+		m.Fs.Versions = versions
+		dirs = append(dirs, m.Fs)
+	}
+	watchEvents(events, dirs)
+	if trash != nil {
+		go trash.Run(context.Background(), dirs)
+	}
+	if versions != nil {
+		go versions.Run(context.Background(), dirs)
+	}
+	if err := fs.RemoveTempFiles(); err != nil {
+		log.Printf("Remove stale temp files error %v", err)
 	}
 	ui := &server.UIHandler{
-		Fs: fs,
+		Fs:    fs,
+		Login: oidc != nil || loginForm,
+	}
+	tus := &server.TusHandler{
+		Fs:         fs,
+		MaxSize:    defaultConfig.tusMaxSize,
+		Expiration: defaultConfig.tusExpiration,
 	}
 
-	handler := &server.BasicAuthHandler{
+	handlers := []server.Handler{tus}
+	if events != nil {
+		handlers = append(handlers, &server.EventsHandler{Fs: fs, Events: events})
+	}
+	if trash != nil {
+		handlers = append(handlers, &server.TrashHandler{Fs: fs})
+	}
+	var shares *server.ShareHandler
+	if defaultConfig.username != "" || defaultConfig.usersFile != "" || certMapping != "" || oidc != nil {
+		// Share links are minted by authenticated users only.
+		shares = &server.ShareHandler{Fs: fs}
+		ui.Shares = shares
+		handlers = append(handlers, shares)
+	}
+	if prefix := strings.TrimSpace(defaultConfig.webdavPrefix); prefix != "" {
+		if !strings.HasPrefix(prefix, "/") || prefix == "/" {
+			log.Fatalf(`-webdav-prefix: want a path like "/dav", got %q`, prefix)
+		}
+		handlers = append(handlers, &server.WebDAVHandler{Fs: fs, Prefix: prefix})
+	}
+	handlers = append(handlers, ui, fs)
+	mountHandler := &server.MountHandler{Mounts: mounts, Next: server.NewCompHandler(handlers...)}
+
+	handler := &server.AuthHandler{
 		Username:      defaultConfig.username,
 		Password:      defaultConfig.password,
+		Users:         loadUsers(),
+		Tokens:        loadTokens(),
+		Shares:        shares,
+		ClientCerts:   certMapping,
+		Sessions:      sessions,
+		OIDC:          oidc,
+		LoginForm:     loginForm,
+		Throttle:      &server.AuthThrottle{MaxFailures: defaultConfig.maxFailures, MaxLockout: defaultConfig.lockout},
 		AuthWriteOnly: defaultConfig.authWriteOnly,
-		Next:          server.NewCompHandler(ui, fs),
+		Mounts:        mountHandler,
+		Metrics:       metrics,
+		Next:          mountHandler,
 	}
-	mux.Handle("/", handler)
+	if len(defaultConfig.s3Keys) > 0 {
+		// SigV4-signed requests carry their own credentials, so the S3 API
+		// sits in front of Basic auth rather than behind it.
+		mux.Handle("/", &server.S3Handler{
+			Fs:          fs,
+			Credentials: defaultConfig.s3Keys,
+			Next:        handler,
+		})
+	} else {
+		mux.Handle("/", handler)
+	}
+	serveMetrics(mux, metrics, dirs)
+	active := &server.InFlight{Next: accessLog(limits(mux))}
+	handleHangup()
 
 	addr := fmt.Sprintf(":%d", defaultConfig.port)
 
@@ -116,9 +792,77 @@ func main() {
 	}
 	fmt.Println("Listen and serve on", addr)
 
-	if len(defaultConfig.keyFile) == 0 || len(defaultConfig.certFile) == 0 {
-		panic(http.ListenAndServe(addr, mux))
-	} else {
-		panic(http.ListenAndServeTLS(addr, defaultConfig.certFile, defaultConfig.keyFile, mux))
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           active,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: defaultConfig.readHeaderTimeout,
+		ReadTimeout:       defaultConfig.readTimeout,
+		WriteTimeout:      defaultConfig.writeTimeout,
+		IdleTimeout:       defaultConfig.idleTimeout,
+	}
+	if events != nil {
+		// Change streams never finish on their own.
+		srv.RegisterOnShutdown(events.Close)
+	}
+	os.Exit(run(srv, active, func() {
+		// Aborted uploads remove their temp files; this catches any whose
+		// handler did not get to it in time.
+		for _, fs := range dirs {
+			if err := fs.RemoveTempFiles(); err != nil {
+				log.Printf("Remove temp files error %v", err)
+			}
+		}
+		if err := audit.Close(); err != nil {
+			log.Printf("Close audit log error %v", err)
+		}
+	}))
+}
+
+// abortGrace is how long the handlers of aborted requests get to clean up.
+const abortGrace = 5 * time.Second
+
+// run serves srv until SIGINT or SIGTERM, then stops accepting connections
+// and waits up to -shutdown-timeout for the requests in progress. Requests
+// still running then are aborted, which makes uploads remove their partial
+// files. cleanup is called last. run returns the exit code: 0 after a clean
+// shutdown, 1 if the server failed or requests had to be aborted.
+func run(srv *http.Server, active *server.InFlight, cleanup func()) int {
+	served := make(chan error, 1)
+	go func() {
+		if len(defaultConfig.keyFile) == 0 || len(defaultConfig.certFile) == 0 {
+			served <- srv.ListenAndServe()
+		} else {
+			served <- srv.ListenAndServeTLS(defaultConfig.certFile, defaultConfig.keyFile)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-served:
+		log.Printf("Serve error %v", err)
+		return 1
+	case sig := <-stop:
+		log.Printf("Received %v, waiting up to %v for %d requests in progress", sig, defaultConfig.shutdownTimeout, active.Active())
+	}
+	// A second signal kills the process right away.
+	signal.Stop(stop)
+
+	code := 0
+	ctx, cancel := context.WithTimeout(context.Background(), defaultConfig.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown error %v, aborting %d requests in progress", err, active.Active())
+		srv.Close()
+		grace, cancel := context.WithTimeout(context.Background(), abortGrace)
+		defer cancel()
+		if err := active.Wait(grace); err != nil {
+			log.Printf("Abort error %v, %d requests still running", err, active.Active())
+		}
+		code = 1
 	}
+	cleanup()
+	log.Printf("Shutdown complete")
+	return code
 }
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is how AccessLogHandler writes its entries.
+type AccessLogFormat int
+
+const (
+	// AccessLogCombined is the Apache Combined Log Format.
+	AccessLogCombined AccessLogFormat = iota
+	// AccessLogJSON writes one JSON object per line with log/slog.
+	AccessLogJSON
+)
+
+// ParseAccessLogFormat parses "combined" or "json".
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "combined":
+		return AccessLogCombined, nil
+	case "json":
+		return AccessLogJSON, nil
+	}
+	return 0, fmt.Errorf(`want "combined" or "json", got %q`, s)
+}
+
+// AccessLogHandler logs every request served by Next once it is answered:
+// client address, user, method, path, status, bytes sent and received,
+// duration and user agent. Requests answered with 5xx are logged at the
+// error level and with 4xx at the warn level, so that a Level above info
+// only logs failures.
+type AccessLogHandler struct {
+	Format AccessLogFormat
+	Level  slog.Level
+	// Out defaults to os.Stderr.
+	Out  io.Writer
+	Next http.Handler
+
+	once   sync.Once
+	out    io.Writer
+	logger *slog.Logger
+	mu     sync.Mutex // serializes Combined lines
+}
+
+// accessEntry is what handlers down the chain know about a request that the
+// access log needs: they get a copy of the request, so they fill in the
+// entry that AccessLogHandler put in its context.
+type accessEntry struct {
+	addr netip.Addr
+	user string
+	err  error
+}
+
+type accessEntryKey struct{}
+
+func requestAccessEntry(r *http.Request) *accessEntry {
+	e, _ := r.Context().Value(accessEntryKey{}).(*accessEntry)
+	return e
+}
+
+func (h *AccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		h.out = h.Out
+		if h.out == nil {
+			h.out = os.Stderr
+		}
+		if h.Format == AccessLogJSON {
+			h.logger = slog.New(slog.NewJSONHandler(h.out, &slog.HandlerOptions{Level: h.Level}))
+		}
+	})
+
+	start := time.Now()
+	entry := &accessEntry{addr: remoteAddr(r), user: "-"}
+	aw := &accessWriter{ResponseWriter: w}
+	var body *countingReader
+	if r.Body != nil {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+	r = r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry))
+	h.Next.ServeHTTP(aw, r)
+
+	var received int64
+	if body != nil {
+		received = body.n
+	}
+	h.log(r, entry, aw, received, time.Since(start))
+}
+
+func (h *AccessLogHandler) log(r *http.Request, e *accessEntry, w *accessWriter, received int64, d time.Duration) {
+	code := w.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	level := slog.LevelInfo
+	switch {
+	case code >= http.StatusInternalServerError:
+		level = slog.LevelError
+	case code >= http.StatusBadRequest:
+		level = slog.LevelWarn
+	}
+	if level < h.Level {
+		return
+	}
+
+	if h.logger != nil {
+		attrs := []slog.Attr{
+			slog.String("remote_addr", e.addr.String()),
+			slog.String("user", e.user),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.RequestURI()),
+			slog.Int("status", code),
+			slog.Int64("bytes_sent", w.n),
+			slog.Int64("bytes_received", received),
+			slog.Float64("duration", d.Seconds()),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("referer", r.Referer()),
+		}
+		if e.err != nil {
+			attrs = append(attrs, slog.String("error", e.err.Error()))
+		}
+		h.logger.LogAttrs(r.Context(), level, "request", attrs...)
+		return
+	}
+
+	sent := "-"
+	if w.n > 0 {
+		sent = strconv.FormatInt(w.n, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		e.addr, e.user, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto), code, sent,
+		strconv.Quote(r.Referer()), strconv.Quote(r.UserAgent()))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	io.WriteString(h.out, line)
+}
+
+// accessWriter records the status and the number of bytes of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.code == 0 && code >= http.StatusOK {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// noteError keeps err for the access log entry of r, and reports whether r
+// passes through an AccessLogHandler.
+func noteError(r *http.Request, err error) bool {
+	e := requestAccessEntry(r)
+	if e == nil {
+		return false
+	}
+	if err != nil {
+		e.err = err
+	}
+	return true
+}
+
+// logRequest logs the outcome of r as answered by component, such as "tus"
+// or "share", with the path it saw. Behind an AccessLogHandler only the
+// error is kept, for the access log entry, so that each request is logged
+// once.
+func logRequest(r *http.Request, component, path string, code int, err error) {
+	if noteError(r, err) {
+		return
+	}
+	if component != "" {
+		component += " "
+	}
+	log.Printf("%s%s %s %s - %d - %v", component, logUser(r), r.Method, path, code, err)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newAccessLogFixture(t *testing.T, format AccessLogFormat, level slog.Level) (http.Handler, *bytes.Buffer) {
+	t.Helper()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0600)
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FSHandler{Basedir: dir}
+	var out bytes.Buffer
+	return &AccessLogHandler{
+		Format: format,
+		Level:  level,
+		Out:    &out,
+		Next: &LimitHandler{
+			Proxies: proxies,
+			Next: &AuthHandler{
+				Username:      "admin",
+				Password:      "secret",
+				AuthWriteOnly: true,
+				Next:          NewCompHandler(&UIHandler{Fs: fs}, fs),
+			},
+		},
+	}, &out
+}
+
+func Test_AccessLogHandler_json(t *testing.T) {
+	h, out := newAccessLogFixture(t, AccessLogJSON, slog.LevelInfo)
+
+	r := httptest.NewRequest(http.MethodPut, "/b.txt?x=1", strings.NewReader("uploaded"))
+	r.RemoteAddr = "10.1.2.3:5000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.SetBasicAuth("admin", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	r = httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+	r.RemoteAddr = "192.0.2.1:5000"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	r = httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("log lines:\n%s", out)
+	}
+	var entries []map[string]any
+	for _, line := range lines {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		entries = append(entries, e)
+	}
+
+	put := entries[0]
+	for k, want := range map[string]any{
+		"level":          "INFO",
+		"msg":            "request",
+		"remote_addr":    "203.0.113.7",
+		"user":           "admin",
+		"method":         "PUT",
+		"path":           "/b.txt?x=1",
+		"status":         float64(http.StatusCreated),
+		"bytes_received": float64(len("uploaded")),
+		"user_agent":     "curl/8.0",
+	} {
+		if put[k] != want {
+			t.Errorf("PUT %s = %v, want %v", k, put[k], want)
+		}
+	}
+	if _, ok := put["duration"].(float64); !ok {
+		t.Errorf("PUT duration = %v", put["duration"])
+	}
+
+	get := entries[1]
+	if get["remote_addr"] != "192.0.2.1" || get["user"] != "-" || get["status"] != float64(http.StatusOK) || get["bytes_sent"] != float64(len("hello")) {
+		t.Errorf("GET entry = %v", get)
+	}
+	missing := entries[2]
+	if missing["level"] != "WARN" || missing["status"] != float64(http.StatusNotFound) || missing["error"] == nil {
+		t.Errorf("404 entry = %v", missing)
+	}
+}
+
+func Test_AccessLogHandler_combined(t *testing.T) {
+	h, out := newAccessLogFixture(t, AccessLogCombined, slog.LevelInfo)
+
+	r := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+	r.RemoteAddr = "192.0.2.1:5000"
+	r.Header.Set("Referer", "http://example.com/")
+	r.Header.Set("User-Agent", `agent "quoted"`)
+	r.SetBasicAuth("admin", "secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	want := regexp.MustCompile(`^192\.0\.2\.1 - admin \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\.txt HTTP/1\.1" 200 5 "http://example\.com/" "agent \\"quoted\\""\n$`)
+	if !want.MatchString(out.String()) {
+		t.Fatalf("combined line = %q", out)
+	}
+
+	out.Reset()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodHead, "/a.txt", nil))
+	if !strings.Contains(out.String(), `"HEAD /a.txt HTTP/1.1" 200 - `) {
+		t.Fatalf("combined line without body = %q", out)
+	}
+}
+
+func Test_AccessLogHandler_level(t *testing.T) {
+	h, out := newAccessLogFixture(t, AccessLogCombined, slog.LevelWarn)
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a.txt", nil))
+	if out.Len() != 0 {
+		t.Fatalf("logged a success at warn level: %q", out)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/b.txt", strings.NewReader("x")))
+	if !strings.Contains(out.String(), `"PUT /b.txt HTTP/1.1" 401 `) {
+		t.Fatalf("refused request not logged: %q", out)
+	}
+
+	if _, err := ParseAccessLogFormat("xml"); err == nil {
+		t.Fatal("ParseAccessLogFormat accepted xml")
+	}
+}
+
+func Test_LogFile_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l := &LogFile{Path: path, MaxSize: 10, Backups: 2}
+	defer l.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := l.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		if b, err := os.ReadFile(path + name); err != nil || string(b) != want {
+			t.Errorf("access.log%s = %q %v, want %q", name, b, err, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept too many backups: %v", err)
+	}
+
+	// Reopen picks up a file moved away by another tool.
+	os.Rename(path, path+".old")
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("new\n"))
+	if b, _ := os.ReadFile(path); string(b) != "new\n" {
+		t.Errorf("after Reopen access.log = %q", b)
+	}
+}
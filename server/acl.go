@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// permission is a set of operations an ACL rule grants or denies.
+type permission uint8
+
+const (
+	permRead permission = 1 << iota
+	permWrite
+	permMkdir
+	permDelete
+
+	permAll = permRead | permWrite | permMkdir | permDelete
+)
+
+var permissionNames = []struct {
+	perm permission
+	name string
+}{
+	{permRead, "read"},
+	{permWrite, "write"},
+	{permMkdir, "mkdir"},
+	{permDelete, "delete"},
+}
+
+func (p permission) String() string {
+	var names []string
+	for _, n := range permissionNames {
+		if p&n.perm != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+const (
+	// subjectAnyone matches every request, including anonymous ones.
+	subjectAnyone = "*"
+	// groupAuthenticated is a built-in group of every authenticated user.
+	groupAuthenticated = "authenticated"
+)
+
+// ACL holds access rules loaded from a file. Each non-blank line that does
+// not start with "#" is either a group definition or a rule:
+//
+//	group <name> <user>...
+//	allow|deny <subject> <glob> <permissions>
+//
+// A subject is a username, "@group", "@authenticated" for any logged-in
+// user or "*" for anyone. Globs are absolute slash-separated paths where
+// "*" matches within one segment and "**" matches any number of segments,
+// so "/releases/**" covers /releases and everything below it. Permissions
+// are a comma-separated list of read, write, mkdir and delete, or "all".
+//
+// A request is allowed when at least one matching allow rule and no
+// matching deny rule grants the permission; everything else is denied.
+type ACL struct {
+	path   string
+	policy atomic.Pointer[aclPolicy]
+}
+
+type aclPolicy struct {
+	rules  []aclRule
+	groups map[string]map[string]bool
+}
+
+type aclRule struct {
+	allow   bool
+	subject string
+	glob    []string
+	perms   permission
+}
+
+// LoadACL reads the ACL file at path.
+func LoadACL(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the ACL file. On error the previous rules are kept.
+func (a *ACL) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p, err := parseACL(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.policy.Store(p)
+	log.Printf("Loaded %d ACL rules from %q", len(p.rules), a.path)
+	return nil
+}
+
+// Watch reloads the ACL file whenever it changes on disk.
+func (a *ACL) Watch() error {
+	return watchFile(a.path, a.Reload)
+}
+
+func (a *ACL) allowed(id identity, rel string, perm permission) bool {
+	return a.policy.Load().allowed(id, rel, perm)
+}
+
+func (p *aclPolicy) allowed(id identity, rel string, perm permission) bool {
+	var segments []string
+	if rel != "." {
+		segments = strings.Split(rel, "/")
+	}
+	allowed := false
+	for _, rule := range p.rules {
+		if rule.perms&perm == 0 || !p.matchSubject(rule.subject, id) || !matchGlob(rule.glob, segments) {
+			continue
+		}
+		if !rule.allow {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+func (p *aclPolicy) matchSubject(subject string, id identity) bool {
+	switch {
+	case subject == subjectAnyone:
+		return true
+	case id.name == "":
+		return false
+	case subject == "@"+groupAuthenticated:
+		return true
+	case strings.HasPrefix(subject, "@"):
+		group := subject[1:]
+		return p.groups[group][id.name] || slices.Contains(id.groups, group)
+	}
+	return subject == id.name
+}
+
+// matchGlob matches path segments against glob segments, where a "**"
+// segment matches zero or more path segments.
+func matchGlob(glob, segments []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchGlob(glob[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], segments[0]); !ok {
+			return false
+		}
+		glob, segments = glob[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+func parseACL(r io.Reader) (*aclPolicy, error) {
+	p := &aclPolicy{groups: map[string]map[string]bool{}}
+	used := map[string]int{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "group":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: expected \"group <name> <user>...\"", n)
+			}
+			name := fields[1]
+			if name == groupAuthenticated {
+				return nil, fmt.Errorf("line %d: group %q is built in", n, name)
+			}
+			if p.groups[name] == nil {
+				p.groups[name] = map[string]bool{}
+			}
+			for _, user := range fields[2:] {
+				p.groups[name][user] = true
+			}
+		case "allow", "deny":
+			rule, err := parseACLRule(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			if group, ok := strings.CutPrefix(rule.subject, "@"); ok && group != groupAuthenticated {
+				if _, seen := used[group]; !seen {
+					used[group] = n
+				}
+			}
+			p.rules = append(p.rules, rule)
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %q", n, fields[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for group, n := range used {
+		if p.groups[group] == nil {
+			return nil, fmt.Errorf("line %d: unknown group %q", n, group)
+		}
+	}
+	return p, nil
+}
+
+func parseACLRule(fields []string) (aclRule, error) {
+	if len(fields) != 4 {
+		return aclRule{}, fmt.Errorf("expected \"%s <subject> <glob> <permissions>\"", fields[0])
+	}
+	rule := aclRule{allow: fields[0] == "allow", subject: fields[1]}
+
+	glob := fields[2]
+	if !strings.HasPrefix(glob, "/") {
+		return aclRule{}, fmt.Errorf("glob %q must start with \"/\"", glob)
+	}
+	if glob = strings.Trim(glob, "/"); glob != "" {
+		rule.glob = strings.Split(glob, "/")
+	}
+	for _, seg := range rule.glob {
+		if _, err := path.Match(seg, ""); err != nil {
+			return aclRule{}, fmt.Errorf("invalid glob %q", fields[2])
+		}
+	}
+
+	for _, name := range strings.Split(fields[3], ",") {
+		if name == "all" {
+			rule.perms |= permAll
+			continue
+		}
+		found := false
+		for _, n := range permissionNames {
+			if n.name == name {
+				rule.perms |= n.perm
+				found = true
+			}
+		}
+		if !found {
+			return aclRule{}, fmt.Errorf("unknown permission %q", name)
+		}
+	}
+	return rule, nil
+}
+
+// allowed reports whether id may perform perm on rel. Without an ACL
+// everything but changes to a read-only directory is allowed.
+func (h *FSHandler) allowed(id identity, rel string, perm permission) bool {
+	if h.ReadOnly && perm != permRead {
+		return false
+	}
+	return h.ACL == nil || h.ACL.allowed(id, h.fullRel(rel), perm)
+}
+
+// checkAccess fails with 401 for anonymous requests, so that clients can
+// retry with credentials, and with 403 for authenticated users whose rules
+// do not allow perm on rel.
+func (h *FSHandler) checkAccess(w http.ResponseWriter, r *http.Request, rel string, perm permission) (int, error) {
+	if h.allowed(requestIdentity(r), rel, perm) {
+		return http.StatusOK, nil
+	}
+	if h.ReadOnly && perm != permRead {
+		return http.StatusForbidden, errReadOnly
+	}
+	return accessDenied(w, r, h.fullRel(rel), perm)
+}
+
+func accessDenied(w http.ResponseWriter, r *http.Request, rel string, perm permission) (int, error) {
+	if requestUser(r) == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fileserver"`)
+		return http.StatusUnauthorized, fmt.Errorf("%s on %q requires authentication", perm, "/"+rel)
+	}
+	return http.StatusForbidden, fmt.Errorf("%s on %q is not allowed", perm, "/"+rel)
+}
+
+// checkTree is checkAccess for rel and every entry below it, for
+// operations such as a recursive delete that affect a whole tree.
+func (h *FSHandler) checkTree(w http.ResponseWriter, r *http.Request, root *os.Root, rel string, perm permission) (int, error) {
+	if h.ACL == nil {
+		return http.StatusOK, nil
+	}
+	denied, err := h.firstDenied(root, requestIdentity(r), rel, perm)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if denied != "" {
+		return accessDenied(w, r, h.fullRel(denied), perm)
+	}
+	return http.StatusOK, nil
+}
+
+// firstDenied returns the first path at or below rel for which perm is not
+// allowed, or "" if the whole tree is allowed.
+func (h *FSHandler) firstDenied(root *os.Root, id identity, rel string, perm permission) (string, error) {
+	if h.ACL == nil {
+		return "", nil
+	}
+	denied := ""
+	err := fs.WalkDir(root.FS(), rel, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		if !h.allowed(id, p, perm) {
+			denied = p
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return denied, err
+}
+
+// checkRelocation checks that every entry of the tree at src may be created
+// at the corresponding path below dst, as a move or copy would.
+func (h *FSHandler) checkRelocation(w http.ResponseWriter, r *http.Request, root *os.Root, src, dst string) (int, error) {
+	if h.ACL == nil {
+		return http.StatusOK, nil
+	}
+	id := requestIdentity(r)
+	denied, deniedPerm := "", permWrite
+	err := fs.WalkDir(root.FS(), src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		target := dst + strings.TrimPrefix(p, src)
+		perm := permWrite
+		if d.IsDir() {
+			perm = permMkdir
+		}
+		if !h.allowed(id, target, perm) {
+			denied, deniedPerm = target, perm
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if denied != "" {
+		return accessDenied(w, r, h.fullRel(denied), deniedPerm)
+	}
+	return http.StatusOK, nil
+}
+
+// filterReadable drops the entries of the directory rel that id may not
+// read.
+func (h *FSHandler) filterReadable(id identity, rel string, infos []fileInfo) []fileInfo {
+	if h.ACL == nil {
+		return infos
+	}
+	readable := infos[:0]
+	for _, info := range infos {
+		if h.allowed(id, path.Join(rel, info.Name), permRead) {
+			readable = append(readable, info)
+		}
+	}
+	return readable
+}
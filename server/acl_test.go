@@ -0,0 +1,349 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testACL = `
+# Everyone may browse, except the secrets.
+allow * /** read
+deny  * /secret/** read
+
+group dev alice bob
+group ops carol
+
+allow @dev /releases/** write,mkdir
+deny  @dev /releases/stable/** write,mkdir,delete
+allow @ops /** all
+deny  bob  /releases/*.exe write
+allow @authenticated /inbox/** write
+allow alice /releases/** delete
+`
+
+func newTestACL(t *testing.T, text string) *ACL {
+	t.Helper()
+	p, err := parseACL(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &ACL{}
+	a.policy.Store(p)
+	return a
+}
+
+func Test_matchGlob(t *testing.T) {
+	tests := []struct {
+		glob, path string
+		want       bool
+	}{
+		{"/**", ".", true},
+		{"/**", "a/b/c", true},
+		{"/", ".", true},
+		{"/", "a", false},
+		{"/a", "a", true},
+		{"/a", "a/b", false},
+		{"/a/**", "a", true},
+		{"/a/**", "a/b/c", true},
+		{"/a/**", "ab", false},
+		{"/a/*", "a", false},
+		{"/a/*", "a/b", true},
+		{"/a/*", "a/b/c", false},
+		{"/a/*.exe", "a/setup.exe", true},
+		{"/a/*.exe", "a/setup.exe.txt", false},
+		{"/**/*.pdf", "doc.pdf", true},
+		{"/**/*.pdf", "x/y/doc.pdf", true},
+		{"/**/*.pdf", "x/y/doc.txt", false},
+		{"/a/**/z", "a/z", true},
+		{"/a/**/z", "a/b/c/z", true},
+		{"/a/**/z", "a/b/c/y", false},
+		{"/a/?", "a/b", true},
+		{"/a/[bc]", "a/d", false},
+	}
+	for _, tt := range tests {
+		var glob, segments []string
+		if g := strings.Trim(tt.glob, "/"); g != "" {
+			glob = strings.Split(g, "/")
+		}
+		if tt.path != "." {
+			segments = strings.Split(tt.path, "/")
+		}
+		if got := matchGlob(glob, segments); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.glob, tt.path, got, tt.want)
+		}
+	}
+}
+
+func Test_ACL_allowed(t *testing.T) {
+	acl := newTestACL(t, testACL)
+
+	tests := []struct {
+		user string
+		path string
+		perm permission
+		want bool
+	}{
+		// Reads: allowed for anyone, denied below /secret for everyone,
+		// including users with "all" because deny overrides allow.
+		{"", ".", permRead, true},
+		{"", "docs/a.txt", permRead, true},
+		{"", "secret", permRead, false},
+		{"", "secret/key", permRead, false},
+		{"carol", "secret/key", permRead, false},
+		{"", "secretary", permRead, true},
+
+		// Nothing is writable anonymously, not even through "*" read rules.
+		{"", "releases/v1", permWrite, false},
+		{"", "inbox/a", permWrite, false},
+
+		// Group rules.
+		{"alice", "releases/v1/app", permWrite, true},
+		{"alice", "releases/v1", permMkdir, true},
+		{"alice", "releases/v1", permDelete, true},
+		{"alice", "releases/stable/app", permWrite, false},
+		{"alice", "releases/stable", permMkdir, false},
+		{"alice", "releases/stable/app", permDelete, false},
+		{"alice", "docs/a.txt", permWrite, false},
+		{"bob", "releases/v1/app", permWrite, true},
+		{"bob", "releases/v1", permDelete, false},
+		{"bob", "releases/setup.exe", permWrite, false},
+		{"bob", "releases/v1/setup.exe", permWrite, true},
+		{"carol", "docs/a.txt", permWrite, true},
+		{"carol", "releases/stable/app", permDelete, true},
+		{"mallory", "releases/v1/app", permWrite, false},
+
+		// Built-in group of logged-in users.
+		{"mallory", "inbox/a", permWrite, true},
+		{"mallory", "inbox/a", permDelete, false},
+	}
+	for _, tt := range tests {
+		if got := acl.allowed(identity{name: tt.user}, tt.path, tt.perm); got != tt.want {
+			t.Errorf("allowed(%q, %q, %s) = %v, want %v", tt.user, tt.path, tt.perm, got, tt.want)
+		}
+	}
+}
+
+func Test_parseACL_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"directive", "permit * /** read\n", "line 1: unknown directive"},
+		{"fields", "allow * /**\n", "line 1: expected"},
+		{"relative-glob", "allow * docs/** read\n", "must start with"},
+		{"bad-glob", "allow * /[a read\n", "invalid glob"},
+		{"permission", "\nallow * /** read,exec\n", "line 2: unknown permission \"exec\""},
+		{"unknown-group", "allow @dev /** read\n", "line 1: unknown group \"dev\""},
+		{"builtin-group", "group authenticated alice\n", "built in"},
+		{"empty-group", "group\n", "line 1: expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseACL(strings.NewReader(tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseACL error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := parseACL(strings.NewReader("allow @dev /** read\ngroup dev alice\n")); err != nil {
+		t.Errorf("groups may be defined after their first use: %v", err)
+	}
+}
+
+func Test_LoadACL_reload(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "acl")
+	os.WriteFile(p, []byte("allow * /** read\n"), 0600)
+	acl, err := LoadACL(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(p, []byte("allow * /** delete-everything\n"), 0600)
+	if err := acl.Reload(); err == nil {
+		t.Fatal("Reload of an invalid file should fail")
+	}
+	if !acl.allowed(identity{}, "a", permRead) {
+		t.Fatal("a failed reload should keep the previous rules")
+	}
+}
+
+func newACLFixture(t *testing.T) (string, *FSHandler) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	for _, dir := range []string{"docs", "secret", "releases/v1", "releases/stable"} {
+		os.MkdirAll(filepath.Join(tmpDir, dir), 0755)
+	}
+	for _, file := range []string{"docs/a.txt", "secret/key", "releases/v1/app", "releases/stable/app"} {
+		os.WriteFile(filepath.Join(tmpDir, file), []byte(file), 0600)
+	}
+	return tmpDir, &FSHandler{Basedir: tmpDir, AllowDelete: true, ACL: newTestACL(t, testACL)}
+}
+
+func Test_FSHandler_acl(t *testing.T) {
+	_, h := newACLFixture(t)
+
+	tests := []struct {
+		name     string
+		user     string
+		method   string
+		target   string
+		header   string
+		wantCode int
+	}{
+		{"read", "", http.MethodGet, "/docs/a.txt", "", http.StatusOK},
+		{"read-denied-anonymous", "", http.MethodGet, "/secret/key", "", http.StatusUnauthorized},
+		{"read-denied", "carol", http.MethodGet, "/secret/key", "", http.StatusForbidden},
+		{"archive-denied", "", http.MethodGet, "/secret/?archive=zip", "", http.StatusUnauthorized},
+		{"upload", "alice", http.MethodPut, "/releases/v1/new", "", http.StatusCreated},
+		{"upload-denied", "alice", http.MethodPut, "/releases/stable/new", "", http.StatusForbidden},
+		{"mkdir", "alice", http.MethodPost, "/releases/?action=mkdir&name=v2", "", http.StatusCreated},
+		{"mkdir-denied", "alice", http.MethodPost, "/docs/?action=mkdir&name=x", "", http.StatusForbidden},
+		{"delete-tree-denied", "alice", http.MethodDelete, "/releases/", "", http.StatusForbidden},
+		{"delete", "alice", http.MethodDelete, "/releases/v1/new", "", http.StatusNoContent},
+		{"move-into-protected", "alice", http.MethodPost, "/releases/v1?action=move&to=/releases/stable/", "", http.StatusForbidden},
+		{"move-without-delete", "bob", http.MethodPost, "/releases/v1/app?action=move&to=/releases/v1/app2", "", http.StatusForbidden},
+		{"move", "alice", http.MethodPost, "/releases/v1/app?action=move&to=/releases/v1/app2", "", http.StatusCreated},
+		{"move-out-of-protected", "alice", http.MethodPost, "/releases/stable/app?action=move&to=/releases/v1/app2", "", http.StatusForbidden},
+		{"copy-secret", "carol", http.MethodPost, "/secret?action=copy&to=/public", "", http.StatusForbidden},
+		{"copy", "carol", http.MethodPost, "/docs?action=copy&to=/docs2", "", http.StatusCreated},
+		{"tus-denied", "bob", http.MethodPost, "/releases/setup.exe", "1.0.0", http.StatusForbidden},
+	}
+	tus := &TusHandler{Fs: h}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://localhost"+tt.target, strings.NewReader("data"))
+			if tt.user != "" {
+				r = withUser(r, tt.user)
+			}
+			w := httptest.NewRecorder()
+			if tt.header != "" {
+				r.Header.Set("Tus-Resumable", tt.header)
+				r.Header.Set("Upload-Length", "4")
+				tus.ServeHTTP(w, r)
+			} else {
+				h.ServeHTTP(w, r)
+			}
+			if w.Code != tt.wantCode {
+				t.Errorf("%s %s as %q = %d, want %d: %s", tt.method, tt.target, tt.user, w.Code, tt.wantCode, w.Body)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 should ask for credentials")
+			}
+		})
+	}
+}
+
+func Test_FSHandler_aclFiltersListings(t *testing.T) {
+	_, h := newACLFixture(t)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+	var infos []fileInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Name == "secret" {
+			t.Fatalf("listing should hide unreadable entries: %+v", infos)
+		}
+	}
+	if len(infos) != 2 {
+		t.Fatalf("want docs and releases, got %+v", infos)
+	}
+}
+
+func Test_WebDAV_acl(t *testing.T) {
+	tmpDir, h := newACLFixture(t)
+	dav := &WebDAVHandler{Fs: h, Prefix: "/dav"}
+
+	do := func(user, method, target string, headers map[string]string) *httptest.ResponseRecorder {
+		var body string
+		if method == http.MethodPut {
+			body = "data"
+		}
+		r := httptest.NewRequest(method, "http://localhost/dav"+target, strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		if user != "" {
+			r = withUser(r, user)
+		}
+		w := httptest.NewRecorder()
+		dav.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("", "PROPFIND", "/", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), "secret") {
+		t.Fatalf("PROPFIND should hide unreadable entries: %d %s", w.Code, w.Body)
+	}
+	if w := do("", http.MethodGet, "/secret/key", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET secret as anonymous = %d, want 401", w.Code)
+	}
+	if w := do("alice", http.MethodPut, "/releases/stable/x", nil); w.Code != http.StatusForbidden {
+		t.Errorf("PUT into protected = %d, want 403", w.Code)
+	}
+	if w := do("alice", "MKCOL", "/releases/v2", nil); w.Code != http.StatusCreated {
+		t.Errorf("MKCOL = %d, want 201", w.Code)
+	}
+	if w := do("alice", "MOVE", "/releases/v1", map[string]string{"Destination": "/dav/releases/stable/v1"}); w.Code != http.StatusForbidden {
+		t.Errorf("MOVE into protected = %d, want 403", w.Code)
+	}
+	if w := do("bob", http.MethodDelete, "/releases/v1/app", nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE without permission = %d, want 403", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "releases", "v1", "app")); err != nil {
+		t.Errorf("file should survive a denied DELETE: %v", err)
+	}
+}
+
+func Test_s3_acl(t *testing.T) {
+	h, tmpDir := newS3Handler(t, true)
+	bucket := filepath.Join(tmpDir, "examplebucket")
+	os.MkdirAll(filepath.Join(bucket, "private"), 0755)
+	os.WriteFile(filepath.Join(bucket, "public.txt"), []byte("p"), 0600)
+	os.WriteFile(filepath.Join(bucket, "private", "a.txt"), []byte("a"), 0600)
+	os.Mkdir(filepath.Join(tmpDir, "hidden"), 0755)
+	h.Fs.ACL = newTestACL(t, `
+allow `+testAccessKey+` /examplebucket/** read,write
+deny  `+testAccessKey+` /examplebucket/private/** read
+allow `+testAccessKey+` / read
+`)
+
+	w := s3Do(t, h, http.MethodGet, "/", "", nil)
+	var buckets struct {
+		Names []string `xml:"Buckets>Bucket>Name"`
+	}
+	xml.Unmarshal(w.Body.Bytes(), &buckets)
+	if len(buckets.Names) != 1 || buckets.Names[0] != "examplebucket" {
+		t.Fatalf("buckets = %q", buckets.Names)
+	}
+
+	w = s3Do(t, h, http.MethodGet, "/examplebucket?list-type=2", "", nil)
+	var list listResult
+	xml.Unmarshal(w.Body.Bytes(), &list)
+	if names := list.names(); len(names) != 1 || names[0] != "public.txt" {
+		t.Fatalf("list = %q", names)
+	}
+
+	if w := s3Do(t, h, http.MethodGet, "/examplebucket/private/a.txt", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("GET denied object = %d, want 403", w.Code)
+	}
+	if w := s3Do(t, h, http.MethodPut, "/examplebucket/copy.txt", "", map[string]string{"X-Amz-Copy-Source": "/examplebucket/private/a.txt"}); w.Code != http.StatusForbidden {
+		t.Errorf("copy from denied object = %d, want 403", w.Code)
+	}
+	if w := s3Do(t, h, http.MethodDelete, "/examplebucket/public.txt", "", nil); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE without permission = %d, want 403", w.Code)
+	}
+	if w := s3Do(t, h, http.MethodPut, "/examplebucket/new.txt", "new", nil); w.Code != http.StatusOK {
+		t.Errorf("PUT = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveWriter adds directory entries and files to a streamed archive.
+type archiveWriter interface {
+	addDir(name string, info fs.FileInfo) error
+	addFile(name string, info fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type archiveFormat struct {
+	ext         string
+	contentType string
+	newWriter   func(w io.Writer) (archiveWriter, error)
+}
+
+var archiveFormats = map[string]archiveFormat{
+	"zip": {
+		ext:         ".zip",
+		contentType: "application/zip",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			return &zipArchive{zw: zip.NewWriter(w)}, nil
+		},
+	},
+	"tar.gz": {
+		ext:         ".tar.gz",
+		contentType: "application/gzip",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			return newTarArchive(gzip.NewWriter(w)), nil
+		},
+	},
+	"tar.zst": {
+		ext:         ".tar.zst",
+		contentType: "application/zstd",
+		newWriter: func(w io.Writer) (archiveWriter, error) {
+			zw, err := zstd.NewWriter(w)
+			if err != nil {
+				return nil, err
+			}
+			return newTarArchive(zw), nil
+		},
+	},
+}
+
+// serveArchive streams the directory tree at r.URL.Path as an archive in
+// the requested format. Nothing is buffered to disk; entries are read
+// through os.Root as they are written to the response.
+func (h *FSHandler) serveArchive(w http.ResponseWriter, r *http.Request, format string) (int, error) {
+	af, ok := archiveFormats[format]
+	if !ok {
+		return http.StatusBadRequest, fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	root, err := h.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	rel := toRelPath(r.URL.Path)
+	info, err := root.Stat(rel)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	if !info.IsDir() {
+		return http.StatusBadRequest, fmt.Errorf("%q is not a directory", r.URL.Path)
+	}
+
+	name := path.Base(rel)
+	if rel == "." {
+		abs, _ := filepath.Abs(h.Basedir)
+		name = filepath.Base(abs)
+	}
+
+	w.Header().Set("Content-Type", af.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + af.ext}))
+	if r.Method == http.MethodHead {
+		return http.StatusOK, nil
+	}
+
+	aw, err := af.newWriter(w)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	// Once the first byte is written the status can no longer change, so a
+	// failure part way through leaves a truncated archive that clients
+	// detect as corrupt.
+	id := requestIdentity(r)
+	readable := func(p string) bool { return h.allowed(id, p, permRead) }
+	if err := writeArchive(root, rel, name, readable, aw); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := aw.Close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// writeArchive adds the tree at rel to aw under prefix, skipping entries
+// for which readable returns false.
+func writeArchive(root *os.Root, rel, prefix string, readable func(string) bool, aw archiveWriter) error {
+	fsys := root.FS()
+	return fs.WalkDir(fsys, rel, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if isInternalPath(p) || !readable(p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		name := prefix
+		if p != rel {
+			name = path.Join(prefix, strings.TrimPrefix(p, rel+"/"))
+		}
+
+		// Stat rather than Lstat so that symlinks (which os.Root keeps
+		// inside Basedir) are archived as the file they point to.
+		info, err := fs.Stat(fsys, p)
+		if err != nil {
+			log.Printf("Archive %q stat error %v", p, err)
+			return nil
+		}
+		if d.IsDir() {
+			return aw.addDir(name+"/", info)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return aw.addFile(name, info, f)
+	})
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) addDir(name string, info fs.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	_, err = a.zw.CreateHeader(hdr)
+	return err
+}
+
+func (a *zipArchive) addFile(name string, info fs.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	fw, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	cw io.WriteCloser
+}
+
+func newTarArchive(cw io.WriteCloser) *tarArchive {
+	return &tarArchive{tw: tar.NewWriter(cw), cw: cw}
+}
+
+func (a *tarArchive) addDir(name string, info fs.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	return a.tw.WriteHeader(hdr)
+}
+
+func (a *tarArchive) addFile(name string, info fs.FileInfo, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// Copy exactly the announced size in case the file grows meanwhile.
+	_, err = io.Copy(a.tw, io.LimitReader(r, hdr.Size))
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.cw.Close()
+}
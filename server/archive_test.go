@@ -0,0 +1,151 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func newArchiveTree(t *testing.T) string {
+	t.Helper()
+	tmpDir := t.TempDir()
+	os.MkdirAll(filepath.Join(tmpDir, "release", "bin"), 0755)
+	os.MkdirAll(filepath.Join(tmpDir, "release", "empty"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "release", "README"), []byte("readme"), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "release", "bin", "app"), []byte("binary"), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "release", tempPrefix+"0123"), []byte("partial"), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "outside.txt"), []byte("outside"), 0600)
+	return tmpDir
+}
+
+func serveArchiveRequest(t *testing.T, h *FSHandler, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost"+target, nil)
+	w := httptest.NewRecorder()
+	code, err := h.serveGet(w, r)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("serveGet(%q) = %d, %v", target, code, err)
+	}
+	return w
+}
+
+var wantArchiveEntries = []string{
+	"release/",
+	"release/README=readme",
+	"release/bin/",
+	"release/bin/app=binary",
+	"release/empty/",
+}
+
+func Test_serveArchive_zip(t *testing.T) {
+	h := &FSHandler{Basedir: newArchiveTree(t)}
+	w := serveArchiveRequest(t, h, "/release/?archive=zip")
+
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename=release.zip` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	body := w.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			entries = append(entries, f.Name)
+			continue
+		}
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		entries = append(entries, f.Name+"="+string(data))
+	}
+	assertEntries(t, entries)
+}
+
+func Test_serveArchive_tar(t *testing.T) {
+	tests := []struct {
+		format     string
+		decompress func(io.Reader) (io.Reader, error)
+	}{
+		{"tar.gz", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"tar.zst", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			h := &FSHandler{Basedir: newArchiveTree(t)}
+			w := serveArchiveRequest(t, h, "/release?archive="+tt.format)
+
+			zr, err := tt.decompress(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(zr)
+			var entries []string
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeDir {
+					entries = append(entries, hdr.Name)
+					continue
+				}
+				data, _ := io.ReadAll(tr)
+				entries = append(entries, hdr.Name+"="+string(data))
+			}
+			assertEntries(t, entries)
+		})
+	}
+}
+
+func Test_serveArchive_rejects(t *testing.T) {
+	h := &FSHandler{Basedir: newArchiveTree(t)}
+
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+	}{
+		{"unknown format", "/release/?archive=rar", http.StatusBadRequest},
+		{"missing dir", "/nope/?archive=zip", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost"+tt.target, nil)
+			code, _ := h.serve(httptest.NewRecorder(), r)
+			if code != tt.wantCode {
+				t.Errorf("want %d, got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func assertEntries(t *testing.T, got []string) {
+	t.Helper()
+	sort.Strings(got)
+	if len(got) != len(wantArchiveEntries) {
+		t.Fatalf("entries = %q, want %q", got, wantArchiveEntries)
+	}
+	for i := range got {
+		if got[i] != wantArchiveEntries[i] {
+			t.Fatalf("entries = %q, want %q", got, wantArchiveEntries)
+		}
+	}
+}
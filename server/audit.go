@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of an audit log.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Action is "upload", "overwrite", "mkdir", "delete", "move", "copy"
+	// or, for the trash, "restore" or "purge".
+	Action   string `json:"action"`
+	User     string `json:"user"`
+	ClientIP string `json:"client_ip"`
+	Path     string `json:"path"`
+	// To is the destination of a move or copy.
+	To string `json:"to,omitempty"`
+	// Size and SHA256 describe the content stored by an upload.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Outcome is "ok", "denied" or "failed", with Error saying why.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// Prev is the SHA-256 of the previous line, empty for the first one.
+	Prev string `json:"prev"`
+}
+
+// AuditLog is an append-only record of the changes made to files, one JSON
+// AuditEntry per line. Each entry carries the hash of the line before it,
+// so editing, removing or reordering entries breaks the chain, which
+// ReadAuditLog detects. Removing entries from the end goes unnoticed unless
+// the hash of the last entry is kept elsewhere too.
+//
+// A nil *AuditLog records nothing.
+type AuditLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+	prev string
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// needed. An existing log must have an intact chain.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	head, err := ReadAuditLog(f, nil)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &AuditLog{f: f, path: path, prev: head}, nil
+}
+
+// Close closes the log; later changes are no longer recorded.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// record appends e for a change requested by r, whose outcome is code and
+// err.
+func (a *AuditLog) record(r *http.Request, e AuditEntry, code int, err error) {
+	if a == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.User = logUser(r)
+	e.ClientIP = clientIP(r).String()
+	switch {
+	case err == nil:
+		e.Outcome = "ok"
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		e.Outcome = "denied"
+	default:
+		e.Outcome = "failed"
+	}
+	if err != nil {
+		e.Error = err.Error()
+		e.Size, e.SHA256 = 0, ""
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return
+	}
+	e.Prev = a.prev
+	line, merr := json.Marshal(e)
+	if merr != nil {
+		log.Printf("audit %s %s error %v", e.Action, e.Path, merr)
+		return
+	}
+	if _, werr := a.f.Write(append(line, '\n')); werr != nil {
+		log.Printf("audit %s %s error %v", e.Action, e.Path, werr)
+		return
+	}
+	if serr := a.f.Sync(); serr != nil {
+		log.Printf("audit sync %q error %v", a.path, serr)
+	}
+	a.prev = auditHash(line)
+}
+
+// ReadAuditLog reads an audit log from r, checking the chain as it goes, and
+// calls fn, if not nil, with each entry in order. It returns the hash of the
+// last line, which an entry appended next carries as Prev.
+func ReadAuditLog(r io.Reader, fn func(n int, e *AuditEntry) error) (string, error) {
+	br := bufio.NewReader(r)
+	prev := ""
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return "", fmt.Errorf("line %d: truncated entry", n)
+			}
+			return prev, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+
+		e := &AuditEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			return "", fmt.Errorf("line %d: %w", n, err)
+		}
+		if e.Prev != prev {
+			return "", fmt.Errorf("line %d: %w", n, errAuditChain)
+		}
+		prev = auditHash(line)
+		if fn != nil {
+			if err := fn(n, e); err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+var errAuditChain = errors.New("chain broken: the entry or the one before it was changed, removed or reordered")
+
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditPath returns the URL path of rel, including the mount prefix.
+func (h *FSHandler) auditPath(rel string) string {
+	return path.Join("/", h.fullRel(rel))
+}
+
+// auditHasher returns a hash for the content of an upload, or nil when
+// there is neither an audit log nor webhooks to report it to.
+func (h *FSHandler) auditHasher() hash.Hash {
+	if h.Audit == nil && h.Webhooks == nil {
+		return nil
+	}
+	return sha256.New()
+}
+
+func hexSum(sum hash.Hash) string {
+	if sum == nil {
+		return ""
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readAudit(t *testing.T, path string) []*AuditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []*AuditEntry
+	if _, err := ReadAuditLog(f, func(_ int, e *AuditEntry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func Test_AuditLog_records(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	fs := &FSHandler{Basedir: t.TempDir(), Audit: audit}
+	tus := &TusHandler{Fs: fs}
+	do := func(method, target, body string) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		(&AuthHandler{Username: "admin", Password: "secret", Next: NewCompHandler(tus, fs)}).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	do(http.MethodPut, "/a.txt", "hello")
+	do(http.MethodPut, "/a.txt", "world")
+	do(http.MethodPost, "/?action=mkdir&name=docs", "")
+	do(http.MethodDelete, "/a.txt", "")
+	do(http.MethodPost, "/a.txt?action=move&to=/docs/", "")
+	loc := tusCreate(t, tus, "/docs/", "b.bin", 3)
+	if w := tusPatch(tus, loc, 0, "abc"); w.Code != http.StatusNoContent {
+		t.Fatalf("tus patch = %d", w.Code)
+	}
+
+	sum := func(s string) string {
+		b := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(b[:])
+	}
+	want := []AuditEntry{
+		{Action: "upload", User: "admin", Path: "/a.txt", Size: 5, SHA256: sum("hello"), Outcome: "ok"},
+		{Action: "overwrite", User: "admin", Path: "/a.txt", Size: 5, SHA256: sum("world"), Outcome: "ok"},
+		{Action: "mkdir", User: "admin", Path: "/docs", Outcome: "ok"},
+		{Action: "delete", User: "admin", Path: "/a.txt", Outcome: "denied", Error: "delete is disabled"},
+		{Action: "move", User: "admin", Path: "/a.txt", To: "/docs/a.txt", Outcome: "ok"},
+		{Action: "upload", User: "-", Path: "/docs/b.bin", Size: 3, SHA256: sum("abc"), Outcome: "ok"},
+	}
+	got := readAudit(t, logPath)
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		if e.Time.IsZero() || (e.User == "admin" && e.ClientIP != "192.0.2.1") {
+			t.Errorf("entry %d: time %v client %q", i, e.Time, e.ClientIP)
+		}
+		w := want[i]
+		w.Time, w.ClientIP, w.Prev = e.Time, e.ClientIP, e.Prev
+		if *e != w {
+			t.Errorf("entry %d = %+v, want %+v", i, *e, w)
+		}
+	}
+
+	// Reopening carries on the chain.
+	audit.Close()
+	audit, err = OpenAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Audit = audit
+	do(http.MethodPost, "/?action=mkdir&name=more", "")
+	if got := readAudit(t, logPath); len(got) != len(want)+1 {
+		t.Fatalf("after reopen: %d entries", len(got))
+	}
+}
+
+func Test_AuditLog_webdavAndS3(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	s3, _ := newS3Handler(t, true)
+	fs := s3.Fs
+	fs.Audit = audit
+	dav := &WebDAVHandler{Fs: fs, Prefix: "/dav"}
+	davDo := func(method, target, body string, headers map[string]string) {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		dav.ServeHTTP(w, withUser(r, "dave"))
+		if w.Code >= 400 {
+			t.Fatalf("%s %s = %d %s", method, target, w.Code, w.Body)
+		}
+	}
+
+	davDo("MKCOL", "/dav/docs", "", nil)
+	davDo(http.MethodPut, "/dav/docs/a.txt", "hello", nil)
+	davDo(http.MethodPut, "/dav/docs/a.txt", "world", nil)
+	davDo("COPY", "/dav/docs", "", map[string]string{"Destination": "/dav/copy"})
+	davDo("MOVE", "/dav/copy", "", map[string]string{"Destination": "/dav/moved"})
+	davDo(http.MethodDelete, "/dav/moved", "", nil)
+	s3Do(t, s3, http.MethodPut, "/examplebucket/b.txt", "bb", nil)
+	s3Do(t, s3, http.MethodPut, "/examplebucket/c.txt", "", map[string]string{"X-Amz-Copy-Source": "/examplebucket/b.txt"})
+	s3Do(t, s3, http.MethodDelete, "/examplebucket/b.txt", "", nil)
+	// Deleting a missing key changes nothing.
+	s3Do(t, s3, http.MethodDelete, "/examplebucket/b.txt", "", nil)
+
+	sum := func(s string) string {
+		b := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(b[:])
+	}
+	want := []AuditEntry{
+		{Action: "mkdir", User: "dave", Path: "/docs"},
+		{Action: "upload", User: "dave", Path: "/docs/a.txt", Size: 5, SHA256: sum("hello")},
+		{Action: "overwrite", User: "dave", Path: "/docs/a.txt", Size: 5, SHA256: sum("world")},
+		{Action: "copy", User: "dave", Path: "/docs", To: "/copy"},
+		{Action: "move", User: "dave", Path: "/copy", To: "/moved"},
+		{Action: "delete", User: "dave", Path: "/moved"},
+		{Action: "upload", User: testAccessKey, Path: "/examplebucket/b.txt", Size: 2, SHA256: sum("bb")},
+		{Action: "copy", User: testAccessKey, Path: "/examplebucket/b.txt", To: "/examplebucket/c.txt"},
+		{Action: "delete", User: testAccessKey, Path: "/examplebucket/b.txt"},
+	}
+	got := readAudit(t, logPath)
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		w := want[i]
+		w.Time, w.ClientIP, w.Prev, w.Outcome = e.Time, e.ClientIP, e.Prev, "ok"
+		if *e != w {
+			t.Errorf("entry %d = %+v, want %+v", i, *e, w)
+		}
+	}
+}
+
+func Test_ReadAuditLog_tampering(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := OpenAuditLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodDelete, "/", nil)
+	for _, p := range []string{"/a", "/b", "/c"} {
+		audit.record(r, AuditEntry{Action: "delete", Path: p}, http.StatusNoContent, nil)
+	}
+	audit.Close()
+	orig, _ := os.ReadFile(logPath)
+	lines := strings.SplitAfter(string(orig), "\n")
+
+	tests := map[string]string{
+		"edited":    strings.Replace(string(orig), `"path":"/b"`, `"path":"/x"`, 1),
+		"removed":   lines[0] + lines[2],
+		"reordered": lines[1] + lines[0] + lines[2],
+		"truncated": strings.TrimSuffix(string(orig), "\n"),
+	}
+	for name, content := range tests {
+		_, err := ReadAuditLog(strings.NewReader(content), nil)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+		if name != "truncated" && !errors.Is(err, errAuditChain) {
+			t.Errorf("%s: error = %v", name, err)
+		}
+	}
+
+	head, err := ReadAuditLog(bytes.NewReader(orig), nil)
+	if err != nil || head != auditHash([]byte(strings.TrimSuffix(lines[2], "\n"))) {
+		t.Fatalf("head = %q, %v", head, err)
+	}
+	if err := os.WriteFile(logPath, []byte(tests["edited"]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenAuditLog(logPath); err == nil {
+		t.Fatal("OpenAuditLog accepted a broken chain")
+	}
+}
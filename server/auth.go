@@ -1,49 +1,320 @@
 package server
 
 import (
+	"context"
 	"crypto/subtle"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
-// BasicAuthHandler enforces HTTP Basic authentication when Username is set
-// (Password may be empty). When AuthWriteOnly is true, only state-changing
-// methods require a valid Authorization header; GET/HEAD (and other reads)
-// are allowed without credentials.
-type BasicAuthHandler struct {
+// AuthHandler authenticates requests before passing them to Next. It is
+// enabled when Username is set (Password may be empty), Users, Tokens or
+// OIDC is non-nil or ClientCerts is set, and accepts:
+//
+//   - HTTP Basic credentials matching Username/Password or Users,
+//   - "Authorization: Bearer" API tokens from Tokens, limited to their scope
+//     and path prefix,
+//   - for GET and HEAD, share link tokens from Shares on the shared path,
+//   - TLS client certificates verified during the handshake, whose
+//     ClientCerts field names the user,
+//   - session cookies from Sessions, issued after logging in with OIDC or,
+//     if LoginForm is set, with Basic credentials on the login page.
+//
+// Basic credentials take precedence over certificates, and both over
+// sessions. Throttle locks out clients and users after repeated failed
+// passwords or tokens. State-changing requests made with a session must
+// carry its CSRF token in the X-CSRF-Token header.
+//
+// When a login is available, browsers that would be asked for Basic
+// credentials are redirected to it instead; other clients still get the
+// Basic challenge. Logins are served under /_auth/, see serveAuth.
+//
+// When AuthWriteOnly is true, only state-changing methods require
+// credentials; GET/HEAD (and other reads) are allowed without them. An
+// invalid bearer token is rejected even on reads.
+//
+// The name of an authenticated user, or of the API token, is stored in the
+// request context, see requestUser.
+type AuthHandler struct {
 	Username      string
 	Password      string
+	Users         *Users
+	Tokens        *Tokens
+	Shares        *ShareHandler
+	ClientCerts   CertMapping
+	Sessions      *Sessions
+	OIDC          *OIDCHandler
+	LoginForm     bool
+	Throttle      *AuthThrottle
 	AuthWriteOnly bool
-	Next          http.Handler
+	// Mounts may override AuthWriteOnly for the requests to their mounts.
+	Mounts *MountHandler
+	// Metrics, when set, counts the requests refused for bad credentials.
+	Metrics *Metrics
+	Next    http.Handler
+}
+
+// BasicAuthHandler is the former name of AuthHandler.
+//
+// Deprecated: use AuthHandler.
+type BasicAuthHandler = AuthHandler
+
+// identity is who a request acts as; the zero value is anonymous.
+type identity struct {
+	name string
+	// groups are reported for the user by an identity provider and count in
+	// addition to the groups of the ACL file.
+	groups []string
+}
+
+type identityKey struct{}
+
+// withUser returns a shallow copy of r that carries the authenticated
+// username.
+func withUser(r *http.Request, name string) *http.Request {
+	return withIdentity(r, identity{name: name})
+}
+
+func withIdentity(r *http.Request, id identity) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+	if e := requestAccessEntry(r); e != nil {
+		e.user = logUser(r)
+	}
+	return r
+}
+
+// requestUser returns the authenticated username of r, or "" for anonymous
+// requests.
+func requestUser(r *http.Request) string {
+	return requestIdentity(r).name
+}
+
+func requestIdentity(r *http.Request) identity {
+	return contextIdentity(r.Context())
+}
+
+func contextIdentity(ctx context.Context) identity {
+	id, _ := ctx.Value(identityKey{}).(identity)
+	return id
+}
+
+// logUser formats the username of r for log lines. Requests made through a
+// share link are logged with the share id.
+func logUser(r *http.Request) string {
+	return contextLogUser(r.Context())
+}
+
+// contextLogUser is logUser for code that only has the request context.
+func contextLogUser(ctx context.Context) string {
+	if s, _ := ctx.Value(shareKey{}).(*share); s != nil {
+		return "share:" + s.ID
+	}
+	if name := contextIdentity(ctx).name; name != "" {
+		return name
+	}
+	return "-"
 }
 
 func writeLikeRequest(r *http.Request) bool {
 	switch r.Method {
 	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
 		return true
+	// WebDAV methods that modify resources or their locks.
+	case "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK":
+		return true
 	default:
 		return false
 	}
 }
 
-func (h *BasicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h.Username == "" {
+func (h *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	if h.serve(sw, r) {
+		h.Metrics.request("auth", r.Method, sw.code, time.Since(start))
+	}
+}
+
+// serve answers r and reports whether it did so itself, refusing it or
+// serving a login, rather than passing it on to Next.
+func (h *AuthHandler) serve(w http.ResponseWriter, r *http.Request) bool {
+	if h.Username == "" && h.Users == nil && h.Tokens == nil && h.ClientCerts == "" && h.OIDC == nil {
 		h.Next.ServeHTTP(w, r)
-		return
+		return false
+	}
+
+	if h.Sessions != nil && strings.HasPrefix(r.URL.Path, authPrefix) {
+		h.serveAuth(w, r)
+		return true
+	}
+
+	secret, bearer := bearerToken(r)
+	if user, _, basic := r.BasicAuth(); basic || bearer {
+		// Credentials from a client, or for a user, that failed too often
+		// are not even checked until the lockout ends.
+		if wait := h.Throttle.wait(throttleKeys(clientIP(r), user)); wait > 0 {
+			err := lockedOut(wait)
+			h.Metrics.authFailure("locked_out")
+			tooManyRequests(w, wait, err)
+			log.Printf("auth %s %s %s %s - %d - %v", clientIP(r), user, r.Method, r.URL.Path, http.StatusTooManyRequests, err)
+			return true
+		}
+	}
+
+	if bearer && h.Tokens != nil {
+		tok, code, err := h.Tokens.authorize(r, secret)
+		if err != nil {
+			switch code {
+			case http.StatusUnauthorized:
+				h.Throttle.fail(throttleKeys(clientIP(r), ""))
+				h.Metrics.authFailure("token")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="fileserver", error="invalid_token"`)
+			case http.StatusForbidden:
+				w.Header().Set("WWW-Authenticate", `Bearer realm="fileserver", error="insufficient_scope"`)
+			}
+			http.Error(w, err.Error(), code)
+			return true
+		}
+		h.Next.ServeHTTP(w, withUser(r, tok.Name))
+		return false
+	}
+
+	if h.Shares != nil {
+		shared, ok, code, err := h.Shares.authorize(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), code)
+			return true
+		}
+		if ok {
+			h.Next.ServeHTTP(w, shared)
+			return false
+		}
+	}
+
+	id, csrf, valid := h.identity(w, r)
+	if csrf != "" {
+		if writeLikeRequest(r) && subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(csrf)) != 1 {
+			h.Metrics.authFailure("csrf")
+			http.Error(w, "missing or invalid CSRF token", http.StatusForbidden)
+			return true
+		}
+		r = withCSRFToken(r, csrf)
+	}
+
+	writeOnly := h.Mounts.authWriteOnly(r, h.AuthWriteOnly)
+	if !valid && h.loginEnabled() && acceptsHTML(r) {
+		// Send browsers to the login page rather than the Basic dialog,
+		// including when the ACL turns out to deny anonymous reads.
+		login := loginURL(r.URL.RequestURI())
+		if !writeOnly {
+			http.Redirect(w, r, login, http.StatusFound)
+			return true
+		}
+		w = &loginRedirector{ResponseWriter: w, login: login}
 	}
 
-	if h.AuthWriteOnly && !writeLikeRequest(r) {
+	if writeOnly && !writeLikeRequest(r) && !trashRequest(r) {
+		// Reads stay public, but browsers keep sending credentials once
+		// they have them; record who is reading when they check out.
+		if valid {
+			r = withIdentity(r, id)
+		}
 		h.Next.ServeHTTP(w, r)
-		return
+		return false
 	}
 
-	user, pass, ok := r.BasicAuth()
-	if !ok ||
-		subtle.ConstantTimeCompare([]byte(user), []byte(h.Username)) != 1 ||
-		subtle.ConstantTimeCompare([]byte(pass), []byte(h.Password)) != 1 {
+	if !valid {
 		w.Header().Set("WWW-Authenticate", `Basic realm="fileserver"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return true
+	}
+
+	h.Next.ServeHTTP(w, withIdentity(r, id))
+	return false
+}
+
+// identity returns who r is authenticated as by Basic credentials, a client
+// certificate or a session, in that order, and the CSRF token if it is a
+// session.
+func (h *AuthHandler) identity(w http.ResponseWriter, r *http.Request) (identity, string, bool) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		if h.verify(user, pass) {
+			h.Throttle.succeed(user)
+			return identity{name: user}, "", true
+		}
+		h.Throttle.fail(throttleKeys(clientIP(r), user))
+		h.Metrics.authFailure("basic")
+	}
+	if name := certUser(r, h.ClientCerts); name != "" {
+		return identity{name: name}, "", true
+	}
+	if h.Sessions != nil {
+		return h.Sessions.identity(w, r)
+	}
+	return identity{}, "", false
+}
+
+func (h *AuthHandler) loginEnabled() bool {
+	return h.Sessions != nil && (h.OIDC != nil || h.LoginForm)
+}
+
+// acceptsHTML reports whether r is a browser navigation, which asks for
+// text/html.
+func acceptsHTML(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, _ := strings.Cut(a, ";"); strings.TrimSpace(mediaType) == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+// loginRedirector turns an Unauthorized response into a redirect to the
+// login page.
+type loginRedirector struct {
+	http.ResponseWriter
+	login      string
+	redirected bool
+}
+
+func (w *loginRedirector) WriteHeader(code int) {
+	if w.redirected {
+		return
+	}
+	if code != http.StatusUnauthorized {
+		w.ResponseWriter.WriteHeader(code)
 		return
 	}
+	w.redirected = true
+	header := w.ResponseWriter.Header()
+	header.Del("WWW-Authenticate")
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	header.Set("Location", w.login)
+	w.ResponseWriter.WriteHeader(http.StatusFound)
+}
+
+func (w *loginRedirector) Write(b []byte) (int, error) {
+	if w.redirected {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
 
-	h.Next.ServeHTTP(w, r)
+func (w *loginRedirector) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (h *AuthHandler) verify(user, pass string) bool {
+	if h.Username != "" &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(h.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(h.Password)) == 1 {
+		return true
+	}
+	return h.Users != nil && h.Users.Verify(user, pass)
 }
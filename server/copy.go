@@ -0,0 +1,259 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// copyFailure describes one entry of a tree copy that could not be copied.
+type copyFailure struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+func (h *FSHandler) serveCopy(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	src := toRelPath(r.URL.Path)
+	if src == "." {
+		return http.StatusBadRequest, errors.New("cannot copy root directory")
+	}
+	dst, code, err := h.destination(r, src)
+	if err != nil {
+		return code, err
+	}
+	defer func() {
+		h.changed(r, AuditEntry{Action: "copy", Path: h.auditPath(src), To: h.auditPath(dst)}, code, err)
+	}()
+	if dst == src {
+		return http.StatusForbidden, errors.New("source and destination are the same")
+	}
+	if strings.HasPrefix(dst, src+"/") {
+		return http.StatusConflict, fmt.Errorf("cannot copy %q into itself", r.URL.Path)
+	}
+
+	// COPY only knows depth 0 (the collection without its members) and
+	// infinity, see RFC 4918 section 9.8.3.
+	recursive := true
+	if r.Method != http.MethodPost {
+		switch r.Header.Get("Depth") {
+		case "", "infinity":
+		case "0":
+			recursive = false
+		default:
+			return http.StatusBadRequest, fmt.Errorf("invalid Depth %q", r.Header.Get("Depth"))
+		}
+	}
+
+	root, err := h.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	info, err := root.Lstat(src)
+	if err != nil {
+		return http.StatusNotFound, fmt.Errorf("%q not found", r.URL.Path)
+	}
+	if code, err := h.checkTree(w, r, root, src, permRead); err != nil {
+		return code, err
+	}
+	if code, err := h.checkRelocation(w, r, root, src, dst); err != nil {
+		return code, err
+	}
+
+	code, err = h.prepareDestination(w, r, root, dst, overwriteAllowed(r))
+	if err != nil {
+		return code, err
+	}
+
+	c := &treeCopier{root: root}
+	c.copy(src, dst, info, recursive)
+
+	switch {
+	case len(c.failures) == 0:
+		w.WriteHeader(code)
+		return code, nil
+	case len(c.failures) == 1 && c.failures[0].Path == "/"+dst:
+		return c.failures[0].Status, errors.New(c.failures[0].Error)
+	}
+	writeCopyFailures(w, r, c.failures)
+	return http.StatusMultiStatus, fmt.Errorf("%d entries could not be copied", len(c.failures))
+}
+
+// treeCopier copies files and directory trees within a root. Failures are
+// recorded per entry and the copy carries on with the remaining entries.
+type treeCopier struct {
+	root     *os.Root
+	failures []copyFailure
+}
+
+func (c *treeCopier) copy(src, dst string, info fs.FileInfo, recursive bool) {
+	var err error
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		err = c.copyDir(src, dst, info, recursive)
+	case mode.IsRegular():
+		err = copyFile(c.root, src, dst, info)
+	case mode&fs.ModeSymlink != 0:
+		err = copySymlink(c.root, src, dst)
+	default:
+		err = fmt.Errorf("%q: unsupported file type %v", src, mode.Type())
+	}
+	if err != nil {
+		c.fail(dst, err)
+	}
+}
+
+func (c *treeCopier) copyDir(src, dst string, info fs.FileInfo, recursive bool) error {
+	// Create the directory writable so its members can be added, and apply
+	// the source permissions once it is filled.
+	if err := c.root.Mkdir(dst, 0700); err != nil {
+		return err
+	}
+	if recursive {
+		entries, err := readDirInRoot(c.root, src)
+		if err != nil {
+			c.fail(dst, err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), tempPrefix) {
+				continue
+			}
+			childDst := path.Join(dst, e.Name())
+			ei, err := e.Info()
+			if err != nil {
+				c.fail(childDst, err)
+				continue
+			}
+			c.copy(path.Join(src, e.Name()), childDst, ei, true)
+		}
+	}
+	if err := c.root.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return c.root.Chtimes(dst, time.Time{}, info.ModTime())
+}
+
+func (c *treeCopier) fail(rel string, err error) {
+	c.failures = append(c.failures, copyFailure{
+		Path:   "/" + rel,
+		Status: copyErrorStatus(err),
+		Error:  err.Error(),
+	})
+}
+
+func copyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrExist):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func readDirInRoot(root *os.Root, dir string) ([]fs.DirEntry, error) {
+	f, err := root.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.ReadDir(-1)
+}
+
+// copyFile copies a regular file through a temp file, so that dst only
+// appears once it is complete, and keeps the permissions and modification
+// time of src. The data is cloned when the filesystem supports reflinks;
+// otherwise io.Copy between the two files uses copy_file_range where the
+// kernel provides it.
+func copyFile(root *os.Root, src, dst string, info fs.FileInfo) error {
+	in, err := root.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, out, err := createTemp(root, path.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if err = reflink(out, in); err != nil {
+		_, err = io.Copy(out, in)
+	}
+	if err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = root.Chtimes(tmp, time.Time{}, info.ModTime())
+	}
+	if err == nil {
+		err = root.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = root.Remove(tmp)
+	}
+	return err
+}
+
+// copySymlink recreates a symbolic link with the same target. The target is
+// not followed, so links pointing outside Basedir stay unusable through the
+// server just like the original.
+func copySymlink(root *os.Root, src, dst string) error {
+	target, err := root.Readlink(src)
+	if err != nil {
+		return err
+	}
+	return root.Symlink(target, dst)
+}
+
+type multiStatus struct {
+	XMLName   xml.Name              `xml:"D:multistatus"`
+	NS        string                `xml:"xmlns:D,attr"`
+	Responses []multiStatusResponse `xml:"D:response"`
+}
+
+type multiStatusResponse struct {
+	Href        string `xml:"D:href"`
+	Status      string `xml:"D:status"`
+	Description string `xml:"D:responsedescription,omitempty"`
+}
+
+// writeCopyFailures answers 207 Multi-Status with one entry per failure: a
+// JSON array for the action API and a DAV multistatus body for COPY.
+func writeCopyFailures(w http.ResponseWriter, r *http.Request, failures []copyFailure) {
+	if r.Method == http.MethodPost {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		_ = json.NewEncoder(w).Encode(failures)
+		return
+	}
+
+	ms := multiStatus{NS: "DAV:"}
+	for _, f := range failures {
+		ms.Responses = append(ms.Responses, multiStatusResponse{
+			Href:        (&url.URL{Path: f.Path}).EscapedPath(),
+			Status:      fmt.Sprintf("HTTP/1.1 %d %s", f.Status, http.StatusText(f.Status)),
+			Description: f.Error,
+		})
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(ms)
+}
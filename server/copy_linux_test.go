@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func Test_serveCopy_partialFailure(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+	if err := syscall.Mkfifo(filepath.Join(tmpDir, "dir", "fifo"), 0600); err != nil {
+		t.Skip(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/dir?action=copy&to=/copy", nil)
+	w := httptest.NewRecorder()
+	code, _ := h.serve(w, r)
+	if code != http.StatusMultiStatus || w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d/%d", code, w.Code)
+	}
+
+	var failures []copyFailure
+	if err := json.Unmarshal(w.Body.Bytes(), &failures); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 1 || failures[0].Path != "/copy/fifo" {
+		t.Fatalf("unexpected failures %+v", failures)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "copy", "sub", "c.txt")); err != nil {
+		t.Errorf("other entries should still be copied: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_serveCopy_file(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(tmpDir, "a.txt"), mtime, mtime)
+	os.Chmod(filepath.Join(tmpDir, "a.txt"), 0640)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/a.txt?action=copy&to=/copy.txt", nil)
+	code, err := h.serve(httptest.NewRecorder(), r)
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, err: %v", code, err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "copy.txt"))
+	if string(data) != "a" {
+		t.Errorf("got %q, want %q", data, "a")
+	}
+	info, err := os.Stat(filepath.Join(tmpDir, "copy.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime not preserved: got %v, want %v", info.ModTime(), mtime)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode not preserved: got %v", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "a.txt")); err != nil {
+		t.Errorf("source should be kept: %v", err)
+	}
+}
+
+func Test_serveCopy_tree(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	os.WriteFile(filepath.Join(tmpDir, "dir", "sub", tempPrefix+"0123"), []byte("partial"), 0600)
+	os.Symlink("c.txt", filepath.Join(tmpDir, "dir", "sub", "link"))
+	os.Chtimes(filepath.Join(tmpDir, "dir", "sub"), mtime, mtime)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/dir/?action=copy&to=/other/", nil)
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, err: %v", code, err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "other", "dir", "sub", "c.txt"))
+	if string(data) != "c" {
+		t.Errorf("got %q, want %q", data, "c")
+	}
+	if target, err := os.Readlink(filepath.Join(tmpDir, "other", "dir", "sub", "link")); err != nil || target != "c.txt" {
+		t.Errorf("symlink should be copied as a link, got %q, %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "other", "dir", "sub", tempPrefix+"0123")); err == nil {
+		t.Error("temp files should not be copied")
+	}
+	info, _ := os.Stat(filepath.Join(tmpDir, "other", "dir", "sub"))
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("directory mtime not preserved: got %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func Test_serveCopy_method(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+
+	r := httptest.NewRequest("COPY", "http://localhost/dir", nil)
+	r.Header.Set("Destination", "http://localhost/shallow")
+	r.Header.Set("Depth", "0")
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, err: %v", code, err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(tmpDir, "shallow")); err != nil || len(entries) != 0 {
+		t.Errorf("Depth 0 should copy the directory only, got %d entries, err: %v", len(entries), err)
+	}
+
+	r = httptest.NewRequest("COPY", "http://localhost/a.txt", nil)
+	r.Header.Set("Destination", "/b.txt")
+	r.Header.Set("Overwrite", "F")
+	if code, _ := h.serve(httptest.NewRecorder(), r); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 with Overwrite: F, got %d", code)
+	}
+	r.Header.Set("Overwrite", "T")
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d, err: %v", code, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "b.txt"))
+	if string(data) != "a" {
+		t.Errorf("got %q, want %q", data, "a")
+	}
+}
+
+func Test_serveCopy_rejected(t *testing.T) {
+	_, h := newMoveFixture(t)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		depth    string
+		wantCode int
+	}{
+		{"root", http.MethodPost, "/?action=copy&to=/x", "", http.StatusBadRequest},
+		{"same", http.MethodPost, "/a.txt?action=copy&to=/a.txt", "", http.StatusForbidden},
+		{"into-itself", http.MethodPost, "/dir?action=copy&to=/dir/sub/", "", http.StatusConflict},
+		{"not-found", http.MethodPost, "/nope?action=copy&to=/x", "", http.StatusNotFound},
+		{"internal", http.MethodPost, "/a.txt?action=copy&to=/" + s3Dir + "/a", "", http.StatusBadRequest},
+		{"depth-1", "COPY", "/dir", "1", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://localhost"+tt.target, nil)
+			r.Header.Set("Destination", "/copy")
+			if tt.depth != "" {
+				r.Header.Set("Depth", tt.depth)
+			}
+			code, _ := h.serve(httptest.NewRecorder(), r)
+			if code != tt.wantCode {
+				t.Errorf("copy %s = %d, want %d", tt.target, code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_writeCopyFailures(t *testing.T) {
+	failures := []copyFailure{{Path: "/dst/a b", Status: http.StatusForbidden, Error: "permission denied"}}
+
+	w := httptest.NewRecorder()
+	writeCopyFailures(w, httptest.NewRequest(http.MethodPost, "http://localhost/src?action=copy", nil), failures)
+	var got []copyFailure
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 1 || got[0] != failures[0] {
+		t.Errorf("unexpected JSON body %s, err: %v", w.Body, err)
+	}
+
+	w = httptest.NewRecorder()
+	writeCopyFailures(w, httptest.NewRequest("COPY", "http://localhost/src", nil), failures)
+	ms := parseMultistatus(t, w.Body.String())
+	if w.Code != http.StatusMultiStatus || len(ms.Responses) != 1 || ms.Responses[0].Href != "/dst/a%20b" {
+		t.Errorf("unexpected multistatus %d %s", w.Code, w.Body)
+	}
+}
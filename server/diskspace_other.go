@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "errors"
+
+// diskSpace is only implemented on Linux; elsewhere the file system metrics
+// are left out.
+func diskSpace(dir string) (free, size uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
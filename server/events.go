@@ -0,0 +1,467 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	eventsPrefix = "/_events"
+
+	// eventsHeartbeat keeps idle streams from being closed by proxies.
+	eventsHeartbeat = 30 * time.Second
+	// eventsSettle is how long changes seen on disk must be quiet before
+	// they are sent, so that a file being written is reported once.
+	eventsSettle = 200 * time.Millisecond
+	// eventsEcho is how long changes seen on disk are ignored after the
+	// server itself changed the same path.
+	eventsEcho = 2 * time.Second
+	// eventsBuffer is how many events a stream may fall behind before it is
+	// closed; the client reconnects and reloads the listing.
+	eventsBuffer = 256
+)
+
+// changeEvent is a change to a file or directory, as sent to subscribers.
+type changeEvent struct {
+	// Type is "create", "modify", "delete" or "rename".
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// To is the new path of a renamed entry.
+	To string `json:"to,omitempty"`
+	// File describes the entry after the change; it is nil for deletes.
+	File *fileInfo `json:"file,omitempty"`
+}
+
+// Events passes the changes made to the served directories on to the
+// clients subscribed through EventsHandler. Changes come from the requests
+// served by FSHandler and TusHandler and, for the directories given to
+// Watch, from the file system, so that changes made directly on disk show
+// up too. A nil *Events passes nothing on.
+type Events struct {
+	mu     sync.Mutex
+	subs   map[*eventsSub]bool
+	recent map[string]time.Time // URL paths the server changed itself
+	closed bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+type eventsSub struct {
+	dir string
+	ch  chan changeEvent
+}
+
+func (e *Events) init() {
+	e.once.Do(func() {
+		e.subs = map[*eventsSub]bool{}
+		e.recent = map[string]time.Time{}
+		e.done = make(chan struct{})
+	})
+}
+
+// Close ends every subscription and the watches, so that a shutdown does
+// not wait for the streams.
+func (e *Events) Close() {
+	if e == nil {
+		return
+	}
+	e.init()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.closed = true
+	close(e.done)
+	for sub := range e.subs {
+		close(sub.ch)
+		delete(e.subs, sub)
+	}
+}
+
+// subscribe returns a subscription to the changes in the directory tree
+// at the URL path dir, or nil once e is closed.
+func (e *Events) subscribe(dir string) *eventsSub {
+	e.init()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	sub := &eventsSub{dir: dir, ch: make(chan changeEvent, eventsBuffer)}
+	e.subs[sub] = true
+	return sub
+}
+
+func (e *Events) unsubscribe(sub *eventsSub) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subs[sub] {
+		close(sub.ch)
+		delete(e.subs, sub)
+	}
+}
+
+// publish sends ev to the subscribers of the directories it is in.
+func (e *Events) publish(ev changeEvent) {
+	e.init()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for sub := range e.subs {
+		if !within(sub.dir, ev.Path) && (ev.To == "" || !within(sub.dir, ev.To)) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			// Too far behind: end the stream rather than leave the
+			// client with a listing that silently misses changes.
+			close(sub.ch)
+			delete(e.subs, sub)
+		}
+	}
+}
+
+// within reports whether the URL path p is inside the directory dir.
+func within(dir, p string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// changed publishes the change e made through h.
+func (e *Events) changed(h *FSHandler, a AuditEntry) {
+	if e == nil {
+		return
+	}
+	ev := changeEvent{Path: a.Path}
+	switch a.Action {
+	case "upload", "mkdir", "restore":
+		ev.Type = "create"
+	case "overwrite":
+		ev.Type = "modify"
+	case "delete":
+		ev.Type = "delete"
+	case "move":
+		ev.Type, ev.To = "rename", a.To
+	case "copy":
+		ev.Type, ev.Path = "create", a.To
+	default:
+		return
+	}
+
+	e.init()
+	e.mu.Lock()
+	now := time.Now()
+	for p, t := range e.recent {
+		if now.Sub(t) > eventsEcho {
+			delete(e.recent, p)
+		}
+	}
+	e.recent[ev.Path] = now
+	if ev.To != "" {
+		e.recent[ev.To] = now
+	}
+	e.mu.Unlock()
+
+	if ev.Type != "delete" {
+		target := ev.Path
+		if ev.To != "" {
+			target = ev.To
+		}
+		ev.File = h.fileInfo(strings.TrimPrefix(target, h.Prefix))
+	}
+	e.publish(ev)
+}
+
+// echo reports whether the URL path p or a directory above it was changed
+// by the server in the last eventsEcho.
+func (e *Events) echo(p string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for {
+		if t, ok := e.recent[p]; ok && time.Since(t) <= eventsEcho {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+		p = path.Dir(p)
+	}
+}
+
+// fileInfo describes the entry at the URL path target of h, or returns nil
+// if it is gone.
+func (h *FSHandler) fileInfo(target string) *fileInfo {
+	root, err := h.openRoot()
+	if err != nil {
+		return nil
+	}
+	defer root.Close()
+	info, err := root.Stat(toRelPath(target))
+	if err != nil {
+		return nil
+	}
+	return &fileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+}
+
+// Watch publishes the changes made on disk in the directory of h, until e
+// is closed. Every directory of the tree is watched, which counts against
+// the inotify watch limit of the user on Linux.
+func (e *Events) Watch(h *FSHandler) error {
+	e.init()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	base := filepath.Clean(h.Basedir)
+	if err := addWatches(w, base, base); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		// pending maps the paths seen changing to whether they were
+		// created, until they settle.
+		pending := map[string]bool{}
+		last := map[string]time.Time{}
+		ticker := time.NewTicker(eventsSettle / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.done:
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				rel, err := filepath.Rel(base, ev.Name)
+				if err != nil || isInternalPath(filepath.ToSlash(rel)) {
+					continue
+				}
+				pending[ev.Name] = pending[ev.Name] || ev.Has(fsnotify.Create)
+				last[ev.Name] = time.Now()
+				if ev.Has(fsnotify.Create) {
+					if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+						if err := addWatches(w, base, ev.Name); err != nil {
+							log.Printf("Watch %q error %v", ev.Name, err)
+						}
+					}
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Watch %q error %v", base, err)
+			case <-ticker.C:
+				for name, created := range pending {
+					if time.Since(last[name]) < eventsSettle {
+						continue
+					}
+					delete(pending, name)
+					delete(last, name)
+					e.diskChanged(h, base, name, created)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// addWatches watches dir and the directories below it, except the
+// bookkeeping directories of base. Directories that cannot be watched, for
+// instance past fs.inotify.max_user_watches, are logged and skipped.
+func addWatches(w *fsnotify.Watcher, base, dir string) error {
+	skipped := 0
+	var first error
+	defer func() {
+		if skipped > 0 {
+			log.Printf("Watch %q: %d directories not watched, first error %v", dir, skipped, first)
+		}
+	}()
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if rel, _ := filepath.Rel(base, p); rel != "." && isInternalPath(filepath.ToSlash(rel)) {
+			return filepath.SkipDir
+		}
+		if err := w.Add(p); err != nil {
+			if skipped == 0 {
+				first = fmt.Errorf("watch %q: %w", p, err)
+			}
+			skipped++
+		}
+		return nil
+	})
+}
+
+// diskChanged publishes a change seen on disk at name, unless the server
+// made it itself.
+func (e *Events) diskChanged(h *FSHandler, base, name string, created bool) {
+	rel, err := filepath.Rel(base, name)
+	if err != nil {
+		return
+	}
+	p := path.Join("/", h.Prefix, filepath.ToSlash(rel))
+	if e.echo(p) {
+		return
+	}
+	ev := changeEvent{Type: "modify", Path: p}
+	info, err := os.Lstat(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if created {
+			// Created and removed again before it settled.
+			return
+		}
+		ev.Type = "delete"
+	case err != nil:
+		return
+	default:
+		if created {
+			ev.Type = "create"
+		}
+		ev.File = &fileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+	}
+	e.publish(ev)
+}
+
+// EventsHandler streams the changes below a directory as Server-Sent
+// Events:
+//
+//	GET /_events?path=/dir/
+//
+// Each change is an event of type "change" whose data is a JSON object with
+// the type of change ("create", "modify", "delete" or "rename"), the path
+// and, unless it was deleted, the file. Changes to entries the client may
+// not read are left out.
+type EventsHandler struct {
+	Fs     *FSHandler
+	Events *Events
+}
+
+func (h *EventsHandler) accept(r *http.Request) bool {
+	return r.URL.Path == eventsPrefix
+}
+
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code, err := h.serve(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+	}
+	logRequest(r, "events", r.URL.RequestURI(), code, err)
+}
+
+func (h *EventsHandler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+	if requestShare(r) != nil {
+		return http.StatusNotFound, errors.New("share links have no change feed")
+	}
+	dir := path.Clean("/" + r.URL.Query().Get("path"))
+	dirFs, rel, auth := h.resolve(dir)
+	if isInternalPath(rel) {
+		return http.StatusNotFound, fmt.Errorf("%q not found", dir)
+	}
+	// AuthHandler applied the scope of /_events, not that of the mount
+	// being watched.
+	if auth == AuthAll && requestUser(r) == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fileserver"`)
+		return http.StatusUnauthorized, fmt.Errorf("changes of %q require authentication", dir)
+	}
+	if code, err := dirFs.checkAccess(w, r, rel, permRead); err != nil {
+		return code, err
+	}
+	if info := dirFs.fileInfo("/" + rel); info == nil || !info.IsDir {
+		return http.StatusNotFound, fmt.Errorf("directory %q not found", dir)
+	}
+
+	sub := h.Events.subscribe(dir)
+	if sub == nil {
+		return http.StatusServiceUnavailable, errors.New("shutting down")
+	}
+	defer h.Events.unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	// The stream outlives any -write-timeout.
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	if err := rc.Flush(); err != nil {
+		return http.StatusOK, err
+	}
+
+	id := requestIdentity(r)
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return http.StatusOK, nil
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return http.StatusOK, nil
+			}
+			if !h.readable(id, ev) {
+				continue
+			}
+			b, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", b)
+		}
+		if err := rc.Flush(); err != nil {
+			return http.StatusOK, err
+		}
+	}
+}
+
+// resolve returns the FSHandler serving the URL path p, root or mount, the
+// path relative to it and the auth scope of the mount.
+func (h *EventsHandler) resolve(p string) (*FSHandler, string, AuthScope) {
+	for _, m := range h.Fs.Mounts {
+		if p == m.Fs.Prefix || strings.HasPrefix(p, m.Fs.Prefix+"/") {
+			return m.Fs, toRelPath(strings.TrimPrefix(p, m.Fs.Prefix)), m.Auth
+		}
+	}
+	return h.Fs, toRelPath(p), AuthDefault
+}
+
+func (h *EventsHandler) readable(id identity, ev changeEvent) bool {
+	for _, p := range []string{ev.Path, ev.To} {
+		if p == "" {
+			continue
+		}
+		dirFs, rel, auth := h.resolve(p)
+		if auth == AuthAll && id.name == "" {
+			continue
+		}
+		if dirFs.allowed(id, rel, permRead) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribeEvents opens the change stream of dir as user and returns the
+// events read from it.
+func subscribeEvents(t *testing.T, srv *httptest.Server, dir, user string) <-chan changeEvent {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+eventsPrefix+"?path="+dir, nil)
+	if user != "" {
+		req.SetBasicAuth(user, "secret")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET %s = %d %s", dir, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	events := make(chan changeEvent, 10)
+	go func() {
+		defer close(events)
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			data, ok := strings.CutPrefix(sc.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var ev changeEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Error(err)
+			}
+			events <- ev
+		}
+	}()
+	return events
+}
+
+func waitEvent(t *testing.T, events <-chan changeEvent) changeEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("stream ended")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return changeEvent{}
+	}
+}
+
+func newEventsServer(t *testing.T, fs *FSHandler) *httptest.Server {
+	t.Helper()
+	fs.Events = &Events{}
+	t.Cleanup(fs.Events.Close)
+	next := NewCompHandler(&EventsHandler{Fs: fs, Events: fs.Events}, fs)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Trust the username, as if AuthHandler had checked it.
+		if user, _, ok := r.BasicAuth(); ok {
+			r = withUser(r, user)
+		}
+		next.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func Test_Events_changes(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	fs := &FSHandler{Basedir: dir, AllowDelete: true}
+	srv := newEventsServer(t, fs)
+	if err := fs.Events.Watch(fs); err != nil {
+		t.Fatal(err)
+	}
+	events := subscribeEvents(t, srv, "/docs", "")
+	do := func(method, target, body string) {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if w.Code >= 300 {
+			t.Fatalf("%s %s = %d", method, target, w.Code)
+		}
+	}
+
+	// Changes outside the directory are left out.
+	do(http.MethodPut, "/outside.txt", "out")
+	do(http.MethodPut, "/docs/a.txt", "hello")
+	ev := waitEvent(t, events)
+	if ev.Type != "create" || ev.Path != "/docs/a.txt" || ev.File == nil || ev.File.Name != "a.txt" || ev.File.Size != 5 {
+		t.Fatalf("upload event = %+v", ev)
+	}
+	do(http.MethodPost, "/docs/a.txt?action=move&to=/docs/b.txt", "")
+	if ev := waitEvent(t, events); ev.Type != "rename" || ev.Path != "/docs/a.txt" || ev.To != "/docs/b.txt" || ev.File.Name != "b.txt" {
+		t.Fatalf("move event = %+v", ev)
+	}
+
+	// Changes made on disk come through the watch, without echoing those
+	// the server made itself.
+	if err := os.WriteFile(filepath.Join(dir, "docs", "c.txt"), []byte("on disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ev := waitEvent(t, events); ev.Type != "create" || ev.Path != "/docs/c.txt" || ev.File.Size != 7 {
+		t.Fatalf("disk create event = %+v", ev)
+	}
+	os.Mkdir(filepath.Join(dir, "docs", "sub"), 0755)
+	if ev := waitEvent(t, events); ev.Type != "create" || ev.Path != "/docs/sub" || !ev.File.IsDir {
+		t.Fatalf("disk mkdir event = %+v", ev)
+	}
+	// New directories are watched too.
+	time.Sleep(50 * time.Millisecond)
+	os.WriteFile(filepath.Join(dir, "docs", "sub", "d.txt"), []byte("d"), 0644)
+	if ev := waitEvent(t, events); ev.Type != "create" || ev.Path != "/docs/sub/d.txt" {
+		t.Fatalf("disk create in new directory event = %+v", ev)
+	}
+	os.Remove(filepath.Join(dir, "docs", "c.txt"))
+	if ev := waitEvent(t, events); ev.Type != "delete" || ev.Path != "/docs/c.txt" || ev.File != nil {
+		t.Fatalf("disk delete event = %+v", ev)
+	}
+
+	do(http.MethodDelete, "/docs/b.txt", "")
+	if ev := waitEvent(t, events); ev.Type != "delete" || ev.Path != "/docs/b.txt" {
+		t.Fatalf("delete event = %+v", ev)
+	}
+
+	// Closing ends the stream.
+	fs.Events.Close()
+	select {
+	case ev, ok := <-events:
+		if ok {
+			t.Fatalf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still open")
+	}
+}
+
+func Test_Events_acl(t *testing.T) {
+	fs := &FSHandler{Basedir: t.TempDir(), ACL: newTestACL(t, `
+allow * /** read
+deny bob /private/** read
+allow alice /** write,mkdir
+`)}
+	srv := newEventsServer(t, fs)
+	events := subscribeEvents(t, srv, "/", "bob")
+
+	r := httptest.NewRequest(http.MethodPost, "/?action=mkdir&name=private", nil)
+	fs.ServeHTTP(httptest.NewRecorder(), withUser(r, "alice"))
+	r = httptest.NewRequest(http.MethodPut, "/private/secret.txt", strings.NewReader("s"))
+	fs.ServeHTTP(httptest.NewRecorder(), withUser(r, "alice"))
+	r = httptest.NewRequest(http.MethodPut, "/public.txt", strings.NewReader("p"))
+	fs.ServeHTTP(httptest.NewRecorder(), withUser(r, "alice"))
+
+	if ev := waitEvent(t, events); ev.Path != "/public.txt" {
+		t.Fatalf("event = %+v", ev)
+	}
+
+	// Subscribing to an unreadable directory is refused.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+eventsPrefix+"?path=/private", nil)
+	req.SetBasicAuth("bob", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /private events = %d", resp.StatusCode)
+	}
+}
+
+func Test_Events_mountAuth(t *testing.T) {
+	mount := &Mount{Fs: &FSHandler{Basedir: t.TempDir(), Prefix: "/secret"}, Auth: AuthAll}
+	fs := &FSHandler{Basedir: t.TempDir(), Mounts: []*Mount{mount}}
+	srv := newEventsServer(t, fs)
+	mount.Fs.Events = fs.Events
+
+	// The mount needs credentials even for reads, so anonymous clients may
+	// not watch it, nor see its changes from the root.
+	resp, err := http.Get(srv.URL + eventsPrefix + "?path=/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous GET /secret events = %d", resp.StatusCode)
+	}
+	anonymous := subscribeEvents(t, srv, "/", "")
+	alice := subscribeEvents(t, srv, "/secret", "alice")
+
+	r := httptest.NewRequest(http.MethodPut, "/a.txt", strings.NewReader("a"))
+	mount.Fs.ServeHTTP(httptest.NewRecorder(), withUser(r, "alice"))
+	r = httptest.NewRequest(http.MethodPut, "/public.txt", strings.NewReader("p"))
+	fs.ServeHTTP(httptest.NewRecorder(), withUser(r, "alice"))
+
+	if ev := waitEvent(t, alice); ev.Path != "/secret/a.txt" {
+		t.Fatalf("alice's event = %+v", ev)
+	}
+	if ev := waitEvent(t, anonymous); ev.Path != "/public.txt" {
+		t.Fatalf("anonymous event = %+v", ev)
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,11 +19,46 @@ import (
 
 const (
 	defaultMaxMemory = 32 << 20 // 32 MB
+
+	// tempPrefix marks in-progress upload files. They are created next to
+	// their destination so the final rename stays on one filesystem, hidden
+	// from listings, and removed at startup if an upload never finished.
+	tempPrefix = ".fileserver-tmp-"
 )
 
+var errReadOnly = errors.New("read-only")
+
 type FSHandler struct {
 	Basedir     string
 	AllowDelete bool
+	// ReadOnly refuses every state-changing request.
+	ReadOnly bool
+	// ACL, when set, restricts every operation; AllowDelete still has to
+	// be enabled for deletions.
+	ACL *ACL
+	// Prefix is the URL path the directory is mounted at by MountHandler,
+	// which strips it from requests. It is empty for the root.
+	Prefix string
+	// Mounts are listed as directories at the top of the root.
+	Mounts []*Mount
+	// Metrics, when set, counts the requests, transfers and deletes of the
+	// directory, including those of its UIHandler and TusHandler.
+	Metrics *Metrics
+	// Audit, when set, records the uploads, new directories, deletes,
+	// moves and copies of the directory, including those of its
+	// TusHandler.
+	Audit *AuditLog
+	// Webhooks, when set, are notified of the same changes once they
+	// succeed.
+	Webhooks *Webhooks
+	// Events, when set, passes the same changes on to the clients
+	// watching the directory.
+	Events *Events
+	// Trash, when set, makes deletes move entries into the trash of the
+	// directory instead of removing them.
+	Trash *Trash
+	// Versions, when set, keeps the content of files replaced by uploads.
+	Versions *Versions
 }
 
 func (h *FSHandler) accept(r *http.Request) bool {
@@ -29,11 +66,64 @@ func (h *FSHandler) accept(r *http.Request) bool {
 }
 
 func (h *FSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	code, err := h.serve(w, r)
-	log.Printf("%s %s - %d - %v", r.Method, r.URL.Path, code, err)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	code, err := h.serve(sw, r)
+	sent := code
+	if sw.wroteHeader {
+		// http.ServeContent picks its own status, such as 206 or 304.
+		sent = sw.code
+	}
+	h.Metrics.request("fs", r.Method, sent, time.Since(start))
+	if err != nil && !sw.wroteHeader {
+		// Client errors explain themselves; server errors may carry local
+		// paths, so only the status text is sent.
+		msg := err.Error()
+		if code >= http.StatusInternalServerError {
+			msg = http.StatusText(code)
+		}
+		http.Error(w, msg, code)
+	}
+	logRequest(r, "", h.Prefix+r.URL.Path, code, err)
+}
+
+// statusWriter records whether a response has been started, so that an
+// error reported after streaming began is not written into the body, and
+// its status code.
+type statusWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	code        int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code = code
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.code = http.StatusOK
+	}
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
 func (h *FSHandler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	if isInternalPath(toRelPath(r.URL.Path)) {
+		return http.StatusNotFound, fmt.Errorf("%q not found", r.URL.Path)
+	}
+	if h.ReadOnly && writeLikeRequest(r) {
+		return http.StatusForbidden, errReadOnly
+	}
+
 	switch r.Method {
 	case http.MethodOptions:
 		return h.serveOption(w, r)
@@ -44,12 +134,23 @@ func (h *FSHandler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
 	case http.MethodDelete:
 		return h.serveDelete(w, r)
 	case http.MethodPost:
-		if r.URL.Query().Get("action") == "mkdir" {
+		switch r.URL.Query().Get("action") {
+		case "mkdir":
 			return h.serveMkdir(w, r)
+		case "move":
+			return h.serveMove(w, r)
+		case "copy":
+			return h.serveCopy(w, r)
+		case "restore":
+			return h.serveRestoreVersion(w, r)
 		}
 		return h.serveCreate(w, r, true)
 	case http.MethodPut:
 		return h.serveCreate(w, r, true)
+	case "MOVE":
+		return h.serveMove(w, r)
+	case "COPY":
+		return h.serveCopy(w, r)
 	default:
 		return http.StatusMethodNotAllowed, errors.New("method not allowed")
 	}
@@ -73,6 +174,28 @@ func toRelPath(urlPath string) string {
 	return p
 }
 
+// isInternalPath reports whether a relative path lies inside one of the
+// server's bookkeeping directories or names an in-progress temp file. Such
+// paths are never exposed to clients.
+func isInternalPath(rel string) bool {
+	first, _, _ := strings.Cut(rel, "/")
+	if isInternalDir(first) {
+		return true
+	}
+	for _, seg := range strings.Split(rel, "/") {
+		if strings.HasPrefix(seg, tempPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInternalDir reports whether name is one of the bookkeeping directories
+// kept at the top of Basedir.
+func isInternalDir(name string) bool {
+	return name == tusDir || name == s3Dir || name == shareDir || name == webhookDir || name == trashDir || name == versionDir
+}
+
 type fileInfo struct {
 	Name    string    `json:"name"`
 	Size    int64     `json:"size"`
@@ -93,21 +216,38 @@ func (fi fileInfo) MarshalJSON() ([]byte, error) {
 }
 
 func (h *FSHandler) serveGet(w http.ResponseWriter, r *http.Request) (int, error) {
+	if q := r.URL.Query(); q.Has("versions") {
+		return h.serveVersions(w, r)
+	} else if q.Has("version") {
+		return h.serveVersion(w, r)
+	}
 	target := r.URL.Path
+	rel := toRelPath(target)
+	if code, err := h.checkAccess(w, r, rel, permRead); err != nil {
+		return code, err
+	}
 	file, info, err := h.stat(target)
 	if err != nil {
 		return http.StatusNotFound, err
 	}
 
 	if info.IsDir() {
+		if format := r.URL.Query().Get("archive"); format != "" {
+			w, done := h.Metrics.download(w)
+			defer done()
+			return h.serveArchive(w, r, format)
+		}
 		infos, err := h.readDir(target)
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
+		infos = h.filterReadable(requestIdentity(r), rel, h.withMounts(rel, infos))
 		bytes, _ := json.Marshal(infos)
 		_, _ = w.Write(bytes)
 	} else {
+		w, done := h.Metrics.download(w)
 		http.ServeContent(w, r, target, info.ModTime(), file)
+		done()
 	}
 	return http.StatusOK, nil
 }
@@ -132,6 +272,9 @@ func (h *FSHandler) readDir(target string) ([]fileInfo, error) {
 	}
 	infos := make([]fileInfo, 0, len(entries))
 	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) || (rel == "." && isInternalDir(entry.Name())) {
+			continue
+		}
 		info, err := entry.Info()
 		if err != nil {
 			log.Printf("Read %q info error %v", entry.Name(), err)
@@ -148,6 +291,10 @@ func (h *FSHandler) readDir(target string) ([]fileInfo, error) {
 }
 
 func (h *FSHandler) stat(target string) (io.ReadSeeker, fs.FileInfo, error) {
+	if isInternalPath(toRelPath(target)) {
+		return nil, nil, fs.ErrNotExist
+	}
+
 	root, err := h.openRoot()
 	if err != nil {
 		return nil, nil, err
@@ -167,8 +314,11 @@ func (h *FSHandler) stat(target string) (io.ReadSeeker, fs.FileInfo, error) {
 	return f, stat, nil
 }
 
-func (h *FSHandler) serveCreate(w http.ResponseWriter, r *http.Request, override bool) (int, error) {
+func (h *FSHandler) serveCreate(w http.ResponseWriter, r *http.Request, override bool) (code int, err error) {
 	urlPath := r.URL.Path
+	var stored int64
+	done := h.Metrics.upload()
+	defer func() { done(stored) }()
 
 	var target string
 	var file io.ReadCloser
@@ -205,65 +355,132 @@ func (h *FSHandler) serveCreate(w http.ResponseWriter, r *http.Request, override
 	defer root.Close()
 
 	rel := toRelPath(target)
+	action := "upload"
+	sum := h.auditHasher()
+	defer func() {
+		e := AuditEntry{Action: action, Path: h.auditPath(rel), Size: stored, SHA256: hexSum(sum)}
+		h.changed(r, e, code, err)
+	}()
+	if code, err := h.checkAccess(w, r, rel, permWrite); err != nil {
+		return code, err
+	}
 
 	info, err := root.Stat(rel)
 	if err == nil {
+		action = "overwrite"
 		if info.IsDir() {
 			return http.StatusConflict, fmt.Errorf("%q is a existing directory", target)
 		}
-		if info.Size() > 0 {
-			if override {
-				_ = root.Remove(rel)
-			} else {
-				return http.StatusConflict, fmt.Errorf("%q already exist", target)
-			}
+		if info.Size() > 0 && !override {
+			return http.StatusConflict, fmt.Errorf("%q already exist", target)
 		}
 	}
 
 	// Ensure parent directories exist.
-	// os.Root.MkdirAll is not available, so create parents via os.MkdirAll
-	// on the resolved path within the root. We use root.Mkdir for each segment.
 	if dir := path.Dir(rel); dir != "." {
-		if err := mkdirAllInRoot(root, dir); err != nil {
+		if err := root.MkdirAll(dir, os.ModePerm); err != nil {
 			return http.StatusInternalServerError, err
 		}
 	}
 
-	dst, err := root.OpenFile(rel, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
-	if err != nil {
-		return http.StatusInternalServerError, err
+	var saved string
+	if action == "overwrite" {
+		if saved, err = h.saveVersion(root, rel, info); err != nil {
+			return http.StatusInternalServerError, err
+		}
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
+	src := io.Reader(file)
+	if sum != nil {
+		src = io.TeeReader(file, sum)
+	}
+	n, err := writeFileAtomic(root, rel, src)
+	if err != nil {
+		dropVersion(root, saved)
 		return http.StatusInternalServerError, err
 	}
+	stored = n
+	if saved != "" {
+		if err := h.pruneVersions(root, rel); err != nil {
+			log.Printf("Prune versions of %q error %v", h.auditPath(rel), err)
+		}
+	}
 	w.WriteHeader(http.StatusCreated)
 	return http.StatusCreated, nil
 }
 
-// mkdirAllInRoot creates all directories along the path within an os.Root.
-func mkdirAllInRoot(root *os.Root, dir string) error {
-	segments := strings.Split(path.Clean(dir), "/")
-	current := ""
-	for _, seg := range segments {
-		if seg == "" || seg == "." {
+// writeFileAtomic streams src into a hidden temp file next to rel, syncs it
+// and renames it over rel. Readers never observe a partially written file,
+// and on failure the temp file is removed and any previous version of rel is
+// left untouched.
+func writeFileAtomic(root *os.Root, rel string, src io.Reader) (int64, error) {
+	tmp, f, err := createTemp(root, path.Dir(rel))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = root.Rename(tmp, rel)
+	}
+	if err != nil {
+		_ = root.Remove(tmp)
+		return n, err
+	}
+	return n, nil
+}
+
+// createTemp creates a new hidden temp file in dir.
+func createTemp(root *os.Root, dir string) (string, *os.File, error) {
+	for {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, err
+		}
+		name := path.Join(dir, tempPrefix+hex.EncodeToString(b))
+		f, err := root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if errors.Is(err, fs.ErrExist) {
 			continue
 		}
-		if current == "" {
-			current = seg
-		} else {
-			current = current + "/" + seg
+		return name, f, err
+	}
+}
+
+// RemoveTempFiles deletes temp files left behind by uploads that were
+// interrupted by a crash or restart. It is meant to be called at startup.
+func (h *FSHandler) RemoveTempFiles() error {
+	root, err := h.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	return fs.WalkDir(root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Walk %q error %v", p, err)
+			return nil
 		}
-		err := root.Mkdir(current, os.ModePerm)
-		if err != nil && !errors.Is(err, fs.ErrExist) {
-			return err
+		if d.IsDir() && p == tusDir {
+			return fs.SkipDir
 		}
-	}
-	return nil
+		if !d.IsDir() && strings.HasPrefix(d.Name(), tempPrefix) {
+			if err := root.Remove(p); err != nil {
+				log.Printf("Remove temp file %q error %v", p, err)
+			} else {
+				log.Printf("Removed stale temp file %q", p)
+			}
+		}
+		return nil
+	})
 }
 
-func (h *FSHandler) serveMkdir(w http.ResponseWriter, r *http.Request) (int, error) {
+func (h *FSHandler) serveMkdir(w http.ResponseWriter, r *http.Request) (code int, err error) {
 	name := r.URL.Query().Get("name")
 	if name == "" {
 		return http.StatusBadRequest, fmt.Errorf("missing 'name' query parameter")
@@ -282,8 +499,12 @@ func (h *FSHandler) serveMkdir(w http.ResponseWriter, r *http.Request) (int, err
 	defer root.Close()
 
 	rel := toRelPath(path.Join(r.URL.Path, cleanName))
+	defer func() { h.changed(r, AuditEntry{Action: "mkdir", Path: h.auditPath(rel)}, code, err) }()
+	if code, err := h.checkAccess(w, r, rel, permMkdir); err != nil {
+		return code, err
+	}
 
-	if _, err := root.Stat(rel); err == nil {
+	if _, err := root.Stat(rel); err == nil || h.mounted(rel) {
 		return http.StatusConflict, fmt.Errorf("%q already exists", rel)
 	}
 
@@ -299,7 +520,9 @@ func (h *FSHandler) serveOption(w http.ResponseWriter, r *http.Request) (int, er
 	return http.StatusNotImplemented, errors.New("not implemented")
 }
 
-func (h *FSHandler) serveDelete(w http.ResponseWriter, r *http.Request) (int, error) {
+func (h *FSHandler) serveDelete(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	rel := toRelPath(r.URL.Path)
+	defer func() { h.changed(r, AuditEntry{Action: "delete", Path: h.auditPath(rel)}, code, err) }()
 	if !h.AllowDelete {
 		return http.StatusForbidden, errors.New("delete is disabled")
 	}
@@ -310,7 +533,6 @@ func (h *FSHandler) serveDelete(w http.ResponseWriter, r *http.Request) (int, er
 	}
 	defer root.Close()
 
-	rel := toRelPath(r.URL.Path)
 	if rel == "." {
 		return http.StatusBadRequest, errors.New("cannot delete root directory")
 	}
@@ -319,44 +541,15 @@ func (h *FSHandler) serveDelete(w http.ResponseWriter, r *http.Request) (int, er
 	if err != nil {
 		return http.StatusNotFound, fmt.Errorf("%q not found", r.URL.Path)
 	}
+	if code, err := h.checkTree(w, r, root, rel, permDelete); err != nil {
+		return code, err
+	}
 
-	if info.IsDir() {
-		if err := removeAllInRoot(root, rel); err != nil {
-			return http.StatusInternalServerError, err
-		}
-	} else {
-		if err := root.Remove(rel); err != nil {
-			return http.StatusInternalServerError, err
-		}
+	if err := h.discard(root, rel, info, logUser(r)); err != nil {
+		return http.StatusInternalServerError, err
 	}
 
+	h.Metrics.deleted()
 	w.WriteHeader(http.StatusNoContent)
 	return http.StatusNoContent, nil
 }
-
-// removeAllInRoot recursively removes a directory and its contents within an os.Root.
-func removeAllInRoot(root *os.Root, dir string) error {
-	f, err := root.Open(dir)
-	if err != nil {
-		return err
-	}
-	entries, err := f.ReadDir(-1)
-	f.Close()
-	if err != nil {
-		return err
-	}
-
-	for _, entry := range entries {
-		child := dir + "/" + entry.Name()
-		if entry.IsDir() {
-			if err := removeAllInRoot(root, child); err != nil {
-				return err
-			}
-		} else {
-			if err := root.Remove(child); err != nil {
-				return err
-			}
-		}
-	}
-	return root.Remove(dir)
-}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -261,3 +262,90 @@ func Test_serveDelete_rootRejected(t *testing.T) {
 		t.Errorf("expected 400, got %d", code)
 	}
 }
+
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func Test_serveCreate_failedUploadKeepsPrevious(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("previous"), 0600)
+
+	h := FSHandler{Basedir: tmpDir}
+
+	r := httptest.NewRequest(http.MethodPut, "http://localhost/a.txt", &failingReader{data: []byte("partial")})
+	w := httptest.NewRecorder()
+	code, _ := h.serveCreate(w, r, true)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", code)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "a.txt"))
+	if string(data) != "previous" {
+		t.Errorf("previous version should survive a failed upload, got %q", data)
+	}
+	entries, _ := os.ReadDir(tmpDir)
+	if len(entries) != 1 {
+		t.Errorf("temp file should be removed after a failed upload, found %d entries", len(entries))
+	}
+}
+
+func Test_serveCreate_replacesExisting(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("previous"), 0600)
+
+	h := FSHandler{Basedir: tmpDir}
+
+	r := httptest.NewRequest(http.MethodPut, "http://localhost/a.txt", bytes.NewReader([]byte("new")))
+	w := httptest.NewRecorder()
+	code, err := h.serveCreate(w, r, true)
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, err: %v", code, err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "a.txt"))
+	if string(data) != "new" {
+		t.Errorf("got %q, want %q", data, "new")
+	}
+}
+
+func Test_tempFiles_hiddenAndRemoved(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.Mkdir(filepath.Join(tmpDir, "sub"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "sub", "a.txt"), []byte("a"), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "sub", tempPrefix+"0123"), []byte("partial"), 0600)
+
+	h := FSHandler{Basedir: tmpDir}
+
+	infos, err := h.readDir("/sub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "a.txt" {
+		t.Fatalf("temp file should be hidden, got %+v", infos)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/sub/"+tempPrefix+"0123", nil)
+	if code, _ := h.serve(httptest.NewRecorder(), r); code != http.StatusNotFound {
+		t.Errorf("temp file should not be downloadable, got %d", code)
+	}
+
+	if err := h.RemoveTempFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "sub", tempPrefix+"0123")); err == nil {
+		t.Error("stale temp file should have been removed")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "sub", "a.txt")); err != nil {
+		t.Errorf("regular file should be kept: %v", err)
+	}
+}
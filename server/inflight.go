@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// InFlight counts the requests being served by Next, so that a shutdown can
+// wait for the handlers of aborted connections to clean up after
+// themselves; http.Server.Close does not wait for them.
+type InFlight struct {
+	Next http.Handler
+
+	active atomic.Int64
+}
+
+func (h *InFlight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.active.Add(1)
+	defer h.active.Add(-1)
+	h.Next.ServeHTTP(w, r)
+}
+
+// Active returns the number of requests being served.
+func (h *InFlight) Active() int {
+	return int(h.active.Load())
+}
+
+// Wait waits until no request is being served or ctx is done.
+func (h *InFlight) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for h.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_InFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := &InFlight{Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	if err := h.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait without requests = %v", err)
+	}
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/f", nil))
+	<-started
+	if h.Active() != 1 {
+		t.Fatalf("Active = %d, want 1", h.Active())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := h.Wait(ctx); err == nil {
+		t.Fatal("Wait returned while a request was running")
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := h.Wait(ctx); err != nil || h.Active() != 0 {
+		t.Fatalf("Wait after the request = %v, %d active", err, h.Active())
+	}
+}
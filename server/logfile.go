@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+)
+
+// LogFile is a log file that rotates itself once it grows past MaxSize
+// bytes: Path is renamed to Path.1, Path.1 to Path.2 and so on, keeping
+// Backups old files. A MaxSize of 0 never rotates, which leaves it to an
+// external tool that calls Reopen afterwards.
+type LogFile struct {
+	Path    string
+	MaxSize int64
+	Backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Reopen closes the file, if open, and opens Path again for appending.
+func (l *LogFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open()
+}
+
+func (l *LogFile) open() error {
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil && l.MaxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the file that is there rather than losing
+			// the entry.
+			log.Printf("Rotate %q error %v", l.Path, err)
+		}
+	}
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *LogFile) rotate() error {
+	for i := l.Backups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", l.Path, i), fmt.Sprintf("%s.%d", l.Path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	var err error
+	if l.Backups > 0 {
+		err = os.Rename(l.Path, l.Path+".1")
+	} else {
+		err = os.Remove(l.Path)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the file; a later Write opens it again.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// loginData is the initial data of the UI on the login page.
+type loginData struct {
+	Login struct {
+		Failed bool `json:"failed"`
+	} `json:"login"`
+}
+
+var crossOrigin = http.NewCrossOriginProtection()
+
+// serveAuth serves the session endpoints:
+//
+//	GET  /_auth/login?next=/path  login page, or redirect to the OIDC provider
+//	POST /_auth/login             check the credentials of the login page
+//	POST /_auth/logout            end the session
+//
+// With OIDC, the callback of the provider is served too.
+func (h *AuthHandler) serveAuth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != authPrefix+"logout" && h.OIDC != nil {
+		h.OIDC.ServeHTTP(w, r)
+		return
+	}
+	code, err := h.serveLogin(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+	}
+	logRequest(r, "auth", r.URL.Path, code, err)
+}
+
+func (h *AuthHandler) serveLogin(w http.ResponseWriter, r *http.Request) (int, error) {
+	switch strings.TrimPrefix(r.URL.Path, authPrefix) {
+	case "logout":
+		return h.serveLogout(w, r)
+	case "login":
+		if !h.LoginForm {
+			break
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			return h.serveLoginPage(w, r)
+		case http.MethodPost:
+			return h.checkLogin(w, r)
+		}
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		return http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)
+	}
+	return http.StatusNotFound, fmt.Errorf("%q not found", r.URL.Path)
+}
+
+// serveLogout ends the session of r. Like other changes made with a session,
+// it needs the CSRF token, so that other sites cannot log the user out.
+func (h *AuthHandler) serveLogout(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method)
+	}
+	if data, ok := h.Sessions.session(r); ok {
+		csrf := h.Sessions.csrfToken(data)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(csrf)) != 1 {
+			h.Metrics.authFailure("csrf")
+			return http.StatusForbidden, errors.New("missing or invalid CSRF token")
+		}
+	}
+	h.Sessions.end(w, r)
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+func (h *AuthHandler) serveLoginPage(w http.ResponseWriter, r *http.Request) (int, error) {
+	if _, _, ok := h.Sessions.identity(w, r); ok {
+		next := localPath(r.URL.Query().Get("next"))
+		http.Redirect(w, r, next, http.StatusFound)
+		return http.StatusFound, nil
+	}
+	var data loginData
+	data.Login.Failed = r.URL.Query().Has("failed")
+	b, err := json.Marshal(data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := index.Execute(w, string(b)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// checkLogin starts a session if the form carries valid Basic credentials,
+// and otherwise sends the browser back to the login page.
+func (h *AuthHandler) checkLogin(w http.ResponseWriter, r *http.Request) (int, error) {
+	// There is no session, and so no CSRF token, yet; keep other sites from
+	// logging the browser in to an account of theirs.
+	if err := crossOrigin.Check(r); err != nil {
+		return http.StatusForbidden, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, err
+	}
+	user, pass, next := r.PostForm.Get("username"), r.PostForm.Get("password"), localPath(r.PostForm.Get("next"))
+	keys := throttleKeys(clientIP(r), user)
+	if wait := h.Throttle.wait(keys); wait > 0 {
+		h.Metrics.authFailure("locked_out")
+		setRetryAfter(w, wait)
+		return http.StatusTooManyRequests, lockedOut(wait)
+	}
+	if user == "" || !h.verify(user, pass) {
+		h.Throttle.fail(keys)
+		h.Metrics.authFailure("login")
+		log.Printf("login failed for %q", user)
+		http.Redirect(w, r, authPrefix+"login?failed&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return http.StatusSeeOther, nil
+	}
+	h.Throttle.succeed(user)
+	if err := h.Sessions.start(w, r, identity{name: user}); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("login %s", user)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+	return http.StatusSeeOther, nil
+}
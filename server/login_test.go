@@ -0,0 +1,177 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newLoginFixture serves a directory through the UI behind an AuthHandler
+// with the login page enabled.
+func newLoginFixture(t *testing.T, writeOnly bool) *httptest.Server {
+	t.Helper()
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+	fs := &FSHandler{Basedir: tmpDir}
+	h := &AuthHandler{
+		Username:      "admin",
+		Password:      "secret",
+		Sessions:      &Sessions{},
+		LoginForm:     true,
+		AuthWriteOnly: writeOnly,
+		Next:          NewCompHandler(&UIHandler{Fs: fs, Login: true}, fs),
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postLogin(t *testing.T, client *http.Client, srv *httptest.Server, user, pass, next string) *http.Response {
+	t.Helper()
+	form := url.Values{"username": {user}, "password": {pass}, "next": {next}}
+	resp, err := client.PostForm(srv.URL+"/_auth/login", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func Test_loginForm(t *testing.T) {
+	srv := newLoginFixture(t, false)
+	client := browser(t, false)
+
+	// Browsers are sent to the login page, API clients get the challenge.
+	resp, _ := browse(t, client, srv.URL+"/a.txt")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/_auth/login?next=%2Fa.txt" {
+		t.Fatalf("anonymous GET = %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, err := http.Get(srv.URL + "/a.txt"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("API GET = %v %v", resp, err)
+	}
+	if resp, body := browse(t, client, srv.URL+"/_auth/login?next=%2Fa.txt"); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"login":{"failed":false}`) {
+		t.Fatalf("login page = %d %q", resp.StatusCode, body)
+	}
+
+	resp = postLogin(t, client, srv, "admin", "wrong", "/a.txt")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/_auth/login?failed&next=%2Fa.txt" {
+		t.Fatalf("bad login = %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if len(resp.Cookies()) != 0 {
+		t.Fatal("bad login set a cookie")
+	}
+
+	// Other sites cannot log the browser in.
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/_auth/login", strings.NewReader("username=admin&password=secret"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-site login = %v %v", resp, err)
+	}
+
+	// An open redirect is not possible through next.
+	resp = postLogin(t, client, srv, "admin", "secret", "//evil.example/")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+		t.Fatalf("login = %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, body := browse(t, client, srv.URL+"/a.txt"); resp.StatusCode != http.StatusOK || body != "a" {
+		t.Fatalf("GET after login = %d %q", resp.StatusCode, body)
+	}
+	// The login page is skipped when logged in.
+	if resp, _ := browse(t, client, srv.URL+"/_auth/login?next=/a.txt"); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/a.txt" {
+		t.Fatalf("login page when logged in = %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	// The UI gets the CSRF token; writes need it.
+	_, body := browse(t, client, srv.URL+"/")
+	_, rest, _ := strings.Cut(body, `"csrf_token":"`)
+	token, _, _ := strings.Cut(rest, `"`)
+	if token == "" || !strings.Contains(body, `"logout_url":"/_auth/logout"`) || !strings.Contains(body, `"user":"admin"`) {
+		t.Fatalf("UI data = %q", body)
+	}
+	put := func(header string) int {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/b.txt", strings.NewReader("b"))
+		if header != "" {
+			req.Header.Set(csrfHeader, header)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := put(""); code != http.StatusForbidden {
+		t.Fatalf("PUT without CSRF token = %d, want 403", code)
+	}
+	if code := put(token + "x"); code != http.StatusForbidden {
+		t.Fatalf("PUT with wrong CSRF token = %d, want 403", code)
+	}
+	if code := put(token); code != http.StatusCreated {
+		t.Fatalf("PUT with CSRF token = %d, want 201", code)
+	}
+
+	// Logging out takes a POST with the CSRF token, and revokes the
+	// session rather than only clearing the cookie.
+	u, _ := url.Parse(srv.URL)
+	copied := browser(t, false)
+	copied.Jar.SetCookies(u, client.Jar.Cookies(u))
+	if resp, _ := browse(t, client, srv.URL+"/_auth/logout"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET logout = %d, want 405", resp.StatusCode)
+	}
+	if code := logout(t, client, srv, ""); code != http.StatusForbidden {
+		t.Fatalf("logout without CSRF token = %d, want 403", code)
+	}
+	if code := logout(t, client, srv, token); code != http.StatusNoContent {
+		t.Fatalf("logout = %d", code)
+	}
+	if resp, _ := browse(t, client, srv.URL+"/a.txt"); resp.StatusCode != http.StatusFound {
+		t.Fatalf("GET after logout = %d, want redirect to login", resp.StatusCode)
+	}
+	if resp, _ := browse(t, copied, srv.URL+"/a.txt"); resp.StatusCode != http.StatusFound {
+		t.Fatalf("GET with a copy of the cookie after logout = %d, want redirect to login", resp.StatusCode)
+	}
+}
+
+// logout posts to the logout endpoint as the UI does.
+func logout(t *testing.T, client *http.Client, srv *httptest.Server, token string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/_auth/logout", nil)
+	if token != "" {
+		req.Header.Set(csrfHeader, token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func Test_loginForm_writeOnly(t *testing.T) {
+	srv := newLoginFixture(t, true)
+	client := browser(t, false)
+
+	// Browsing stays public and offers to sign in.
+	resp, body := browse(t, client, srv.URL+"/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"login_url":"/_auth/login?next=%2F"`) {
+		t.Fatalf("anonymous UI = %d %q", resp.StatusCode, body)
+	}
+	if strings.Contains(body, "csrf_token") {
+		t.Fatalf("anonymous UI has a CSRF token: %q", body)
+	}
+
+	// Basic credentials need no CSRF token, even with a session.
+	postLogin(t, client, srv, "admin", "secret", "/")
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/b.txt", strings.NewReader("b"))
+	req.SetBasicAuth("admin", "secret")
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT with Basic = %v %v", resp, err)
+	}
+}
@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration
+// histogram. Transfers of large files take minutes, so they go up to 5m.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metricMethods are the methods counted under their own name; anything else
+// is counted as "OTHER", so that clients cannot create unbounded series.
+var metricMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, "MOVE", "COPY", "MKCOL", "PROPFIND",
+	"PROPPATCH", "LOCK", "UNLOCK",
+}
+
+// Metrics counts what the handlers it is given to do, for MetricsHandler to
+// export. A nil *Metrics counts nothing.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestSeries]*histogram
+	failures map[string]uint64
+
+	uploaded   atomic.Uint64
+	downloaded atomic.Uint64
+	uploads    atomic.Int64
+	downloads  atomic.Int64
+	deletes    atomic.Uint64
+}
+
+type requestSeries struct {
+	handler string
+	method  string
+	code    int
+}
+
+type histogram struct {
+	buckets []uint64 // per bucket of latencyBuckets, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// request records a request answered by handler.
+func (m *Metrics) request(handler, method string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if !slices.Contains(metricMethods, method) {
+		method = "OTHER"
+	}
+	key := requestSeries{handler: handler, method: method, code: code}
+	seconds := d.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = map[requestSeries]*histogram{}
+	}
+	h := m.requests[key]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.requests[key] = h
+	}
+	h.count++
+	h.sum += seconds
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+}
+
+// authFailure records a request refused for reason, such as a wrong
+// password or an invalid token.
+func (m *Metrics) authFailure(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures == nil {
+		m.failures = map[string]uint64{}
+	}
+	m.failures[reason]++
+}
+
+// deleted records a successful delete.
+func (m *Metrics) deleted() {
+	if m == nil {
+		return
+	}
+	m.deletes.Add(1)
+}
+
+// upload records the start of an upload. The returned function records its
+// end, with the number of bytes stored.
+func (m *Metrics) upload() func(n int64) {
+	if m == nil {
+		return func(int64) {}
+	}
+	m.uploads.Add(1)
+	return func(n int64) {
+		m.uploads.Add(-1)
+		m.uploaded.Add(uint64(max(n, 0)))
+	}
+}
+
+// download records the start of a download through w. The returned writer
+// counts the bytes sent, and the returned function records its end.
+func (m *Metrics) download(w http.ResponseWriter) (http.ResponseWriter, func()) {
+	if m == nil {
+		return w, func() {}
+	}
+	m.downloads.Add(1)
+	cw := &countingWriter{ResponseWriter: w}
+	return cw, func() {
+		m.downloads.Add(-1)
+		m.downloaded.Add(uint64(cw.n))
+	}
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// MetricsHandler serves Metrics in the Prometheus text exposition format,
+// along with the free space of the file systems Fs are on.
+type MetricsHandler struct {
+	Metrics *Metrics
+	Fs      []*FSHandler
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	bw := bufio.NewWriter(w)
+	h.write(bw)
+	if err := bw.Flush(); err != nil {
+		log.Printf("metrics %s %s %s - %d - %v", clientIP(r), r.Method, r.URL.Path, http.StatusOK, err)
+	}
+}
+
+func (h *MetricsHandler) write(w io.Writer) {
+	m := h.Metrics
+	if m == nil {
+		m = &Metrics{}
+	}
+
+	m.mu.Lock()
+	series := make([]requestSeries, 0, len(m.requests))
+	for key := range m.requests {
+		series = append(series, key)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i], series[j]
+		if a.handler != b.handler {
+			return a.handler < b.handler
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	requests := make([]histogram, len(series))
+	for i, key := range series {
+		h := m.requests[key]
+		requests[i] = histogram{buckets: append([]uint64(nil), h.buckets...), count: h.count, sum: h.sum}
+	}
+	reasons := make([]string, 0, len(m.failures))
+	for reason := range m.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	failures := make([]uint64, len(reasons))
+	for i, reason := range reasons {
+		failures[i] = m.failures[reason]
+	}
+	m.mu.Unlock()
+
+	metricHeader(w, "fileserver_http_requests_total", "counter", "Requests answered, by handler, method and status code.")
+	for i, key := range series {
+		fmt.Fprintf(w, "fileserver_http_requests_total{%s} %d\n", key.labels(), requests[i].count)
+	}
+	metricHeader(w, "fileserver_http_request_duration_seconds", "histogram", "Time taken to answer requests, by handler, method and status code.")
+	for i, key := range series {
+		labels, hist := key.labels(), requests[i]
+		var cumulative uint64
+		for j, bound := range latencyBuckets {
+			cumulative += hist.buckets[j]
+			fmt.Fprintf(w, "fileserver_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "fileserver_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, hist.count)
+		fmt.Fprintf(w, "fileserver_http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(hist.sum))
+		fmt.Fprintf(w, "fileserver_http_request_duration_seconds_count{%s} %d\n", labels, hist.count)
+	}
+
+	metricHeader(w, "fileserver_uploaded_bytes_total", "counter", "Bytes of files stored by uploads.")
+	fmt.Fprintf(w, "fileserver_uploaded_bytes_total %d\n", m.uploaded.Load())
+	metricHeader(w, "fileserver_downloaded_bytes_total", "counter", "Bytes of files and archives sent by downloads.")
+	fmt.Fprintf(w, "fileserver_downloaded_bytes_total %d\n", m.downloaded.Load())
+	metricHeader(w, "fileserver_active_transfers", "gauge", "Uploads and downloads in progress.")
+	fmt.Fprintf(w, "fileserver_active_transfers{direction=\"download\"} %d\n", m.downloads.Load())
+	fmt.Fprintf(w, "fileserver_active_transfers{direction=\"upload\"} %d\n", m.uploads.Load())
+	metricHeader(w, "fileserver_auth_failures_total", "counter", "Requests refused for invalid credentials, by reason.")
+	for i, reason := range reasons {
+		fmt.Fprintf(w, "fileserver_auth_failures_total{reason=\"%s\"} %d\n", escapeLabel(reason), failures[i])
+	}
+	metricHeader(w, "fileserver_deletes_total", "counter", "Files and directories deleted.")
+	fmt.Fprintf(w, "fileserver_deletes_total %d\n", m.deletes.Load())
+
+	metricHeader(w, "fileserver_filesystem_free_bytes", "gauge", "Space available to the server on the file system of each served directory.")
+	var sizes []string
+	for _, fs := range h.Fs {
+		root := fs.Prefix
+		if root == "" {
+			root = "/"
+		}
+		free, size, err := diskSpace(fs.Basedir)
+		if err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				log.Printf("metrics disk space of %q error %v", fs.Basedir, err)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "fileserver_filesystem_free_bytes{root=\"%s\"} %d\n", escapeLabel(root), free)
+		sizes = append(sizes, fmt.Sprintf("fileserver_filesystem_size_bytes{root=\"%s\"} %d\n", escapeLabel(root), size))
+	}
+	metricHeader(w, "fileserver_filesystem_size_bytes", "gauge", "Size of the file system of each served directory.")
+	for _, line := range sizes {
+		io.WriteString(w, line)
+	}
+}
+
+func (k requestSeries) labels() string {
+	return fmt.Sprintf(`handler="%s",method="%s",code="%d"`, escapeLabel(k.handler), escapeLabel(k.method), k.code)
+}
+
+func metricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
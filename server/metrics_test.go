@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Metrics(t *testing.T) {
+	metrics := &Metrics{}
+	fs := &FSHandler{Basedir: t.TempDir(), AllowDelete: true, Metrics: metrics}
+	h := &AuthHandler{
+		Username:      "admin",
+		Password:      "secret",
+		AuthWriteOnly: true,
+		Metrics:       metrics,
+		Next:          NewCompHandler(&UIHandler{Fs: fs}, fs),
+	}
+	do := func(method, target, body string, auth bool, header ...string) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if auth {
+			r.SetBasicAuth("admin", "secret")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := do(http.MethodPut, "/a.txt", "hello", true); code != http.StatusCreated {
+		t.Fatalf("PUT = %d", code)
+	}
+	if code := do(http.MethodGet, "/a.txt", "", false); code != http.StatusOK {
+		t.Fatalf("GET = %d", code)
+	}
+	if code := do(http.MethodGet, "/a.txt", "", false, "Range", "bytes=1-2"); code != http.StatusPartialContent {
+		t.Fatalf("GET range = %d", code)
+	}
+	if code := do(http.MethodGet, "/", "", false, "Accept", "text/html"); code != http.StatusOK {
+		t.Fatalf("UI = %d", code)
+	}
+	if code := do(http.MethodDelete, "/a.txt", "", false); code != http.StatusUnauthorized {
+		t.Fatalf("anonymous DELETE = %d", code)
+	}
+	r := httptest.NewRequest(http.MethodDelete, "/a.txt", nil)
+	r.SetBasicAuth("admin", "guess")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if code := do(http.MethodDelete, "/a.txt", "", true); code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", code)
+	}
+	do("BREW", "/a.txt", "", true)
+
+	w := httptest.NewRecorder()
+	(&MetricsHandler{Metrics: metrics, Fs: []*FSHandler{fs}}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	out := w.Body.String()
+	for _, want := range []string{
+		"# TYPE fileserver_http_requests_total counter\n",
+		`fileserver_http_requests_total{handler="fs",method="PUT",code="201"} 1` + "\n",
+		`fileserver_http_requests_total{handler="fs",method="GET",code="200"} 1` + "\n",
+		`fileserver_http_requests_total{handler="fs",method="GET",code="206"} 1` + "\n",
+		`fileserver_http_requests_total{handler="ui",method="GET",code="200"} 1` + "\n",
+		`fileserver_http_requests_total{handler="auth",method="DELETE",code="401"} 2` + "\n",
+		`fileserver_http_requests_total{handler="fs",method="OTHER",code="405"} 1` + "\n",
+		"# TYPE fileserver_http_request_duration_seconds histogram\n",
+		`fileserver_http_request_duration_seconds_bucket{handler="fs",method="PUT",code="201",le="+Inf"} 1` + "\n",
+		`fileserver_http_request_duration_seconds_count{handler="fs",method="PUT",code="201"} 1` + "\n",
+		"fileserver_uploaded_bytes_total 5\n",
+		"fileserver_downloaded_bytes_total 7\n",
+		`fileserver_active_transfers{direction="upload"} 0` + "\n",
+		`fileserver_auth_failures_total{reason="basic"} 1` + "\n",
+		"fileserver_deletes_total 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q:\n%s", want, out)
+		}
+	}
+	if !strings.Contains(out, `fileserver_filesystem_free_bytes{root="/"} `) && diskSpaceSupported(fs.Basedir) {
+		t.Errorf("metrics missing free space:\n%s", out)
+	}
+}
+
+func diskSpaceSupported(dir string) bool {
+	_, _, err := diskSpace(dir)
+	return err == nil
+}
+
+func Test_Metrics_histogram(t *testing.T) {
+	m := &Metrics{}
+	m.request("fs", http.MethodGet, 200, 3*time.Millisecond)
+	m.request("fs", http.MethodGet, 200, 200*time.Millisecond)
+	m.request("fs", http.MethodGet, 200, 10*time.Minute)
+
+	var b strings.Builder
+	(&MetricsHandler{Metrics: m}).write(&b)
+	out := b.String()
+	labels := `handler="fs",method="GET",code="200"`
+	for _, want := range []string{
+		`fileserver_http_request_duration_seconds_bucket{` + labels + `,le="0.005"} 1`,
+		`fileserver_http_request_duration_seconds_bucket{` + labels + `,le="0.1"} 1`,
+		`fileserver_http_request_duration_seconds_bucket{` + labels + `,le="0.25"} 2`,
+		`fileserver_http_request_duration_seconds_bucket{` + labels + `,le="300"} 2`,
+		`fileserver_http_request_duration_seconds_bucket{` + labels + `,le="+Inf"} 3`,
+		`fileserver_http_request_duration_seconds_count{` + labels + `} 3`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("histogram missing %q:\n%s", want, out)
+		}
+	}
+
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %s", got)
+	}
+	var none *Metrics
+	none.request("fs", http.MethodGet, 200, time.Second)
+	none.authFailure("basic")
+	none.upload()(10)
+}
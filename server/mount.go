@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// AuthScope is which requests to a mount need credentials.
+type AuthScope int
+
+const (
+	// AuthDefault follows AuthHandler.AuthWriteOnly.
+	AuthDefault AuthScope = iota
+	// AuthWrites requires credentials for state-changing requests only.
+	AuthWrites
+	// AuthAll requires credentials for every request.
+	AuthAll
+)
+
+// ParseAuthScope parses "write" or "all"; "" is AuthDefault.
+func ParseAuthScope(s string) (AuthScope, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return AuthDefault, nil
+	case "write":
+		return AuthWrites, nil
+	case "all":
+		return AuthAll, nil
+	}
+	return AuthDefault, errors.New(`want "write" or "all"`)
+}
+
+// Mount is a directory served at a URL prefix by MountHandler.
+type Mount struct {
+	// Fs serves the directory. Its Prefix is the URL path of the mount, a
+	// single segment such as "/builds".
+	Fs *FSHandler
+	// Auth overrides AuthHandler.AuthWriteOnly for requests to the mount.
+	Auth AuthScope
+	// Next serves the requests to the mount, with Fs.Prefix stripped from
+	// their path; usually a compHandler of a TusHandler, UIHandler and Fs.
+	Next http.Handler
+}
+
+// name is the directory the mount is listed as at the top of the root.
+func (m *Mount) name() string {
+	return strings.TrimPrefix(m.Fs.Prefix, "/")
+}
+
+// MountHandler passes requests below the prefix of one of Mounts to it and
+// everything else to Next, which serves the root directory. Each mount has
+// its own FSHandler, so it stays confined to its directory, and its own
+// delete permission and read-only flag. The root lists the mounts as
+// directories, see FSHandler.Mounts.
+//
+// Share links only cover the root directory, so requests made with one
+// never reach a mount.
+type MountHandler struct {
+	Mounts []*Mount
+	Next   http.Handler
+}
+
+// find returns the mount urlPath is in, or nil.
+func (h *MountHandler) find(urlPath string) *Mount {
+	if h == nil {
+		return nil
+	}
+	for _, m := range h.Mounts {
+		if urlPath == m.Fs.Prefix || strings.HasPrefix(urlPath, m.Fs.Prefix+"/") {
+			return m
+		}
+	}
+	return nil
+}
+
+// authWriteOnly returns whether only state-changing requests like r need
+// credentials, which is writeOnly unless the mount of r says otherwise.
+func (h *MountHandler) authWriteOnly(r *http.Request, writeOnly bool) bool {
+	m := h.find(r.URL.Path)
+	if m == nil {
+		return writeOnly
+	}
+	switch m.Auth {
+	case AuthWrites:
+		return true
+	case AuthAll:
+		return false
+	}
+	return writeOnly
+}
+
+func (h *MountHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := h.find(r.URL.Path)
+	if m == nil {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	if requestShare(r) != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		logRequest(r, "", r.URL.Path, http.StatusNotFound, errors.New("share links do not cover mounts"))
+		return
+	}
+	m.Next.ServeHTTP(w, stripPrefix(r, m.Fs.Prefix))
+}
+
+// stripPrefix returns a shallow copy of r whose path has prefix removed,
+// leaving at least "/".
+func stripPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	if r2.URL.Path == "" {
+		r2.URL.Path = "/"
+	}
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// withMounts adds the mounts of h to infos, the listing of the directory
+// rel, replacing entries of the same name.
+func (h *FSHandler) withMounts(rel string, infos []fileInfo) []fileInfo {
+	if rel != "." || len(h.Mounts) == 0 {
+		return infos
+	}
+	listed := infos[:0]
+	for _, info := range infos {
+		if !h.mounted(info.Name) {
+			listed = append(listed, info)
+		}
+	}
+	for _, m := range h.Mounts {
+		info := fileInfo{Name: m.name(), IsDir: true}
+		if root, err := m.Fs.openRoot(); err == nil {
+			if stat, err := root.Stat("."); err == nil {
+				info.ModTime = stat.ModTime()
+			}
+			root.Close()
+		}
+		listed = append(listed, info)
+	}
+	return listed
+}
+
+// mounted reports whether rel is at or below one of the mounts of h, which
+// hide that part of Basedir.
+func (h *FSHandler) mounted(rel string) bool {
+	first, _, _ := strings.Cut(rel, "/")
+	for _, m := range h.Mounts {
+		if first == m.name() {
+			return true
+		}
+	}
+	return false
+}
+
+// fullRel returns rel, relative to Basedir, as a path relative to the URL
+// root, which is what ACL rules are written against.
+func (h *FSHandler) fullRel(rel string) string {
+	if h.Prefix == "" {
+		return rel
+	}
+	return toRelPath(path.Join(h.Prefix, rel))
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newMountFixture serves a root directory with a read-only mount at /docs
+// and a writable one at /builds that needs credentials for everything.
+func newMountFixture(t *testing.T) (*httptest.Server, string, string, string) {
+	t.Helper()
+	rootDir, docsDir, buildsDir := t.TempDir(), t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(rootDir, "root.txt"), []byte("root"), 0600)
+	os.Mkdir(filepath.Join(rootDir, "docs"), 0700)
+	os.WriteFile(filepath.Join(rootDir, "docs", "hidden.txt"), []byte("hidden"), 0600)
+	os.WriteFile(filepath.Join(docsDir, "guide.txt"), []byte("guide"), 0600)
+	os.WriteFile(filepath.Join(buildsDir, "app.tar"), []byte("app"), 0600)
+
+	mount := func(prefix, dir string, auth AuthScope, readOnly, allowDelete bool) *Mount {
+		fs := &FSHandler{Basedir: dir, Prefix: prefix, ReadOnly: readOnly, AllowDelete: allowDelete}
+		tus := &TusHandler{Fs: fs}
+		return &Mount{Fs: fs, Auth: auth, Next: NewCompHandler(tus, &UIHandler{Fs: fs}, fs)}
+	}
+	mounts := []*Mount{
+		mount("/docs", docsDir, AuthDefault, true, false),
+		mount("/builds", buildsDir, AuthAll, false, true),
+	}
+	fs := &FSHandler{Basedir: rootDir, Mounts: mounts}
+	mh := &MountHandler{Mounts: mounts, Next: NewCompHandler(&UIHandler{Fs: fs}, fs)}
+	srv := httptest.NewServer(&AuthHandler{
+		Username:      "admin",
+		Password:      "secret",
+		AuthWriteOnly: true,
+		Mounts:        mh,
+		Next:          mh,
+	})
+	t.Cleanup(srv.Close)
+	return srv, rootDir, docsDir, buildsDir
+}
+
+func mountRequest(t *testing.T, method, url string, body io.Reader, header ...string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, body)
+	req.SetBasicAuth("admin", "secret")
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i] == "Authorization" && header[i+1] == "" {
+			req.Header.Del("Authorization")
+			continue
+		}
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func Test_MountHandler_listing(t *testing.T) {
+	srv, _, _, _ := newMountFixture(t)
+
+	resp, body := mountRequest(t, http.MethodGet, srv.URL+"/", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET / = %d", resp.StatusCode)
+	}
+	var infos []fileInfo
+	if err := json.Unmarshal([]byte(body), &infos); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, info := range infos {
+		got[info.Name] = info.IsDir
+	}
+	if len(got) != 3 || got["root.txt"] || !got["docs"] || !got["builds"] {
+		t.Fatalf("root listing = %s", body)
+	}
+
+	// The mount hides the root directory of the same name.
+	resp, body = mountRequest(t, http.MethodGet, srv.URL+"/docs/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "guide.txt") || strings.Contains(body, "hidden.txt") {
+		t.Fatalf("GET /docs/ = %d %s", resp.StatusCode, body)
+	}
+	if resp, body := mountRequest(t, http.MethodGet, srv.URL+"/docs/guide.txt", nil); resp.StatusCode != http.StatusOK || body != "guide" {
+		t.Fatalf("GET /docs/guide.txt = %d %q", resp.StatusCode, body)
+	}
+
+	// The UI sees full paths.
+	resp, body = mountRequest(t, http.MethodGet, srv.URL+"/docs/", nil, "Accept", "text/html")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"path":"/docs/"`) || !strings.Contains(body, `"can_write":false`) {
+		t.Fatalf("UI of /docs/ = %d %s", resp.StatusCode, body)
+	}
+	resp, body = mountRequest(t, http.MethodGet, srv.URL+"/", nil, "Accept", "text/html")
+	if !strings.Contains(body, `"name":"builds"`) {
+		t.Fatalf("UI of / = %d %s", resp.StatusCode, body)
+	}
+}
+
+func Test_MountHandler_policies(t *testing.T) {
+	srv, rootDir, docsDir, buildsDir := newMountFixture(t)
+
+	// Read-only.
+	if resp, body := mountRequest(t, http.MethodPut, srv.URL+"/docs/new.txt", strings.NewReader("x")); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("PUT into read-only mount = %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := mountRequest(t, http.MethodPost, srv.URL+"/docs/", nil, "Tus-Resumable", tusVersion, "Upload-Length", "1", "Upload-Metadata", "filename bmV3LnR4dA=="); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("tus upload into read-only mount = %d", resp.StatusCode)
+	}
+
+	// Per-mount delete permission; the root does not allow deleting.
+	if resp, _ := mountRequest(t, http.MethodDelete, srv.URL+"/root.txt", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("DELETE in root = %d", resp.StatusCode)
+	}
+	if resp, _ := mountRequest(t, http.MethodDelete, srv.URL+"/builds/app.tar", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE in /builds = %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(buildsDir, "app.tar")); !os.IsNotExist(err) {
+		t.Fatalf("app.tar still there: %v", err)
+	}
+
+	// Per-mount auth scope: /builds needs credentials for reads too.
+	if resp, _ := mountRequest(t, http.MethodGet, srv.URL+"/builds/", nil, "Authorization", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("anonymous GET /builds/ = %d", resp.StatusCode)
+	}
+	if resp, _ := mountRequest(t, http.MethodGet, srv.URL+"/docs/guide.txt", nil, "Authorization", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("anonymous GET /docs/guide.txt = %d", resp.StatusCode)
+	}
+
+	// Each mount stays in its directory.
+	if resp, _ := mountRequest(t, http.MethodGet, srv.URL+"/builds/../docs/guide.txt", nil); resp.StatusCode == http.StatusOK {
+		t.Fatal("escaped /builds")
+	}
+	resp, _ := mountRequest(t, http.MethodPut, srv.URL+"/builds/out.txt", strings.NewReader("out"))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT /builds/out.txt = %d", resp.StatusCode)
+	}
+	if resp, body := mountRequest(t, http.MethodPost, srv.URL+"/builds/out.txt?action=move&to=/docs/", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("move across mounts = %d %s", resp.StatusCode, body)
+	}
+	if resp, body := mountRequest(t, http.MethodPost, srv.URL+"/builds/out.txt?action=move&to=/builds/moved.txt", nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("move within mount = %d %s", resp.StatusCode, body)
+	}
+	if _, err := os.Stat(filepath.Join(buildsDir, "moved.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := mountRequest(t, http.MethodPost, srv.URL+"/root.txt?action=copy&to=/builds/", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("copy from root into mount = %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, "builds")); !os.IsNotExist(err) {
+		t.Fatalf("root gained a builds entry: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(docsDir, "out.txt")); !os.IsNotExist(err) {
+		t.Fatalf("out.txt reached /docs: %v", err)
+	}
+
+	// Resumable uploads come back to their mount.
+	resp, _ = mountRequest(t, http.MethodPost, srv.URL+"/builds/", nil, "Tus-Resumable", tusVersion, "Upload-Length", "2", "Upload-Metadata", "filename bmV3LnR4dA==")
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || !strings.HasPrefix(location, "/builds"+tusPrefix) {
+		t.Fatalf("tus creation = %d %q", resp.StatusCode, location)
+	}
+	resp, _ = mountRequest(t, http.MethodPatch, srv.URL+location, strings.NewReader("hi"),
+		"Tus-Resumable", tusVersion, "Upload-Offset", "0", "Content-Type", "application/offset+octet-stream")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("tus patch = %d", resp.StatusCode)
+	}
+	if b, err := os.ReadFile(filepath.Join(buildsDir, "new.txt")); err != nil || string(b) != "hi" {
+		t.Fatalf("uploaded file = %q %v", b, err)
+	}
+}
+
+func Test_MountHandler_acl(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("s"), 0600)
+	os.WriteFile(filepath.Join(dir, "open.txt"), []byte("o"), 0600)
+	acl := newTestACL(t, "allow * /** read\ndeny * /builds/secret.txt read\n")
+	fs := &FSHandler{Basedir: dir, Prefix: "/builds", ACL: acl}
+	h := &MountHandler{Mounts: []*Mount{{Fs: fs, Next: fs}}, Next: http.NotFoundHandler()}
+
+	// ACL rules are written against full URL paths.
+	for p, want := range map[string]int{"/builds/open.txt": http.StatusOK, "/builds/secret.txt": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, p, nil))
+		if w.Code != want {
+			t.Errorf("GET %s = %d, want %d", p, w.Code, want)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/builds", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret.txt") || !strings.Contains(w.Body.String(), "open.txt") {
+		t.Fatalf("GET /builds = %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// destination resolves the target of a move or copy. It comes from the "to"
+// query parameter or, for the WebDAV-style methods, from the Destination
+// header. A target ending in "/" names the directory to place the source in.
+// Moves and copies stay within one mount.
+func (h *FSHandler) destination(r *http.Request, src string) (string, int, error) {
+	to := r.URL.Query().Get("to")
+	if r.Method != http.MethodPost {
+		header := r.Header.Get("Destination")
+		if header == "" {
+			return "", http.StatusBadRequest, errors.New("missing Destination header")
+		}
+		u, err := url.Parse(header)
+		if err != nil {
+			return "", http.StatusBadRequest, fmt.Errorf("invalid Destination %q", header)
+		}
+		if u.Host != "" && u.Host != r.Host {
+			return "", http.StatusBadGateway, fmt.Errorf("destination %q is on another server", header)
+		}
+		to = u.Path
+	}
+	if to == "" {
+		return "", http.StatusBadRequest, errors.New("missing 'to' query parameter")
+	}
+	if h.Prefix != "" {
+		rest, ok := strings.CutPrefix(to, h.Prefix+"/")
+		if !ok {
+			return "", http.StatusBadRequest, fmt.Errorf("destination %q is outside %s", to, h.Prefix)
+		}
+		to = "/" + rest
+	}
+	if strings.HasSuffix(to, "/") {
+		to = path.Join(to, path.Base(src))
+	}
+	dst := toRelPath(to)
+	if h.mounted(dst) {
+		return "", http.StatusBadRequest, fmt.Errorf("destination %q is in a mount", to)
+	}
+	if dst == "." || isInternalPath(dst) {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid destination %q", to)
+	}
+	return dst, http.StatusOK, nil
+}
+
+// overwriteAllowed reads the overwrite preference: the "overwrite" query
+// parameter for the action API (default false) or the WebDAV Overwrite
+// header (default true).
+func overwriteAllowed(r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return r.URL.Query().Get("overwrite") == "true"
+	}
+	return r.Header.Get("Overwrite") != "F"
+}
+
+func (h *FSHandler) serveMove(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	src := toRelPath(r.URL.Path)
+	if src == "." {
+		return http.StatusBadRequest, errors.New("cannot move root directory")
+	}
+	dst, code, err := h.destination(r, src)
+	if err != nil {
+		return code, err
+	}
+	defer func() {
+		h.changed(r, AuditEntry{Action: "move", Path: h.auditPath(src), To: h.auditPath(dst)}, code, err)
+	}()
+	if dst == src {
+		return http.StatusForbidden, errors.New("source and destination are the same")
+	}
+	if strings.HasPrefix(dst, src+"/") {
+		return http.StatusConflict, fmt.Errorf("cannot move %q into itself", r.URL.Path)
+	}
+
+	root, err := h.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	info, err := root.Lstat(src)
+	if err != nil {
+		return http.StatusNotFound, fmt.Errorf("%q not found", r.URL.Path)
+	}
+	// A move removes the source, so it takes what a delete of it does.
+	if info.IsDir() && !h.AllowDelete {
+		return http.StatusForbidden, errors.New("moving a directory requires delete to be enabled")
+	}
+	if code, err := h.checkTree(w, r, root, src, permWrite); err != nil {
+		return code, err
+	}
+	if code, err := h.checkTree(w, r, root, src, permDelete); err != nil {
+		return code, err
+	}
+	if code, err := h.checkRelocation(w, r, root, src, dst); err != nil {
+		return code, err
+	}
+
+	code, err = h.prepareDestination(w, r, root, dst, overwriteAllowed(r))
+	if err != nil {
+		return code, err
+	}
+	if err := root.Rename(src, dst); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.WriteHeader(code)
+	return code, nil
+}
+
+// prepareDestination makes dst ready to be replaced by a move or copy. It
+// returns 201 if dst is new or 204 if an existing entry was removed.
+// Replacing a directory tree is a deletion and needs AllowDelete and, with
+// an ACL, delete permission on the whole tree.
+func (h *FSHandler) prepareDestination(w http.ResponseWriter, r *http.Request, root *os.Root, dst string, overwrite bool) (int, error) {
+	info, err := root.Lstat(dst)
+	if err != nil {
+		if dir := path.Dir(dst); dir != "." {
+			if err := root.MkdirAll(dir, os.ModePerm); err != nil {
+				return http.StatusConflict, err
+			}
+		}
+		return http.StatusCreated, nil
+	}
+	if !overwrite {
+		return http.StatusPreconditionFailed, fmt.Errorf("%q already exists", dst)
+	}
+	if info.IsDir() {
+		if !h.AllowDelete {
+			return http.StatusForbidden, errors.New("replacing a directory requires delete to be enabled")
+		}
+		if code, err := h.checkTree(w, r, root, dst, permDelete); err != nil {
+			return code, err
+		}
+	}
+	if err := h.supersede(root, dst, info, logUser(r)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusNoContent, nil
+}
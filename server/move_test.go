@@ -0,0 +1,174 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newMoveFixture(t *testing.T) (string, *FSHandler) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	os.MkdirAll(filepath.Join(tmpDir, "dir", "sub"), 0755)
+	os.Mkdir(filepath.Join(tmpDir, "other"), 0755)
+	os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "b.txt"), []byte("b"), 0600)
+	os.WriteFile(filepath.Join(tmpDir, "dir", "sub", "c.txt"), []byte("c"), 0600)
+	return tmpDir, &FSHandler{Basedir: tmpDir}
+}
+
+func Test_serveMove_rename(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/a.txt?action=move&to=/renamed.txt", nil)
+	code, err := h.serve(httptest.NewRecorder(), r)
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, err: %v", code, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "a.txt")); err == nil {
+		t.Error("source should be gone after a move")
+	}
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "renamed.txt"))
+	if string(data) != "a" {
+		t.Errorf("got %q, want %q", data, "a")
+	}
+}
+
+func Test_serveMove_intoDirectory(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+
+	// Moving a directory removes it from where it was, like a delete.
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/dir?action=move&to=/other/", nil)
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusForbidden {
+		t.Fatalf("without delete: expected 403, got %d, err: %v", code, err)
+	}
+	h.AllowDelete = true
+	r = httptest.NewRequest(http.MethodPost, "http://localhost/dir?action=move&to=/other/", nil)
+	code, err := h.serve(httptest.NewRecorder(), r)
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, err: %v", code, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "other", "dir", "sub", "c.txt")); err != nil {
+		t.Errorf("directory tree should be moved: %v", err)
+	}
+}
+
+func Test_serveMove_createsParents(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/a.txt?action=move&to=/x/y/a.txt", nil)
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d, err: %v", code, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "x", "y", "a.txt")); err != nil {
+		t.Errorf("file should be moved into new parents: %v", err)
+	}
+}
+
+func Test_serveMove_overwrite(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/a.txt?action=move&to=/b.txt", nil)
+	if code, _ := h.serve(httptest.NewRecorder(), r); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 without overwrite, got %d", code)
+	}
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "b.txt"))
+	if string(data) != "b" {
+		t.Fatalf("destination should be untouched, got %q", data)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "http://localhost/a.txt?action=move&to=/b.txt&overwrite=true", nil)
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusNoContent {
+		t.Fatalf("expected 204 with overwrite, got %d, err: %v", code, err)
+	}
+	data, _ = os.ReadFile(filepath.Join(tmpDir, "b.txt"))
+	if string(data) != "a" {
+		t.Errorf("got %q, want %q", data, "a")
+	}
+}
+
+func Test_serveMove_replaceDirectoryNeedsDelete(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/a.txt?action=move&to=/other&overwrite=true", nil)
+	if code, _ := h.serve(httptest.NewRecorder(), r); code != http.StatusForbidden {
+		t.Fatalf("expected 403 when delete disabled, got %d", code)
+	}
+
+	h.AllowDelete = true
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d, err: %v", code, err)
+	}
+	if info, err := os.Stat(filepath.Join(tmpDir, "other")); err != nil || info.IsDir() {
+		t.Errorf("directory should be replaced by the file: %v", err)
+	}
+}
+
+func Test_serveMove_rejected(t *testing.T) {
+	_, h := newMoveFixture(t)
+
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+	}{
+		{"root", "/?action=move&to=/x", http.StatusBadRequest},
+		{"missing-to", "/a.txt?action=move", http.StatusBadRequest},
+		{"same", "/a.txt?action=move&to=/a.txt", http.StatusForbidden},
+		{"into-itself", "/dir?action=move&to=/dir/sub/dir", http.StatusConflict},
+		{"not-found", "/nope?action=move&to=/x", http.StatusNotFound},
+		{"same-dir", "/a.txt?action=move&to=/", http.StatusForbidden},
+		{"internal", "/a.txt?action=move&to=/" + tusDir + "/a", http.StatusBadRequest},
+		// Traversal is clamped to the basedir like any other request path.
+		{"traversal", "/a.txt?action=move&to=/../../x.txt", http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://localhost"+tt.target, nil)
+			code, _ := h.serve(httptest.NewRecorder(), r)
+			if code != tt.wantCode {
+				t.Errorf("move %s = %d, want %d", tt.target, code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func Test_serveMove_method(t *testing.T) {
+	tmpDir, h := newMoveFixture(t)
+
+	r := httptest.NewRequest("MOVE", "http://localhost/a.txt", nil)
+	r.Header.Set("Destination", "http://localhost/b.txt")
+	r.Header.Set("Overwrite", "F")
+	if code, _ := h.serve(httptest.NewRecorder(), r); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 with Overwrite: F, got %d", code)
+	}
+
+	r.Header.Del("Overwrite")
+	if code, err := h.serve(httptest.NewRecorder(), r); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d, err: %v", code, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "b.txt"))
+	if string(data) != "a" {
+		t.Errorf("got %q, want %q", data, "a")
+	}
+
+	r = httptest.NewRequest("MOVE", "http://localhost/b.txt", nil)
+	r.Header.Set("Destination", "http://elsewhere/b.txt")
+	if code, _ := h.serve(httptest.NewRecorder(), r); code != http.StatusBadGateway {
+		t.Errorf("expected 502 for a foreign destination, got %d", code)
+	}
+}
+
+func Test_fsHandler_writesErrorStatus(t *testing.T) {
+	_, h := newMoveFixture(t)
+
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/a.txt?action=move&to=/b.txt", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected the error status in the response, got %d", w.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// CertMapping selects the field of a TLS client certificate that names its
+// user.
+type CertMapping string
+
+const (
+	// CertMappingCN uses the subject common name.
+	CertMappingCN CertMapping = "cn"
+	// CertMappingEmail uses the first email address SAN.
+	CertMappingEmail CertMapping = "email"
+	// CertMappingDNS uses the first DNS name SAN.
+	CertMappingDNS CertMapping = "dns"
+	// CertMappingURI uses the first URI SAN, e.g. a SPIFFE ID.
+	CertMappingURI CertMapping = "uri"
+)
+
+// ParseCertMapping parses "cn", "email", "dns" or "uri".
+func ParseCertMapping(s string) (CertMapping, error) {
+	switch m := CertMapping(s); m {
+	case CertMappingCN, CertMappingEmail, CertMappingDNS, CertMappingURI:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown certificate field %q, want cn, email, dns or uri", s)
+}
+
+// user returns the username for cert, or "" if the field is empty.
+func (m CertMapping) user(cert *x509.Certificate) string {
+	switch m {
+	case CertMappingCN:
+		return cert.Subject.CommonName
+	case CertMappingEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case CertMappingDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case CertMappingURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+	return ""
+}
+
+// certUser returns the user named by the verified client certificate of r,
+// or "" if there is none. Certificates are verified against the client CAs
+// during the handshake, see ClientAuthTLSConfig.
+func certUser(r *http.Request, m CertMapping) string {
+	if m == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return m.user(r.TLS.VerifiedChains[0][0])
+}
+
+// ClientAuthTLSConfig returns a TLS config that verifies client
+// certificates against the PEM bundle in caFile. auth is
+// tls.VerifyClientCertIfGiven to accept clients without a certificate, or
+// tls.RequireAndVerifyClientCert to refuse them during the handshake.
+func ClientAuthTLSConfig(caFile string, auth tls.ClientAuthType) (*tls.Config, error) {
+	if auth != tls.VerifyClientCertIfGiven && auth != tls.RequireAndVerifyClientCert {
+		return nil, errors.New("client certificates must be verified")
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: auth,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a leaf certificate for tmpl, filling in the boilerplate.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// newMTLSServer starts a TLS server whose AuthHandler maps client
+// certificates issued by clientCA, and returns it with its CA pool.
+func newMTLSServer(t *testing.T, clientCA *testCA, auth tls.ClientAuthType, mapping CertMapping) (*httptest.Server, *x509.CertPool) {
+	t.Helper()
+	config, err := ClientAuthTLSConfig(clientCA.writePEM(t), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCA := newTestCA(t, "server CA")
+	config.Certificates = []tls.Certificate{serverCA.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, x509.ExtKeyUsageServerAuth)}
+
+	h := &AuthHandler{
+		ClientCerts:   mapping,
+		AuthWriteOnly: true,
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(requestUser(r)))
+		}),
+	}
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = config
+	// Rejected handshakes are expected; keep them out of the test output.
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	return srv, roots
+}
+
+func mtlsClient(roots *x509.CertPool, cert *tls.Certificate) *http.Client {
+	config := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		// Present the certificate even if the server does not list its
+		// issuer as acceptable, as a misbehaving client might.
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func mtlsDo(t *testing.T, client *http.Client, method, url string) (int, string, error) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	var body [256]byte
+	n, _ := resp.Body.Read(body[:])
+	return resp.StatusCode, string(body[:n]), nil
+}
+
+func Test_mtls_request(t *testing.T) {
+	ca := newTestCA(t, "lab CA")
+	srv, roots := newMTLSServer(t, ca, tls.VerifyClientCertIfGiven, CertMappingCN)
+	cert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "builder-01"}}, x509.ExtKeyUsageClientAuth)
+
+	withCert := mtlsClient(roots, &cert)
+	if code, user, err := mtlsDo(t, withCert, http.MethodPost, srv.URL+"/"); err != nil || code != http.StatusOK || user != "builder-01" {
+		t.Fatalf("POST with certificate = %d %q %v", code, user, err)
+	}
+
+	anonymous := mtlsClient(roots, nil)
+	if code, user, err := mtlsDo(t, anonymous, http.MethodGet, srv.URL+"/"); err != nil || code != http.StatusOK || user != "" {
+		t.Fatalf("GET without certificate = %d %q %v", code, user, err)
+	}
+	if code, _, err := mtlsDo(t, anonymous, http.MethodPost, srv.URL+"/"); err != nil || code != http.StatusUnauthorized {
+		t.Fatalf("POST without certificate = %d %v", code, err)
+	}
+
+	// A certificate is still verified when it is optional.
+	rogue := newTestCA(t, "rogue CA").issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "builder-01"}}, x509.ExtKeyUsageClientAuth)
+	if _, _, err := mtlsDo(t, mtlsClient(roots, &rogue), http.MethodGet, srv.URL+"/"); err == nil {
+		t.Fatal("certificate from an unknown CA was accepted")
+	}
+}
+
+func Test_mtls_require(t *testing.T) {
+	ca := newTestCA(t, "lab CA")
+	srv, roots := newMTLSServer(t, ca, tls.RequireAndVerifyClientCert, CertMappingCN)
+
+	if _, _, err := mtlsDo(t, mtlsClient(roots, nil), http.MethodGet, srv.URL+"/"); err == nil {
+		t.Fatal("request without certificate was accepted")
+	}
+	cert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "builder-02"}}, x509.ExtKeyUsageClientAuth)
+	if code, user, err := mtlsDo(t, mtlsClient(roots, &cert), http.MethodGet, srv.URL+"/"); err != nil || code != http.StatusOK || user != "builder-02" {
+		t.Fatalf("GET with certificate = %d %q %v", code, user, err)
+	}
+
+	// Server certificates are not meant to authenticate clients.
+	serverCert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "builder-02"}}, x509.ExtKeyUsageServerAuth)
+	if _, _, err := mtlsDo(t, mtlsClient(roots, &serverCert), http.MethodGet, srv.URL+"/"); err == nil {
+		t.Fatal("certificate without client auth usage was accepted")
+	}
+}
+
+func Test_mtls_sanMapping(t *testing.T) {
+	ca := newTestCA(t, "lab CA")
+	spiffe, _ := url.Parse("spiffe://lab.example/builder")
+	tmpl := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:        pkix.Name{CommonName: "cn-name"},
+			EmailAddresses: []string{"ci@lab.example"},
+			DNSNames:       []string{"builder.lab.example"},
+			URIs:           []*url.URL{spiffe},
+		}
+	}
+	tests := []struct {
+		mapping CertMapping
+		want    string
+	}{
+		{CertMappingCN, "cn-name"},
+		{CertMappingEmail, "ci@lab.example"},
+		{CertMappingDNS, "builder.lab.example"},
+		{CertMappingURI, "spiffe://lab.example/builder"},
+	}
+	for _, tt := range tests {
+		srv, roots := newMTLSServer(t, ca, tls.VerifyClientCertIfGiven, tt.mapping)
+		cert := ca.issue(t, tmpl(), x509.ExtKeyUsageClientAuth)
+		if code, user, err := mtlsDo(t, mtlsClient(roots, &cert), http.MethodPost, srv.URL+"/"); err != nil || code != http.StatusOK || user != tt.want {
+			t.Errorf("%s: POST = %d %q %v, want %q", tt.mapping, code, user, err, tt.want)
+		}
+	}
+
+	// A certificate without the mapped field authenticates nobody.
+	srv, roots := newMTLSServer(t, ca, tls.VerifyClientCertIfGiven, CertMappingEmail)
+	cert := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "no-email"}}, x509.ExtKeyUsageClientAuth)
+	if code, _, err := mtlsDo(t, mtlsClient(roots, &cert), http.MethodPost, srv.URL+"/"); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("POST without email SAN = %d %v, want 401", code, err)
+	}
+}
+
+func Test_ClientAuthTLSConfig_errors(t *testing.T) {
+	ca := newTestCA(t, "lab CA").writePEM(t)
+	if _, err := ClientAuthTLSConfig(ca, tls.RequestClientCert); err == nil {
+		t.Error("unverified client certificates were allowed")
+	}
+	if _, err := ClientAuthTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), tls.VerifyClientCertIfGiven); err == nil {
+		t.Error("missing CA file was accepted")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientAuthTLSConfig(empty, tls.VerifyClientCertIfGiven); err == nil {
+		t.Error("CA file without certificates was accepted")
+	}
+	if _, err := ParseCertMapping("serial"); err == nil {
+		t.Error("unknown certificate field was accepted")
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcFlowCookie keeps the state, nonce and PKCE verifier of a login in
+	// progress until the provider redirects back.
+	oidcFlowCookie = "fileserver_oidc"
+	oidcFlowTTL    = 10 * time.Minute
+
+	// defaultUsernameClaim is the subject, which the provider keeps unique
+	// and stable; claims such as "preferred_username" or "email" may be
+	// chosen by the users themselves at some providers.
+	defaultUsernameClaim = "sub"
+)
+
+// OIDCHandler logs browser users in with OpenID Connect, using the
+// authorization code flow with PKCE, and starts a session for them:
+//
+//	GET /_auth/login?next=/path  redirect to the provider
+//	GET /_auth/callback          return from the provider
+//
+// The provider is discovered from Issuer on first use. AuthHandler routes
+// these paths here without authentication and sends browsers that need to
+// log in to /_auth/login.
+type OIDCHandler struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL of /_auth/callback as registered with
+	// the provider.
+	RedirectURL string
+	// Scopes are requested in addition to "openid"; nil means "profile" and
+	// "email".
+	Scopes []string
+	// UsernameClaim is the ID token claim used as the username; "" means
+	// "sub". The names share the namespace of the other users and of the
+	// ACL, so the claim must be one users cannot set to another's name.
+	UsernameClaim string
+	// GroupsClaim is an ID token claim listing the user's groups, which
+	// count for "@group" ACL rules; "" ignores groups.
+	GroupsClaim string
+	Sessions    *Sessions
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+type oidcFlow struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Next     string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+func (h *OIDCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code, err := h.serve(w, r)
+	if err != nil {
+		msg := err.Error()
+		if code >= http.StatusInternalServerError {
+			msg = http.StatusText(code)
+		}
+		http.Error(w, msg, code)
+	}
+	logRequest(r, "oidc", r.URL.Path, code, err)
+}
+
+func (h *OIDCHandler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	switch strings.TrimPrefix(r.URL.Path, authPrefix) {
+	case "login":
+		return h.serveLogin(w, r)
+	case "callback":
+		return h.serveCallback(w, r)
+	}
+	return http.StatusNotFound, fmt.Errorf("%q not found", r.URL.Path)
+}
+
+func (h *OIDCHandler) serveLogin(w http.ResponseWriter, r *http.Request) (int, error) {
+	config, err := h.oauth2Config(r)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	flow := oidcFlow{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     localPath(r.URL.Query().Get("next")),
+		Expires:  time.Now().Add(oidcFlowTTL).Unix(),
+	}
+	value, err := signValue(h.Sessions.signingKey(), flow)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    value,
+		Path:     authPrefix,
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// The provider redirects back with a top-level GET, which Lax
+		// cookies are sent with.
+		SameSite: http.SameSiteLaxMode,
+	})
+	target := config.AuthCodeURL(flow.State, oidc.Nonce(flow.Nonce), oauth2.S256ChallengeOption(flow.Verifier))
+	http.Redirect(w, r, target, http.StatusFound)
+	return http.StatusFound, nil
+}
+
+func (h *OIDCHandler) serveCallback(w http.ResponseWriter, r *http.Request) (int, error) {
+	c, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("no login in progress")
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcFlowCookie, Path: authPrefix, MaxAge: -1})
+
+	var flow oidcFlow
+	if err := verifyValue(h.Sessions.signingKey(), c.Value, &flow); err != nil || time.Now().Unix() > flow.Expires {
+		return http.StatusBadRequest, errors.New("login expired, please try again")
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return http.StatusUnauthorized, fmt.Errorf("login failed: %s %s", e, q.Get("error_description"))
+	}
+	if !hmac.Equal([]byte(q.Get("state")), []byte(flow.State)) {
+		return http.StatusBadRequest, errors.New("login state mismatch")
+	}
+
+	config, err := h.oauth2Config(r)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	token, err := config.Exchange(r.Context(), q.Get("code"), oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("code exchange: %w", err)
+	}
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return http.StatusBadGateway, errors.New("provider returned no ID token")
+	}
+	idToken, err := h.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if !hmac.Equal([]byte(idToken.Nonce), []byte(flow.Nonce)) {
+		return http.StatusUnauthorized, errors.New("ID token nonce mismatch")
+	}
+
+	id, err := h.identity(idToken)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+	if err := h.Sessions.start(w, r, id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	log.Printf("oidc login %s groups %v", id.name, id.groups)
+	http.Redirect(w, r, flow.Next, http.StatusFound)
+	return http.StatusFound, nil
+}
+
+// identity maps the claims of an ID token to a user and groups.
+func (h *OIDCHandler) identity(idToken *oidc.IDToken) (identity, error) {
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return identity{}, err
+	}
+	claim := h.UsernameClaim
+	if claim == "" {
+		claim = defaultUsernameClaim
+	}
+	name, _ := claims[claim].(string)
+	if name == "" {
+		return identity{}, fmt.Errorf("ID token has no %q claim", claim)
+	}
+	id := identity{name: name}
+	if h.GroupsClaim != "" {
+		switch v := claims[h.GroupsClaim].(type) {
+		case string:
+			id.groups = []string{v}
+		case []any:
+			for _, g := range v {
+				if s, ok := g.(string); ok {
+					id.groups = append(id.groups, s)
+				}
+			}
+		}
+	}
+	return id, nil
+}
+
+// oauth2Config discovers the provider on first use. A failed discovery is
+// retried on the next login.
+func (h *OIDCHandler) oauth2Config(r *http.Request) (*oauth2.Config, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.provider == nil {
+		provider, err := oidc.NewProvider(r.Context(), h.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("discover %q: %w", h.Issuer, err)
+		}
+		h.provider = provider
+		h.verifier = provider.Verifier(&oidc.Config{ClientID: h.ClientID})
+	}
+	scopes := h.Scopes
+	if scopes == nil {
+		scopes = []string{"profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     h.ClientID,
+		ClientSecret: h.ClientSecret,
+		Endpoint:     h.provider.Endpoint(),
+		RedirectURL:  h.RedirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+	}, nil
+}
+
+// localPath returns next if it is a path on this server, so that the login
+// cannot be abused to redirect elsewhere, or "/" otherwise.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, keys, an authorize
+// endpoint that logs in whoever is configured and a token endpoint that
+// checks the PKCE verifier.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// claims are added to the ID tokens of the next logins.
+	claims map[string]any
+	grants map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+const mockClientID = "fileserver"
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/keys", idp.keys)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) setClaims(claims map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                idp.URL,
+		"authorization_endpoint":                idp.URL + "/authorize",
+		"token_endpoint":                        idp.URL + "/token",
+		"jwks_uri":                              idp.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (idp *mockIdP) keys(w http.ResponseWriter, r *http.Request) {
+	pub := idp.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "test",
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != mockClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" ||
+		!strings.Contains(q.Get("scope"), "openid") {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+	idp.mu.Lock()
+	idp.grants[code] = mockGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: idp.claims}
+	idp.mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v := url.Values{"code": {code}, "state": {q.Get("state")}}
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.PostForm.Get("code")]
+	delete(idp.grants, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   idp.URL,
+		"sub":   "subject-1",
+		"aud":   mockClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idp.sign(claims),
+	})
+}
+
+// sign returns claims as an RS256 JWT.
+func (idp *mockIdP) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+const oidcTestACL = `
+allow * /docs/** read
+allow @authenticated /** read
+group ops carol
+allow @ops /** all
+`
+
+// newOIDCFixture serves files behind an AuthHandler that logs browsers in
+// at idp and still accepts Basic credentials for carol.
+func newOIDCFixture(t *testing.T, idp *mockIdP) (*httptest.Server, *AuthHandler) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	for _, file := range []string{"docs/a.txt", "secret/key"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, file)), 0755)
+		os.WriteFile(filepath.Join(tmpDir, file), []byte(file), 0600)
+	}
+	fs := &FSHandler{Basedir: tmpDir, ACL: newTestACL(t, oidcTestACL)}
+	sessions := &Sessions{Key: []byte("test key")}
+	h := &AuthHandler{
+		Username: "carol",
+		Password: "pw",
+		Sessions: sessions,
+		OIDC: &OIDCHandler{
+			Issuer:      idp.URL,
+			ClientID:    mockClientID,
+			GroupsClaim: "groups",
+			Sessions:    sessions,
+		},
+		AuthWriteOnly: true,
+		Next:          fs,
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	h.OIDC.RedirectURL = srv.URL + "/_auth/callback"
+	return srv, h
+}
+
+func browser(t *testing.T, follow bool) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	if !follow {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+func browse(t *testing.T, client *http.Client, target string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// sessionCSRFToken returns the CSRF token of the session of client, which
+// the UI would get in its initial data.
+func sessionCSRFToken(t *testing.T, client *http.Client, srv *httptest.Server, s *Sessions) string {
+	t.Helper()
+	_, token := clientSession(t, client, srv, s)
+	return token
+}
+
+// sessionIdentity returns who the session of client is for.
+func sessionIdentity(t *testing.T, client *http.Client, srv *httptest.Server, s *Sessions) identity {
+	t.Helper()
+	id, _ := clientSession(t, client, srv, s)
+	return id
+}
+
+func clientSession(t *testing.T, client *http.Client, srv *httptest.Server, s *Sessions) (identity, string) {
+	t.Helper()
+	u, _ := url.Parse(srv.URL)
+	for _, c := range client.Jar.Cookies(u) {
+		if c.Name == sessionCookie {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.AddCookie(c)
+			if id, token, ok := s.identity(httptest.NewRecorder(), r); ok {
+				return id, token
+			}
+		}
+	}
+	t.Fatal("no session")
+	return identity{}, ""
+}
+
+func Test_oidc_login(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.setClaims(map[string]any{"preferred_username": "dana", "groups": []string{"ops"}})
+	srv, h := newOIDCFixture(t, idp)
+
+	// The ACL denies anonymous reads of /secret, so the browser is sent to
+	// log in and then back.
+	client := browser(t, true)
+	resp, body := browse(t, client, srv.URL+"/secret/key")
+	if resp.StatusCode != http.StatusOK || body != "secret/key" {
+		t.Fatalf("GET /secret/key after login = %d %q", resp.StatusCode, body)
+	}
+	if resp.Request.URL.Path != "/secret/key" {
+		t.Fatalf("ended up at %s", resp.Request.URL)
+	}
+
+	// The groups from the ID token count for the ACL.
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/secret/new", strings.NewReader("x"))
+	req.Header.Set(csrfHeader, sessionCSRFToken(t, client, srv, h.Sessions))
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT with session = %v %v", resp, err)
+	}
+
+	// API clients keep getting the Basic challenge, and Basic still works.
+	resp, err := http.Get(srv.URL + "/secret/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Basic") {
+		t.Fatalf("API GET = %d %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/secret/key", nil)
+	req.SetBasicAuth("carol", "pw")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET with Basic = %v %v", resp, err)
+	}
+
+	// After logging out, the browser is sent to the login page again.
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	if code := logout(t, client, srv, sessionCSRFToken(t, client, srv, h.Sessions)); code != http.StatusNoContent {
+		t.Fatalf("logout = %d", code)
+	}
+	resp, _ = browse(t, client, srv.URL+"/secret/key")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/_auth/login?next=%2Fsecret%2Fkey" {
+		t.Fatalf("GET after logout = %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	// Public paths stay readable without logging in.
+	if resp, body := browse(t, client, srv.URL+"/docs/a.txt"); resp.StatusCode != http.StatusOK || body != "docs/a.txt" {
+		t.Fatalf("GET public file = %d %q", resp.StatusCode, body)
+	}
+}
+
+func Test_oidc_claims(t *testing.T) {
+	idp := newMockIdP(t)
+	srv, h := newOIDCFixture(t, idp)
+
+	// Without the ops group the logged-in user may only read.
+	idp.setClaims(map[string]any{"preferred_username": "dana"})
+	client := browser(t, true)
+	if resp, _ := browse(t, client, srv.URL+"/secret/key"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET as dana = %d, want 200", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodPut, srv.URL+"/secret/new", strings.NewReader("x"))
+	req.Header.Set(csrfHeader, sessionCSRFToken(t, client, srv, h.Sessions))
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("PUT as dana without groups = %v %v, want 403", resp, err)
+	}
+	// By default the username is the subject, which users cannot choose.
+	if id := sessionIdentity(t, client, srv, h.Sessions); id.name != "subject-1" {
+		t.Fatalf("default username = %q, want the subject", id.name)
+	}
+
+	// The username claim is configurable; a single group may be a string.
+	h.OIDC.UsernameClaim = "email"
+	idp.setClaims(map[string]any{"preferred_username": "dana", "email": "dana@example.com", "groups": "ops"})
+	client = browser(t, true)
+	browse(t, client, srv.URL+"/secret/key")
+	req, _ = http.NewRequest(http.MethodPut, srv.URL+"/secret/new", strings.NewReader("x"))
+	req.Header.Set(csrfHeader, sessionCSRFToken(t, client, srv, h.Sessions))
+	if resp, err := client.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT as dana@example.com in ops = %v %v, want 201", resp, err)
+	}
+	if id := sessionIdentity(t, client, srv, h.Sessions); id.name != "dana@example.com" {
+		t.Fatalf("session identity = %+v", id)
+	}
+
+	// A token without the username claim logs nobody in.
+	idp.setClaims(map[string]any{"preferred_username": "dana"})
+	if resp, _ := browse(t, browser(t, true), srv.URL+"/secret/key"); resp.StatusCode != http.StatusForbidden || resp.Request.URL.Path != "/_auth/callback" {
+		t.Fatalf("login without email claim = %d, want 403", resp.StatusCode)
+	}
+}
+
+// startLogin follows the login redirects up to the callback, which it
+// returns without calling.
+func startLogin(t *testing.T, client *http.Client, srv *httptest.Server) *url.URL {
+	t.Helper()
+	resp, _ := browse(t, client, srv.URL+"/_auth/login?next=/docs/")
+	for resp.StatusCode == http.StatusFound {
+		loc, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.Path == "/_auth/callback" {
+			return loc
+		}
+		resp, _ = browse(t, client, loc.String())
+	}
+	t.Fatalf("login stopped with %d", resp.StatusCode)
+	return nil
+}
+
+// alterFlow rewrites the signed login flow cookie of client.
+func alterFlow(t *testing.T, client *http.Client, srv *httptest.Server, key []byte, alter func(*oidcFlow)) {
+	t.Helper()
+	u, _ := url.Parse(srv.URL + authPrefix)
+	for _, c := range client.Jar.Cookies(u) {
+		if c.Name != oidcFlowCookie {
+			continue
+		}
+		var flow oidcFlow
+		if err := verifyValue(key, c.Value, &flow); err != nil {
+			t.Fatal(err)
+		}
+		alter(&flow)
+		value, err := signValue(key, flow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Jar.SetCookies(u, []*http.Cookie{{Name: oidcFlowCookie, Value: value, Path: authPrefix}})
+		return
+	}
+	t.Fatal("no login flow cookie")
+}
+
+func Test_oidc_callbackErrors(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.setClaims(map[string]any{"preferred_username": "dana"})
+	srv, h := newOIDCFixture(t, idp)
+	key := h.Sessions.Key
+
+	tests := []struct {
+		name     string
+		alter    func(callback *url.URL, client *http.Client)
+		wantCode int
+	}{
+		{"ok", func(*url.URL, *http.Client) {}, http.StatusOK},
+		{"state", func(callback *url.URL, _ *http.Client) {
+			q := callback.Query()
+			q.Set("state", "forged")
+			callback.RawQuery = q.Encode()
+		}, http.StatusBadRequest},
+		{"pkce", func(_ *url.URL, client *http.Client) {
+			alterFlow(t, client, srv, key, func(f *oidcFlow) { f.Verifier = strings.Repeat("x", 43) })
+		}, http.StatusBadGateway},
+		{"nonce", func(_ *url.URL, client *http.Client) {
+			alterFlow(t, client, srv, key, func(f *oidcFlow) { f.Nonce = "replayed" })
+		}, http.StatusUnauthorized},
+		{"expired", func(_ *url.URL, client *http.Client) {
+			alterFlow(t, client, srv, key, func(f *oidcFlow) { f.Expires = time.Now().Add(-time.Second).Unix() })
+		}, http.StatusBadRequest},
+		{"forged flow", func(_ *url.URL, client *http.Client) {
+			u, _ := url.Parse(srv.URL + authPrefix)
+			value, _ := signValue([]byte("other key"), oidcFlow{Expires: time.Now().Add(time.Minute).Unix()})
+			client.Jar.SetCookies(u, []*http.Cookie{{Name: oidcFlowCookie, Value: value, Path: authPrefix}})
+		}, http.StatusBadRequest},
+		{"no flow", func(_ *url.URL, client *http.Client) {
+			jar, _ := cookiejar.New(nil)
+			client.Jar = jar
+		}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := browser(t, false)
+			callback := startLogin(t, client, srv)
+			tt.alter(callback, client)
+			resp, _ := browse(t, client, callback.String())
+			if tt.wantCode == http.StatusOK {
+				if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/docs/" {
+					t.Fatalf("callback = %d %q", resp.StatusCode, resp.Header.Get("Location"))
+				}
+				return
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("callback = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			u, _ := url.Parse(srv.URL)
+			for _, c := range client.Jar.Cookies(u) {
+				if c.Name == sessionCookie {
+					t.Fatal("failed login started a session")
+				}
+			}
+		})
+	}
+}
+
+func Test_localPath(t *testing.T) {
+	tests := map[string]string{
+		"/docs/?x=1":            "/docs/?x=1",
+		"":                      "/",
+		"//evil.example/":       "/",
+		"/\\evil.example/":      "/",
+		"https://evil.example/": "/",
+		"docs":                  "/",
+	}
+	for next, want := range tests {
+		if got := localPath(next); got != want {
+			t.Errorf("localPath(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// TrustedProxies lists the reverse proxies whose X-Forwarded-For header is
+// believed when telling who the client of a request is.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies parses a comma-separated list of addresses and CIDR
+// ranges such as "10.0.0.0/8, ::1".
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) trusted(addr netip.Addr) bool {
+	for _, p := range t {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client of r. If the connection comes
+// from a trusted proxy, X-Forwarded-For is read from the right, skipping
+// further trusted proxies; entries to the left of the first untrusted
+// address could be made up by the client.
+func (t TrustedProxies) ClientIP(r *http.Request) netip.Addr {
+	addr := remoteAddr(r)
+	if !addr.IsValid() || !t.trusted(addr) {
+		return addr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !t.trusted(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// clientNet returns the address that limits count addr under. IPv6
+// clients usually have a whole /64, so that is what is counted.
+func clientNet(addr netip.Addr) netip.Addr {
+	if addr.Is6() {
+		return netip.PrefixFrom(addr, 64).Masked().Addr()
+	}
+	return addr
+}
+
+type clientIPKey struct{}
+
+func withClientIP(r *http.Request, addr netip.Addr) *http.Request {
+	if e := requestAccessEntry(r); e != nil {
+		e.addr = addr
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, addr))
+}
+
+// clientIP returns the client address of r as found by LimitHandler, or the
+// peer address if r did not pass through one.
+func clientIP(r *http.Request) netip.Addr {
+	if addr, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return addr
+	}
+	return remoteAddr(r)
+}
+
+// LimitHandler finds the client address of each request, behind Proxies,
+// and limits how fast each client may make requests. Reads and writes (see
+// writeLikeRequest) are limited separately; a nil limit lets everything
+// through.
+type LimitHandler struct {
+	Proxies TrustedProxies
+	Reads   *RateLimit
+	Writes  *RateLimit
+	Next    http.Handler
+}
+
+func (h *LimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr := h.Proxies.ClientIP(r)
+	r = withClientIP(r, addr)
+
+	limit := h.Reads
+	if writeLikeRequest(r) {
+		limit = h.Writes
+	}
+	if wait := limit.wait(clientNet(addr)); wait > 0 {
+		err := fmt.Errorf("rate limit exceeded, retry in %v", wait.Round(time.Millisecond))
+		tooManyRequests(w, wait, err)
+		log.Printf("limit %s %s %s - %d - %v", addr, r.Method, r.URL.Path, http.StatusTooManyRequests, err)
+		return
+	}
+	h.Next.ServeHTTP(w, r)
+}
+
+// RateLimit is a token bucket per client: each client may make Burst
+// requests at once, and Rate requests per second after that.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*rateClient
+	pruned  time.Time
+}
+
+type rateClient struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// wait returns how long the client at addr has to wait before its next
+// request is allowed, or 0 if it is allowed now.
+func (l *RateLimit) wait(addr netip.Addr) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	if l.clients == nil {
+		l.clients = map[netip.Addr]*rateClient{}
+	}
+	l.prune(now)
+	c := l.clients[addr]
+	if c == nil {
+		c = &rateClient{limiter: rate.NewLimiter(rate.Limit(l.Rate), l.Burst)}
+		l.clients[addr] = c
+	}
+	c.seen = now
+	l.mu.Unlock()
+
+	res := c.limiter.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Second
+	}
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// prune forgets clients whose bucket has filled up again, since a new
+// bucket for them would be the same.
+func (l *RateLimit) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	full := time.Minute
+	if l.Rate > 0 {
+		full = max(full, time.Duration(float64(l.Burst)/l.Rate*float64(time.Second)))
+	}
+	for addr, c := range l.clients {
+		if now.Sub(c.seen) > full {
+			delete(l.clients, addr)
+		}
+	}
+}
+
+// tooManyRequests answers 429 with a Retry-After of wait.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, err error) {
+	setRetryAfter(w, wait)
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// setRetryAfter sets Retry-After to wait, rounded up to whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(wait, time.Second).Seconds()))))
+}
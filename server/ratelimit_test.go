@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func Test_TrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"proxy", "10.1.2.3:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed", "10.1.2.3:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "192.168.1.1:5000", []string{"198.51.100.1, 10.0.0.2", "10.9.9.9"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3:5000", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"garbage", "10.1.2.3:5000", []string{"198.51.100.1, nonsense"}, "10.1.2.3"},
+		{"ipv6 proxy", "[::1]:5000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"mapped", "[::ffff:203.0.113.7]:5000", nil, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			if got := proxies.ClientIP(r); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("ClientIP = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+	if _, err := ParseTrustedProxies("proxy.local"); err == nil {
+		t.Error("host name accepted")
+	}
+}
+
+func Test_LimitHandler(t *testing.T) {
+	var seen netip.Addr
+	h := &LimitHandler{
+		Proxies: TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")},
+		Reads:   &RateLimit{Rate: 0.001, Burst: 3},
+		Writes:  &RateLimit{Rate: 0.001, Burst: 1},
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = clientIP(r)
+		}),
+	}
+	do := func(method, remote, forwarded string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		r.RemoteAddr = remote
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := do(http.MethodGet, "203.0.113.7:1", ""); w.Code != http.StatusOK {
+			t.Fatalf("read %d = %d", i, w.Code)
+		}
+	}
+	w := do(http.MethodGet, "203.0.113.7:1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("read over burst = %d, want 429", w.Code)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Fatalf("Retry-After = %q", w.Header().Get("Retry-After"))
+	}
+
+	// Writes have their own bucket.
+	if w := do(http.MethodPut, "203.0.113.7:1", ""); w.Code != http.StatusOK {
+		t.Fatalf("write = %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "203.0.113.7:1", ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second write = %d, want 429", w.Code)
+	}
+
+	// Clients behind a trusted proxy are told apart.
+	if w := do(http.MethodGet, "10.0.0.1:1", "198.51.100.1"); w.Code != http.StatusOK || seen != netip.MustParseAddr("198.51.100.1") {
+		t.Fatalf("read through proxy = %d as %v", w.Code, seen)
+	}
+	// An IPv6 client cannot dodge the limit by changing its interface ID.
+	for i := 0; i < 3; i++ {
+		do(http.MethodGet, "[2001:db8:1:2::"+strconv.Itoa(i+1)+"]:1", "")
+	}
+	if w := do(http.MethodGet, "[2001:db8:1:2::99]:1", ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("read from same /64 = %d, want 429", w.Code)
+	}
+}
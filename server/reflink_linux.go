@@ -0,0 +1,42 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request, _IOW(0x94, 9, int).
+const ficlone = 0x40049409
+
+// reflink makes dst share src's data blocks on copy-on-write filesystems
+// such as Btrfs and XFS. It fails when the filesystem cannot clone, and the
+// caller falls back to a regular copy.
+func reflink(dst, src *os.File) error {
+	dc, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+	sc, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	var srcErr error
+	err = dc.Control(func(dfd uintptr) {
+		srcErr = sc.Control(func(sfd uintptr) {
+			_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dfd, ficlone, sfd)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if srcErr != nil {
+		return srcErr
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only implemented on Linux; elsewhere copies fall back to
+// io.Copy.
+func reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
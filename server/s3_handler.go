@@ -0,0 +1,902 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+	// s3Dir holds the parts of in-progress multipart uploads inside
+	// Basedir. Like tusDir it is hidden from every other API.
+	s3Dir = ".s3"
+
+	s3MaxKeys     = 1000
+	s3MaxParts    = 10000
+	s3MinPartSize = 5 << 20
+
+	// s3MultipartExpiration is how long an abandoned multipart upload is
+	// kept before its parts are removed.
+	s3MultipartExpiration = 7 * 24 * time.Hour
+)
+
+// S3Handler exposes Basedir through a path-style subset of the Amazon S3
+// API. Top-level directories act as buckets and the paths below them as
+// object keys. Requests must be signed with AWS Signature Version 4 using
+// one of Credentials; requests without SigV4 credentials are passed to Next
+// so the regular API keeps working on the same port.
+type S3Handler struct {
+	Fs *FSHandler
+	// Credentials maps access key IDs to secret access keys.
+	Credentials map[string]string
+	Next        http.Handler
+
+	now func() time.Time
+}
+
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string { return e.code + ": " + e.message }
+
+func s3Err(status int, code, format string, args ...any) *s3Error {
+	return &s3Error{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+var (
+	errNoSuchBucket = s3Err(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	errNoSuchKey    = s3Err(http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+	errNoSuchUpload = s3Err(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+	errInternal     = s3Err(http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+)
+
+func (h *S3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isSigV4Request(r) {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+
+	err := h.serve(w, r)
+	code := http.StatusOK
+	if err != nil {
+		e := asS3Error(err)
+		code = e.status
+		writeS3Error(w, r, e)
+	}
+	logRequest(r, "s3", r.URL.Path, code, err)
+}
+
+// asS3Error returns the S3 error to answer err with. Unexpected errors,
+// which may name local paths, are only logged.
+func asS3Error(err error) *s3Error {
+	var e *s3Error
+	if !errors.As(err, &e) {
+		e = errInternal
+	}
+	return e
+}
+
+// changed records a change made through S3 like FSHandler records its own.
+func (h *S3Handler) changed(r *http.Request, e AuditEntry, err error) {
+	code := http.StatusOK
+	if err != nil {
+		code = asS3Error(err).status
+	}
+	h.Fs.changed(r, e, code, err)
+}
+
+func (h *S3Handler) serve(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now
+	if h.now != nil {
+		now = h.now
+	}
+	sig, err := verifySigV4(r, h.Credentials, now().UTC())
+	if err != nil {
+		if errors.Is(err, errSignatureMismatch) {
+			return s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "%v", err)
+		}
+		return s3Err(http.StatusForbidden, "AccessDenied", "%v", err)
+	}
+	body, err := sig.payloadReader(r.Body)
+	if err != nil {
+		return s3Err(http.StatusBadRequest, "InvalidRequest", "%v", err)
+	}
+
+	bucket, key, err := splitS3Path(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	user := sig.accessKey
+	r = withIdentity(r, identity{name: user})
+	if err := h.authorize(r, user, bucket, key); err != nil {
+		return err
+	}
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			return s3Err(http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+		}
+		return h.listBuckets(w, user)
+	}
+
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	if info, err := root.Stat(bucket); err != nil || !info.IsDir() {
+		return errNoSuchBucket
+	}
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			return nil
+		case r.Method == http.MethodGet && q.Has("location"):
+			return writeS3XML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				NS      string   `xml:"xmlns,attr"`
+			}{NS: s3Namespace})
+		case r.Method == http.MethodGet:
+			return h.listObjects(w, root, user, bucket, q)
+		}
+		return s3Err(http.StatusNotImplemented, "NotImplemented", "bucket operation not implemented")
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return h.getObject(w, r, root, bucket, key)
+	case http.MethodPut:
+		if q.Has("uploadId") {
+			return h.uploadPart(w, root, bucket, key, q, body)
+		}
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			return h.copyObject(w, r, root, bucket, key, src)
+		}
+		return h.putObject(w, r, root, bucket, key, body)
+	case http.MethodPost:
+		if q.Has("uploads") {
+			return h.createMultipartUpload(w, root, bucket, key)
+		}
+		if q.Has("uploadId") {
+			return h.completeMultipartUpload(w, r, root, bucket, key, q.Get("uploadId"), body)
+		}
+	case http.MethodDelete:
+		if q.Has("uploadId") {
+			return h.abortMultipartUpload(w, root, bucket, key, q.Get("uploadId"))
+		}
+		return h.deleteObject(w, r, root, bucket, key)
+	}
+	return s3Err(http.StatusNotImplemented, "NotImplemented", "object operation not implemented")
+}
+
+// splitS3Path splits a path-style request path into bucket and key. Keys
+// must not contain "." or ".." segments so that they cannot reach outside
+// their bucket.
+func splitS3Path(p string) (bucket, key string, err error) {
+	p = strings.TrimPrefix(p, "/")
+	bucket, key, _ = strings.Cut(p, "/")
+	if bucket == "" {
+		return "", "", nil
+	}
+	if bucket == "." || bucket == ".." || isInternalPath(bucket) {
+		return "", "", errNoSuchBucket
+	}
+	segments := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, seg := range segments {
+		if seg == "." || seg == ".." || (seg == "" && key != "") || strings.HasPrefix(seg, tempPrefix) {
+			return "", "", s3Err(http.StatusBadRequest, "InvalidArgument", "invalid object key %q", key)
+		}
+	}
+	return bucket, key, nil
+}
+
+// authorize applies FSHandler.ACL to a request, with the access key as the
+// user name. Listings are filtered separately.
+func (h *S3Handler) authorize(r *http.Request, user, bucket, key string) error {
+	if h.Fs.ACL == nil || bucket == "" {
+		return nil
+	}
+	perm := permRead
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		perm = permWrite
+	case http.MethodDelete:
+		perm = permDelete
+		if r.URL.Query().Has("uploadId") {
+			perm = permWrite
+		}
+	}
+	if !h.Fs.allowed(identity{name: user}, path.Join(bucket, key), perm) {
+		return s3Err(http.StatusForbidden, "AccessDenied", "Access Denied")
+	}
+
+	if src := r.Header.Get("X-Amz-Copy-Source"); src != "" && r.Method == http.MethodPut {
+		src, err := url.PathUnescape(src)
+		if err != nil {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid copy source")
+		}
+		src, _, _ = strings.Cut(src, "?")
+		srcBucket, srcKey, err := splitS3Path("/" + strings.TrimPrefix(src, "/"))
+		if err != nil {
+			return err
+		}
+		if !h.Fs.allowed(identity{name: user}, toRelPath(path.Join(srcBucket, srcKey)), permRead) {
+			return s3Err(http.StatusForbidden, "AccessDenied", "Access Denied")
+		}
+	}
+	return nil
+}
+
+func (h *S3Handler) listBuckets(w http.ResponseWriter, user string) error {
+	infos, err := h.Fs.readDir("/")
+	if err != nil {
+		return err
+	}
+	infos = h.Fs.filterReadable(identity{name: user}, ".", infos)
+	type bucket struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		NS      string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID          string `xml:"ID"`
+			DisplayName string `xml:"DisplayName"`
+		} `xml:"Owner"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{NS: s3Namespace}
+	result.Owner.ID = "fileserver"
+	result.Owner.DisplayName = "fileserver"
+	for _, info := range infos {
+		if info.IsDir {
+			result.Buckets = append(result.Buckets, bucket{Name: info.Name, CreationDate: s3Time(info.ModTime)})
+		}
+	}
+	return writeS3XML(w, http.StatusOK, result)
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listObjects implements ListObjectsV2 (list-type=2) and the original
+// ListObjects, which differ only in how pagination is expressed.
+func (h *S3Handler) listObjects(w http.ResponseWriter, root *os.Root, user, bucket string, q url.Values) error {
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	// The directory part of the prefix is where the listing starts, so it
+	// must not climb out of the bucket.
+	for _, seg := range strings.Split(prefix, "/") {
+		if seg == ".." {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid prefix %q", prefix)
+		}
+	}
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid max-keys %q", v)
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+
+	v2 := q.Get("list-type") == "2"
+	marker := q.Get("marker")
+	if v2 {
+		marker = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid continuation token")
+			}
+			marker = string(b)
+		}
+	}
+
+	readable := func(p string) bool { return h.Fs.allowed(identity{name: user}, p, permRead) }
+	objects, err := collectS3Objects(root, bucket, prefix, delimiter == "/", readable)
+	if err != nil {
+		return err
+	}
+
+	// Group keys by delimiter, then page through keys and common prefixes
+	// together in lexical order, as S3 does.
+	type entry struct {
+		name   string
+		object *s3Object
+	}
+	var entries []entry
+	seen := map[string]bool{}
+	for i := range objects {
+		o := &objects[i]
+		if !strings.HasPrefix(o.Key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(o.Key[len(prefix):], delimiter); i >= 0 {
+				cp := o.Key[:len(prefix)+i+len(delimiter)]
+				if !seen[cp] {
+					seen[cp] = true
+					entries = append(entries, entry{name: cp})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{name: o.Key, object: o})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].name > marker })
+	entries = entries[start:]
+	truncated := len(entries) > maxKeys
+	if truncated {
+		entries = entries[:maxKeys]
+	}
+
+	type result struct {
+		XMLName               xml.Name   `xml:"ListBucketResult"`
+		NS                    string     `xml:"xmlns,attr"`
+		Name                  string     `xml:"Name"`
+		Prefix                string     `xml:"Prefix"`
+		Delimiter             string     `xml:"Delimiter,omitempty"`
+		MaxKeys               int        `xml:"MaxKeys"`
+		IsTruncated           bool       `xml:"IsTruncated"`
+		Marker                *string    `xml:"Marker,omitempty"`
+		NextMarker            string     `xml:"NextMarker,omitempty"`
+		KeyCount              *int       `xml:"KeyCount,omitempty"`
+		StartAfter            string     `xml:"StartAfter,omitempty"`
+		ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+		Contents              []s3Object `xml:"Contents"`
+		CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+	}
+	res := result{
+		NS:          s3Namespace,
+		Name:        bucket,
+		Prefix:      prefix,
+		Delimiter:   delimiter,
+		MaxKeys:     maxKeys,
+		IsTruncated: truncated,
+	}
+	for _, e := range entries {
+		if e.object != nil {
+			res.Contents = append(res.Contents, *e.object)
+		} else {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{Prefix: e.name})
+		}
+	}
+	var last string
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].name
+	}
+	if v2 {
+		count := len(entries)
+		res.KeyCount = &count
+		res.StartAfter = q.Get("start-after")
+		res.ContinuationToken = q.Get("continuation-token")
+		if truncated {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		res.Marker = &marker
+		if truncated {
+			res.NextMarker = last
+		}
+	}
+	return writeS3XML(w, http.StatusOK, res)
+}
+
+// collectS3Objects lists the objects of a bucket below the directory part
+// of prefix. With shallow set (delimiter "/"), subdirectories are not
+// descended into and are returned as "dir/" keys so that they group into
+// common prefixes; otherwise only empty directories are returned that way.
+// Entries for which readable returns false are left out.
+func collectS3Objects(root *os.Root, bucket, prefix string, shallow bool, readable func(string) bool) ([]s3Object, error) {
+	start := bucket
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = path.Join(bucket, prefix[:i])
+	}
+	var objects []s3Object
+	err := fs.WalkDir(root.FS(), start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == start && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			if p == start {
+				return err
+			}
+			log.Printf("s3 list %q error %v", p, err)
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		if p != start && !readable(p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		key := strings.TrimPrefix(p, bucket+"/")
+		if d.IsDir() {
+			if p == start || p == bucket {
+				return nil
+			}
+			if shallow {
+				objects = append(objects, s3Object{Key: key + "/"})
+				return fs.SkipDir
+			}
+			if entries, err := fs.ReadDir(root.FS(), p); err == nil && len(entries) == 0 {
+				info, _ := d.Info()
+				objects = append(objects, newS3Object(key+"/", info))
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		objects = append(objects, newS3Object(key, info))
+		return nil
+	})
+	return objects, err
+}
+
+func newS3Object(key string, info fs.FileInfo) s3Object {
+	o := s3Object{Key: key, StorageClass: "STANDARD"}
+	if info != nil {
+		o.LastModified = s3Time(info.ModTime())
+		o.ETag = s3ETag(info)
+		if !info.IsDir() {
+			o.Size = info.Size()
+		}
+	}
+	return o
+}
+
+// s3ETag derives an ETag from size and modification time. Computing a real
+// MD5 would mean reading every file on every listing, so the ETag takes the
+// multipart form ("-1" suffix), which clients do not compare to an MD5.
+func s3ETag(info fs.FileInfo) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())))
+	return `"` + hex.EncodeToString(sum[:]) + `-1"`
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (h *S3Handler) getObject(w http.ResponseWriter, r *http.Request, root *os.Root, bucket, key string) error {
+	rel := path.Join(bucket, key)
+	if strings.HasSuffix(key, "/") {
+		info, err := root.Stat(rel)
+		if err != nil || !info.IsDir() {
+			return errNoSuchKey
+		}
+		w.Header().Set("Content-Type", "application/x-directory")
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		return nil
+	}
+
+	f, err := root.Open(rel)
+	if err != nil {
+		return errNoSuchKey
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return errNoSuchKey
+	}
+
+	w.Header().Set("ETag", s3ETag(info))
+	w.Header().Set("Accept-Ranges", "bytes")
+	// ServeContent takes care of Range, If-Modified-Since and HEAD.
+	http.ServeContent(w, r, key, info.ModTime(), f)
+	return nil
+}
+
+func (h *S3Handler) putObject(w http.ResponseWriter, r *http.Request, root *os.Root, bucket, key string, body io.Reader) (err error) {
+	rel := path.Join(bucket, key)
+	info, statErr := root.Stat(rel)
+	if strings.HasSuffix(key, "/") {
+		// Folder marker objects map to directories.
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return s3Err(http.StatusBadRequest, "IncompleteBody", "%v", err)
+		}
+		if statErr != nil {
+			defer func() { h.changed(r, AuditEntry{Action: "mkdir", Path: h.Fs.auditPath(rel)}, err) }()
+		}
+		if err := root.MkdirAll(rel, os.ModePerm); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	e := AuditEntry{Action: "upload", Path: h.Fs.auditPath(rel)}
+	if statErr == nil {
+		if info.IsDir() {
+			return s3Err(http.StatusConflict, "InvalidRequest", "%q is a directory", key)
+		}
+		e.Action = "overwrite"
+	}
+	defer func() { h.changed(r, e, err) }()
+	if err := root.MkdirAll(path.Dir(rel), os.ModePerm); err != nil {
+		return err
+	}
+
+	sum := md5.New()
+	src := io.TeeReader(body, sum)
+	audit := h.Fs.auditHasher()
+	if audit != nil {
+		src = io.TeeReader(src, audit)
+	}
+	err = h.Fs.overwrite(root, rel, info, func() error {
+		n, err := writeFileAtomic(root, rel, src)
+		if err != nil {
+			return s3Err(http.StatusBadRequest, "IncompleteBody", "%v", err)
+		}
+		e.Size = n
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	e.SHA256 = hexSum(audit)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *S3Handler) copyObject(w http.ResponseWriter, r *http.Request, root *os.Root, bucket, key, source string) (err error) {
+	source, err = url.PathUnescape(source)
+	if err != nil {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid copy source")
+	}
+	source, _, _ = strings.Cut(source, "?")
+	srcBucket, srcKey, err := splitS3Path("/" + strings.TrimPrefix(source, "/"))
+	if err != nil {
+		return err
+	}
+	if srcBucket == "" || srcKey == "" {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid copy source %q", source)
+	}
+	rel := path.Join(bucket, key)
+	defer func() {
+		h.changed(r, AuditEntry{Action: "copy", Path: h.Fs.auditPath(path.Join(srcBucket, srcKey)), To: h.Fs.auditPath(rel)}, err)
+	}()
+
+	src, err := root.Open(path.Join(srcBucket, srcKey))
+	if err != nil {
+		return errNoSuchKey
+	}
+	defer src.Close()
+	if info, err := src.Stat(); err != nil || !info.Mode().IsRegular() {
+		return errNoSuchKey
+	}
+
+	var old fs.FileInfo
+	if info, err := root.Stat(rel); err == nil {
+		if info.IsDir() {
+			return s3Err(http.StatusConflict, "InvalidRequest", "%q is a directory", key)
+		}
+		old = info
+	}
+	if err := root.MkdirAll(path.Dir(rel), os.ModePerm); err != nil {
+		return err
+	}
+	err = h.Fs.overwrite(root, rel, old, func() error {
+		_, err := writeFileAtomic(root, rel, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	info, err := root.Stat(rel)
+	if err != nil {
+		return err
+	}
+	return writeS3XML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		NS           string   `xml:"xmlns,attr"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{NS: s3Namespace, LastModified: s3Time(info.ModTime()), ETag: s3ETag(info)})
+}
+
+func (h *S3Handler) deleteObject(w http.ResponseWriter, r *http.Request, root *os.Root, bucket, key string) (err error) {
+	rel := path.Join(bucket, key)
+	e := AuditEntry{Action: "delete", Path: h.Fs.auditPath(rel)}
+	if !h.Fs.AllowDelete {
+		err = s3Err(http.StatusForbidden, "AccessDenied", "delete is disabled")
+		h.changed(r, e, err)
+		return err
+	}
+	info, err := root.Stat(rel)
+	switch {
+	case err != nil:
+		// Deleting a missing key succeeds in S3.
+	case info.IsDir():
+		// A directory is only an object as a "dir/" folder marker, and it
+		// only goes away once it is empty.
+		if strings.HasSuffix(key, "/") && root.Remove(rel) == nil {
+			h.changed(r, e, nil)
+		}
+	default:
+		err := h.Fs.discard(root, rel, info, logUser(r))
+		h.changed(r, e, err)
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3Multipart struct {
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+func s3UploadDir(id string) string { return s3Dir + "/" + id }
+
+// newS3UploadID returns a random multipart upload ID, which also names the
+// directory of its parts.
+func newS3UploadID() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func validS3UploadID(id string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && len(b) == 24
+}
+
+func (h *S3Handler) loadMultipart(root *os.Root, bucket, key, id string) error {
+	if !validS3UploadID(id) {
+		return errNoSuchUpload
+	}
+	b, err := root.ReadFile(s3UploadDir(id) + "/upload.json")
+	if err != nil {
+		return errNoSuchUpload
+	}
+	var m s3Multipart
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if m.Bucket != bucket || m.Key != key {
+		return errNoSuchUpload
+	}
+	return nil
+}
+
+func (h *S3Handler) createMultipartUpload(w http.ResponseWriter, root *os.Root, bucket, key string) error {
+	purgeS3Multipart(root)
+
+	id, err := newS3UploadID()
+	if err != nil {
+		return err
+	}
+	if err := root.MkdirAll(s3UploadDir(id), os.ModePerm); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(s3Multipart{Bucket: bucket, Key: key, Created: time.Now()})
+	if err := root.WriteFile(s3UploadDir(id)+"/upload.json", b, 0600); err != nil {
+		return err
+	}
+	return writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		NS       string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{NS: s3Namespace, Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (h *S3Handler) uploadPart(w http.ResponseWriter, root *os.Root, bucket, key string, q url.Values, body io.Reader) error {
+	id := q.Get("uploadId")
+	if err := h.loadMultipart(root, bucket, key, id); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || n < 1 || n > s3MaxParts {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid part number %q", q.Get("partNumber"))
+	}
+
+	sum := md5.New()
+	if _, err := writeFileAtomic(root, s3UploadDir(id)+"/"+strconv.Itoa(n), io.TeeReader(body, sum)); err != nil {
+		return s3Err(http.StatusBadRequest, "IncompleteBody", "%v", err)
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum.Sum(nil))+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *S3Handler) completeMultipartUpload(w http.ResponseWriter, r *http.Request, root *os.Root, bucket, key, id string, body io.Reader) (err error) {
+	if err := h.loadMultipart(root, bucket, key, id); err != nil {
+		return err
+	}
+	rel := path.Join(bucket, key)
+	e := AuditEntry{Action: "upload", Path: h.Fs.auditPath(rel)}
+	var old fs.FileInfo
+	if info, err := root.Stat(rel); err == nil && !info.IsDir() {
+		e.Action = "overwrite"
+		old = info
+	}
+	defer func() { h.changed(r, e, err) }()
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(body, 1<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return s3Err(http.StatusBadRequest, "MalformedXML", "invalid CompleteMultipartUpload body")
+	}
+
+	// Validate every part before assembling anything.
+	var readers []io.Reader
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+	combined := md5.New()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			return s3Err(http.StatusBadRequest, "InvalidPartOrder", "parts must be in ascending order")
+		}
+		f, err := root.Open(s3UploadDir(id) + "/" + strconv.Itoa(part.PartNumber))
+		if err != nil {
+			return s3Err(http.StatusBadRequest, "InvalidPart", "part %d not found", part.PartNumber)
+		}
+		closers = append(closers, f)
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if i < len(req.Parts)-1 && info.Size() < s3MinPartSize {
+			return s3Err(http.StatusBadRequest, "EntityTooSmall", "part %d is smaller than 5 MiB", part.PartNumber)
+		}
+		sum := md5.New()
+		if _, err := io.Copy(sum, f); err != nil {
+			return err
+		}
+		if strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum.Sum(nil)) {
+			return s3Err(http.StatusBadRequest, "InvalidPart", "ETag mismatch for part %d", part.PartNumber)
+		}
+		combined.Write(sum.Sum(nil))
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		readers = append(readers, f)
+	}
+
+	if err := root.MkdirAll(path.Dir(rel), os.ModePerm); err != nil {
+		return err
+	}
+	src := io.MultiReader(readers...)
+	audit := h.Fs.auditHasher()
+	if audit != nil {
+		src = io.TeeReader(src, audit)
+	}
+	err = h.Fs.overwrite(root, rel, old, func() error {
+		var err error
+		e.Size, err = writeFileAtomic(root, rel, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	e.SHA256 = hexSum(audit)
+	_ = root.RemoveAll(s3UploadDir(id))
+
+	return writeS3XML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		NS      string   `xml:"xmlns,attr"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{NS: s3Namespace, Bucket: bucket, Key: key, ETag: fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(combined.Sum(nil)), len(req.Parts))})
+}
+
+// purgeS3Multipart removes multipart uploads that were neither completed nor
+// aborted within s3MultipartExpiration.
+func purgeS3Multipart(root *os.Root) {
+	dir, err := root.Open(s3Dir)
+	if err != nil {
+		return
+	}
+	names, _ := dir.Readdirnames(-1)
+	dir.Close()
+
+	for _, id := range names {
+		b, err := root.ReadFile(s3UploadDir(id) + "/upload.json")
+		if err != nil {
+			continue
+		}
+		var m s3Multipart
+		if json.Unmarshal(b, &m) != nil || time.Since(m.Created) > s3MultipartExpiration {
+			_ = root.RemoveAll(s3UploadDir(id))
+		}
+	}
+}
+
+func (h *S3Handler) abortMultipartUpload(w http.ResponseWriter, root *os.Root, bucket, key, id string) error {
+	if err := h.loadMultipart(root, bucket, key, id); err != nil {
+		return err
+	}
+	if err := root.RemoveAll(s3UploadDir(id)); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v any) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(b)
+	return nil
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.status)
+		return
+	}
+	_ = writeS3XML(w, e.status, struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string   `xml:"Code"`
+		Message   string   `xml:"Message"`
+		Resource  string   `xml:"Resource"`
+		RequestID string   `xml:"RequestId"`
+	}{Code: e.code, Message: e.message, Resource: r.URL.Path, RequestID: hex.EncodeToString(id)})
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm    = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat   = "20060102T150405Z"
+	sigV4MaxClockSkew = 15 * time.Minute
+
+	unsignedPayload        = "UNSIGNED-PAYLOAD"
+	streamingSignedPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrail = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxChunkSize bounds how much of a signed aws-chunked body is buffered
+	// while its chunk signature is checked.
+	maxChunkSize = 16 << 20
+)
+
+var errSignatureMismatch = errors.New("signature does not match")
+
+// sigV4Request holds the parts of a SigV4 authorization needed to verify
+// the request and, for streaming uploads, its chunk signatures.
+type sigV4Request struct {
+	accessKey     string
+	date          string // yyyymmdd
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	signingKey    []byte
+}
+
+func (s *sigV4Request) scope() string {
+	return s.date + "/" + s.region + "/" + s.service + "/aws4_request"
+}
+
+// isSigV4Request reports whether r carries AWS Signature Version 4
+// credentials, either in the Authorization header or as a presigned URL.
+func isSigV4Request(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ") ||
+		r.URL.Query().Get("X-Amz-Algorithm") == sigV4Algorithm
+}
+
+// verifySigV4 checks the request signature using the secret for its access
+// key. The payload itself is verified later, while the body is consumed.
+func verifySigV4(r *http.Request, secrets map[string]string, now time.Time) (*sigV4Request, error) {
+	var s *sigV4Request
+	var err error
+	presigned := r.Header.Get("Authorization") == ""
+	if presigned {
+		s, err = parsePresigned(r.URL.Query(), now)
+	} else {
+		s, err = parseAuthorization(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, ok := secrets[s.accessKey]
+	if !ok {
+		return nil, fmt.Errorf("unknown access key %q", s.accessKey)
+	}
+
+	t, err := time.Parse(sigV4TimeFormat, s.amzDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Amz-Date %q", s.amzDate)
+	}
+	if !strings.HasPrefix(s.amzDate, s.date) {
+		return nil, errors.New("credential date does not match X-Amz-Date")
+	}
+	if !presigned && (now.Sub(t) > sigV4MaxClockSkew || t.Sub(now) > sigV4MaxClockSkew) {
+		return nil, errors.New("request time too skewed")
+	}
+
+	s.signingKey = sigV4SigningKey(secret, s.date, s.region, s.service)
+	canonical := canonicalRequest(r, s, presigned)
+	expected := hex.EncodeToString(hmacSHA256(s.signingKey, stringToSign(s, canonical)))
+	if !hmac.Equal([]byte(expected), []byte(s.signature)) {
+		return nil, errSignatureMismatch
+	}
+	return s, nil
+}
+
+func parseAuthorization(r *http.Request) (*sigV4Request, error) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" ")
+	s := &sigV4Request{
+		amzDate:     r.Header.Get("X-Amz-Date"),
+		payloadHash: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	if s.amzDate == "" {
+		if d, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+			s.amzDate = d.UTC().Format(sigV4TimeFormat)
+		}
+	}
+	if s.payloadHash == "" {
+		return nil, errors.New("missing X-Amz-Content-Sha256")
+	}
+
+	var credential, signedHeaders string
+	for _, field := range strings.Split(auth, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch k {
+		case "Credential":
+			credential = v
+		case "SignedHeaders":
+			signedHeaders = v
+		case "Signature":
+			s.signature = v
+		}
+	}
+	if err := s.setCredential(credential); err != nil {
+		return nil, err
+	}
+	if signedHeaders == "" || s.signature == "" {
+		return nil, errors.New("malformed Authorization header")
+	}
+	s.signedHeaders = strings.Split(signedHeaders, ";")
+	return s, nil
+}
+
+func parsePresigned(q url.Values, now time.Time) (*sigV4Request, error) {
+	s := &sigV4Request{
+		amzDate:     q.Get("X-Amz-Date"),
+		signature:   q.Get("X-Amz-Signature"),
+		payloadHash: unsignedPayload,
+	}
+	if err := s.setCredential(q.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	if q.Get("X-Amz-SignedHeaders") == "" || s.signature == "" {
+		return nil, errors.New("malformed presigned URL")
+	}
+	s.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 1 || expires > 7*24*3600 {
+		return nil, errors.New("invalid X-Amz-Expires")
+	}
+	t, err := time.Parse(sigV4TimeFormat, s.amzDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Amz-Date %q", s.amzDate)
+	}
+	if now.After(t.Add(time.Duration(expires)*time.Second)) || t.Sub(now) > sigV4MaxClockSkew {
+		return nil, errors.New("presigned URL expired")
+	}
+	return s, nil
+}
+
+func (s *sigV4Request) setCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return fmt.Errorf("malformed credential %q", credential)
+	}
+	s.accessKey, s.date, s.region, s.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+func canonicalRequest(r *http.Request, s *sigV4Request, presigned bool) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(awsURIEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(r.URL.RawQuery, presigned))
+	b.WriteByte('\n')
+	for _, name := range s.signedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(canonicalHeaderValue(r, name))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(s.signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(s.payloadHash)
+	return b.String()
+}
+
+func canonicalQuery(rawQuery string, presigned bool) string {
+	type pair struct{ k, v string }
+	var pairs []pair
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(part, "=")
+		k, _ = url.QueryUnescape(k)
+		v, _ = url.QueryUnescape(v)
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		pairs = append(pairs, pair{awsURIEncode(k, true), awsURIEncode(v, true)})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+		return pairs[i].v < pairs[j].v
+	})
+	encoded := make([]string, len(pairs))
+	for i, p := range pairs {
+		encoded[i] = p.k + "=" + p.v
+	}
+	return strings.Join(encoded, "&")
+}
+
+func canonicalHeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		if v := r.Header.Get("Content-Length"); v != "" {
+			values = []string{v}
+		}
+	default:
+		values = r.Header.Values(name)
+	}
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, and
+// optionally "/", as SigV4 requires.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func stringToSign(s *sigV4Request, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return sigV4Algorithm + "\n" + s.amzDate + "\n" + s.scope() + "\n" + hex.EncodeToString(sum[:])
+}
+
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// payloadReader returns a reader for the request body that decodes
+// aws-chunked uploads and fails at EOF if the body does not match the
+// signed payload hash.
+func (s *sigV4Request) payloadReader(body io.Reader) (io.Reader, error) {
+	switch s.payloadHash {
+	case unsignedPayload:
+		return body, nil
+	case streamingSignedPayload:
+		return &chunkedReader{r: bufio.NewReader(body), sig: s, prevSignature: s.signature}, nil
+	case streamingUnsignedTrail:
+		return &chunkedReader{r: bufio.NewReader(body)}, nil
+	}
+	if strings.HasPrefix(s.payloadHash, "STREAMING-") {
+		return nil, fmt.Errorf("unsupported payload type %q", s.payloadHash)
+	}
+	want, err := hex.DecodeString(s.payloadHash)
+	if err != nil || len(want) != sha256.Size {
+		return nil, fmt.Errorf("invalid X-Amz-Content-Sha256 %q", s.payloadHash)
+	}
+	return &hashingReader{r: body, h: sha256.New(), want: want}, nil
+}
+
+// hashingReader verifies the SHA-256 of everything read once r is drained.
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(h.h.Sum(nil), h.want) {
+		return n, errors.New("payload does not match X-Amz-Content-Sha256")
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body. When sig is set every chunk
+// signature is checked before its data is released.
+type chunkedReader struct {
+	r             *bufio.Reader
+	sig           *sigV4Request
+	prevSignature string
+	buf           []byte
+	done          bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return fmt.Errorf("invalid chunk size %q", sizeHex)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+
+	if c.sig != nil {
+		chunkSig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return errors.New("missing chunk signature")
+		}
+		sum := sha256.Sum256(data)
+		toSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.amzDate + "\n" + c.sig.scope() + "\n" +
+			c.prevSignature + "\n" + emptySHA256 + "\n" + hex.EncodeToString(sum[:])
+		expected := hex.EncodeToString(hmacSHA256(c.sig.signingKey, toSign))
+		if !hmac.Equal([]byte(expected), []byte(chunkSig)) {
+			return errSignatureMismatch
+		}
+		c.prevSignature = chunkSig
+	}
+
+	if size == 0 {
+		// Skip optional trailing headers up to the terminating blank line.
+		for {
+			line, err := c.readLine()
+			if err != nil || line == "" {
+				break
+			}
+		}
+		c.done = true
+		return nil
+	}
+	if _, err := c.readLine(); err != nil {
+		return err
+	}
+	c.buf = data
+	return nil
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
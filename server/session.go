@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authPrefix is where the login and logout endpoints live.
+	authPrefix = "/_auth/"
+
+	sessionCookie      = "fileserver_session"
+	defaultSessionTTL  = 12 * time.Hour
+	defaultSessionIdle = time.Hour
+
+	// sessionRefresh is how often the cookie of an active session is
+	// re-issued to push back its idle timeout.
+	sessionRefresh = time.Minute
+
+	// csrfHeader carries the CSRF token of the session on state-changing
+	// requests from the UI.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Sessions issues and checks the signed cookies that keep browser users
+// logged in. The cookie carries the user's name, groups and expiry, so the
+// only state kept on the server is the list of sessions that were logged
+// out before they expired.
+type Sessions struct {
+	// Key signs session cookies. If empty, a random key is used, so that
+	// all sessions end when the server restarts.
+	Key []byte
+	// TTL is how long a session lasts at most, however active it is; 0
+	// means defaultSessionTTL.
+	TTL time.Duration
+	// IdleTimeout ends sessions that make no request for that long; 0
+	// means defaultSessionIdle.
+	IdleTimeout time.Duration
+
+	keyOnce sync.Once
+	key     []byte
+
+	mu      sync.Mutex
+	revoked map[string]int64 // session id -> deadline
+}
+
+type sessionData struct {
+	ID     string   `json:"i"`
+	Name   string   `json:"n"`
+	Groups []string `json:"g,omitempty"`
+	// Expires is the idle timeout, Deadline the absolute one.
+	Expires  int64 `json:"e"`
+	Deadline int64 `json:"d"`
+}
+
+func (s *Sessions) signingKey() []byte {
+	s.keyOnce.Do(func() {
+		s.key = s.Key
+		if len(s.key) == 0 {
+			s.key = make([]byte, 32)
+			if _, err := rand.Read(s.key); err != nil {
+				panic(err)
+			}
+		}
+	})
+	return s.key
+}
+
+func (s *Sessions) ttl() time.Duration {
+	if s.TTL > 0 {
+		return s.TTL
+	}
+	return defaultSessionTTL
+}
+
+func (s *Sessions) idle() time.Duration {
+	if s.IdleTimeout > 0 {
+		return s.IdleTimeout
+	}
+	return defaultSessionIdle
+}
+
+// start logs id in by setting the session cookie.
+func (s *Sessions) start(w http.ResponseWriter, r *http.Request, id identity) error {
+	data := sessionData{
+		ID:       randomString(),
+		Name:     id.name,
+		Groups:   id.groups,
+		Deadline: time.Now().Add(s.ttl()).Unix(),
+	}
+	return s.issue(w, r, &data)
+}
+
+// issue sets the session cookie for data, expiring after the idle timeout.
+func (s *Sessions) issue(w http.ResponseWriter, r *http.Request, data *sessionData) error {
+	data.Expires = min(time.Now().Add(s.idle()).Unix(), data.Deadline)
+	value, err := signValue(s.signingKey(), data)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  time.Unix(data.Expires, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// end logs the user out by clearing the session cookie. The session is
+// revoked too, so that copies of the cookie stop working.
+func (s *Sessions) end(w http.ResponseWriter, r *http.Request) {
+	if data, ok := s.session(r); ok {
+		s.mu.Lock()
+		now := time.Now().Unix()
+		for id, deadline := range s.revoked {
+			if now >= deadline {
+				delete(s.revoked, id)
+			}
+		}
+		if s.revoked == nil {
+			s.revoked = map[string]int64{}
+		}
+		s.revoked[data.ID] = data.Deadline
+		s.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// identity returns the logged-in user of r and the CSRF token of the
+// session, if its session cookie is valid. The cookie of an active session
+// is re-issued on w to push back its idle timeout.
+func (s *Sessions) identity(w http.ResponseWriter, r *http.Request) (identity, string, bool) {
+	data, ok := s.session(r)
+	if !ok {
+		return identity{}, "", false
+	}
+	issued := time.Unix(data.Expires, 0).Add(-s.idle())
+	if time.Since(issued) > sessionRefresh && data.Expires < data.Deadline {
+		s.issue(w, r, data)
+	}
+	return identity{name: data.Name, groups: data.Groups}, s.csrfToken(data), true
+}
+
+// session returns the session of r, if its session cookie is valid.
+func (s *Sessions) session(r *http.Request) (*sessionData, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	var data sessionData
+	if err := verifyValue(s.signingKey(), c.Value, &data); err != nil {
+		return nil, false
+	}
+	now := time.Now().Unix()
+	if data.Name == "" || now >= data.Expires || now >= data.Deadline {
+		return nil, false
+	}
+	s.mu.Lock()
+	_, revoked := s.revoked[data.ID]
+	s.mu.Unlock()
+	if revoked {
+		return nil, false
+	}
+	return &data, true
+}
+
+// csrfToken returns the token that state-changing requests made with the
+// session must carry in csrfHeader. Other sites can make the browser send
+// the cookie, but cannot read the token.
+func (s *Sessions) csrfToken(data *sessionData) string {
+	return base64.RawURLEncoding.EncodeToString(macOf(s.signingKey(), "csrf\n"+data.ID))
+}
+
+type csrfKey struct{}
+
+func withCSRFToken(r *http.Request, token string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), csrfKey{}, token))
+}
+
+// requestCSRFToken returns the CSRF token of the session r was made with,
+// or "" if it was not authenticated by a session.
+func requestCSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfKey{}).(string)
+	return token
+}
+
+// loginURL returns the URL that logs in and then returns to next.
+func loginURL(next string) string {
+	return authPrefix + "login?next=" + url.QueryEscape(next)
+}
+
+// signValue encodes v as JSON and appends an HMAC, for values that clients
+// keep but must not alter, such as cookies.
+func signValue(key []byte, v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(macOf(key, payload)), nil
+}
+
+// verifyValue checks a value produced by signValue and decodes it into v.
+func verifyValue(key []byte, s string, v any) error {
+	payload, sig, ok := strings.Cut(s, ".")
+	if !ok {
+		return errors.New("malformed signed value")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, macOf(key, payload)) {
+		return errors.New("invalid signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func macOf(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sessionRequest(value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+	return r
+}
+
+func Test_Sessions(t *testing.T) {
+	s := &Sessions{Key: []byte("test key")}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := s.start(w, r, identity{name: "dana", groups: []string{"ops"}}); err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != sessionCookie || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unexpected cookie %+v", cookie)
+	}
+
+	identify := func(value string) (identity, string, bool) {
+		return s.identity(httptest.NewRecorder(), sessionRequest(value))
+	}
+	id, csrf, ok := identify(cookie.Value)
+	if !ok || id.name != "dana" || !slices.Equal(id.groups, []string{"ops"}) || csrf == "" {
+		t.Fatalf("identity = %+v %q %v", id, csrf, ok)
+	}
+
+	// Changing the payload, say to add a group, breaks the signature.
+	forged, err := signValue([]byte("other key"), sessionData{Name: "dana", Groups: []string{"admin"}, Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _, _ := strings.Cut(forged, ".")
+	_, sig, _ := strings.Cut(cookie.Value, ".")
+	for _, value := range []string{forged, payload + "." + sig, cookie.Value + "x", "", "garbage"} {
+		if id, _, ok := identify(value); ok {
+			t.Errorf("session %q accepted as %+v", value, id)
+		}
+	}
+
+	// A session does not survive a change of key, e.g. a restart with a
+	// random one.
+	if _, _, ok := (&Sessions{}).identity(httptest.NewRecorder(), sessionRequest(cookie.Value)); ok {
+		t.Error("session accepted with another key")
+	}
+
+	w = httptest.NewRecorder()
+	s.end(w, r)
+	if c := w.Result().Cookies()[0]; c.Name != sessionCookie || c.MaxAge >= 0 {
+		t.Fatalf("end set %+v", c)
+	}
+}
+
+func Test_Sessions_timeouts(t *testing.T) {
+	s := &Sessions{Key: []byte("test key"), TTL: 8 * time.Hour, IdleTimeout: 30 * time.Minute}
+	now := time.Now()
+	cookie := func(expires, deadline time.Time) string {
+		value, err := signValue(s.signingKey(), sessionData{ID: "1", Name: "dana", Expires: expires.Unix(), Deadline: deadline.Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	tests := []struct {
+		name              string
+		expires, deadline time.Time
+		wantOK            bool
+		wantRefresh       bool
+	}{
+		{"fresh", now.Add(30 * time.Minute), now.Add(8 * time.Hour), true, false},
+		{"active", now.Add(20 * time.Minute), now.Add(8 * time.Hour), true, true},
+		{"idle", now.Add(-time.Second), now.Add(8 * time.Hour), false, false},
+		{"absolute", now.Add(20 * time.Minute), now.Add(-time.Second), false, false},
+		// Near the deadline the idle timeout is not pushed past it.
+		{"last minutes", now.Add(10 * time.Minute), now.Add(10 * time.Minute), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			_, _, ok := s.identity(w, sessionRequest(cookie(tt.expires, tt.deadline)))
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			cookies := w.Result().Cookies()
+			if refreshed := len(cookies) > 0; refreshed != tt.wantRefresh {
+				t.Fatalf("refreshed = %v, want %v", refreshed, tt.wantRefresh)
+			}
+			if tt.wantRefresh {
+				var data sessionData
+				if err := verifyValue(s.signingKey(), cookies[0].Value, &data); err != nil {
+					t.Fatal(err)
+				}
+				if got := time.Unix(data.Expires, 0); got.Before(now.Add(29*time.Minute)) || data.Deadline != tt.deadline.Unix() {
+					t.Fatalf("refreshed to %v, deadline %v", got, time.Unix(data.Deadline, 0))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,575 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sharePrefix = "/_shares"
+
+	// shareDir holds share records and the signing key inside Basedir. It is
+	// hidden from listings and cannot be reached through the file API.
+	shareDir     = ".shares"
+	shareKeyPath = shareDir + "/key"
+
+	// shareCookie carries the token of a shared directory to the requests
+	// made while browsing it, which do not repeat the query parameter.
+	shareCookie = "fileserver_share"
+
+	defaultShareExpiration = 24 * time.Hour
+	maxShareRequest        = 64 << 10
+)
+
+// ShareHandler mints and manages share links: URLs carrying an HMAC-signed
+// token that lets anyone read a single file or directory tree without an
+// account, until the link expires, runs out of downloads or is revoked.
+//
+// Authenticated users manage their own links under /_shares:
+//
+//	POST   /_shares       create, JSON {"path", "expires_in", "max_downloads", "password"}
+//	GET    /_shares       list the caller's active links
+//	DELETE /_shares/<id>  revoke a link
+//
+// The tokens themselves are checked by AuthHandler, see authorize.
+type ShareHandler struct {
+	Fs *FSHandler
+
+	// mu serializes updates of share records, so that concurrent downloads
+	// are counted exactly, and guards key.
+	mu  sync.Mutex
+	key []byte
+}
+
+type share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	IsDir        bool      `json:"is_dir"`
+	Owner        string    `json:"owner"`
+	OwnerGroups  []string  `json:"owner_groups,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+}
+
+// shareInfo is the client view of a share.
+type shareInfo struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	URL          string    `json:"url"`
+	IsDir        bool      `json:"is_dir"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Password     bool      `json:"password"`
+}
+
+type shareRequest struct {
+	Path         string `json:"path"`
+	ExpiresIn    string `json:"expires_in"`
+	MaxDownloads int    `json:"max_downloads"`
+	Password     string `json:"password"`
+}
+
+func (s *share) exhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// covers reports whether the share grants access to rel.
+func (s *share) covers(rel string) bool {
+	if rel == s.Path {
+		return true
+	}
+	return s.IsDir && (s.Path == "." || strings.HasPrefix(rel, s.Path+"/"))
+}
+
+// urlPath is the path of the shared entry as it appears in URLs.
+func (s *share) urlPath() string {
+	if s.Path == "." {
+		return "/"
+	}
+	p := "/" + s.Path
+	if s.IsDir {
+		p += "/"
+	}
+	return p
+}
+
+func (h *ShareHandler) accept(r *http.Request) bool {
+	return r.URL.Path == sharePrefix || strings.HasPrefix(r.URL.Path, sharePrefix+"/")
+}
+
+func (h *ShareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code, err := h.serve(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+	}
+	logRequest(r, "share", r.URL.Path, code, err)
+}
+
+func (h *ShareHandler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	id := requestIdentity(r)
+	if id.name == "" || requestShare(r) != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fileserver"`)
+		return http.StatusUnauthorized, errors.New("managing shares requires authentication")
+	}
+
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	if r.URL.Path == sharePrefix {
+		switch r.Method {
+		case http.MethodGet:
+			return h.serveList(w, root, id.name)
+		case http.MethodPost:
+			return h.serveCreate(w, r, root, id)
+		}
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	if r.Method != http.MethodDelete {
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+	return h.serveRevoke(w, root, id.name, strings.TrimPrefix(r.URL.Path, sharePrefix+"/"))
+}
+
+func (h *ShareHandler) serveCreate(w http.ResponseWriter, r *http.Request, root *os.Root, owner identity) (int, error) {
+	var req shareRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxShareRequest)).Decode(&req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid share request: %v", err)
+	}
+
+	rel := toRelPath(req.Path)
+	if req.Path == "" || isInternalPath(rel) {
+		return http.StatusBadRequest, fmt.Errorf("invalid path %q", req.Path)
+	}
+	if !h.Fs.allowed(owner, rel, permRead) {
+		return http.StatusForbidden, fmt.Errorf("%s on %q is not allowed", permRead, "/"+rel)
+	}
+	info, err := root.Stat(rel)
+	if err != nil {
+		return http.StatusNotFound, fmt.Errorf("%q not found", req.Path)
+	}
+
+	expiresIn := defaultShareExpiration
+	if req.ExpiresIn != "" {
+		if expiresIn, err = time.ParseDuration(req.ExpiresIn); err != nil || expiresIn <= 0 {
+			return http.StatusBadRequest, fmt.Errorf("invalid expires_in %q", req.ExpiresIn)
+		}
+	}
+	if req.MaxDownloads < 0 {
+		return http.StatusBadRequest, fmt.Errorf("invalid max_downloads %d", req.MaxDownloads)
+	}
+
+	id, err := newShareID()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	now := time.Now()
+	s := &share{
+		ID:           id,
+		Path:         rel,
+		IsDir:        info.IsDir(),
+		Owner:        owner.name,
+		OwnerGroups:  owner.groups,
+		Created:      now,
+		Expires:      now.Add(expiresIn),
+		MaxDownloads: req.MaxDownloads,
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		s.PasswordHash = string(hash)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := root.MkdirAll(shareDir, os.ModePerm); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := writeShare(root, s); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	resp, err := h.info(root, s)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(resp)
+	return http.StatusCreated, nil
+}
+
+func (h *ShareHandler) serveList(w http.ResponseWriter, root *os.Root, user string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	shares, err := h.loadAll(root)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	infos := []shareInfo{}
+	for _, s := range shares {
+		if s.Owner != user {
+			continue
+		}
+		info, err := h.info(root, s)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.After(infos[j].Created)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(infos)
+	return http.StatusOK, nil
+}
+
+func (h *ShareHandler) serveRevoke(w http.ResponseWriter, root *os.Root, user, id string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, err := loadShare(root, id)
+	if err != nil || s.Owner != user {
+		return http.StatusNotFound, fmt.Errorf("unknown share %q", id)
+	}
+	if err := root.Remove(sharePath(id)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// authorize checks the share token of a GET or HEAD request, taken from the
+// "share" query parameter or, while browsing a shared directory, from the
+// share cookie. ok is false when r carries no usable token and should be
+// authenticated as usual. Otherwise either an error or a copy of r is
+// returned, acting as the share's owner so that the owner's access rules
+// still apply, and downloads of files are counted.
+//
+// Password protected shares expect the password as the Basic Auth
+// password; the username is ignored.
+func (h *ShareHandler) authorize(w http.ResponseWriter, r *http.Request) (_ *http.Request, ok bool, code int, err error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, false, 0, nil
+	}
+	if _, err := r.Cookie(shareCookie); err != nil && !r.URL.Query().Has("share") {
+		return nil, false, 0, nil
+	}
+	rel := toRelPath(r.URL.Path)
+
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return nil, true, http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	h.mu.Lock()
+	s, ok, code, err := h.lookup(w, r, root, rel)
+	h.mu.Unlock()
+	if s == nil {
+		return nil, ok, code, err
+	}
+
+	// bcrypt is slow by design, so it runs without holding mu.
+	if s.PasswordHash != "" {
+		_, pass, _ := r.BasicAuth()
+		if bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(pass)) != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fileserver shared link"`)
+			return nil, true, http.StatusUnauthorized, errors.New("shared link requires a password")
+		}
+	}
+
+	if countsAsDownload(r, root, rel) {
+		if code, err := h.countDownload(root, s); err != nil {
+			return nil, true, code, err
+		}
+	}
+	return withShare(withIdentity(r, identity{name: s.Owner, groups: s.OwnerGroups}), s), true, http.StatusOK, nil
+}
+
+// lookup finds the share r is made with, from the query parameter or the
+// cookie it sets. It returns a nil share and ok false if r is not made with
+// one.
+func (h *ShareHandler) lookup(w http.ResponseWriter, r *http.Request, root *os.Root, rel string) (s *share, ok bool, code int, err error) {
+	if token := r.URL.Query().Get("share"); token != "" {
+		if s, code, err = h.verify(root, token, rel); err != nil {
+			return nil, true, code, err
+		}
+		// Later requests within a shared directory, such as opening a
+		// subfolder, do not repeat the query parameter.
+		http.SetCookie(w, &http.Cookie{
+			Name:     shareCookie,
+			Value:    token,
+			Path:     s.urlPath(),
+			Expires:  s.Expires,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return s, true, http.StatusOK, nil
+	}
+	for _, c := range r.Cookies() {
+		if c.Name != shareCookie {
+			continue
+		}
+		// A stale cookie, e.g. of a revoked share, does not stand in the
+		// way of regular access.
+		if s, _, err = h.verify(root, c.Value, rel); err == nil {
+			return s, true, http.StatusOK, nil
+		}
+	}
+	return nil, false, 0, nil
+}
+
+// countDownload counts a download of s. The record is read again, as other
+// downloads may have been counted since s was loaded.
+func (h *ShareHandler) countDownload(root *os.Root, s *share) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current, err := loadShare(root, s.ID)
+	if err != nil {
+		return http.StatusNotFound, errors.New("shared link not found or revoked")
+	}
+	if current.exhausted() {
+		_ = root.Remove(sharePath(s.ID))
+		return http.StatusGone, errors.New("shared link expired")
+	}
+	current.Downloads++
+	if err := writeShare(root, current); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	s.Downloads = current.Downloads
+	return http.StatusOK, nil
+}
+
+// verify loads the share named by token and checks that it is intact,
+// still valid and covers rel.
+func (h *ShareHandler) verify(root *os.Root, token, rel string) (*share, int, error) {
+	id, rest, _ := strings.Cut(token, ".")
+	expires, sig, _ := strings.Cut(rest, ".")
+	if !validShareID(id) {
+		return nil, http.StatusForbidden, errors.New("invalid share link")
+	}
+	s, err := loadShare(root, id)
+	if err != nil {
+		return nil, http.StatusNotFound, errors.New("shared link not found or revoked")
+	}
+	want, err := h.sign(root, s)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !hmac.Equal([]byte(expires+"."+sig), []byte(want)) {
+		return nil, http.StatusForbidden, errors.New("invalid share link")
+	}
+	if time.Now().After(s.Expires) || s.exhausted() {
+		_ = root.Remove(sharePath(id))
+		return nil, http.StatusGone, errors.New("shared link expired")
+	}
+	if !s.covers(rel) {
+		return nil, http.StatusForbidden, errors.New("path is not part of the shared link")
+	}
+	return s, http.StatusOK, nil
+}
+
+// countsAsDownload reports whether r fetches a file or an archive. Range
+// requests that do not start at the beginning continue a download that has
+// already been counted.
+func countsAsDownload(r *http.Request, root *os.Root, rel string) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+		return false
+	}
+	info, err := root.Stat(rel)
+	if err != nil {
+		return false
+	}
+	return !info.IsDir() || r.URL.Query().Has("archive")
+}
+
+func (h *ShareHandler) info(root *os.Root, s *share) (shareInfo, error) {
+	token, err := h.token(root, s)
+	if err != nil {
+		return shareInfo{}, err
+	}
+	return shareInfo{
+		ID:           s.ID,
+		Path:         s.urlPath(),
+		URL:          (&url.URL{Path: s.urlPath(), RawQuery: "share=" + token}).String(),
+		IsDir:        s.IsDir,
+		Created:      s.Created,
+		Expires:      s.Expires,
+		MaxDownloads: s.MaxDownloads,
+		Downloads:    s.Downloads,
+		Password:     s.PasswordHash != "",
+	}, nil
+}
+
+// token returns "<id>.<expires>.<signature>".
+func (h *ShareHandler) token(root *os.Root, s *share) (string, error) {
+	sig, err := h.sign(root, s)
+	if err != nil {
+		return "", err
+	}
+	return s.ID + "." + sig, nil
+}
+
+// sign returns "<expires>.<signature>", where the signature is an HMAC of
+// the share id, path and expiry.
+func (h *ShareHandler) sign(root *os.Root, s *share) (string, error) {
+	key, err := h.signingKey(root)
+	if err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(s.Expires.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s", s.ID, s.Path, expires)
+	return expires + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// signingKey returns the HMAC key, creating it on first use. It is kept in
+// Basedir so that links survive restarts; deleting it invalidates them all.
+func (h *ShareHandler) signingKey(root *os.Root) ([]byte, error) {
+	if h.key != nil {
+		return h.key, nil
+	}
+	key, err := root.ReadFile(shareKeyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := root.MkdirAll(shareDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		err = root.WriteFile(shareKeyPath, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.key = key
+	return key, nil
+}
+
+// loadAll reads every share record, removing the ones that expired or ran
+// out of downloads.
+func (h *ShareHandler) loadAll(root *os.Root) ([]*share, error) {
+	dir, err := root.Open(shareDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var shares []*share
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok || !validShareID(id) {
+			continue
+		}
+		s, err := loadShare(root, id)
+		if err != nil {
+			continue
+		}
+		if now.After(s.Expires) || s.exhausted() {
+			_ = root.Remove(sharePath(id))
+			continue
+		}
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+func loadShare(root *os.Root, id string) (*share, error) {
+	b, err := root.ReadFile(sharePath(id))
+	if err != nil {
+		return nil, err
+	}
+	s := &share{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func writeShare(root *os.Root, s *share) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return root.WriteFile(sharePath(s.ID), b, 0600)
+}
+
+func sharePath(id string) string { return shareDir + "/" + id + ".json" }
+
+func newShareID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validShareID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+type shareKey struct{}
+
+func withShare(r *http.Request, s *share) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), shareKey{}, s))
+	if e := requestAccessEntry(r); e != nil {
+		e.user = logUser(r)
+	}
+	return r
+}
+
+// requestShare returns the share that authorized r, or nil.
+func requestShare(r *http.Request) *share {
+	s, _ := r.Context().Value(shareKey{}).(*share)
+	return s
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newShareFixture(t *testing.T) (string, *ShareHandler, http.Handler) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"docs/a.txt":     "alpha",
+		"docs/b.txt":     "bravo",
+		"docs/sub/c.txt": "charlie",
+		"other.txt":      "other",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := &FSHandler{Basedir: dir}
+	shares := &ShareHandler{Fs: fs}
+	h := &AuthHandler{
+		Username: "alice",
+		Password: "pw",
+		Shares:   shares,
+		Next:     NewCompHandler(shares, fs),
+	}
+	return dir, shares, h
+}
+
+func createShare(t *testing.T, h http.Handler, body string) shareInfo {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, sharePrefix, strings.NewReader(body))
+	req.SetBasicAuth("alice", "pw")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create share = %d %s", rec.Code, rec.Body.String())
+	}
+	var info shareInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func doRequest(h http.Handler, method, target string, setup func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if setup != nil {
+		setup(req)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func Test_share_file(t *testing.T) {
+	_, _, h := newShareFixture(t)
+	info := createShare(t, h, `{"path": "/docs/a.txt", "max_downloads": 2}`)
+	if info.Path != "/docs/a.txt" || info.MaxDownloads != 2 || info.Password {
+		t.Fatalf("unexpected share %+v", info)
+	}
+	if !strings.HasPrefix(info.URL, "/docs/a.txt?share="+info.ID+".") {
+		t.Fatalf("unexpected url %q", info.URL)
+	}
+	token := strings.TrimPrefix(info.URL, "/docs/a.txt?share=")
+
+	if rec := doRequest(h, http.MethodGet, "/docs/a.txt", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("GET without token = %d, want 401", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodGet, "/docs/b.txt?share="+token, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("GET of sibling = %d, want 403", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodPut, info.URL, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("PUT with token = %d, want 401", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodHead, info.URL, nil); rec.Code != http.StatusOK {
+		t.Errorf("HEAD = %d, want 200", rec.Code)
+	}
+	for i := 0; i < 2; i++ {
+		rec := doRequest(h, http.MethodGet, info.URL, nil)
+		if rec.Code != http.StatusOK || rec.Body.String() != "alpha" {
+			t.Fatalf("download %d = %d %q", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := doRequest(h, http.MethodGet, info.URL, nil); rec.Code != http.StatusGone {
+		t.Errorf("download beyond limit = %d, want 410", rec.Code)
+	}
+}
+
+func Test_share_directory(t *testing.T) {
+	_, _, h := newShareFixture(t)
+	info := createShare(t, h, `{"path": "/docs", "expires_in": "1h"}`)
+	if info.Path != "/docs/" || !info.IsDir {
+		t.Fatalf("unexpected share %+v", info)
+	}
+	if d := time.Until(info.Expires); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("expires in %v, want 1h", d)
+	}
+	token := strings.TrimPrefix(info.URL, "/docs/?share=")
+
+	rec := doRequest(h, http.MethodGet, info.URL, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET shared dir = %d %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != shareCookie || cookies[0].Path != "/docs/" {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+	withCookie := func(r *http.Request) { r.AddCookie(cookies[0]) }
+
+	if rec := doRequest(h, http.MethodGet, "/docs/sub/c.txt", withCookie); rec.Code != http.StatusOK || rec.Body.String() != "charlie" {
+		t.Errorf("GET below share with cookie = %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, http.MethodGet, "/docs/sub/c.txt?share="+url.QueryEscape(token), nil); rec.Code != http.StatusOK {
+		t.Errorf("GET below share with token = %d", rec.Code)
+	}
+	// Outside the share the cookie is ignored and regular auth applies.
+	if rec := doRequest(h, http.MethodGet, "/other.txt", withCookie); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET outside share = %d, want 401", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodGet, "/other.txt?share="+token, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("GET outside share with token = %d, want 403", rec.Code)
+	}
+}
+
+func Test_share_password(t *testing.T) {
+	_, _, h := newShareFixture(t)
+	info := createShare(t, h, `{"path": "/docs/a.txt", "password": "s3cret"}`)
+	if !info.Password {
+		t.Fatalf("share %+v not password protected", info)
+	}
+
+	rec := doRequest(h, http.MethodGet, info.URL, nil)
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Header().Get("WWW-Authenticate"), "shared link") {
+		t.Fatalf("GET without password = %d %q", rec.Code, rec.Header().Get("WWW-Authenticate"))
+	}
+	if rec := doRequest(h, http.MethodGet, info.URL, func(r *http.Request) { r.SetBasicAuth("", "wrong") }); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET with wrong password = %d, want 401", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodGet, info.URL, func(r *http.Request) { r.SetBasicAuth("guest", "s3cret") }); rec.Code != http.StatusOK {
+		t.Errorf("GET with password = %d, want 200", rec.Code)
+	}
+
+	// Passwords are checked concurrently, downloads are still counted
+	// exactly.
+	limited := createShare(t, h, `{"path": "/docs/b.txt", "password": "s3cret", "max_downloads": 3}`)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var ok int
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := doRequest(h, http.MethodGet, limited.URL, func(r *http.Request) { r.SetBasicAuth("", "s3cret") })
+			if rec.Code == http.StatusOK {
+				mu.Lock()
+				ok++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if ok != 3 {
+		t.Errorf("%d concurrent downloads succeeded, want 3", ok)
+	}
+}
+
+func Test_share_listAndRevoke(t *testing.T) {
+	dir, _, h := newShareFixture(t)
+	a := createShare(t, h, `{"path": "/docs/a.txt", "password": "s3cret"}`)
+	b := createShare(t, h, `{"path": "/docs/b.txt"}`)
+
+	asAlice := func(r *http.Request) { r.SetBasicAuth("alice", "pw") }
+	if rec := doRequest(h, http.MethodGet, sharePrefix, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous list = %d, want 401", rec.Code)
+	}
+	// A share link does not authenticate its visitors as the owner.
+	if rec := doRequest(h, http.MethodGet, sharePrefix+"?share="+strings.TrimPrefix(b.URL, "/docs/b.txt?share="), nil); rec.Code != http.StatusForbidden {
+		t.Errorf("list with share token = %d, want 403", rec.Code)
+	}
+
+	rec := doRequest(h, http.MethodGet, sharePrefix, asAlice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list = %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "$2a$") {
+		t.Errorf("list exposes password hash: %s", rec.Body.String())
+	}
+	var infos []shareInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].ID != b.ID || infos[1].ID != a.ID || infos[0].URL != b.URL {
+		t.Fatalf("unexpected list %+v", infos)
+	}
+
+	if rec := doRequest(h, http.MethodDelete, sharePrefix+"/"+b.ID, asAlice); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke = %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(h, http.MethodGet, b.URL, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET revoked share = %d, want 404", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodDelete, sharePrefix+"/"+b.ID, asAlice); rec.Code != http.StatusNotFound {
+		t.Errorf("revoke twice = %d, want 404", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, shareDir, b.ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("revoked share still on disk: %v", err)
+	}
+	if rec := doRequest(h, http.MethodGet, "/"+shareDir+"/key", asAlice); rec.Code != http.StatusNotFound {
+		t.Errorf("GET signing key = %d, want 404", rec.Code)
+	}
+}
+
+func Test_share_invalidTokens(t *testing.T) {
+	dir, shares, h := newShareFixture(t)
+	info := createShare(t, h, `{"path": "/docs/a.txt"}`)
+	token := strings.TrimPrefix(info.URL, "/docs/a.txt?share=")
+
+	tampered := token[:len(token)-1] + "A"
+	if strings.HasSuffix(token, "A") {
+		tampered = token[:len(token)-1] + "B"
+	}
+	if rec := doRequest(h, http.MethodGet, "/docs/a.txt?share="+tampered, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("tampered token = %d, want 403", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodGet, "/docs/a.txt?share=garbage", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("garbage token = %d, want 403", rec.Code)
+	}
+
+	// Expire the share behind the handler's back; the old token must stop
+	// working even though it carries the original expiry.
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	s, err := loadShare(root, info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Expires = time.Now().Add(-time.Minute)
+	if err := writeShare(root, s); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(h, http.MethodGet, info.URL, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("token with changed expiry = %d, want 403", rec.Code)
+	}
+	expired, err := shares.token(root, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(h, http.MethodGet, "/docs/a.txt?share="+expired, nil); rec.Code != http.StatusGone {
+		t.Errorf("expired token = %d, want 410", rec.Code)
+	}
+}
+
+func Test_share_createErrors(t *testing.T) {
+	_, _, h := newShareFixture(t)
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"path": "/missing"}`, http.StatusNotFound},
+		{`{"path": ""}`, http.StatusBadRequest},
+		{`{"path": "/.shares/key"}`, http.StatusBadRequest},
+		{`{"path": "/docs", "expires_in": "-1h"}`, http.StatusBadRequest},
+		{`{"path": "/docs", "expires_in": "soon"}`, http.StatusBadRequest},
+		{`{"path": "/docs", "max_downloads": -1}`, http.StatusBadRequest},
+		{`not json`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, sharePrefix, strings.NewReader(tt.body))
+		req.SetBasicAuth("alice", "pw")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("create %s = %d, want %d", tt.body, rec.Code, tt.want)
+		}
+	}
+}
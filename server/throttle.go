@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFailures = 5
+	defaultBackoff     = time.Second
+	defaultMaxLockout  = 15 * time.Minute
+)
+
+// AuthThrottle slows down password guessing. Failed logins are counted
+// per client address and per username; once either has MaxFailures
+// failures, it is locked out for Backoff, doubling with every further
+// failure up to MaxLockout. Counts are forgotten after MaxLockout without
+// failures, and a username's count after a successful login. The zero
+// value uses the defaults; a nil *AuthThrottle does not throttle.
+type AuthThrottle struct {
+	MaxFailures int
+	Backoff     time.Duration
+	MaxLockout  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+	pruned  time.Time
+}
+
+type throttleEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+func (t *AuthThrottle) maxFailures() int {
+	if t.MaxFailures > 0 {
+		return t.MaxFailures
+	}
+	return defaultMaxFailures
+}
+
+func (t *AuthThrottle) backoff() time.Duration {
+	if t.Backoff > 0 {
+		return t.Backoff
+	}
+	return defaultBackoff
+}
+
+func (t *AuthThrottle) maxLockout() time.Duration {
+	if t.MaxLockout > 0 {
+		return t.MaxLockout
+	}
+	return defaultMaxLockout
+}
+
+// throttleKeys returns the keys failures of user from addr count for.
+func throttleKeys(addr netip.Addr, user string) []string {
+	keys := []string{"ip " + clientNet(addr).String()}
+	if user != "" {
+		keys = append(keys, "user "+user)
+	}
+	return keys
+}
+
+// wait returns how long the longest lockout of keys lasts, or 0.
+func (t *AuthThrottle) wait(keys []string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if e := t.entries[key]; e != nil {
+			wait = max(wait, e.until.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failed login for keys.
+func (t *AuthThrottle) fail(keys []string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = map[string]*throttleEntry{}
+	}
+	t.prune(now)
+	for _, key := range keys {
+		e := t.entries[key]
+		if e == nil || now.Sub(e.last) > t.maxLockout() {
+			e = &throttleEntry{}
+			t.entries[key] = e
+		}
+		e.failures++
+		e.last = now
+		if over := e.failures - t.maxFailures(); over >= 0 {
+			lockout := t.maxLockout()
+			if over < 32 {
+				lockout = min(lockout, t.backoff()<<over)
+			}
+			e.until = now.Add(lockout)
+		}
+	}
+}
+
+// succeed forgets the failures of a user who logged in.
+func (t *AuthThrottle) succeed(user string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, "user "+user)
+}
+
+func (t *AuthThrottle) prune(now time.Time) {
+	if now.Sub(t.pruned) < time.Minute {
+		return
+	}
+	t.pruned = now
+	for key, e := range t.entries {
+		if now.Sub(e.last) > t.maxLockout() && now.After(e.until) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// lockedOut is the error of requests refused by AuthThrottle.
+func lockedOut(wait time.Duration) error {
+	return fmt.Errorf("too many failed logins, retry in %v", wait.Round(time.Second))
+}
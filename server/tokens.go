@@ -0,0 +1,372 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenPrefix starts every API token, so that leaked tokens are easy to
+// recognize and search for.
+const tokenPrefix = "fst_"
+
+// TokenScope is the set of operations an API token may perform.
+type TokenScope uint8
+
+const (
+	// ScopeRead allows GET, HEAD, OPTIONS and PROPFIND.
+	ScopeRead TokenScope = 1 << iota
+	// ScopeWrite allows every other method except DELETE: uploads, mkdir,
+	// move, copy and WebDAV writes.
+	ScopeWrite
+	// ScopeDelete allows DELETE.
+	ScopeDelete
+)
+
+var scopeNames = []struct {
+	scope TokenScope
+	name  string
+}{
+	{ScopeRead, "read"},
+	{ScopeWrite, "write"},
+	{ScopeDelete, "delete"},
+}
+
+func (s TokenScope) String() string {
+	var names []string
+	for _, n := range scopeNames {
+		if s&n.scope != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseTokenScope parses a comma-separated list of read, write and delete.
+func ParseTokenScope(s string) (TokenScope, error) {
+	var scope TokenScope
+	for _, name := range strings.Split(s, ",") {
+		found := false
+		for _, n := range scopeNames {
+			if n.name == strings.TrimSpace(name) {
+				scope |= n.scope
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown scope %q, want read, write or delete", name)
+		}
+	}
+	return scope, nil
+}
+
+// Token is an API token as kept in the tokens file. Only a SHA-256 digest of
+// the secret is stored; the secret is shown once, when the token is created.
+type Token struct {
+	ID   string
+	Name string
+	// Scope limits the methods the token may use.
+	Scope TokenScope
+	// Prefix limits the token to a URL path and everything below it; "/"
+	// allows every path.
+	Prefix string
+	// Expires is when the token stops working; zero means never.
+	Expires time.Time
+
+	hash [sha256.Size]byte
+}
+
+// NewToken creates a token and returns it along with its secret.
+func NewToken(name string, scope TokenScope, prefix string, expires time.Time) (*Token, string, error) {
+	if name == "" || strings.ContainsFunc(name, isSpace) {
+		return nil, "", fmt.Errorf("invalid token name %q", name)
+	}
+	if scope == 0 {
+		return nil, "", errors.New("token needs at least one scope")
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return nil, "", fmt.Errorf("prefix %q must start with \"/\"", prefix)
+	}
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	t := &Token{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Scope:   scope,
+		Prefix:  path.Clean(prefix),
+		Expires: expires,
+	}
+	token := tokenPrefix + t.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	t.hash = sha256.Sum256([]byte(token))
+	return t, token, nil
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// covers reports whether urlPath lies within the token's prefix.
+func (t *Token) covers(urlPath string) bool {
+	p := path.Clean("/" + urlPath)
+	return t.Prefix == "/" || p == t.Prefix || strings.HasPrefix(p, t.Prefix+"/")
+}
+
+// ReadTokenFile reads the tokens file at name. A missing file holds no
+// tokens.
+//
+// Each non-blank line that does not start with "#" describes one token:
+//
+//	<id> <sha256> <scope> <prefix> <expires> <name>
+//
+// where scope is a comma-separated list and expires is an RFC 3339 time or
+// "never".
+func ReadTokenFile(name string) ([]*Token, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens, err := parseTokens(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return tokens, nil
+}
+
+// WriteTokenFile replaces the tokens file at name. The new contents are
+// written to a temp file that is renamed over the old one, so that a running
+// server never reads a partial file.
+func WriteTokenFile(name string, tokens []*Token) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# fileserver API tokens, managed with \"fileserver token\".")
+	fmt.Fprintln(w, "# <id> <sha256> <scope> <prefix> <expires> <name>")
+	for _, t := range tokens {
+		expires := "never"
+		if !t.Expires.IsZero() {
+			expires = t.Expires.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s %x %s %s %s %s\n", t.ID, t.hash, t.Scope, url.PathEscape(t.Prefix), expires, t.Name)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func parseTokens(r io.Reader) ([]*Token, error) {
+	var tokens []*Token
+	seen := map[string]bool{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		t, err := parseToken(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if seen[t.ID] {
+			return nil, fmt.Errorf("line %d: duplicate token %q", n, t.ID)
+		}
+		seen[t.ID] = true
+		tokens = append(tokens, t)
+	}
+	return tokens, s.Err()
+}
+
+func parseToken(fields []string) (*Token, error) {
+	if len(fields) != 6 {
+		return nil, errors.New("expected \"<id> <sha256> <scope> <prefix> <expires> <name>\"")
+	}
+	t := &Token{ID: fields[0], Name: fields[5]}
+	hash, err := hex.DecodeString(fields[1])
+	if err != nil || len(hash) != sha256.Size {
+		return nil, errors.New("malformed token hash")
+	}
+	copy(t.hash[:], hash)
+	if t.Scope, err = ParseTokenScope(fields[2]); err != nil {
+		return nil, err
+	}
+	prefix, err := url.PathUnescape(fields[3])
+	if err != nil || !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("invalid prefix %q", fields[3])
+	}
+	t.Prefix = path.Clean(prefix)
+	if fields[4] != "never" {
+		if t.Expires, err = time.Parse(time.RFC3339, fields[4]); err != nil {
+			return nil, fmt.Errorf("invalid expiry %q", fields[4])
+		}
+	}
+	return t, nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// Tokens is the set of API tokens the server accepts as
+// "Authorization: Bearer" credentials, loaded from a file written by the
+// "fileserver token" command.
+type Tokens struct {
+	path string
+
+	mu   sync.RWMutex
+	byID map[string]*Token
+}
+
+// LoadTokens reads the tokens file at path.
+func LoadTokens(path string) (*Tokens, error) {
+	t := &Tokens{path: path}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Reload re-reads the tokens file. On error the previous tokens are kept.
+func (t *Tokens) Reload() error {
+	tokens, err := ReadTokenFile(t.path)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*Token, len(tokens))
+	for _, tok := range tokens {
+		byID[tok.ID] = tok
+	}
+
+	t.mu.Lock()
+	t.byID = byID
+	t.mu.Unlock()
+	log.Printf("Loaded %d API tokens from %q", len(tokens), t.path)
+	return nil
+}
+
+// Watch reloads the tokens file whenever it changes on disk.
+func (t *Tokens) Watch() error {
+	return watchFile(t.path, t.Reload)
+}
+
+// lookup returns the token matching secret, or nil.
+func (t *Tokens) lookup(secret string) *Token {
+	rest, ok := strings.CutPrefix(secret, tokenPrefix)
+	if !ok {
+		return nil
+	}
+	id, _, _ := strings.Cut(rest, "_")
+
+	t.mu.RLock()
+	tok := t.byID[id]
+	t.mu.RUnlock()
+
+	if tok == nil {
+		return nil
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], tok.hash[:]) != 1 {
+		return nil
+	}
+	return tok
+}
+
+// bearerToken returns the credential of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authorize checks the bearer token of r against its scope and prefix. The
+// destination of a move or copy must lie within the prefix as well.
+// Resumable uploads continue at /_tus/<id> once they were created within
+// the prefix, and share links cannot be managed with tokens.
+func (t *Tokens) authorize(r *http.Request, secret string) (*Token, int, error) {
+	tok := t.lookup(secret)
+	if tok == nil {
+		return nil, http.StatusUnauthorized, errors.New("invalid token")
+	}
+	if tok.expired(time.Now()) {
+		return nil, http.StatusUnauthorized, errors.New("token expired")
+	}
+
+	scope := requiredScope(r)
+	if tok.Scope&scope == 0 {
+		return nil, http.StatusForbidden, fmt.Errorf("token lacks %s scope", scope)
+	}
+
+	if strings.HasPrefix(r.URL.Path, sharePrefix) {
+		return nil, http.StatusForbidden, errors.New("share links cannot be managed with API tokens")
+	}
+	if strings.HasPrefix(r.URL.Path, tusPrefix) {
+		return tok, http.StatusOK, nil
+	}
+	paths := []string{r.URL.Path}
+	if to := r.URL.Query().Get("to"); to != "" && r.Method == http.MethodPost {
+		paths = append(paths, to)
+	}
+	if dst := r.Header.Get("Destination"); dst != "" {
+		if u, err := url.Parse(dst); err == nil {
+			paths = append(paths, u.Path)
+		}
+	}
+	for _, p := range paths {
+		if !tok.covers(p) {
+			return nil, http.StatusForbidden, fmt.Errorf("token is limited to %q", tok.Prefix)
+		}
+	}
+	return tok, http.StatusOK, nil
+}
+
+func requiredScope(r *http.Request) TokenScope {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return ScopeRead
+	case http.MethodDelete:
+		return ScopeDelete
+	default:
+		return ScopeWrite
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ParseTokenScope(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TokenScope
+		wantErr bool
+	}{
+		{"read", ScopeRead, false},
+		{"read,write", ScopeRead | ScopeWrite, false},
+		{"delete, write", ScopeWrite | ScopeDelete, false},
+		{"read,admin", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTokenScope(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTokenScope(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if s := (ScopeRead | ScopeDelete).String(); s != "read,delete" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func Test_tokenFile_roundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	if tokens, err := ReadTokenFile(file); err != nil || len(tokens) != 0 {
+		t.Fatalf("ReadTokenFile(missing) = %v, %v", tokens, err)
+	}
+
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	a, secretA, err := NewToken("ci", ScopeRead|ScopeWrite, "/artifacts/", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _, err := NewToken("backup", ScopeRead, "/with space", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secretA, tokenPrefix+a.ID+"_") {
+		t.Fatalf("unexpected secret %q", secretA)
+	}
+	if err := WriteTokenFile(file, []*Token{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("tokens file mode = %v, %v", info.Mode(), err)
+	}
+	b2, _ := os.ReadFile(file)
+	if strings.Contains(string(b2), secretA) {
+		t.Fatal("tokens file contains the secret")
+	}
+
+	tokens, err := ReadTokenFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 {
+		t.Fatalf("got %d tokens", len(tokens))
+	}
+	got := tokens[0]
+	if got.ID != a.ID || got.Name != "ci" || got.Scope != a.Scope || got.Prefix != "/artifacts" ||
+		!got.Expires.Equal(expires) || got.hash != a.hash {
+		t.Errorf("round trip = %+v, want %+v", got, a)
+	}
+	if tokens[1].Prefix != "/with space" || !tokens[1].Expires.IsZero() {
+		t.Errorf("round trip = %+v", tokens[1])
+	}
+}
+
+func Test_parseTokens_errors(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tests := []string{
+		"abc " + hash + " read / never",
+		"abc " + hash[2:] + " read / never ci",
+		"abc " + hash + " admin / never ci",
+		"abc " + hash + " read relative never ci",
+		"abc " + hash + " read / tomorrow ci",
+		"abc " + hash + " read / never ci\nabc " + hash + " read / never ci2",
+	}
+	for _, text := range tests {
+		if _, err := parseTokens(strings.NewReader(text)); err == nil {
+			t.Errorf("parseTokens(%q) succeeded", text)
+		}
+	}
+}
+
+func newTokenFixture(t *testing.T) (*AuthHandler, map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, d := range []string{"artifacts/old", "other"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "artifacts/a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "other/b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := map[string]string{}
+	var tokens []*Token
+	for _, spec := range []struct {
+		name    string
+		scope   TokenScope
+		prefix  string
+		expires time.Time
+	}{
+		{"reader", ScopeRead, "/", time.Time{}},
+		{"ci", ScopeRead | ScopeWrite, "/artifacts", time.Now().Add(time.Hour)},
+		{"cleaner", ScopeDelete, "/artifacts", time.Time{}},
+		{"expired", ScopeRead | ScopeWrite | ScopeDelete, "/", time.Now().Add(-time.Hour)},
+	} {
+		tok, secret, err := NewToken(spec.name, spec.scope, spec.prefix, spec.expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, tok)
+		secrets[spec.name] = secret
+	}
+	file := filepath.Join(t.TempDir(), "tokens")
+	if err := WriteTokenFile(file, tokens); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTokens(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &FSHandler{Basedir: dir, AllowDelete: true}
+	return &AuthHandler{
+		Username:      "admin",
+		Password:      "pw",
+		Tokens:        loaded,
+		AuthWriteOnly: true,
+		Next:          fs,
+	}, secrets
+}
+
+func Test_AuthHandler_tokens(t *testing.T) {
+	h, secrets := newTokenFixture(t)
+	tests := []struct {
+		name          string
+		token, method string
+		target        string
+		header        map[string]string
+		want          int
+	}{
+		{"read", "reader", http.MethodGet, "/other/b.txt", nil, http.StatusOK},
+		{"read scope cannot write", "reader", http.MethodPut, "/other/c.txt", nil, http.StatusForbidden},
+		{"write in prefix", "ci", http.MethodPut, "/artifacts/new.txt", nil, http.StatusCreated},
+		{"write outside prefix", "ci", http.MethodPut, "/other/new.txt", nil, http.StatusForbidden},
+		{"prefix is not a string prefix", "ci", http.MethodPut, "/artifacts-x/new.txt", nil, http.StatusForbidden},
+		{"traversal out of prefix", "ci", http.MethodPut, "/artifacts/../other/new.txt", nil, http.StatusForbidden},
+		{"read outside prefix", "ci", http.MethodGet, "/other/b.txt", nil, http.StatusForbidden},
+		{"mkdir in prefix", "ci", http.MethodPost, "/artifacts/?action=mkdir&name=v2", nil, http.StatusCreated},
+		{"move out of prefix", "ci", http.MethodPost, "/artifacts/a.txt?action=move&to=/other/", nil, http.StatusForbidden},
+		{"MOVE out of prefix", "ci", "MOVE", "/artifacts/a.txt", map[string]string{"Destination": "/other/a.txt"}, http.StatusForbidden},
+		{"write scope cannot delete", "ci", http.MethodDelete, "/artifacts/old", nil, http.StatusForbidden},
+		{"delete", "cleaner", http.MethodDelete, "/artifacts/old", nil, http.StatusNoContent},
+		{"delete scope cannot read", "cleaner", http.MethodGet, "/artifacts/a.txt", nil, http.StatusForbidden},
+		{"expired", "expired", http.MethodGet, "/other/b.txt", nil, http.StatusUnauthorized},
+		{"unknown", "", http.MethodGet, "/other/b.txt", nil, http.StatusUnauthorized},
+		{"shares are off limits", "reader", http.MethodGet, sharePrefix, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *strings.Reader
+			if tt.method == http.MethodPut {
+				body = strings.NewReader("data")
+			} else {
+				body = strings.NewReader("")
+			}
+			req := httptest.NewRequest(tt.method, tt.target, body)
+			secret, ok := secrets[tt.token]
+			if !ok {
+				secret = tokenPrefix + "0000000000000000_bogus"
+			}
+			req.Header.Set("Authorization", "Bearer "+secret)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.target, rec.Code, rec.Body.String(), tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Bearer ") {
+				t.Errorf("WWW-Authenticate = %q", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func Test_AuthHandler_tokenUser(t *testing.T) {
+	h, secrets := newTokenFixture(t)
+	var user string
+	h.Next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { user = requestUser(r) })
+
+	req := httptest.NewRequest(http.MethodPost, "/artifacts/", nil)
+	req.Header.Set("Authorization", "bearer "+secrets["ci"])
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || user != "ci" {
+		t.Fatalf("got %d, user %q", rec.Code, user)
+	}
+
+	// Basic credentials keep working next to tokens.
+	req = httptest.NewRequest(http.MethodPost, "/artifacts/", nil)
+	req.SetBasicAuth("admin", "pw")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if user != "admin" {
+		t.Fatalf("user = %q, want admin", user)
+	}
+}
+
+func Test_Tokens_reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	tok, secret, err := NewToken("ci", ScopeRead, "/", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTokenFile(file, []*Token{tok}); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokens(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.lookup(secret) == nil {
+		t.Fatal("token not found")
+	}
+	if tokens.lookup(secret+"x") != nil || tokens.lookup(strings.TrimPrefix(secret, tokenPrefix)) != nil {
+		t.Fatal("lookup accepted a wrong secret")
+	}
+
+	if err := WriteTokenFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if tokens.lookup(secret) != nil {
+		t.Fatal("revoked token still accepted")
+	}
+
+	if err := os.WriteFile(file, []byte("garbage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Reload(); err == nil {
+		t.Fatal("Reload accepted a malformed file")
+	}
+}
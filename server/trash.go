@@ -0,0 +1,521 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	trashPrefix = "/_trash"
+
+	// trashDir holds the deleted entries of Basedir, each renamed to its
+	// id next to an <id>.json record of where it came from.
+	trashDir = ".trash"
+
+	// trashInterval is how often Trash.Run purges expired entries.
+	trashInterval = time.Hour
+)
+
+// Trash makes FSHandler move deleted files and directories into a hidden
+// .trash directory of its Basedir instead of removing them, so that
+// TrashHandler can restore them. Entries are purged for good once they are
+// older than MaxAge, or oldest first while the trash of a directory holds
+// more than MaxSize bytes.
+type Trash struct {
+	// MaxAge is how long deleted entries are kept, 0 for ever.
+	MaxAge time.Duration
+	// MaxSize caps the size of the trash of each directory, 0 for no
+	// limit.
+	MaxSize int64
+
+	// mu serializes the changes to the trash.
+	mu sync.Mutex
+}
+
+type trashItem struct {
+	ID string `json:"id"`
+	// Path is where the entry was, relative to Basedir.
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	DeletedBy string    `json:"deleted_by"`
+	Deleted   time.Time `json:"deleted"`
+}
+
+// trashInfo is the client view of a trashItem.
+type trashInfo struct {
+	ID string `json:"id"`
+	// Path is the URL path the entry is restored to.
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	DeletedBy string    `json:"deleted_by"`
+	Deleted   time.Time `json:"deleted"`
+}
+
+func trashDataPath(id string) string { return trashDir + "/" + id }
+func trashItemPath(id string) string { return trashDir + "/" + id + ".json" }
+
+// newTrashID returns a random id for a deleted entry.
+func newTrashID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validTrashID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Run purges the expired entries of dirs now and then every hour, until ctx
+// is done.
+func (t *Trash) Run(ctx context.Context, dirs []*FSHandler) {
+	ticker := time.NewTicker(trashInterval)
+	defer ticker.Stop()
+	for {
+		for _, h := range dirs {
+			if err := h.PurgeTrash(); err != nil {
+				log.Printf("Purge trash %q error %v", h.Basedir, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeTrash removes the entries of the trash that are past MaxAge or over
+// MaxSize.
+func (h *FSHandler) PurgeTrash() error {
+	if h.Trash == nil {
+		return nil
+	}
+	root, err := h.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	h.Trash.mu.Lock()
+	defer h.Trash.mu.Unlock()
+	return h.expireTrash(root)
+}
+
+// expireTrash is PurgeTrash with root open and the trash locked.
+func (h *FSHandler) expireTrash(root *os.Root) error {
+	items, err := loadTrash(root)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, it := range items {
+		total += it.Size
+	}
+	// Oldest first.
+	for _, it := range items {
+		expired := h.Trash.MaxAge > 0 && time.Since(it.Deleted) > h.Trash.MaxAge
+		if !expired && (h.Trash.MaxSize <= 0 || total <= h.Trash.MaxSize) {
+			continue
+		}
+		if err := purgeTrashItem(root, it); err != nil {
+			return err
+		}
+		total -= it.Size
+	}
+	return nil
+}
+
+// discard deletes rel, described by info, on behalf of user: into the
+// trash if there is one, for good otherwise.
+func (h *FSHandler) discard(root *os.Root, rel string, info fs.FileInfo, user string) error {
+	switch {
+	case h.Trash != nil:
+		return h.moveToTrash(root, rel, info, user)
+	case info.IsDir():
+		return root.RemoveAll(rel)
+	default:
+		return root.Remove(rel)
+	}
+}
+
+// moveToTrash moves rel, described by info, into the trash on behalf of
+// user.
+func (h *FSHandler) moveToTrash(root *os.Root, rel string, info fs.FileInfo, user string) error {
+	id, err := newTrashID()
+	if err != nil {
+		return err
+	}
+	it := &trashItem{
+		ID:        id,
+		Path:      rel,
+		IsDir:     info.IsDir(),
+		Size:      treeSize(root, rel, info),
+		DeletedBy: user,
+		Deleted:   time.Now().UTC(),
+	}
+
+	h.Trash.mu.Lock()
+	defer h.Trash.mu.Unlock()
+	if err := root.MkdirAll(trashDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeTrashItem(root, it); err != nil {
+		return err
+	}
+	if err := root.Rename(rel, trashDataPath(id)); err != nil {
+		_ = root.Remove(trashItemPath(id))
+		return err
+	}
+	if err := h.expireTrash(root); err != nil {
+		log.Printf("Purge trash %q error %v", h.Basedir, err)
+	}
+	return nil
+}
+
+// treeSize returns the size of the files in rel, which info describes.
+func treeSize(root *os.Root, rel string, info fs.FileInfo) int64 {
+	if !info.IsDir() {
+		return info.Size()
+	}
+	var size int64
+	_ = fs.WalkDir(root.FS(), rel, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// loadTrash reads the records of the trash, oldest first.
+func loadTrash(root *os.Root) ([]*trashItem, error) {
+	dir, err := root.Open(trashDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*trashItem
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".json")
+		if !ok || !validTrashID(id) {
+			continue
+		}
+		it, err := loadTrashItem(root, id)
+		if err != nil {
+			continue
+		}
+		items = append(items, it)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Deleted.Before(items[j].Deleted)
+	})
+	return items, nil
+}
+
+func loadTrashItem(root *os.Root, id string) (*trashItem, error) {
+	b, err := root.ReadFile(trashItemPath(id))
+	if err != nil {
+		return nil, err
+	}
+	it := &trashItem{}
+	if err := json.Unmarshal(b, it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func writeTrashItem(root *os.Root, it *trashItem) error {
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	return root.WriteFile(trashItemPath(it.ID), b, 0600)
+}
+
+// purgeTrashItem removes it from the trash for good.
+func purgeTrashItem(root *os.Root, it *trashItem) error {
+	data := trashDataPath(it.ID)
+	var err error
+	if it.IsDir {
+		err = root.RemoveAll(data)
+	} else {
+		err = root.Remove(data)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return root.Remove(trashItemPath(it.ID))
+}
+
+// TrashHandler lists, restores and purges the entries deleted into the
+// trash of FSHandler and its mounts:
+//
+//	GET    /_trash                     list the entries the caller may delete
+//	POST   /_trash/<id>?action=restore move an entry back where it was
+//	DELETE /_trash/<id>                purge an entry
+//	DELETE /_trash                     purge every entry the caller may delete
+//
+// An entry counts as the caller's when the caller may delete its original
+// path; restoring it also takes write access, or mkdir for directories.
+// Entries are only purged where FSHandler.AllowDelete is set.
+// AuthHandler asks for credentials on every request, as the trash holds
+// data only the people allowed to delete it should see.
+type TrashHandler struct {
+	Fs *FSHandler
+}
+
+func (h *TrashHandler) accept(r *http.Request) bool {
+	return trashRequest(r)
+}
+
+func trashRequest(r *http.Request) bool {
+	return r.URL.Path == trashPrefix || strings.HasPrefix(r.URL.Path, trashPrefix+"/")
+}
+
+func (h *TrashHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code, err := h.serve(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+	}
+	logRequest(r, "trash", r.URL.RequestURI(), code, err)
+}
+
+func (h *TrashHandler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	if requestShare(r) != nil {
+		return http.StatusNotFound, errors.New("share links have no trash")
+	}
+
+	if r.URL.Path == trashPrefix {
+		switch r.Method {
+		case http.MethodGet:
+			return h.serveList(w, r)
+		case http.MethodDelete:
+			return h.serveEmpty(w, r)
+		}
+		w.Header().Set("Allow", "GET, DELETE")
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, trashPrefix+"/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Query().Get("action") == "restore":
+		return h.serveRestore(w, r, id)
+	case r.Method == http.MethodDelete:
+		return h.servePurge(w, r, id)
+	}
+	return http.StatusMethodNotAllowed, errors.New("method not allowed")
+}
+
+// dirs returns the directories whose trash h manages.
+func (h *TrashHandler) dirs() []*FSHandler {
+	dirs := []*FSHandler{h.Fs}
+	for _, m := range h.Fs.Mounts {
+		dirs = append(dirs, m.Fs)
+	}
+	return dirs
+}
+
+// each calls fn with every entry of the trash that r may see, oldest first
+// within each directory.
+func (h *TrashHandler) each(r *http.Request, fn func(dir *FSHandler, root *os.Root, it *trashItem) error) error {
+	id := requestIdentity(r)
+	for _, dir := range h.dirs() {
+		if dir.Trash == nil {
+			continue
+		}
+		root, err := dir.openRoot()
+		if err != nil {
+			return err
+		}
+		dir.Trash.mu.Lock()
+		items, err := loadTrash(root)
+		for _, it := range items {
+			if err != nil {
+				break
+			}
+			if dir.allowed(id, it.Path, permDelete) {
+				err = fn(dir, root, it)
+			}
+		}
+		dir.Trash.mu.Unlock()
+		root.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *TrashHandler) serveList(w http.ResponseWriter, r *http.Request) (int, error) {
+	infos := []trashInfo{}
+	err := h.each(r, func(dir *FSHandler, _ *os.Root, it *trashItem) error {
+		infos = append(infos, trashInfo{
+			ID:        it.ID,
+			Path:      dir.auditPath(it.Path),
+			IsDir:     it.IsDir,
+			Size:      it.Size,
+			DeletedBy: it.DeletedBy,
+			Deleted:   it.Deleted,
+		})
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Deleted.After(infos[j].Deleted)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(infos)
+	return http.StatusOK, nil
+}
+
+func (h *TrashHandler) serveEmpty(w http.ResponseWriter, r *http.Request) (int, error) {
+	err := h.each(r, func(dir *FSHandler, root *os.Root, it *trashItem) error {
+		// Where deletes are disabled, the trash only holds what moves and
+		// copies replaced, which nobody may destroy.
+		if !dir.AllowDelete {
+			return nil
+		}
+		err := purgeTrashItem(root, it)
+		dir.changed(r, AuditEntry{Action: "purge", Path: dir.auditPath(it.Path)}, http.StatusInternalServerError, err)
+		return err
+	})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// find returns the directory and record of the entry id, with the trash of
+// the directory locked; unlock releases both.
+func (h *TrashHandler) find(id string) (dir *FSHandler, root *os.Root, it *trashItem, unlock func(), err error) {
+	if !validTrashID(id) {
+		return nil, nil, nil, nil, fs.ErrNotExist
+	}
+	for _, dir := range h.dirs() {
+		if dir.Trash == nil {
+			continue
+		}
+		root, err := dir.openRoot()
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		dir.Trash.mu.Lock()
+		it, err := loadTrashItem(root, id)
+		if err == nil {
+			return dir, root, it, func() {
+				dir.Trash.mu.Unlock()
+				root.Close()
+			}, nil
+		}
+		dir.Trash.mu.Unlock()
+		root.Close()
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, nil, nil, err
+		}
+	}
+	return nil, nil, nil, nil, fs.ErrNotExist
+}
+
+// open returns the entry id for a request that may delete its original
+// path, failing like a missing entry otherwise.
+func (h *TrashHandler) open(r *http.Request, id string) (*FSHandler, *os.Root, *trashItem, func(), int, error) {
+	dir, root, it, unlock, err := h.find(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil, nil, http.StatusNotFound, fmt.Errorf("unknown trash entry %q", id)
+	}
+	if err != nil {
+		return nil, nil, nil, nil, http.StatusInternalServerError, err
+	}
+	if !dir.allowed(requestIdentity(r), it.Path, permDelete) {
+		unlock()
+		return nil, nil, nil, nil, http.StatusNotFound, fmt.Errorf("unknown trash entry %q", id)
+	}
+	return dir, root, it, unlock, http.StatusOK, nil
+}
+
+func (h *TrashHandler) serveRestore(w http.ResponseWriter, r *http.Request, id string) (code int, err error) {
+	dir, root, it, unlock, code, err := h.open(r, id)
+	if err != nil {
+		return code, err
+	}
+	defer unlock()
+	defer func() { dir.changed(r, AuditEntry{Action: "restore", Path: dir.auditPath(it.Path)}, code, err) }()
+
+	perm := permWrite
+	if it.IsDir {
+		perm = permMkdir
+	}
+	if code, err := dir.checkAccess(w, r, it.Path, perm); err != nil {
+		return code, err
+	}
+	if _, err := root.Lstat(it.Path); err == nil {
+		return http.StatusConflict, fmt.Errorf("%q already exists", dir.auditPath(it.Path))
+	}
+	if parent := path.Dir(it.Path); parent != "." {
+		if err := root.MkdirAll(parent, os.ModePerm); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	if err := root.Rename(trashDataPath(it.ID), it.Path); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := root.Remove(trashItemPath(it.ID)); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+func (h *TrashHandler) servePurge(w http.ResponseWriter, r *http.Request, id string) (code int, err error) {
+	dir, root, it, unlock, code, err := h.open(r, id)
+	if err != nil {
+		return code, err
+	}
+	defer unlock()
+	defer func() { dir.changed(r, AuditEntry{Action: "purge", Path: dir.auditPath(it.Path)}, code, err) }()
+
+	if !dir.AllowDelete {
+		return http.StatusForbidden, errors.New("delete is disabled")
+	}
+	if err := purgeTrashItem(root, it); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listTrash(t *testing.T, h http.Handler, user string) []trashInfo {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, withUser(httptest.NewRequest(http.MethodGet, trashPrefix, nil), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d %s", trashPrefix, w.Code, w.Body)
+	}
+	var infos []trashInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func Test_Trash(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "docs", "old"), 0755)
+	os.WriteFile(filepath.Join(dir, "docs", "old", "a.txt"), []byte("aaaa"), 0644)
+	os.WriteFile(filepath.Join(dir, "docs", "b.txt"), []byte("bb"), 0644)
+	fs := &FSHandler{Basedir: dir, AllowDelete: true, Trash: &Trash{}, ACL: newTestACL(t, `
+allow * /** read
+allow alice /** all
+allow bob /docs/b.txt all
+`)}
+	h := NewCompHandler(&TrashHandler{Fs: fs}, fs)
+	do := func(method, target, user string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, withUser(httptest.NewRequest(method, target, nil), user))
+		return w.Code
+	}
+
+	if code := do(http.MethodDelete, "/docs/old/", "alice"); code != http.StatusNoContent {
+		t.Fatalf("DELETE /docs/old/ = %d", code)
+	}
+	if code := do(http.MethodDelete, "/docs/b.txt", "alice"); code != http.StatusNoContent {
+		t.Fatalf("DELETE /docs/b.txt = %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docs", "old")); !os.IsNotExist(err) {
+		t.Fatalf("deleted directory still there: %v", err)
+	}
+	if code := do(http.MethodGet, "/"+trashDir+"/", "alice"); code != http.StatusNotFound {
+		t.Errorf("GET /%s/ = %d", trashDir, code)
+	}
+
+	items := listTrash(t, h, "alice")
+	if len(items) != 2 {
+		t.Fatalf("trash = %+v", items)
+	}
+	file, folder := items[0], items[1]
+	if file.Path != "/docs/b.txt" || file.IsDir || file.Size != 2 || file.DeletedBy != "alice" ||
+		folder.Path != "/docs/old" || !folder.IsDir || folder.Size != 4 {
+		t.Fatalf("trash = %+v", items)
+	}
+	// Others only see what they may delete.
+	if items := listTrash(t, h, "bob"); len(items) != 1 || items[0].ID != file.ID {
+		t.Errorf("bob's trash = %+v", items)
+	}
+	if code := do(http.MethodDelete, trashPrefix+"/"+folder.ID, "bob"); code != http.StatusNotFound {
+		t.Errorf("bob purging alice's entry = %d", code)
+	}
+
+	if code := do(http.MethodPost, trashPrefix+"/"+file.ID+"?action=restore", "bob"); code != http.StatusNoContent {
+		t.Fatalf("restore = %d", code)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "docs", "b.txt")); string(b) != "bb" {
+		t.Fatalf("restored file = %q, %v", b, err)
+	}
+
+	// Restoring does not overwrite what took the place of the entry.
+	os.MkdirAll(filepath.Join(dir, "docs", "old"), 0755)
+	if code := do(http.MethodPost, trashPrefix+"/"+folder.ID+"?action=restore", "alice"); code != http.StatusConflict {
+		t.Fatalf("restore over an existing directory = %d", code)
+	}
+	if code := do(http.MethodDelete, trashPrefix, "alice"); code != http.StatusNoContent {
+		t.Fatalf("empty trash = %d", code)
+	}
+	if items := listTrash(t, h, "alice"); len(items) != 0 {
+		t.Fatalf("trash after emptying = %+v", items)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, trashDir)); len(entries) != 0 {
+		t.Fatalf("trash directory = %v", entries)
+	}
+}
+
+// Test_Trash_replaced checks that moves, copies, WebDAV and S3 send what
+// they delete or replace to the trash as well.
+func Test_Trash_replaced(t *testing.T) {
+	s3, dir := newS3Handler(t, true)
+	fs := s3.Fs
+	fs.Trash = &Trash{}
+	os.MkdirAll(filepath.Join(dir, "docs", "old"), 0755)
+	os.WriteFile(filepath.Join(dir, "docs", "old", "a.txt"), []byte("aaaa"), 0644)
+	os.WriteFile(filepath.Join(dir, "docs", "b.txt"), []byte("bb"), 0644)
+	os.WriteFile(filepath.Join(dir, "docs", "c.txt"), []byte("ccc"), 0644)
+	os.WriteFile(filepath.Join(dir, "examplebucket", "d.txt"), []byte("d"), 0644)
+	h := NewCompHandler(&TrashHandler{Fs: fs}, &WebDAVHandler{Fs: fs, Prefix: "/dav"}, fs)
+	do := func(method, target string, headers map[string]string) {
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, withUser(r, "alice"))
+		if w.Code >= 400 {
+			t.Fatalf("%s %s = %d %s", method, target, w.Code, w.Body)
+		}
+	}
+
+	do(http.MethodPost, "/docs/c.txt?action=copy&to=/docs/b.txt&overwrite=true", nil)
+	do("MOVE", "/dav/docs/c.txt", map[string]string{"Destination": "/dav/docs/old", "Overwrite": "T"})
+	do(http.MethodDelete, "/dav/docs/b.txt", nil)
+	s3Do(t, s3, http.MethodDelete, "/examplebucket/d.txt", "", nil)
+
+	items := listTrash(t, h, "alice")
+	want := []struct {
+		path  string
+		isDir bool
+		user  string
+	}{
+		{"/docs/b.txt", false, "alice"},
+		{"/docs/old", true, "alice"},
+		{"/docs/b.txt", false, "alice"},
+		{"/examplebucket/d.txt", false, testAccessKey},
+	}
+	if len(items) != len(want) {
+		t.Fatalf("trash = %+v", items)
+	}
+	// The list is newest first.
+	for i, w := range want {
+		it := items[len(items)-1-i]
+		if it.Path != w.path || it.IsDir != w.isDir || it.DeletedBy != w.user {
+			t.Errorf("entry %d = %+v, want %+v", i, it, w)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "docs", "old")); string(b) != "ccc" {
+		t.Fatalf("moved file = %q, %v", b, err)
+	}
+}
+
+func Test_Trash_deleteDisabled(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+	fs := &FSHandler{Basedir: dir, Trash: &Trash{}}
+	h := NewCompHandler(&TrashHandler{Fs: fs}, fs)
+	do := func(method, target string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, withUser(httptest.NewRequest(method, target, nil), "alice"))
+		return w.Code
+	}
+
+	// Replaced files go to the trash even where deletes are disabled, and
+	// must not be destroyed from there.
+	if code := do(http.MethodPost, "/a.txt?action=copy&to=/b.txt&overwrite=true"); code != http.StatusNoContent {
+		t.Fatalf("overwriting copy = %d", code)
+	}
+	items := listTrash(t, h, "alice")
+	if len(items) != 1 {
+		t.Fatalf("trash = %+v", items)
+	}
+	if code := do(http.MethodDelete, trashPrefix+"/"+items[0].ID); code != http.StatusForbidden {
+		t.Errorf("purge = %d", code)
+	}
+	if code := do(http.MethodDelete, trashPrefix); code != http.StatusNoContent {
+		t.Errorf("empty = %d", code)
+	}
+	if items := listTrash(t, h, "alice"); len(items) != 1 {
+		t.Fatalf("trash after purge and empty = %+v", items)
+	}
+}
+
+func Test_Trash_expire(t *testing.T) {
+	dir := t.TempDir()
+	fs := &FSHandler{Basedir: dir, AllowDelete: true, Trash: &Trash{MaxAge: time.Hour, MaxSize: 10}}
+	for _, name := range []string{"a", "b", "c"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat(name, 4)), 0644)
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/"+name, nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("DELETE /%s = %d", name, w.Code)
+		}
+	}
+
+	// 12 bytes are over the cap: the oldest entry went.
+	root, _ := fs.openRoot()
+	defer root.Close()
+	items, err := loadTrash(root)
+	if err != nil || len(items) != 2 || items[0].Path != "b" || items[1].Path != "c" {
+		t.Fatalf("trash = %+v, %v", items, err)
+	}
+
+	items[0].Deleted = time.Now().Add(-2 * time.Hour)
+	writeTrashItem(root, items[0])
+	if err := fs.PurgeTrash(); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ := loadTrash(root); len(items) != 1 || items[0].Path != "c" {
+		t.Fatalf("trash after expiry = %+v", items)
+	}
+
+	// Without a trash, deletes are for good.
+	fs.Trash = nil
+	os.WriteFile(filepath.Join(dir, "d"), []byte("d"), 0644)
+	fs.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/d", nil))
+	if items, _ := loadTrash(root); len(items) != 1 {
+		t.Fatalf("trash without Trash = %+v", items)
+	}
+}
+
+func Test_Trash_requiresAuth(t *testing.T) {
+	fs := &FSHandler{Basedir: t.TempDir(), AllowDelete: true, Trash: &Trash{}}
+	h := &AuthHandler{Username: "u", Password: "p", AuthWriteOnly: true, Next: NewCompHandler(&TrashHandler{Fs: fs}, fs)}
+
+	// Reads are public, but not those of the trash.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, trashPrefix, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous GET %s = %d", trashPrefix, w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, trashPrefix, nil)
+	r.SetBasicAuth("u", "p")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("GET %s = %d %s", trashPrefix, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,485 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusPrefix     = "/_tus/"
+
+	// tusDir holds partial uploads inside Basedir. It is hidden from listings
+	// and cannot be reached through the regular file API.
+	tusDir = ".tus"
+
+	defaultTusExpiration = 24 * time.Hour
+)
+
+// TusHandler implements the tus 1.0 resumable upload protocol with the
+// creation, termination and expiration extensions.
+//
+// An upload is created by a POST carrying a Tus-Resumable header to the
+// destination path (a directory ending in "/" plus a "filename" metadata
+// entry, or a full file path). Data is appended with PATCH requests to the
+// returned /_tus/<id> location and renamed into place once complete.
+type TusHandler struct {
+	Fs *FSHandler
+	// MaxSize limits the length of a single upload; 0 means unlimited.
+	MaxSize int64
+	// Expiration is how long an unfinished upload is kept after its last
+	// write; 0 means defaultTusExpiration.
+	Expiration time.Duration
+
+	locks sync.Map // upload id -> *sync.Mutex
+}
+
+type tusUpload struct {
+	ID       string            `json:"id"`
+	Size     int64             `json:"size"`
+	Target   string            `json:"target"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Expires  time.Time         `json:"expires"`
+}
+
+func (h *TusHandler) accept(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, tusPrefix) {
+		return true
+	}
+	return r.Header.Get("Tus-Resumable") != "" && (r.Method == http.MethodPost || r.Method == http.MethodOptions)
+}
+
+func (h *TusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	code, err := h.serve(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+	}
+	logRequest(r, "tus", h.Fs.Prefix+r.URL.Path, code, err)
+}
+
+func (h *TusHandler) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method == http.MethodOptions {
+		return h.serveOptions(w, r)
+	}
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		return http.StatusPreconditionFailed, fmt.Errorf("unsupported tus version %q", v)
+	}
+
+	if !strings.HasPrefix(r.URL.Path, tusPrefix) {
+		if r.Method != http.MethodPost {
+			return http.StatusMethodNotAllowed, errors.New("method not allowed")
+		}
+		return h.serveCreation(w, r)
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusPrefix)
+	if !validTusID(id) {
+		return http.StatusNotFound, fmt.Errorf("unknown upload %q", id)
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		return h.serveHead(w, r, id)
+	case http.MethodPatch:
+		return h.servePatch(w, r, id)
+	case http.MethodDelete:
+		return h.serveTermination(w, r, id)
+	default:
+		return http.StatusMethodNotAllowed, errors.New("method not allowed")
+	}
+}
+
+func (h *TusHandler) serveOptions(w http.ResponseWriter, r *http.Request) (int, error) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if h.MaxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+func (h *TusHandler) serveCreation(w http.ResponseWriter, r *http.Request) (int, error) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return http.StatusBadRequest, errors.New("missing or invalid Upload-Length")
+	}
+	if h.MaxSize > 0 && size > h.MaxSize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("upload of %d bytes exceeds the %d byte limit", size, h.MaxSize)
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	target := r.URL.Path
+	if strings.HasSuffix(target, "/") {
+		// Same sanitization as multipart uploads in serveCreate.
+		cleanName := filepath.Base(metadata["filename"])
+		if cleanName == "." || cleanName == string(filepath.Separator) {
+			return http.StatusBadRequest, fmt.Errorf("invalid filename %q", metadata["filename"])
+		}
+		target = path.Join(target, cleanName)
+	}
+	rel := toRelPath(target)
+	if rel == "." || isInternalPath(rel) {
+		return http.StatusBadRequest, fmt.Errorf("invalid upload target %q", target)
+	}
+	if code, err := h.Fs.checkAccess(w, r, rel, permWrite); err != nil {
+		return code, err
+	}
+
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	if info, err := root.Stat(rel); err == nil && info.IsDir() {
+		return http.StatusConflict, fmt.Errorf("%q is a existing directory", target)
+	}
+
+	h.purgeExpired(root)
+
+	if err := root.Mkdir(tusDir, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return http.StatusInternalServerError, err
+	}
+
+	id, err := newTusID()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	upload := &tusUpload{
+		ID:       id,
+		Size:     size,
+		Target:   rel,
+		Metadata: metadata,
+		Expires:  time.Now().Add(h.expiration()),
+	}
+
+	data, err := root.OpenFile(tusDataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	data.Close()
+	if err := writeTusUpload(root, upload); err != nil {
+		_ = root.Remove(tusDataPath(id))
+		return http.StatusInternalServerError, err
+	}
+
+	if size == 0 {
+		if err := h.finish(r, root, upload); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	w.Header().Set("Location", h.Fs.Prefix+tusPrefix+id)
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	return http.StatusCreated, nil
+}
+
+func (h *TusHandler) serveHead(w http.ResponseWriter, r *http.Request, id string) (int, error) {
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	upload, offset, code, err := h.load(root, id)
+	if err != nil {
+		return code, err
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	if len(upload.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
+}
+
+func (h *TusHandler) servePatch(w http.ResponseWriter, r *http.Request, id string) (int, error) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return http.StatusUnsupportedMediaType, errors.New("content type must be application/offset+octet-stream")
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return http.StatusBadRequest, errors.New("missing or invalid Upload-Offset")
+	}
+
+	unlock, ok := h.lock(id)
+	if !ok {
+		return http.StatusLocked, fmt.Errorf("upload %q is being written by another request", id)
+	}
+	defer unlock()
+
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	upload, current, code, err := h.load(root, id)
+	if err != nil {
+		return code, err
+	}
+	if offset != current {
+		return http.StatusConflict, fmt.Errorf("offset mismatch: upload is at %d, request is at %d", current, offset)
+	}
+
+	data, err := root.OpenFile(tusDataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	done := h.Fs.Metrics.upload()
+	n, copyErr := io.Copy(data, io.LimitReader(r.Body, upload.Size-current))
+	done(n)
+	if err := data.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	current += n
+
+	// Whatever was received is kept so that the client can resume from it,
+	// even if the body was cut short.
+	upload.Expires = time.Now().Add(h.expiration())
+	if err := writeTusUpload(root, upload); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if copyErr != nil {
+		return http.StatusInternalServerError, copyErr
+	}
+
+	if current == upload.Size {
+		if err := h.finish(r, root, upload); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		h.locks.Delete(id)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+func (h *TusHandler) serveTermination(w http.ResponseWriter, r *http.Request, id string) (int, error) {
+	unlock, ok := h.lock(id)
+	if !ok {
+		return http.StatusLocked, fmt.Errorf("upload %q is being written by another request", id)
+	}
+	defer unlock()
+
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	if _, _, code, err := h.load(root, id); err != nil {
+		return code, err
+	}
+	h.remove(root, id)
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// load reads the upload state and its current offset. Expired uploads are
+// removed and reported as gone.
+func (h *TusHandler) load(root *os.Root, id string) (*tusUpload, int64, int, error) {
+	b, err := root.ReadFile(tusInfoPath(id))
+	if err != nil {
+		// Forget the lock a PATCH or DELETE took for an unknown id.
+		h.locks.Delete(id)
+		return nil, 0, http.StatusNotFound, fmt.Errorf("unknown upload %q", id)
+	}
+	upload := &tusUpload{}
+	if err := json.Unmarshal(b, upload); err != nil {
+		return nil, 0, http.StatusInternalServerError, err
+	}
+	if time.Now().After(upload.Expires) {
+		h.remove(root, id)
+		return nil, 0, http.StatusGone, fmt.Errorf("upload %q expired", id)
+	}
+	info, err := root.Stat(tusDataPath(id))
+	if err != nil {
+		return nil, 0, http.StatusInternalServerError, err
+	}
+	return upload, info.Size(), http.StatusOK, nil
+}
+
+// finish moves a completed upload to its destination.
+func (h *TusHandler) finish(r *http.Request, root *os.Root, upload *tusUpload) (err error) {
+	e := AuditEntry{Action: "upload", Path: h.Fs.auditPath(upload.Target), Size: upload.Size}
+	info, statErr := root.Stat(upload.Target)
+	if statErr == nil && !info.IsDir() {
+		e.Action = "overwrite"
+	}
+	defer func() { h.Fs.changed(r, e, http.StatusInternalServerError, err) }()
+	if sum := h.Fs.auditHasher(); sum != nil {
+		// The content came in over several requests, so it is hashed
+		// once complete.
+		f, err := root.Open(tusDataPath(upload.ID))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(sum, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		e.SHA256 = hexSum(sum)
+	}
+
+	if dir := path.Dir(upload.Target); dir != "." {
+		if err := root.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+	var saved string
+	if e.Action == "overwrite" {
+		if saved, err = h.Fs.saveVersion(root, upload.Target, info); err != nil {
+			return err
+		}
+	}
+	if err := root.Rename(tusDataPath(upload.ID), upload.Target); err != nil {
+		dropVersion(root, saved)
+		return err
+	}
+	if saved != "" {
+		if err := h.Fs.pruneVersions(root, upload.Target); err != nil {
+			log.Printf("Prune versions of %q error %v", e.Path, err)
+		}
+	}
+	return root.Remove(tusInfoPath(upload.ID))
+}
+
+// purgeExpired removes unfinished uploads whose expiration has passed.
+func (h *TusHandler) purgeExpired(root *os.Root) {
+	dir, err := root.Open(tusDir)
+	if err != nil {
+		return
+	}
+	names, _ := dir.Readdirnames(-1)
+	dir.Close()
+
+	now := time.Now()
+	for _, name := range names {
+		id, ok := strings.CutSuffix(name, ".info")
+		if !ok || !validTusID(id) {
+			continue
+		}
+		b, err := root.ReadFile(tusInfoPath(id))
+		if err != nil {
+			continue
+		}
+		var upload tusUpload
+		if json.Unmarshal(b, &upload) != nil || now.After(upload.Expires) {
+			h.remove(root, id)
+		}
+	}
+}
+
+func (h *TusHandler) expiration() time.Duration {
+	if h.Expiration > 0 {
+		return h.Expiration
+	}
+	return defaultTusExpiration
+}
+
+// lock serializes writes to a single upload; it fails instead of blocking so
+// that a stalled connection cannot hold up a resumed one forever.
+func (h *TusHandler) lock(id string) (func(), bool) {
+	v, _ := h.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+func writeTusUpload(root *os.Root, upload *tusUpload) error {
+	b, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return root.WriteFile(tusInfoPath(upload.ID), b, 0600)
+}
+
+// remove deletes an unfinished upload and forgets its lock.
+func (h *TusHandler) remove(root *os.Root, id string) {
+	_ = root.Remove(tusDataPath(id))
+	_ = root.Remove(tusInfoPath(id))
+	h.locks.Delete(id)
+}
+
+func tusDataPath(id string) string { return tusDir + "/" + id + ".bin" }
+func tusInfoPath(id string) string { return tusDir + "/" + id + ".info" }
+
+func newTusID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs where the value is optional.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTusRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, "http://localhost"+target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", tusVersion)
+	return r
+}
+
+func tusCreate(t *testing.T, h *TusHandler, dir, name string, size int) string {
+	t.Helper()
+	r := newTusRequest(http.MethodPost, dir, "")
+	r.Header.Set("Upload-Length", strconv.Itoa(size))
+	r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(name)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creation: want 201, got %d: %s", w.Code, w.Body)
+	}
+	loc := w.Header().Get("Location")
+	if !strings.HasPrefix(loc, tusPrefix) {
+		t.Fatalf("creation: unexpected Location %q", loc)
+	}
+	return loc
+}
+
+func tusPatch(h *TusHandler, loc string, offset int, body string) *httptest.ResponseRecorder {
+	r := newTusRequest(http.MethodPatch, loc, body)
+	r.Header.Set("Content-Type", "application/offset+octet-stream")
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func Test_tusHandler_resumedUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := &TusHandler{Fs: &FSHandler{Basedir: tmpDir}}
+
+	loc := tusCreate(t, h, "/a/b/", "artifact.bin", 10)
+
+	if w := tusPatch(h, loc, 0, "hello"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first patch: got %d offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// A client reconnecting asks where to resume from.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTusRequest(http.MethodHead, loc, ""))
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "10" {
+		t.Fatalf("head: got %d offset %q length %q", w.Code, w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+
+	if w := tusPatch(h, loc, 0, "hello"); w.Code != http.StatusConflict {
+		t.Fatalf("stale offset: want 409, got %d", w.Code)
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "a/b/artifact.bin")); err == nil {
+		t.Fatal("incomplete upload must not be visible at its destination")
+	}
+
+	if w := tusPatch(h, loc, 5, "world"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("second patch: got %d offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmpDir, "a/b/artifact.bin"))
+	if err != nil || string(data) != "helloworld" {
+		t.Fatalf("completed upload: got %q, %v", data, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(tmpDir, tusDir))
+	if len(entries) != 0 {
+		t.Fatalf("upload state should be cleaned up, found %d entries", len(entries))
+	}
+}
+
+func Test_tusHandler_termination(t *testing.T) {
+	h := &TusHandler{Fs: &FSHandler{Basedir: t.TempDir()}}
+
+	loc := tusCreate(t, h, "/", "x.txt", 4)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTusRequest(http.MethodDelete, loc, ""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("termination: want 204, got %d", w.Code)
+	}
+
+	if w := tusPatch(h, loc, 0, "data"); w.Code != http.StatusNotFound {
+		t.Fatalf("patch after termination: want 404, got %d", w.Code)
+	}
+}
+
+func Test_tusHandler_expiration(t *testing.T) {
+	tmpDir := t.TempDir()
+	h := &TusHandler{Fs: &FSHandler{Basedir: tmpDir}, Expiration: time.Millisecond}
+
+	loc := tusCreate(t, h, "/", "x.txt", 4)
+	time.Sleep(5 * time.Millisecond)
+
+	if w := tusPatch(h, loc, 0, "data"); w.Code != http.StatusGone {
+		t.Fatalf("patch after expiry: want 410, got %d", w.Code)
+	}
+	id := strings.TrimPrefix(loc, tusPrefix)
+	if _, err := os.Stat(filepath.Join(tmpDir, tusDataPath(id))); err == nil {
+		t.Fatal("expired upload data should be removed")
+	}
+	if _, ok := h.locks.Load(id); ok {
+		t.Fatal("expired upload lock should be forgotten")
+	}
+}
+
+func Test_tusHandler_rejects(t *testing.T) {
+	h := &TusHandler{Fs: &FSHandler{Basedir: t.TempDir()}, MaxSize: 8}
+
+	tests := []struct {
+		name     string
+		target   string
+		version  string
+		length   string
+		filename string
+		wantCode int
+	}{
+		{"wrong version", "/", "0.2.0", "4", "x", http.StatusPreconditionFailed},
+		{"missing length", "/", tusVersion, "", "x", http.StatusBadRequest},
+		{"too large", "/", tusVersion, "9", "x", http.StatusRequestEntityTooLarge},
+		{"internal target", "/" + tusDir + "/", tusVersion, "4", "x", http.StatusBadRequest},
+		{"traversal filename", "/", tusVersion, "4", "../", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTusRequest(http.MethodPost, tt.target, "")
+			r.Header.Set("Tus-Resumable", tt.version)
+			r.Header.Set("Upload-Length", tt.length)
+			r.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(tt.filename)))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("want %d, got %d", tt.wantCode, w.Code)
+			}
+		})
+	}
+}
+
+func Test_readDir_hidesTusDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.Mkdir(filepath.Join(tmpDir, tusDir), 0700)
+	os.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+
+	h := FSHandler{Basedir: tmpDir}
+	infos, err := h.readDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "a.txt" {
+		t.Fatalf("unexpected listing %+v", infos)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"github.com/aix3/fileserver/web"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 )
 
 var asset http.Handler
@@ -22,6 +24,11 @@ func init() {
 
 type UIHandler struct {
 	Fs *FSHandler
+	// Shares enables the share actions of the UI.
+	Shares *ShareHandler
+	// Login adds sign in and sign out links to the UI, for when
+	// AuthHandler has a login page.
+	Login bool
 }
 
 func (h *UIHandler) accept(r *http.Request) bool {
@@ -41,35 +48,67 @@ type uiData struct {
 	Files       []fileInfo `json:"files"`
 	Path        string     `json:"path"`
 	AllowDelete bool       `json:"allow_delete"`
+	CanWrite    bool       `json:"can_write"`
+	CanMkdir    bool       `json:"can_mkdir"`
+	AllowShare  bool       `json:"allow_share"`
+	User        string     `json:"user"`
+	LoginURL    string     `json:"login_url,omitempty"`
+	LogoutURL   string     `json:"logout_url,omitempty"`
+	CSRFToken   string     `json:"csrf_token,omitempty"`
+	// EventsURL streams the changes to the directory, see EventsHandler.
+	EventsURL string `json:"events_url,omitempty"`
+	// Trash says deletes go to the trash, which TrashHandler serves.
+	Trash bool `json:"trash"`
+	// Versions says files keep their history, see FSHandler.serveVersions.
+	Versions bool `json:"versions"`
 }
 
 func (h *UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	if h.serve(sw, r) {
+		h.Fs.Metrics.request("ui", r.Method, sw.code, time.Since(start))
+	}
+}
+
+// serve answers r and reports whether it did so itself rather than leaving
+// it to the file handler.
+func (h *UIHandler) serve(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method != http.MethodGet {
 		h.Fs.ServeHTTP(w, r)
-		return
+		return false
 	}
 
 	if strings.HasPrefix(r.URL.Path, "/_ui/") {
 		asset.ServeHTTP(w, r)
-		return
+		return true
+	}
+
+	rel := toRelPath(r.URL.Path)
+	id := requestIdentity(r)
+	if !h.Fs.allowed(id, rel, permRead) {
+		// Let the file handler answer with the right 401 or 403.
+		h.Fs.ServeHTTP(w, r)
+		return false
 	}
 
 	_, info, err := h.Fs.stat(r.URL.Path)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
-		return
+		return true
 	}
 
-	if !info.IsDir() {
+	if !info.IsDir() || r.URL.Query().Has("archive") {
 		h.Fs.ServeHTTP(w, r)
-		return
+		return false
 	}
 
 	infos, err := h.Fs.readDir(r.URL.Path)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return true
 	}
+	infos = h.Fs.filterReadable(id, rel, h.Fs.withMounts(rel, infos))
 
 	sort.Slice(infos, func(i, j int) bool {
 		a, b := infos[i], infos[j]
@@ -83,9 +122,34 @@ func (h *UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	})
 
 	data := uiData{
-		Files:       infos,
-		Path:        r.URL.Path,
-		AllowDelete: h.Fs.AllowDelete,
+		Files: infos,
+		Path:  h.Fs.Prefix + r.URL.Path,
+		// The buttons of the UI follow the permissions on the directory
+		// itself; the file handler still checks every request.
+		AllowDelete: h.Fs.AllowDelete && h.Fs.allowed(id, rel, permDelete),
+		CanWrite:    h.Fs.allowed(id, rel, permWrite),
+		CanMkdir:    h.Fs.allowed(id, rel, permMkdir),
+		AllowShare:  h.Shares != nil,
+		Trash:       h.Fs.Trash != nil,
+		Versions:    h.Fs.Versions != nil,
+		User:        id.name,
+		CSRFToken:   requestCSRFToken(r),
+	}
+	if h.Fs.Events != nil {
+		data.EventsURL = eventsPrefix + "?path=" + url.QueryEscape(data.Path)
+	}
+	if h.Login {
+		if id.name == "" {
+			data.LoginURL = loginURL(h.Fs.Prefix + r.URL.RequestURI())
+		} else {
+			data.LogoutURL = authPrefix + "logout"
+		}
+	}
+	if requestShare(r) != nil {
+		// Visitors of a share link only get to read, whatever the owner
+		// could do.
+		data.AllowDelete, data.CanWrite, data.CanMkdir, data.AllowShare, data.Trash, data.Versions = false, false, false, false, false, false
+		data.User, data.LoginURL, data.LogoutURL, data.EventsURL = "", "", "", ""
 	}
 
 	bytes, _ := json.Marshal(data)
@@ -95,6 +159,6 @@ func (h *UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err = index.Execute(w, string(bytes))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		return
 	}
+	return true
 }
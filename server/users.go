@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GehirnInc/crypt/sha512_crypt"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxVerifiedCache bounds the number of remembered successful logins.
+const maxVerifiedCache = 4096
+
+// Users is a set of accounts loaded from an htpasswd-style file with one
+// "name:hash" entry per line. Blank lines and lines starting with "#" are
+// ignored. Supported hashes are bcrypt ("$2y$", as written by
+// `htpasswd -B`), Argon2 in PHC format ("$argon2id$", "$argon2i$") and
+// SHA-512-crypt ("$6$").
+type Users struct {
+	path string
+
+	mu     sync.RWMutex
+	hashes map[string]string
+	// verified remembers credentials that matched, keyed by a digest of the
+	// name and password, so that slow hashes are not recomputed on every
+	// request. It is dropped whenever the file is reloaded.
+	verified map[[sha256.Size]byte]string
+}
+
+// LoadUsers reads the users file at path.
+func LoadUsers(path string) (*Users, error) {
+	u := &Users{path: path}
+	if err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Reload re-reads the users file. On error the previous accounts are kept.
+func (u *Users) Reload() error {
+	f, err := os.Open(u.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes, err := parseUsers(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", u.path, err)
+	}
+
+	u.mu.Lock()
+	u.hashes = hashes
+	u.verified = map[[sha256.Size]byte]string{}
+	u.mu.Unlock()
+	log.Printf("Loaded %d users from %q", len(hashes), u.path)
+	return nil
+}
+
+// Verify reports whether password is correct for the named user. Unknown
+// users cost as much as a wrong password, so response times do not reveal
+// which names exist.
+func (u *Users) Verify(name, password string) bool {
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+
+	u.mu.RLock()
+	hash, ok := u.hashes[name]
+	cached := u.verified[key]
+	u.mu.RUnlock()
+
+	if !ok {
+		_, _ = checkHash(dummyHash(), password)
+		return false
+	}
+	if cached != "" && subtle.ConstantTimeCompare([]byte(cached), []byte(hash)) == 1 {
+		return true
+	}
+	if match, err := checkHash(hash, password); err != nil || !match {
+		return false
+	}
+
+	u.mu.Lock()
+	if len(u.verified) >= maxVerifiedCache {
+		clear(u.verified)
+	}
+	u.verified[key] = hash
+	u.mu.Unlock()
+	return true
+}
+
+// Watch reloads the users file whenever it changes on disk.
+func (u *Users) Watch() error {
+	return watchFile(u.path, u.Reload)
+}
+
+// watchFile calls reload whenever the file at name changes. The parent
+// directory is watched rather than the file itself, so that editors and
+// tools that replace the file by renaming a new one over it are noticed.
+// Reload errors are logged.
+func watchFile(name string, reload func() error) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	name = filepath.Clean(name)
+	if err := w.Add(filepath.Dir(name)); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		// Writes often arrive as several events; reload once they settle.
+		var timer *time.Timer
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != name || !ev.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(100*time.Millisecond, func() {
+					if err := reload(); err != nil {
+						log.Printf("Reload %q error %v", name, err)
+					}
+				})
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Watch %q error %v", name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func parseUsers(r io.Reader) (map[string]string, error) {
+	hashes := map[string]string{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected \"name:hash\"", n)
+		}
+		if _, dup := hashes[name]; dup {
+			return nil, fmt.Errorf("line %d: duplicate user %q", n, name)
+		}
+		if err := validateHash(hash); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %w", n, name, err)
+		}
+		hashes[name] = hash
+	}
+	return hashes, s.Err()
+}
+
+func validateHash(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$argon2"):
+		_, err := parseArgon2(hash)
+		return err
+	case strings.HasPrefix(hash, "$6$"):
+		return nil
+	}
+	return errors.New("unsupported hash, want bcrypt, argon2 or SHA-512-crypt")
+}
+
+func isBcrypt(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHash compares password against hash in constant time.
+func checkHash(hash, password string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2"):
+		p, err := parseArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare(p.derive(password), p.key) == 1, nil
+	case strings.HasPrefix(hash, "$6$"):
+		err := sha512_crypt.New().Verify(hash, []byte(password))
+		return err == nil, nil
+	}
+	return false, errors.New("unsupported hash")
+}
+
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("fileserver"), bcrypt.DefaultCost)
+	return string(hash)
+})
+
+type argon2Params struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2 decodes a PHC string such as
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>".
+func parseArgon2(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return nil, errors.New("malformed argon2 hash")
+	}
+	p := &argon2Params{variant: parts[1]}
+	if p.variant != "argon2id" && p.variant != "argon2i" {
+		return nil, fmt.Errorf("unsupported argon2 variant %q", p.variant)
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2 parameters %q", parts[3])
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.New("malformed argon2 salt")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return nil, errors.New("malformed argon2 hash")
+	}
+	if p.time == 0 || p.threads == 0 {
+		return nil, errors.New("invalid argon2 parameters")
+	}
+	return p, nil
+}
+
+func (p *argon2Params) derive(password string) []byte {
+	keyLen := uint32(len(p.key))
+	if p.variant == "argon2i" {
+		return argon2.Key([]byte(password), p.salt, p.time, p.memory, p.threads, keyLen)
+	}
+	return argon2.IDKey([]byte(password), p.salt, p.time, p.memory, p.threads, keyLen)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sha512CryptVector is from the SHA-crypt specification test vectors.
+const sha512CryptVector = "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"
+
+func testUsersFile(t *testing.T) string {
+	t.Helper()
+	bc, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("argon-pass"), salt, 1, 64, 1, 32)
+	argon := fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	content := "# team\n" +
+		"alice:" + string(bc) + "\n" +
+		"\n" +
+		"bob:" + argon + "\n" +
+		"ci:" + sha512CryptVector + "\n"
+	p := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_Users_Verify(t *testing.T) {
+	users, err := LoadUsers(testUsersFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, pass string
+		want       bool
+	}{
+		{"alice", "bcrypt-pass", true},
+		{"alice", "bcrypt-pass", true}, // served from the cache
+		{"alice", "wrong", false},
+		{"bob", "argon-pass", true},
+		{"bob", "argon-pas", false},
+		{"ci", "Hello world!", true},
+		{"ci", "Hello world", false},
+		{"mallory", "bcrypt-pass", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := users.Verify(tt.name, tt.pass); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.name, tt.pass, got, tt.want)
+		}
+	}
+}
+
+func Test_parseUsers_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"no-colon", "alice\n", "line 1"},
+		{"empty-name", ":$6$salt$hash\n", "line 1"},
+		{"apr1", "# md5\nalice:$apr1$abc$def\n", "line 2: user \"alice\": unsupported hash"},
+		{"plain", "alice:secret\n", "unsupported hash"},
+		{"duplicate", "a:" + sha512CryptVector + "\na:" + sha512CryptVector + "\n", "duplicate user"},
+		{"argon-version", "a:$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA\n", "unsupported argon2 version"},
+		{"argon-params", "a:$argon2id$v=19$m=64$c2FsdA$aGFzaA\n", "malformed argon2 parameters"},
+		{"bcrypt", "a:$2y$10$short\n", "line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseUsers(strings.NewReader(tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseUsers error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Users_Reload(t *testing.T) {
+	p := testUsersFile(t)
+	users, err := LoadUsers(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(p, []byte("broken\n"), 0600)
+	if err := users.Reload(); err == nil {
+		t.Fatal("Reload of a broken file should fail")
+	}
+	if !users.Verify("ci", "Hello world!") {
+		t.Fatal("a failed reload should keep the previous users")
+	}
+
+	os.WriteFile(p, []byte("dave:"+sha512CryptVector+"\n"), 0600)
+	if err := users.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if users.Verify("ci", "Hello world!") || !users.Verify("dave", "Hello world!") {
+		t.Fatal("Reload should replace the users")
+	}
+}
+
+func Test_Users_Watch(t *testing.T) {
+	p := testUsersFile(t)
+	users, err := LoadUsers(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Watch(); err != nil {
+		t.Skip(err)
+	}
+
+	// Replace the file the way editors do: write a new one and rename it.
+	tmp := p + ".new"
+	os.WriteFile(tmp, []byte("erin:"+sha512CryptVector+"\n"), 0600)
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !users.Verify("erin", "Hello world!") {
+		if time.Now().After(deadline) {
+			t.Fatal("users file change was not picked up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBasicAuthHandler_usersFile(t *testing.T) {
+	users, err := LoadUsers(testUsersFile(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = requestUser(r) })
+
+	h := &BasicAuthHandler{
+		Username:      "admin",
+		Password:      "secret",
+		Users:         users,
+		AuthWriteOnly: true,
+		Next:          next,
+	}
+
+	tests := []struct {
+		method, user, pass string
+		wantCode           int
+		wantUser           string
+	}{
+		{http.MethodPost, "bob", "argon-pass", http.StatusOK, "bob"},
+		{http.MethodPost, "admin", "secret", http.StatusOK, "admin"},
+		{http.MethodPost, "bob", "wrong", http.StatusUnauthorized, ""},
+		{http.MethodGet, "alice", "bcrypt-pass", http.StatusOK, "alice"},
+		{http.MethodGet, "alice", "wrong", http.StatusOK, ""},
+		{http.MethodGet, "", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		got = ""
+		req := httptest.NewRequest(tt.method, "/", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.wantCode || got != tt.wantUser {
+			t.Errorf("%s as %q: got %d user %q, want %d user %q", tt.method, tt.user, w.Code, got, tt.wantCode, tt.wantUser)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// versionDir keeps the replaced versions of files inside Basedir, at
+	// .versions/<path of the file>/<id>, where the id is the time the
+	// version was replaced in nanoseconds, zero-padded so that ids sort by
+	// time.
+	versionDir = ".versions"
+
+	// versionsInterval is how often Versions.Run prunes old versions.
+	versionsInterval = time.Hour
+)
+
+// Versions makes FSHandler and TusHandler keep the content a file had
+// before an upload replaced it. Versions are pruned when they are not among
+// the Keep most recent ones of their file, or are older than MaxAge;
+// either limit may be 0 to not apply it.
+type Versions struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+// versionInfo describes a version in ?versions listings.
+type versionInfo struct {
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Saved is when the version was replaced.
+	Saved time.Time `json:"saved"`
+}
+
+// versionsPath returns the directory of the versions of rel.
+func versionsPath(rel string) string { return versionDir + "/" + rel }
+
+func versionID(t time.Time) string { return fmt.Sprintf("%020d", t.UnixNano()) }
+
+// versionTime parses a version id, reporting whether it is one.
+func versionTime(id string) (time.Time, bool) {
+	if len(id) != 20 {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// saveVersion keeps the current content of the file rel, described by
+// info, as a version, and returns where it went. The version is a hard link
+// to the file, which uploads replace by renaming rather than rewrite, or a
+// copy where links are not supported.
+func (h *FSHandler) saveVersion(root *os.Root, rel string, info fs.FileInfo) (string, error) {
+	if h.Versions == nil || !info.Mode().IsRegular() {
+		return "", nil
+	}
+	dir := versionsPath(rel)
+	if err := root.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	for t := time.Now(); ; t = t.Add(1) {
+		saved := dir + "/" + versionID(t)
+		err := root.Link(rel, saved)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			if err := copyFile(root, rel, saved, info); err != nil {
+				return "", err
+			}
+		}
+		return saved, nil
+	}
+}
+
+// dropVersion undoes saveVersion after the upload failed.
+func dropVersion(root *os.Root, saved string) {
+	if saved != "" {
+		_ = root.Remove(saved)
+	}
+}
+
+// overwrite calls replace, which replaces the file rel, after keeping its
+// current content, described by info, as a version. info is nil if rel does
+// not exist yet.
+func (h *FSHandler) overwrite(root *os.Root, rel string, info fs.FileInfo, replace func() error) error {
+	var saved string
+	if info != nil {
+		var err error
+		if saved, err = h.saveVersion(root, rel, info); err != nil {
+			return err
+		}
+	}
+	if err := replace(); err != nil {
+		dropVersion(root, saved)
+		return err
+	}
+	if saved != "" {
+		if err := h.pruneVersions(root, rel); err != nil {
+			log.Printf("Prune versions of %q error %v", h.auditPath(rel), err)
+		}
+	}
+	return nil
+}
+
+// supersede removes rel, described by info, before a move or copy puts
+// something else there on behalf of user. A regular file is kept as a
+// version if there are versions; anything else goes where deletes go.
+func (h *FSHandler) supersede(root *os.Root, rel string, info fs.FileInfo, user string) error {
+	if h.Versions == nil || !info.Mode().IsRegular() {
+		return h.discard(root, rel, info, user)
+	}
+	return h.overwrite(root, rel, info, func() error { return root.Remove(rel) })
+}
+
+// loadVersions returns the versions of rel, newest first.
+func loadVersions(root *os.Root, rel string) ([]versionInfo, error) {
+	entries, err := readDirInRoot(root, versionsPath(rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var versions []versionInfo
+	for _, entry := range entries {
+		saved, ok := versionTime(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		versions = append(versions, versionInfo{ID: entry.Name(), Size: info.Size(), ModTime: info.ModTime(), Saved: saved})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+	return versions, nil
+}
+
+// pruneVersions removes the versions of rel past Keep or MaxAge.
+func (h *FSHandler) pruneVersions(root *os.Root, rel string) error {
+	versions, err := loadVersions(root, rel)
+	if err != nil {
+		return err
+	}
+	for i, v := range versions {
+		expired := h.Versions.MaxAge > 0 && time.Since(v.Saved) > h.Versions.MaxAge
+		if !expired && (h.Versions.Keep <= 0 || i < h.Versions.Keep) {
+			continue
+		}
+		if err := root.Remove(versionsPath(rel) + "/" + v.ID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run prunes the versions of dirs now and then every hour, until ctx is
+// done, so that the versions of files no longer uploaded expire too.
+func (v *Versions) Run(ctx context.Context, dirs []*FSHandler) {
+	ticker := time.NewTicker(versionsInterval)
+	defer ticker.Stop()
+	for {
+		for _, h := range dirs {
+			if err := h.PruneVersions(); err != nil {
+				log.Printf("Prune versions %q error %v", h.Basedir, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PruneVersions removes the versions past Keep or MaxAge of every file, and
+// the directories left empty.
+func (h *FSHandler) PruneVersions() error {
+	if h.Versions == nil {
+		return nil
+	}
+	root, err := h.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if _, err := root.Stat(versionDir); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return h.pruneVersionTree(root, ".")
+}
+
+func (h *FSHandler) pruneVersionTree(root *os.Root, rel string) error {
+	entries, err := readDirInRoot(root, versionsPath(rel))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err := h.pruneVersionTree(root, path.Join(rel, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if rel == "." {
+		return nil
+	}
+	if err := h.pruneVersions(root, rel); err != nil {
+		return err
+	}
+	// Fails unless the directory is empty, which is fine.
+	_ = root.Remove(versionsPath(rel))
+	return nil
+}
+
+// serveVersions lists the versions of a file:
+//
+//	GET /path/to/file?versions
+func (h *FSHandler) serveVersions(w http.ResponseWriter, r *http.Request) (int, error) {
+	rel, code, err := h.versionedFile(w, r, permRead)
+	if err != nil {
+		return code, err
+	}
+	root, err := h.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+	versions, err := loadVersions(root, rel)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if versions == nil {
+		versions = []versionInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(versions)
+	return http.StatusOK, nil
+}
+
+// serveVersion downloads a version of a file:
+//
+//	GET /path/to/file?version=<id>
+func (h *FSHandler) serveVersion(w http.ResponseWriter, r *http.Request) (int, error) {
+	rel, code, err := h.versionedFile(w, r, permRead)
+	if err != nil {
+		return code, err
+	}
+	root, err := h.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+	f, info, code, err := openVersion(root, rel, r.URL.Query().Get("version"))
+	if err != nil {
+		return code, err
+	}
+	defer f.Close()
+
+	w, done := h.Metrics.download(w)
+	defer done()
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(rel)))
+	http.ServeContent(w, r, path.Base(rel), info.ModTime(), f)
+	return http.StatusOK, nil
+}
+
+// serveRestoreVersion makes a version the current content of its file,
+// keeping the content it replaces as a version too:
+//
+//	POST /path/to/file?action=restore&version=<id>
+func (h *FSHandler) serveRestoreVersion(w http.ResponseWriter, r *http.Request) (code int, err error) {
+	rel := toRelPath(r.URL.Path)
+	var stored int64
+	sum := h.auditHasher()
+	defer func() {
+		e := AuditEntry{Action: "overwrite", Path: h.auditPath(rel), Size: stored, SHA256: hexSum(sum)}
+		h.changed(r, e, code, err)
+	}()
+	if _, code, err := h.versionedFile(w, r, permWrite); err != nil {
+		return code, err
+	}
+	root, err := h.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+	f, _, code, err := openVersion(root, rel, r.URL.Query().Get("version"))
+	if err != nil {
+		return code, err
+	}
+	defer f.Close()
+
+	var saved string
+	if info, err := root.Stat(rel); err == nil {
+		if info.IsDir() {
+			return http.StatusConflict, fmt.Errorf("%q is a existing directory", r.URL.Path)
+		}
+		if saved, err = h.saveVersion(root, rel, info); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	src := io.Reader(f)
+	if sum != nil {
+		src = io.TeeReader(f, sum)
+	}
+	if stored, err = writeFileAtomic(root, rel, src); err != nil {
+		dropVersion(root, saved)
+		return http.StatusInternalServerError, err
+	}
+	if err := h.pruneVersions(root, rel); err != nil {
+		log.Printf("Prune versions of %q error %v", h.auditPath(rel), err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// versionedFile checks a request for the versions of a file, returning
+// the path of the file.
+func (h *FSHandler) versionedFile(w http.ResponseWriter, r *http.Request, perm permission) (string, int, error) {
+	rel := toRelPath(r.URL.Path)
+	if h.Versions == nil || requestShare(r) != nil {
+		return "", http.StatusNotFound, errors.New("file versions are disabled")
+	}
+	if rel == "." {
+		return "", http.StatusBadRequest, errors.New("directories have no versions")
+	}
+	if code, err := h.checkAccess(w, r, rel, perm); err != nil {
+		return "", code, err
+	}
+	return rel, http.StatusOK, nil
+}
+
+func openVersion(root *os.Root, rel, id string) (*os.File, fs.FileInfo, int, error) {
+	if _, ok := versionTime(id); !ok {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid version %q", id)
+	}
+	f, err := root.Open(versionsPath(rel) + "/" + id)
+	if err != nil {
+		return nil, nil, http.StatusNotFound, fmt.Errorf("version %q of %q not found", id, "/"+rel)
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, http.StatusNotFound, fmt.Errorf("version %q of %q not found", id, "/"+rel)
+	}
+	return f, info, http.StatusOK, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Versions(t *testing.T) {
+	dir := t.TempDir()
+	fs := &FSHandler{Basedir: dir, Versions: &Versions{Keep: 2}}
+	tus := &TusHandler{Fs: fs}
+	h := NewCompHandler(tus, fs)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	list := func() []versionInfo {
+		t.Helper()
+		w := do(http.MethodGet, "/a.txt?versions", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET ?versions = %d %s", w.Code, w.Body)
+		}
+		var versions []versionInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &versions); err != nil {
+			t.Fatal(err)
+		}
+		return versions
+	}
+
+	do(http.MethodPut, "/a.txt", "one")
+	if versions := list(); len(versions) != 0 {
+		t.Fatalf("versions of a new file = %+v", versions)
+	}
+	do(http.MethodPut, "/a.txt", "two")
+	loc := tusCreate(t, tus, "/", "a.txt", 5)
+	if w := tusPatch(tus, loc, 0, "three"); w.Code != http.StatusNoContent {
+		t.Fatalf("tus patch = %d", w.Code)
+	}
+	do(http.MethodPut, "/a.txt", "four")
+
+	// Only the two most recent versions are kept.
+	versions := list()
+	if len(versions) != 2 || versions[0].Size != 5 || versions[1].Size != 3 {
+		t.Fatalf("versions = %+v", versions)
+	}
+	if w := do(http.MethodGet, "/a.txt?version="+versions[1].ID, ""); w.Code != http.StatusOK || w.Body.String() != "two" {
+		t.Fatalf("GET ?version = %d %q", w.Code, w.Body)
+	}
+	if w := do(http.MethodGet, "/a.txt?version=00000000000000000001", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET unknown version = %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/a.txt?version=../../etc/passwd", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET invalid version = %d", w.Code)
+	}
+
+	// Restoring keeps the content it replaces.
+	if w := do(http.MethodPost, "/a.txt?action=restore&version="+versions[1].ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("restore = %d %s", w.Code, w.Body)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(b) != "two" {
+		t.Fatalf("restored content = %q", b)
+	}
+	if versions := list(); len(versions) != 2 || versions[0].Size != 4 || versions[1].Size != 5 {
+		t.Fatalf("versions after restore = %+v", versions)
+	}
+
+	// The versions are hidden, and gone from shares.
+	if w := do(http.MethodGet, "/"+versionDir+"/", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /%s/ = %d", versionDir, w.Code)
+	}
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, withShare(httptest.NewRequest(http.MethodGet, "/a.txt?versions", nil), &share{Path: "a.txt"}))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET ?versions through a share = %d", w.Code)
+	}
+}
+
+// Test_Versions_replaced checks that WebDAV, S3 and overwriting moves and
+// copies keep the content they replace as a version.
+func Test_Versions_replaced(t *testing.T) {
+	s3, dir := newS3Handler(t, false)
+	fs := s3.Fs
+	fs.Versions = &Versions{}
+	os.WriteFile(filepath.Join(dir, "examplebucket", "src.txt"), []byte("copied"), 0644)
+	h := NewCompHandler(&WebDAVHandler{Fs: fs, Prefix: "/dav"}, fs)
+	do := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code >= 400 {
+			t.Fatalf("%s %s = %d %s", method, target, w.Code, w.Body)
+		}
+		return w
+	}
+
+	do(http.MethodPut, "/dav/examplebucket/a.txt", "dav put", nil)
+	do(http.MethodPut, "/dav/examplebucket/a.txt", "dav overwrite", nil)
+	do("COPY", "/dav/examplebucket/src.txt", "", map[string]string{"Destination": "/dav/examplebucket/a.txt"})
+	s3Do(t, s3, http.MethodPut, "/examplebucket/a.txt", "s3 put", nil)
+	s3Do(t, s3, http.MethodPut, "/examplebucket/a.txt", "", map[string]string{"X-Amz-Copy-Source": "/examplebucket/src.txt"})
+	do(http.MethodPut, "/examplebucket/b.txt", "moved", nil)
+	do(http.MethodPost, "/examplebucket/b.txt?action=move&to=/examplebucket/a.txt&overwrite=true", "", nil)
+
+	var versions []versionInfo
+	if err := json.Unmarshal(do(http.MethodGet, "/examplebucket/a.txt?versions", "", nil).Body.Bytes(), &versions); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"copied", "s3 put", "copied", "dav overwrite", "dav put"}
+	if len(versions) != len(want) {
+		t.Fatalf("versions = %+v", versions)
+	}
+	for i, v := range versions {
+		if got := do(http.MethodGet, "/examplebucket/a.txt?version="+v.ID, "", nil).Body.String(); got != want[i] {
+			t.Errorf("version %d = %q, want %q", i, got, want[i])
+		}
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "examplebucket", "a.txt")); string(b) != "moved" {
+		t.Errorf("a.txt = %q", b)
+	}
+}
+
+func Test_Versions_maxAge(t *testing.T) {
+	dir := t.TempDir()
+	fs := &FSHandler{Basedir: dir, Versions: &Versions{MaxAge: time.Hour}}
+	for _, body := range []string{"one", "two", "three"} {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/docs/a.txt", strings.NewReader(body)))
+	}
+	root, _ := fs.openRoot()
+	defer root.Close()
+	versions, _ := loadVersions(root, "docs/a.txt")
+	if len(versions) != 2 {
+		t.Fatalf("versions = %+v", versions)
+	}
+
+	// Age the oldest version past MaxAge.
+	old := versionID(time.Now().Add(-2 * time.Hour))
+	if err := root.Rename(versionsPath("docs/a.txt")+"/"+versions[1].ID, versionsPath("docs/a.txt")+"/"+old); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PruneVersions(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := loadVersions(root, "docs/a.txt"); len(versions) != 1 || versions[0].Size != 3 {
+		t.Fatalf("versions after pruning = %+v", versions)
+	}
+
+	// Once all versions expire, their directories go too.
+	fs.Versions.MaxAge = time.Nanosecond
+	if err := fs.PruneVersions(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, versionDir)); len(entries) != 0 {
+		t.Fatalf("versions directory = %v", entries)
+	}
+}
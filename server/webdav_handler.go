@@ -0,0 +1,428 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// WebDAVHandler serves Basedir over WebDAV (class 1 and 2) below Prefix so it
+// can be mounted by Finder, Windows Explorer, davfs2 or rclone. Files are
+// accessed through the same os.Root confinement as FSHandler, deletes and
+// COPY or MOVE over an existing collection honour FSHandler.AllowDelete,
+// FSHandler.ACL applies to every method, and uploads are written atomically.
+type WebDAVHandler struct {
+	Fs     *FSHandler
+	Prefix string
+
+	once    sync.Once
+	handler *webdav.Handler
+}
+
+func (h *WebDAVHandler) accept(r *http.Request) bool {
+	prefix := strings.TrimSuffix(h.Prefix, "/")
+	return r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/")
+}
+
+func (h *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		h.handler = &webdav.Handler{
+			Prefix:     strings.TrimSuffix(h.Prefix, "/"),
+			FileSystem: &davFS{fs: h.Fs},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if p, ok := r.Context().Value(davErrKey{}).(*error); ok && err != nil {
+					*p = err
+				}
+				if !noteError(r, err) {
+					log.Printf("dav %s %s %s - %v", logUser(r), r.Method, r.URL.Path, err)
+				}
+			},
+		}
+	})
+
+	if e, ok := h.auditEntry(r); ok {
+		// The change is recorded once for the whole request, as FSHandler
+		// does, rather than for each file a COPY or MOVE touches.
+		aw := &accessWriter{ResponseWriter: w}
+		var err error
+		r = r.WithContext(context.WithValue(r.Context(), davErrKey{}, &err))
+		defer func() {
+			if err == nil && aw.code >= http.StatusBadRequest {
+				err = errors.New(http.StatusText(aw.code))
+			}
+			if body, ok := r.Context().Value(putBodyKey{}).(*recordingReader); ok && err == nil {
+				e.Size, e.SHA256 = body.n, hexSum(body.sum)
+			}
+			h.Fs.changed(r, e, aw.code, err)
+		}()
+		w = aw
+	}
+
+	if r.Method == http.MethodDelete && !h.Fs.AllowDelete {
+		h.fail(w, r, http.StatusForbidden, errors.New("delete is disabled"))
+		return
+	}
+	if r.Method == "MOVE" && !h.Fs.AllowDelete && h.isDir(r) {
+		// Moving a collection removes it, which FSHandler.serveMove refuses
+		// too.
+		h.fail(w, r, http.StatusForbidden, errors.New("moving a directory requires delete to be enabled"))
+		return
+	}
+	if code, err := h.authorize(w, r); err != nil {
+		h.fail(w, r, code, err)
+		return
+	}
+
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		r = r.WithContext(context.WithValue(r.Context(), davReplaceKey{}, true))
+	}
+	if r.Method == http.MethodPut && r.Body != nil {
+		// Let the atomic file created for this PUT find out whether the body
+		// was received completely before it replaces the destination.
+		body := &recordingReader{r: r.Body, sum: h.Fs.auditHasher()}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, r.Body}
+		r = r.WithContext(context.WithValue(r.Context(), putBodyKey{}, body))
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// fail answers r with an error before it reaches the webdav package.
+func (h *WebDAVHandler) fail(w http.ResponseWriter, r *http.Request, code int, err error) {
+	if p, ok := r.Context().Value(davErrKey{}).(*error); ok {
+		*p = err
+	}
+	http.Error(w, err.Error(), code)
+	logRequest(r, "dav", r.URL.Path, code, err)
+}
+
+// auditEntry describes the change r makes to the files, for the audit log,
+// webhooks and events, or returns false if r changes none.
+func (h *WebDAVHandler) auditEntry(r *http.Request) (AuditEntry, bool) {
+	rel := toRelPath(h.strip(r.URL.Path))
+	e := AuditEntry{Path: h.Fs.auditPath(rel)}
+	switch r.Method {
+	case http.MethodPut:
+		e.Action = "upload"
+		if root, err := h.Fs.openRoot(); err == nil {
+			if info, err := root.Stat(rel); err == nil && !info.IsDir() {
+				e.Action = "overwrite"
+			}
+			root.Close()
+		}
+	case "MKCOL":
+		e.Action = "mkdir"
+	case http.MethodDelete:
+		e.Action = "delete"
+	case "COPY", "MOVE":
+		e.Action = strings.ToLower(r.Method)
+		if u, err := url.Parse(r.Header.Get("Destination")); err == nil {
+			e.To = h.Fs.auditPath(toRelPath(h.strip(u.Path)))
+		}
+	default:
+		return AuditEntry{}, false
+	}
+	return e, true
+}
+
+// authorize checks the ACL before a request reaches the webdav package,
+// which would turn permission errors from the file system into 404 or 405.
+// Listings are filtered by davFile instead.
+func (h *WebDAVHandler) authorize(w http.ResponseWriter, r *http.Request) (int, error) {
+	if h.Fs.ACL == nil {
+		return http.StatusOK, nil
+	}
+	rel := toRelPath(h.strip(r.URL.Path))
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, "PROPFIND":
+		return h.Fs.checkAccess(w, r, rel, permRead)
+	case http.MethodPut, "PROPPATCH", "LOCK", "UNLOCK":
+		return h.Fs.checkAccess(w, r, rel, permWrite)
+	case "MKCOL":
+		return h.Fs.checkAccess(w, r, rel, permMkdir)
+	}
+
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer root.Close()
+
+	switch r.Method {
+	case http.MethodDelete:
+		return h.Fs.checkTree(w, r, root, rel, permDelete)
+	case "COPY", "MOVE":
+		perm := permRead
+		if r.Method == "MOVE" {
+			perm = permWrite
+		}
+		if code, err := h.Fs.checkTree(w, r, root, rel, perm); err != nil {
+			return code, err
+		}
+		if r.Method == "MOVE" {
+			if code, err := h.Fs.checkTree(w, r, root, rel, permDelete); err != nil {
+				return code, err
+			}
+		}
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			// Left for the webdav package to reject.
+			return http.StatusOK, nil
+		}
+		dst := toRelPath(h.strip(u.Path))
+		if r.Header.Get("Overwrite") != "F" {
+			if code, err := h.Fs.checkTree(w, r, root, dst, permDelete); err != nil {
+				return code, err
+			}
+		}
+		return h.Fs.checkRelocation(w, r, root, rel, dst)
+	}
+	return http.StatusOK, nil
+}
+
+// isDir returns whether the resource of r is a directory.
+func (h *WebDAVHandler) isDir(r *http.Request) bool {
+	root, err := h.Fs.openRoot()
+	if err != nil {
+		return false
+	}
+	defer root.Close()
+	info, err := root.Stat(toRelPath(h.strip(r.URL.Path)))
+	return err == nil && info.IsDir()
+}
+
+// strip removes Prefix from a request path.
+func (h *WebDAVHandler) strip(p string) string {
+	return "/" + strings.TrimPrefix(p, strings.TrimSuffix(h.Prefix, "/"))
+}
+
+type putBodyKey struct{}
+
+// davReplaceKey marks COPY and MOVE requests, whose removals make room for
+// the destination rather than delete it.
+type davReplaceKey struct{}
+
+// davErrKey holds where the error a request ended with is kept for its
+// audit entry.
+type davErrKey struct{}
+
+// recordingReader remembers the first non-EOF error returned by r, and
+// counts and, if sum is set, hashes what was read.
+type recordingReader struct {
+	r   io.Reader
+	err error
+	n   int64
+	sum hash.Hash
+}
+
+func (b *recordingReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.sum != nil {
+		b.sum.Write(p[:n])
+	}
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// davFS implements webdav.FileSystem on top of os.Root.
+type davFS struct {
+	fs *FSHandler
+}
+
+// davRel maps a WebDAV name to a path relative to Basedir. Internal
+// bookkeeping paths are reported as missing.
+func davRel(name string) (string, error) {
+	rel := toRelPath(name)
+	if isInternalPath(rel) {
+		return "", fs.ErrNotExist
+	}
+	return rel, nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	rel, err := davRel(name)
+	if err != nil {
+		return err
+	}
+	root, err := d.fs.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Mkdir(rel, perm)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	rel, err := davRel(name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := d.fs.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	if flag&os.O_CREATE != 0 && flag&os.O_TRUNC != 0 && rel != "." {
+		if info, err := root.Stat(rel); err == nil && info.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		tmp, f, err := createTemp(root, path.Dir(rel))
+		if err != nil {
+			return nil, err
+		}
+		body, _ := ctx.Value(putBodyKey{}).(*recordingReader)
+		return &atomicFile{File: f, fs: d.fs, tmp: tmp, rel: rel, body: body}, nil
+	}
+
+	f, err := root.OpenFile(rel, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: f, dir: rel, fs: d.fs, id: contextIdentity(ctx)}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	rel, err := davRel(name)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return errors.New("cannot delete root directory")
+	}
+	root, err := d.fs.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	info, err := root.Lstat(rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// DELETE is refused earlier; this catches COPY and MOVE replacing a
+	// collection, as FSHandler.prepareDestination does.
+	if info.IsDir() && !d.fs.AllowDelete {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("replacing a directory requires delete to be enabled")}
+	}
+	if ctx.Value(davReplaceKey{}) != nil {
+		return d.fs.supersede(root, rel, info, contextLogUser(ctx))
+	}
+	return d.fs.discard(root, rel, info, contextLogUser(ctx))
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldRel, err := davRel(oldName)
+	if err != nil {
+		return err
+	}
+	newRel, err := davRel(newName)
+	if err != nil {
+		return err
+	}
+	if oldRel == "." || newRel == "." {
+		return errors.New("cannot rename root directory")
+	}
+	root, err := d.fs.openRoot()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Rename(oldRel, newRel)
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	rel, err := davRel(name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := d.fs.openRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Stat(rel)
+}
+
+// davFile hides internal entries and entries the user may not read from
+// directory listings.
+type davFile struct {
+	*os.File
+	dir string
+	fs  *FSHandler
+	id  identity
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		p := path.Join(f.dir, info.Name())
+		if !isInternalPath(p) && f.fs.allowed(f.id, p, permRead) {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+// atomicFile is a temp file that replaces its destination when closed, like
+// writeFileAtomic. If the request body it was filled from failed part way,
+// the temp file is discarded instead.
+type atomicFile struct {
+	*os.File
+	fs   *FSHandler
+	tmp  string
+	rel  string
+	body *recordingReader
+}
+
+func (f *atomicFile) Close() error {
+	root, err := f.fs.openRoot()
+	if err != nil {
+		f.File.Close()
+		return err
+	}
+	defer root.Close()
+
+	if f.body != nil && f.body.err != nil {
+		err = f.body.err
+	}
+	if err == nil {
+		err = f.File.Sync()
+	}
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		var info fs.FileInfo
+		if fi, statErr := root.Lstat(f.rel); statErr == nil {
+			info = fi
+		}
+		err = f.fs.overwrite(root, f.rel, info, func() error { return root.Rename(f.tmp, f.rel) })
+	}
+	if err != nil {
+		_ = root.Remove(f.tmp)
+	}
+	return err
+}
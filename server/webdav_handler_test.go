@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// davClient issues raw WebDAV requests against a test server, in the spirit
+// of the litmus conformance suite.
+type davClient struct {
+	t    *testing.T
+	base string
+	user string
+	pass string
+}
+
+func newDavServer(t *testing.T, allowDelete bool) (*davClient, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	fs := &FSHandler{Basedir: tmpDir, AllowDelete: allowDelete}
+	handler := &BasicAuthHandler{
+		Username:      "u",
+		Password:      "p",
+		AuthWriteOnly: true,
+		Next: NewCompHandler(
+			&WebDAVHandler{Fs: fs, Prefix: "/dav"},
+			&UIHandler{Fs: fs},
+			fs,
+		),
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &davClient{t: t, base: srv.URL + "/dav", user: "u", pass: "p"}, tmpDir
+}
+
+func (c *davClient) do(method, p string, body string, headers map[string]string) (*http.Response, string) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.base+p, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res, string(data)
+}
+
+func (c *davClient) expect(method, p, body string, headers map[string]string, want int) string {
+	c.t.Helper()
+	res, data := c.do(method, p, body, headers)
+	if res.StatusCode != want {
+		c.t.Fatalf("%s %s: want %d, got %d: %s", method, p, want, res.StatusCode, data)
+	}
+	return data
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func parseMultistatus(t *testing.T, data string) davMultistatus {
+	t.Helper()
+	var ms davMultistatus
+	if err := xml.Unmarshal([]byte(data), &ms); err != nil {
+		t.Fatalf("invalid multistatus %q: %v", data, err)
+	}
+	return ms
+}
+
+func Test_webdav_basic(t *testing.T) {
+	c, tmpDir := newDavServer(t, true)
+
+	res, _ := c.do(http.MethodOptions, "/", "", nil)
+	if dav := res.Header.Get("DAV"); !strings.Contains(dav, "1") || !strings.Contains(dav, "2") {
+		t.Fatalf("OPTIONS: DAV header %q should advertise class 1 and 2", dav)
+	}
+
+	c.expect(http.MethodPut, "/res", "This is a test file", nil, http.StatusCreated)
+	if got := c.expect(http.MethodGet, "/res", "", nil, http.StatusOK); got != "This is a test file" {
+		t.Fatalf("GET: got %q", got)
+	}
+	c.expect(http.MethodPut, "/notexist/res", "x", nil, http.StatusConflict)
+	c.expect(http.MethodDelete, "/res", "", nil, http.StatusNoContent)
+	c.expect(http.MethodDelete, "/res", "", nil, http.StatusNotFound)
+
+	c.expect("MKCOL", "/coll", "", nil, http.StatusCreated)
+	c.expect("MKCOL", "/coll", "", nil, http.StatusMethodNotAllowed)
+	c.expect("MKCOL", "/missing/coll", "", nil, http.StatusConflict)
+	c.expect(http.MethodDelete, "/coll", "", nil, http.StatusNoContent)
+
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 0 {
+		t.Fatalf("basedir should be empty, found %d entries", len(entries))
+	}
+}
+
+func Test_webdav_copymove(t *testing.T) {
+	c, tmpDir := newDavServer(t, true)
+
+	c.expect(http.MethodPut, "/src", "source", nil, http.StatusCreated)
+	c.expect(http.MethodPut, "/existing", "existing", nil, http.StatusCreated)
+	c.expect("MKCOL", "/coll", "", nil, http.StatusCreated)
+	c.expect(http.MethodPut, "/coll/inner", "inner", nil, http.StatusCreated)
+
+	c.expect("COPY", "/src", "", map[string]string{"Destination": c.base + "/copy"}, http.StatusCreated)
+	c.expect("COPY", "/src", "", map[string]string{"Destination": c.base + "/existing", "Overwrite": "F"}, http.StatusPreconditionFailed)
+	c.expect("COPY", "/src", "", map[string]string{"Destination": c.base + "/existing", "Overwrite": "T"}, http.StatusNoContent)
+	c.expect("COPY", "/coll", "", map[string]string{"Destination": c.base + "/coll2", "Depth": "infinity"}, http.StatusCreated)
+
+	data, _ := os.ReadFile(filepath.Join(tmpDir, "coll2", "inner"))
+	if string(data) != "inner" {
+		t.Fatalf("COPY collection: got %q", data)
+	}
+
+	c.expect("MOVE", "/copy", "", map[string]string{"Destination": c.base + "/moved"}, http.StatusCreated)
+	c.expect(http.MethodGet, "/copy", "", nil, http.StatusNotFound)
+	c.expect("MOVE", "/coll2", "", map[string]string{"Destination": c.base + "/coll", "Overwrite": "F"}, http.StatusPreconditionFailed)
+	c.expect("MOVE", "/coll2", "", map[string]string{"Destination": c.base + "/coll3"}, http.StatusCreated)
+	if got := c.expect(http.MethodGet, "/coll3/inner", "", nil, http.StatusOK); got != "inner" {
+		t.Fatalf("MOVE collection: got %q", got)
+	}
+}
+
+func Test_webdav_props(t *testing.T) {
+	c, tmpDir := newDavServer(t, true)
+
+	c.expect("MKCOL", "/coll", "", nil, http.StatusCreated)
+	c.expect(http.MethodPut, "/coll/a.txt", "a", nil, http.StatusCreated)
+	// Internal files must never show up over WebDAV.
+	os.WriteFile(filepath.Join(tmpDir, "coll", tempPrefix+"0123"), []byte("partial"), 0600)
+	os.Mkdir(filepath.Join(tmpDir, tusDir), 0700)
+
+	propfind := `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><allprop/></propfind>`
+	ms := parseMultistatus(t, c.expect("PROPFIND", "/coll/", propfind, map[string]string{"Depth": "1"}, http.StatusMultiStatus))
+	if len(ms.Responses) != 2 {
+		t.Fatalf("PROPFIND depth 1: want 2 responses, got %+v", ms.Responses)
+	}
+	ms = parseMultistatus(t, c.expect("PROPFIND", "/", propfind, map[string]string{"Depth": "1"}, http.StatusMultiStatus))
+	for _, r := range ms.Responses {
+		if strings.Contains(r.Href, tusDir) {
+			t.Fatalf("PROPFIND should hide %q", r.Href)
+		}
+	}
+	c.expect("PROPFIND", "/"+tusDir+"/", propfind, map[string]string{"Depth": "0"}, http.StatusNotFound)
+	c.expect("PROPFIND", "/nope", propfind, map[string]string{"Depth": "0"}, http.StatusNotFound)
+
+	proppatch := `<?xml version="1.0" encoding="utf-8"?>
+<propertyupdate xmlns="DAV:" xmlns:z="http://example.com/ns"><set><prop><z:color>red</z:color></prop></set></propertyupdate>`
+	ms = parseMultistatus(t, c.expect("PROPPATCH", "/coll/a.txt", proppatch, nil, http.StatusMultiStatus))
+	if len(ms.Responses) != 1 || len(ms.Responses[0].Propstat) == 0 {
+		t.Fatalf("PROPPATCH: unexpected response %+v", ms)
+	}
+}
+
+func Test_webdav_locks(t *testing.T) {
+	c, _ := newDavServer(t, true)
+
+	c.expect(http.MethodPut, "/lockme", "v1", nil, http.StatusCreated)
+
+	lockinfo := `<?xml version="1.0" encoding="utf-8"?>
+<lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype><owner>litmus</owner></lockinfo>`
+	res, data := c.do("LOCK", "/lockme", lockinfo, map[string]string{"Timeout": "Second-60"})
+	if res.StatusCode != http.StatusOK || !strings.Contains(data, "lockdiscovery") {
+		t.Fatalf("LOCK: got %d: %s", res.StatusCode, data)
+	}
+	token := strings.Trim(res.Header.Get("Lock-Token"), "<>")
+	if token == "" {
+		t.Fatal("LOCK: missing Lock-Token header")
+	}
+
+	c.expect("LOCK", "/lockme", lockinfo, nil, http.StatusLocked)
+	c.expect(http.MethodPut, "/lockme", "v2", nil, http.StatusLocked)
+	c.expect(http.MethodDelete, "/lockme", "", nil, http.StatusLocked)
+	c.expect(http.MethodPut, "/lockme", "v2", map[string]string{"If": "(<" + token + ">)"}, http.StatusCreated)
+
+	c.expect("UNLOCK", "/lockme", "", map[string]string{"Lock-Token": "<" + token + ">"}, http.StatusNoContent)
+	c.expect(http.MethodPut, "/lockme", "v3", nil, http.StatusCreated)
+	if got := c.expect(http.MethodGet, "/lockme", "", nil, http.StatusOK); got != "v3" {
+		t.Fatalf("GET after unlock: got %q", got)
+	}
+}
+
+func Test_webdav_policy(t *testing.T) {
+	c, tmpDir := newDavServer(t, false)
+
+	c.expect(http.MethodPut, "/keep", "data", nil, http.StatusCreated)
+	c.expect(http.MethodDelete, "/keep", "", nil, http.StatusForbidden)
+	if _, err := os.Stat(filepath.Join(tmpDir, "keep")); err != nil {
+		t.Fatalf("file should survive a rejected DELETE: %v", err)
+	}
+	// Replacing a collection deletes it, so it is refused too; files may
+	// still be replaced.
+	c.expect("MKCOL", "/coll", "", nil, http.StatusCreated)
+	c.expect(http.MethodPut, "/coll/inner", "inner", nil, http.StatusCreated)
+	c.expect("MKCOL", "/other", "", nil, http.StatusCreated)
+	c.expect("MOVE", "/other", "", map[string]string{"Destination": c.base + "/coll", "Overwrite": "T"}, http.StatusForbidden)
+	c.expect("COPY", "/keep", "", map[string]string{"Destination": c.base + "/coll", "Overwrite": "T"}, http.StatusForbidden)
+	if _, err := os.Stat(filepath.Join(tmpDir, "coll", "inner")); err != nil {
+		t.Fatalf("collection should survive a rejected overwrite: %v", err)
+	}
+	c.expect(http.MethodPut, "/copy", "old", nil, http.StatusCreated)
+	c.expect("COPY", "/keep", "", map[string]string{"Destination": c.base + "/copy", "Overwrite": "T"}, http.StatusNoContent)
+	// Moving a collection takes it away like a delete.
+	c.expect("MOVE", "/other", "", map[string]string{"Destination": c.base + "/other2"}, http.StatusForbidden)
+	c.expect("MOVE", "/copy", "", map[string]string{"Destination": c.base + "/copy2"}, http.StatusCreated)
+
+	anon := &davClient{t: t, base: c.base}
+	anon.expect("PROPFIND", "/", "", map[string]string{"Depth": "0"}, http.StatusMultiStatus)
+	for _, method := range []string{"MKCOL", "PROPPATCH", "LOCK", http.MethodPut} {
+		anon.expect(method, "/anon", "", nil, http.StatusUnauthorized)
+	}
+	anon.expect("MOVE", "/keep", "", map[string]string{"Destination": c.base + "/stolen"}, http.StatusUnauthorized)
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// webhookDir holds the queue of pending webhook deliveries inside Basedir.
+// It is hidden from listings and cannot be reached through the file API.
+const webhookDir = ".webhooks"
+
+// webhookTempPattern names the files deliveries are written to before they
+// are renamed into the queue.
+const webhookTempPattern = ".tmp-*"
+
+const (
+	defaultWebhookAttempts = 10
+	defaultWebhookBackoff  = 10 * time.Second
+	maxWebhookBackoff      = time.Hour
+)
+
+// webhookEvents are the events a webhook can subscribe to; they are the
+// actions of the audit log.
+var webhookEvents = []string{"upload", "overwrite", "mkdir", "delete", "move", "copy", "restore", "purge"}
+
+// Webhooks posts the changes made through FSHandler to the URLs of a
+// webhooks file, one per line:
+//
+//	<url> <events> <glob> <secret>
+//
+// where events is a comma-separated list of upload, overwrite, mkdir,
+// delete, move, copy, restore and purge, or "all", and glob is matched
+// like the globs of the ACL file against the path of the change or, for
+// moves and copies, its destination. Each delivery is a JSON POST signed
+// with HMAC-SHA256 of the body under secret, in the X-Fileserver-Signature
+// header.
+//
+// Deliveries are queued in files, so that they survive restarts, and sent
+// in the order of the changes by Run. Failed deliveries are retried with
+// exponential backoff, so they can arrive after later ones. A delivery can
+// also arrive more than once, for example when the server stops while
+// sending it; receivers can tell by the id of the event.
+type Webhooks struct {
+	// MaxAttempts is how often a delivery is tried before it is dropped,
+	// 10 by default.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, 10s by default. It
+	// doubles with every further failure, up to an hour.
+	Backoff time.Duration
+	// Client sends the deliveries; the default gives up after 10s.
+	Client *http.Client
+
+	path  string
+	queue string
+	hooks atomic.Pointer[[]*webhook]
+	wake  chan struct{}
+}
+
+type webhook struct {
+	url    string
+	events []string // nil for all
+	glob   []string
+	secret []byte
+}
+
+// webhookEvent is the body of a delivery.
+type webhookEvent struct {
+	ID     string    `json:"id"`
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Path   string    `json:"path"`
+	To     string    `json:"to,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	SHA256 string    `json:"sha256,omitempty"`
+}
+
+// webhookDelivery is a queued delivery.
+type webhookDelivery struct {
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	ID       string          `json:"id"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// LoadWebhooks reads the webhooks file at path and prepares the delivery
+// queue inside basedir. Deliveries left in the queue are sent once Run is
+// called; files a crash left half written are removed.
+func LoadWebhooks(path, basedir string) (*Webhooks, error) {
+	w := &Webhooks{path: path, queue: filepath.Join(basedir, webhookDir), wake: make(chan struct{}, 1)}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(w.queue, 0o700); err != nil {
+		return nil, err
+	}
+	temps, _ := filepath.Glob(filepath.Join(w.queue, webhookTempPattern))
+	for _, name := range temps {
+		_ = os.Remove(name)
+	}
+	return w, nil
+}
+
+// Reload re-reads the webhooks file. On error the previous webhooks are
+// kept. Queued deliveries to URLs no longer in the file are dropped when
+// they are due.
+func (w *Webhooks) Reload() error {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hooks, err := parseWebhooks(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", w.path, err)
+	}
+	w.hooks.Store(&hooks)
+	log.Printf("Loaded %d webhooks from %q", len(hooks), w.path)
+	return nil
+}
+
+// Watch reloads the webhooks file whenever it changes on disk.
+func (w *Webhooks) Watch() error {
+	return watchFile(w.path, w.Reload)
+}
+
+func parseWebhooks(r io.Reader) ([]*webhook, error) {
+	var hooks []*webhook
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		hook, err := parseWebhook(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, s.Err()
+}
+
+func parseWebhook(fields []string) (*webhook, error) {
+	if len(fields) != 4 {
+		return nil, errors.New(`expected "<url> <events> <glob> <secret>"`)
+	}
+	u, err := url.Parse(fields[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", fields[0])
+	}
+	hook := &webhook{url: fields[0], secret: []byte(fields[3])}
+
+	if fields[1] != "all" {
+		for _, event := range strings.Split(fields[1], ",") {
+			if !slices.Contains(webhookEvents, event) {
+				return nil, fmt.Errorf("unknown event %q, want %s or all", event, strings.Join(webhookEvents, ", "))
+			}
+			hook.events = append(hook.events, event)
+		}
+	}
+
+	glob := fields[2]
+	if !strings.HasPrefix(glob, "/") {
+		return nil, fmt.Errorf("glob %q must start with \"/\"", glob)
+	}
+	if glob = strings.Trim(glob, "/"); glob != "" {
+		hook.glob = strings.Split(glob, "/")
+	}
+	for _, seg := range hook.glob {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q", fields[2])
+		}
+	}
+	return hook, nil
+}
+
+func (hook *webhook) match(e *webhookEvent) bool {
+	if hook.events != nil && !slices.Contains(hook.events, e.Event) {
+		return false
+	}
+	under := func(p string) bool {
+		var segments []string
+		if p = strings.Trim(p, "/"); p != "" {
+			segments = strings.Split(p, "/")
+		}
+		return matchGlob(hook.glob, segments)
+	}
+	return under(e.Path) || (e.To != "" && under(e.To))
+}
+
+// notify queues a delivery of the successful change e, made by r, to each
+// matching webhook.
+func (w *Webhooks) notify(r *http.Request, e AuditEntry) {
+	if w == nil {
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("webhook %s %s error %v", e.Action, e.Path, err)
+		return
+	}
+	event := &webhookEvent{
+		ID:     hex.EncodeToString(b),
+		Event:  e.Action,
+		Time:   time.Now().UTC(),
+		User:   logUser(r),
+		Path:   e.Path,
+		To:     e.To,
+		Size:   e.Size,
+		SHA256: e.SHA256,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("webhook %s %s error %v", e.Action, e.Path, err)
+		return
+	}
+
+	queued := false
+	for i, hook := range *w.hooks.Load() {
+		if !hook.match(event) {
+			continue
+		}
+		d := &webhookDelivery{URL: hook.url, Event: event.Event, ID: event.ID, Next: event.Time, Body: body}
+		name := fmt.Sprintf("%020d-%s-%d.json", time.Now().UnixNano(), event.ID[:8], i)
+		if err := w.save(name, d); err != nil {
+			log.Printf("webhook %s %s queue error %v", hook.url, event.ID, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// save writes d to the queue file name. The file is renamed into place, so
+// that Run never reads a partial delivery.
+func (w *Webhooks) save(name string, d *webhookDelivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(w.queue, webhookTempPattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(w.queue, name))
+}
+
+// Run sends the queued deliveries until ctx is done.
+func (w *Webhooks) Run(ctx context.Context) {
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait := w.deliver(ctx); wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-w.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// deliver sends the deliveries that are due, in the order they were
+// queued, and returns how long until the next one is, or 0 if none is
+// left.
+func (w *Webhooks) deliver(ctx context.Context) time.Duration {
+	entries, err := os.ReadDir(w.queue)
+	if err != nil {
+		log.Printf("webhook queue %q error %v", w.queue, err)
+		return w.backoff(1)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var next time.Time
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return 0
+		}
+		file := filepath.Join(w.queue, name)
+		b, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		d := &webhookDelivery{}
+		if err := json.Unmarshal(b, d); err != nil {
+			log.Printf("webhook queue %q error %v, dropped", name, err)
+			os.Remove(file)
+			continue
+		}
+		if now := time.Now(); d.Next.After(now) {
+			if next.IsZero() || d.Next.Before(next) {
+				next = d.Next
+			}
+			continue
+		}
+
+		code, err := w.send(ctx, d)
+		if ctx.Err() != nil {
+			return 0
+		}
+		d.Attempts++
+		switch {
+		case err == nil:
+			log.Printf("webhook %s %s %s - %d - attempt %d", d.URL, d.Event, d.ID, code, d.Attempts)
+			os.Remove(file)
+		case errors.Is(err, errWebhookGone):
+			log.Printf("webhook %s %s %s - %v, dropped", d.URL, d.Event, d.ID, err)
+			os.Remove(file)
+		case d.Attempts >= w.maxAttempts():
+			log.Printf("webhook %s %s %s - %d - %v, dropped after %d attempts", d.URL, d.Event, d.ID, code, err, d.Attempts)
+			os.Remove(file)
+		default:
+			d.Next = time.Now().Add(w.backoff(d.Attempts))
+			log.Printf("webhook %s %s %s - %d - %v, retry at %s", d.URL, d.Event, d.ID, code, err, d.Next.Format(time.RFC3339))
+			if err := w.save(name, d); err != nil {
+				log.Printf("webhook queue %q error %v", name, err)
+			}
+			if next.IsZero() || d.Next.Before(next) {
+				next = d.Next
+			}
+		}
+	}
+	if next.IsZero() {
+		return 0
+	}
+	return max(time.Until(next), time.Millisecond)
+}
+
+var errWebhookGone = errors.New("webhook no longer configured")
+
+// send posts d to its webhook and reports the status code it got.
+func (w *Webhooks) send(ctx context.Context, d *webhookDelivery) (int, error) {
+	hooks := *w.hooks.Load()
+	i := slices.IndexFunc(hooks, func(hook *webhook) bool { return hook.url == d.URL })
+	if i < 0 {
+		return 0, errWebhookGone
+	}
+	mac := hmac.New(sha256.New, hooks[i].secret)
+	mac.Write(d.Body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fileserver-webhook")
+	req.Header.Set("X-Fileserver-Event", d.Event)
+	req.Header.Set("X-Fileserver-Delivery", d.ID)
+	req.Header.Set("X-Fileserver-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (w *Webhooks) maxAttempts() int {
+	if w.MaxAttempts > 0 {
+		return w.MaxAttempts
+	}
+	return defaultWebhookAttempts
+}
+
+// backoff returns the wait after the given number of failed attempts.
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	d := w.Backoff
+	if d <= 0 {
+		d = defaultWebhookBackoff
+	}
+	for i := 1; i < attempts && d < maxWebhookBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxWebhookBackoff)
+}
+
+// changed records a change made by r in the audit log and, if it
+// succeeded, notifies the webhooks and the clients watching for changes.
+func (h *FSHandler) changed(r *http.Request, e AuditEntry, code int, err error) {
+	h.Audit.record(r, e, code, err)
+	if err == nil {
+		h.Webhooks.notify(r, e)
+		h.Events.changed(h, e)
+	}
+}
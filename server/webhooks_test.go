@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookCall struct {
+	header http.Header
+	body   []byte
+	event  webhookEvent
+}
+
+// newWebhookReceiver serves a webhook endpoint that fails the first
+// failures requests and passes the others on.
+func newWebhookReceiver(t *testing.T, failures int32) (*httptest.Server, chan webhookCall) {
+	t.Helper()
+	calls := make(chan webhookCall, 10)
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.Add(1) <= failures {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		call := webhookCall{header: r.Header, body: body}
+		if err := json.Unmarshal(body, &call.event); err != nil {
+			t.Error(err)
+		}
+		calls <- call
+	}))
+	t.Cleanup(srv.Close)
+	return srv, calls
+}
+
+func loadTestWebhooks(t *testing.T, basedir, content string) *Webhooks {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "webhooks")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := LoadWebhooks(file, basedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Backoff = 10 * time.Millisecond
+	return w
+}
+
+func runWebhooks(t *testing.T, w *Webhooks) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitWebhook(t *testing.T, calls chan webhookCall) webhookCall {
+	t.Helper()
+	select {
+	case call := <-calls:
+		return call
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+		return webhookCall{}
+	}
+}
+
+func Test_Webhooks_deliver(t *testing.T) {
+	releases, releaseCalls := newWebhookReceiver(t, 0)
+	everything, allCalls := newWebhookReceiver(t, 0)
+	dir := t.TempDir()
+	hooks := loadTestWebhooks(t, dir, "# deploy new releases\n"+
+		releases.URL+" upload,overwrite /releases/** s3cr3t\n"+
+		everything.URL+" all /** other\n")
+	runWebhooks(t, hooks)
+	fs := &FSHandler{Basedir: dir, Webhooks: hooks}
+	do := func(method, target, body string) {
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		if w.Code >= 300 {
+			t.Fatalf("%s %s = %d", method, target, w.Code)
+		}
+	}
+
+	do(http.MethodPost, "/?action=mkdir&name=releases", "")
+	do(http.MethodPut, "/releases/app-1.0.tar", "artifact")
+	do(http.MethodPut, "/notes.txt", "notes")
+
+	call := waitWebhook(t, releaseCalls)
+	sum := sha256.Sum256([]byte("artifact"))
+	if call.event.Event != "upload" || call.event.Path != "/releases/app-1.0.tar" || call.event.Size != 8 || call.event.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("release event = %+v", call.event)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(call.body)
+	if got := call.header.Get("X-Fileserver-Signature"); got != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature = %q", got)
+	}
+	if call.header.Get("X-Fileserver-Event") != "upload" || call.header.Get("X-Fileserver-Delivery") != call.event.ID {
+		t.Errorf("headers = %v", call.header)
+	}
+
+	var events []string
+	for range 3 {
+		call := waitWebhook(t, allCalls)
+		events = append(events, call.event.Event+" "+call.event.Path)
+	}
+	if strings.Join(events, ", ") != "mkdir /releases, upload /releases/app-1.0.tar, upload /notes.txt" {
+		t.Errorf("events = %v", events)
+	}
+
+	select {
+	case call := <-releaseCalls:
+		t.Errorf("unexpected release delivery %+v", call.event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Internal directories stay hidden.
+	w := httptest.NewRecorder()
+	fs.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+webhookDir+"/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /%s/ = %d", webhookDir, w.Code)
+	}
+}
+
+func Test_Webhooks_retry(t *testing.T) {
+	srv, calls := newWebhookReceiver(t, 2)
+	dir := t.TempDir()
+	hooks := loadTestWebhooks(t, dir, srv.URL+" delete /** key\n")
+	runWebhooks(t, hooks)
+	os.WriteFile(filepath.Join(dir, "old.txt"), []byte("old"), 0600)
+	fs := &FSHandler{Basedir: dir, AllowDelete: true, Webhooks: hooks}
+	fs.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/old.txt", nil))
+
+	if call := waitWebhook(t, calls); call.event.Event != "delete" || call.event.Path != "/old.txt" {
+		t.Fatalf("event = %+v", call.event)
+	}
+	// The delivered file leaves the queue.
+	deadline := time.Now().Add(time.Second)
+	for {
+		entries, _ := os.ReadDir(filepath.Join(dir, webhookDir))
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue not empty: %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := hooks.backoff(1); got != 10*time.Millisecond {
+		t.Errorf("backoff(1) = %v", got)
+	}
+	if got := hooks.backoff(3); got != 40*time.Millisecond {
+		t.Errorf("backoff(3) = %v", got)
+	}
+	if got := (&Webhooks{}).backoff(100); got != maxWebhookBackoff {
+		t.Errorf("backoff(100) = %v", got)
+	}
+}
+
+func Test_Webhooks_persisted(t *testing.T) {
+	srv, calls := newWebhookReceiver(t, 0)
+	dir := t.TempDir()
+	content := srv.URL + " mkdir /** key\n"
+
+	// Changes made while deliveries are not running stay queued...
+	hooks := loadTestWebhooks(t, dir, content)
+	fs := &FSHandler{Basedir: dir, Webhooks: hooks}
+	fs.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?action=mkdir&name=a", nil))
+	if entries, _ := os.ReadDir(filepath.Join(dir, webhookDir)); len(entries) != 1 {
+		t.Fatalf("queue = %v", entries)
+	}
+
+	// ...and are sent after a restart, which also removes what a crash
+	// left half written.
+	partial := filepath.Join(dir, webhookDir, ".tmp-123")
+	os.WriteFile(partial, []byte("{"), 0600)
+	runWebhooks(t, loadTestWebhooks(t, dir, content))
+	if call := waitWebhook(t, calls); call.event.Path != "/a" {
+		t.Fatalf("event = %+v", call.event)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial delivery left in the queue: %v", err)
+	}
+}
+
+func Test_parseWebhooks(t *testing.T) {
+	for _, content := range []string{
+		"https://ci.example.com/hook upload /releases/**\n",
+		"ftp://ci.example.com/hook upload /releases/** key\n",
+		"https://ci.example.com/hook rename /releases/** key\n",
+		"https://ci.example.com/hook upload releases/** key\n",
+		"https://ci.example.com/hook upload /[ key\n",
+	} {
+		if _, err := parseWebhooks(strings.NewReader(content)); err == nil {
+			t.Errorf("parseWebhooks(%q) succeeded", content)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aix3/fileserver/server"
+)
+
+const tokenUsage = `usage: fileserver token <command> [flags]
+
+Manage the API tokens accepted with -tokens-file.
+
+commands:
+  create -file <tokens> -name <name> [-scope read,write,delete] [-prefix /path] [-expires 2160h]
+  list   -file <tokens>
+  revoke -file <tokens> <id>...
+`
+
+// tokenCommand runs "fileserver token ..." and returns the exit code.
+func tokenCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, tokenUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "tokens file, as passed to -tokens-file")
+
+	var run func() error
+	switch args[0] {
+	case "create":
+		name := flags.String("name", "", "name of the token, used as its user name in access rules and logs")
+		scope := flags.String("scope", "read", `comma-separated scopes: "read", "write", "delete"`)
+		prefix := flags.String("prefix", "/", "URL path the token is limited to")
+		expires := flags.Duration("expires", 90*24*time.Hour, "lifetime of the token, 0 for no expiry")
+		run = func() error {
+			return createToken(stdout, stderr, *file, *name, *scope, *prefix, *expires)
+		}
+	case "list":
+		run = func() error {
+			return listTokens(stdout, *file)
+		}
+	case "revoke":
+		run = func() error {
+			return revokeTokens(stderr, *file, flags.Args())
+		}
+	default:
+		fmt.Fprint(stderr, tokenUsage)
+		return 2
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *file == "" {
+		fmt.Fprintln(stderr, "-file is required")
+		return 2
+	}
+	if err := run(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func createToken(stdout, stderr io.Writer, file, name, scopes, prefix string, lifetime time.Duration) error {
+	scope, err := server.ParseTokenScope(scopes)
+	if err != nil {
+		return err
+	}
+	var expires time.Time
+	if lifetime < 0 {
+		return fmt.Errorf("invalid -expires %v", lifetime)
+	} else if lifetime > 0 {
+		expires = time.Now().Add(lifetime).Truncate(time.Second)
+	}
+
+	tokens, err := server.ReadTokenFile(file)
+	if err != nil {
+		return err
+	}
+	tok, secret, err := server.NewToken(name, scope, prefix, expires)
+	if err != nil {
+		return err
+	}
+	if err := server.WriteTokenFile(file, append(tokens, tok)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "Created token %s (%s) with scope %s on %s, expires %s.\n",
+		tok.ID, tok.Name, tok.Scope, tok.Prefix, formatExpiry(tok.Expires))
+	fmt.Fprintln(stderr, "Store it now, it cannot be shown again:")
+	fmt.Fprintln(stdout, secret)
+	return nil
+}
+
+func listTokens(stdout io.Writer, file string) error {
+	tokens, err := server.ReadTokenFile(file)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCOPE\tPREFIX\tEXPIRES")
+	now := time.Now()
+	for _, t := range tokens {
+		expires := formatExpiry(t.Expires)
+		if !t.Expires.IsZero() && now.After(t.Expires) {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Scope, t.Prefix, expires)
+	}
+	return tw.Flush()
+}
+
+func revokeTokens(stderr io.Writer, file string, ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("no token id given")
+	}
+	tokens, err := server.ReadTokenFile(file)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		i := slices.IndexFunc(tokens, func(t *server.Token) bool { return t.ID == id })
+		if i < 0 {
+			return fmt.Errorf("unknown token %q", id)
+		}
+		tokens = slices.Delete(tokens, i, i+1)
+	}
+	if err := server.WriteTokenFile(file, tokens); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Revoked %d token(s).\n", len(ids))
+	return nil
+}
+
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aix3/fileserver/server"
+)
+
+func Test_tokenCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tokens")
+	run := func(args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		code := tokenCommand(args, &stdout, &stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, secret, stderr := run("create", "-file", file, "-name", "ci", "-scope", "read,write", "-prefix", "/artifacts")
+	if code != 0 {
+		t.Fatalf("create = %d: %s", code, stderr)
+	}
+	secret = strings.TrimSpace(secret)
+	if !strings.HasPrefix(secret, "fst_") {
+		t.Fatalf("create printed %q", secret)
+	}
+	tokens, err := server.ReadTokenFile(file)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("ReadTokenFile = %v, %v", tokens, err)
+	}
+	id := tokens[0].ID
+	if !strings.HasPrefix(secret, "fst_"+id+"_") || tokens[0].Scope != server.ScopeRead|server.ScopeWrite {
+		t.Fatalf("unexpected token %+v", tokens[0])
+	}
+
+	if code, _, _ := run("create", "-file", file, "-name", "x", "-scope", "admin"); code != 1 {
+		t.Errorf("create with unknown scope = %d, want 1", code)
+	}
+	if code, _, _ := run("create", "-name", "x"); code != 2 {
+		t.Errorf("create without -file = %d, want 2", code)
+	}
+
+	code, out, _ := run("list", "-file", file)
+	if code != 0 || !strings.Contains(out, id) || !strings.Contains(out, "read,write") || !strings.Contains(out, "/artifacts") {
+		t.Fatalf("list = %d %q", code, out)
+	}
+	if strings.Contains(out, secret) {
+		t.Fatal("list shows the secret")
+	}
+
+	if code, _, stderr := run("revoke", "-file", file, "nope"); code != 1 {
+		t.Errorf("revoke unknown = %d %s", code, stderr)
+	}
+	if code, _, stderr := run("revoke", "-file", file, id); code != 0 {
+		t.Fatalf("revoke = %d %s", code, stderr)
+	}
+	if tokens, _ := server.ReadTokenFile(file); len(tokens) != 0 {
+		t.Fatalf("tokens left after revoke: %v", tokens)
+	}
+
+	if code, _, _ := run("frobnicate"); code != 2 {
+		t.Errorf("unknown command = %d, want 2", code)
+	}
+}
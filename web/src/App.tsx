@@ -4,10 +4,12 @@ import '@fontsource/roboto/400.css'
 import '@fontsource/roboto/500.css'
 
 import Box from '@mui/material/Box'
+import Button from '@mui/material/Button'
 import Container from '@mui/material/Container'
 import Paper from '@mui/material/Paper'
 import Stack from '@mui/material/Stack'
 import Typography from '@mui/material/Typography'
+import axios from 'axios'
 
 import FileList from './components/FileList'
 import {FileInfo} from './components/FileListTable'
@@ -17,6 +19,18 @@ interface InitialData {
     files: FileInfo[]
     path: string
     allow_delete: boolean
+    can_write: boolean
+    can_mkdir: boolean
+    allow_share: boolean
+    trash: boolean
+    versions: boolean
+    user: string
+    login_url?: string
+    logout_url?: string
+    csrf_token?: string
+    events_url?: string
+    /** Set instead of the other fields on the login page. */
+    login?: {failed: boolean}
 }
 
 declare global {
@@ -29,6 +43,18 @@ function App() {
     const files = window.__INITIAL_DATA__.files
     const currentPath = window.__INITIAL_DATA__.path
     const allowDelete = window.__INITIAL_DATA__.allow_delete
+    const canWrite = window.__INITIAL_DATA__.can_write
+    const canMkdir = window.__INITIAL_DATA__.can_mkdir
+    const allowShare = window.__INITIAL_DATA__.allow_share
+    const trash = window.__INITIAL_DATA__.trash
+    const versions = window.__INITIAL_DATA__.versions
+    const {user, login_url: loginUrl, logout_url: logoutUrl, events_url: eventsUrl} = window.__INITIAL_DATA__
+
+    // Logging out is a POST carrying the CSRF token, so that other sites
+    // cannot end the session.
+    const handleLogout = () => {
+        axios.post(logoutUrl!).finally(() => window.location.assign('/'))
+    }
 
     return (
         <Box
@@ -41,14 +67,31 @@ function App() {
         >
             <Container maxWidth="lg" sx={{pt: {xs: 2, sm: 3}, px: {xs: 1.5, sm: 3}}}>
                 <Stack spacing={2.5}>
-                    <Box>
-                        <Typography variant="h5" component="h1" sx={{mb: 0.5}}>
-                            Files
-                        </Typography>
-                        <Typography variant="body2" color="text.secondary">
-                            Open folders, download files, or upload new content to this directory.
-                        </Typography>
-                    </Box>
+                    <Stack direction="row" alignItems="flex-start" justifyContent="space-between" spacing={2}>
+                        <Box>
+                            <Typography variant="h5" component="h1" sx={{mb: 0.5}}>
+                                Files
+                            </Typography>
+                            <Typography variant="body2" color="text.secondary">
+                                Open folders, download files, or upload new content to this directory.
+                            </Typography>
+                        </Box>
+                        {loginUrl && (
+                            <Button variant="outlined" href={loginUrl} sx={{whiteSpace: 'nowrap'}}>
+                                Sign in
+                            </Button>
+                        )}
+                        {logoutUrl && (
+                            <Stack direction="row" alignItems="center" spacing={1}>
+                                <Typography variant="body2" color="text.secondary" noWrap>
+                                    {user}
+                                </Typography>
+                                <Button variant="text" onClick={handleLogout} sx={{whiteSpace: 'nowrap'}}>
+                                    Sign out
+                                </Button>
+                            </Stack>
+                        )}
+                    </Stack>
 
                     <Paper
                         elevation={0}
@@ -60,7 +103,17 @@ function App() {
                             boxShadow: '0 1px 3px rgba(15, 23, 42, 0.06)',
                         }}
                     >
-                        <FileList files={files} currentPath={currentPath} allowDelete={allowDelete}/>
+                        <FileList
+                            files={files}
+                            currentPath={currentPath}
+                            allowDelete={allowDelete}
+                            canWrite={canWrite}
+                            canMkdir={canMkdir}
+                            allowShare={allowShare}
+                            trash={trash}
+                            versions={versions}
+                            eventsUrl={eventsUrl}
+                        />
                     </Paper>
                 </Stack>
                 <ScrollTop/>
@@ -5,57 +5,178 @@ import useMediaQuery from "@mui/material/useMediaQuery";
 import {useTheme} from "@mui/material/styles";
 import AddIcon from '@mui/icons-material/Add';
 import CreateNewFolderIcon from '@mui/icons-material/CreateNewFolder';
+import LinkIcon from '@mui/icons-material/Link';
+import DeleteOutlineIcon from '@mui/icons-material/DeleteOutline';
 
-import {useState} from "react";
+import {useEffect, useState} from "react";
 import Breadcrumb from "./Breadcrumb";
 import UploadDialog from "./UploadDialog";
 import CreateDirDialog from "./CreateDirDialog";
+import SharesDialog from "./SharesDialog";
+import TrashDialog from "./TrashDialog";
 import FileListTable, {FileInfo} from "./FileListTable";
 
 export interface FileListProp {
     files: FileInfo[]
     currentPath: string
     allowDelete: boolean
+    canWrite: boolean
+    canMkdir: boolean
+    allowShare: boolean
+    /** Deletes go to the trash, which can be browsed. */
+    trash: boolean
+    /** Files keep the versions uploads replaced. */
+    versions: boolean
+    /** Streams the changes to the directory; without it the page reloads after changes. */
+    eventsUrl?: string
+}
+
+interface ChangeEvent {
+    type: 'create' | 'modify' | 'delete' | 'rename'
+    path: string
+    to?: string
+    file?: FileInfo
+}
+
+/** Orders files the way the server lists them: folders first, then by name. */
+function compareFiles(a: FileInfo, b: FileInfo) {
+    if (a.is_dir !== b.is_dir) {
+        return a.is_dir ? -1 : 1
+    }
+    return a.name < b.name ? -1 : a.name > b.name ? 1 : 0
+}
+
+/** Returns the name of path if it is directly in dir, which ends with a slash. */
+function childName(dir: string, path: string | undefined) {
+    if (!path || !path.startsWith(dir)) {
+        return undefined
+    }
+    const name = path.slice(dir.length)
+    return name === '' || name.includes('/') ? undefined : name
+}
+
+function applyChange(files: FileInfo[], dir: string, event: ChangeEvent) {
+    const removed = event.type === 'delete' || event.type === 'rename' ? childName(dir, event.path) : undefined
+    const added = event.type === 'delete' ? undefined : childName(dir, event.type === 'rename' ? event.to : event.path)
+    if (removed === undefined && (added === undefined || !event.file)) {
+        return files
+    }
+    const next = files.filter(f => f.name !== removed && f.name !== added)
+    if (added !== undefined && event.file) {
+        next.push({...event.file, name: added})
+        next.sort(compareFiles)
+    }
+    return next
 }
 
 function FileList(props: FileListProp) {
+    const [files, setFiles] = useState(props.files)
     const [dialogOpen, setDialogOpen] = useState(false)
     const [mkdirOpen, setMkdirOpen] = useState(false)
+    const [sharesOpen, setSharesOpen] = useState(false)
+    const [trashOpen, setTrashOpen] = useState(false)
     const theme = useTheme()
     const isMobile = useMediaQuery(theme.breakpoints.down('sm'))
 
+    useEffect(() => {
+        if (!props.eventsUrl) {
+            return
+        }
+        const dir = props.currentPath.endsWith('/') ? props.currentPath : props.currentPath + '/'
+        const source = new EventSource(props.eventsUrl)
+        let missed = false
+        source.addEventListener('change', (e: MessageEvent) => {
+            const event: ChangeEvent = JSON.parse(e.data)
+            setFiles(files => applyChange(files, dir, event))
+        })
+        source.onerror = () => {
+            missed = true
+        }
+        source.onopen = () => {
+            if (!missed) {
+                return
+            }
+            // Changes made while disconnected were not streamed.
+            missed = false
+            fetch(window.location.pathname, {headers: {Accept: 'application/json'}})
+                .then(resp => resp.ok ? resp.json() : Promise.reject(resp.status))
+                .then((list: FileInfo[] | null) => setFiles((list ?? []).sort(compareFiles)))
+                .catch(() => undefined)
+        }
+        return () => source.close()
+    }, [props.eventsUrl, props.currentPath])
+
     const handleUploadSuccess = function () {
         setDialogOpen(false)
-        window.location.reload()
+        if (!props.eventsUrl) {
+            window.location.reload()
+        }
     }
 
     const handleMkdirSuccess = function () {
         setMkdirOpen(false)
-        window.location.reload()
+        if (!props.eventsUrl) {
+            window.location.reload()
+        }
+    }
+
+    const handleTrashClose = function (restored: boolean) {
+        setTrashOpen(false)
+        if (restored && !props.eventsUrl) {
+            window.location.reload()
+        }
     }
 
     const actionButtons = (
         <>
-            <Button
-                fullWidth={isMobile}
-                variant="outlined"
-                size={isMobile ? 'large' : 'medium'}
-                startIcon={<CreateNewFolderIcon/>}
-                onClick={() => setMkdirOpen(true)}
-                sx={{whiteSpace: 'nowrap'}}
-            >
-                New folder
-            </Button>
-            <Button
-                fullWidth={isMobile}
-                variant="contained"
-                size={isMobile ? 'large' : 'medium'}
-                startIcon={<AddIcon/>}
-                onClick={() => setDialogOpen(true)}
-                sx={{whiteSpace: 'nowrap'}}
-            >
-                Upload
-            </Button>
+            {props.allowShare && (
+                <Button
+                    fullWidth={isMobile}
+                    variant="text"
+                    size={isMobile ? 'large' : 'medium'}
+                    startIcon={<LinkIcon/>}
+                    onClick={() => setSharesOpen(true)}
+                    sx={{whiteSpace: 'nowrap'}}
+                >
+                    Shared links
+                </Button>
+            )}
+            {props.trash && (
+                <Button
+                    fullWidth={isMobile}
+                    variant="text"
+                    size={isMobile ? 'large' : 'medium'}
+                    startIcon={<DeleteOutlineIcon/>}
+                    onClick={() => setTrashOpen(true)}
+                    sx={{whiteSpace: 'nowrap'}}
+                >
+                    Trash
+                </Button>
+            )}
+            {props.canMkdir && (
+                <Button
+                    fullWidth={isMobile}
+                    variant="outlined"
+                    size={isMobile ? 'large' : 'medium'}
+                    startIcon={<CreateNewFolderIcon/>}
+                    onClick={() => setMkdirOpen(true)}
+                    sx={{whiteSpace: 'nowrap'}}
+                >
+                    New folder
+                </Button>
+            )}
+            {props.canWrite && (
+                <Button
+                    fullWidth={isMobile}
+                    variant="contained"
+                    size={isMobile ? 'large' : 'medium'}
+                    startIcon={<AddIcon/>}
+                    onClick={() => setDialogOpen(true)}
+                    sx={{whiteSpace: 'nowrap'}}
+                >
+                    Upload
+                </Button>
+            )}
         </>
     )
 
@@ -97,7 +218,26 @@ function FileList(props: FileListProp) {
                     onSuccess={handleMkdirSuccess}
                 />
             )}
-            <FileListTable files={props.files} allowDelete={props.allowDelete}/>
+            {sharesOpen && (
+                <SharesDialog
+                    open={sharesOpen}
+                    onClose={() => setSharesOpen(false)}
+                />
+            )}
+            {trashOpen && (
+                <TrashDialog
+                    open={trashOpen}
+                    onClose={handleTrashClose}
+                />
+            )}
+            <FileListTable
+                files={files}
+                allowDelete={props.allowDelete}
+                canWrite={props.canWrite}
+                allowShare={props.allowShare}
+                trash={props.trash}
+                versions={props.versions}
+            />
         </Stack>
     )
 }
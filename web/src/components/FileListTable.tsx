@@ -18,7 +18,7 @@ import InsertDriveFileOutlinedIcon from "@mui/icons-material/InsertDriveFileOutl
 import FolderOpenOutlinedIcon from "@mui/icons-material/FolderOpenOutlined";
 import {humanFileSize, formatModTime} from "../utils/humanize";
 import MoreButton from "./MoreButton";
-import {useState} from "react";
+import {useMemo, useState} from "react";
 
 export interface FileInfo {
     name: string;
@@ -30,6 +30,10 @@ export interface FileInfo {
 export interface FileListTableProps {
     files: FileInfo[]
     allowDelete: boolean
+    canWrite: boolean
+    allowShare: boolean
+    trash?: boolean
+    versions?: boolean
 }
 
 const tableHeadCells = [
@@ -49,24 +53,28 @@ function descendingComparator<T>(a: T, b: T, orderBy: keyof T) {
 }
 
 export default function FileListTable(props: FileListTableProps) {
-    const [rows, setRows] = useState<FileInfo[]>(props.files)
-    const [orderBy, setOrderBy] = useState('');
+    const [orderBy, setOrderBy] = useState<keyof FileInfo | ''>('');
     const [order, setOrder] = useState<'asc' | 'desc'>('asc');
     const theme = useTheme()
     const isMobile = useMediaQuery(theme.breakpoints.down('sm'))
 
+    // The files change as the list updates live, so the sort is applied on
+    // every render rather than once.
+    const rows = useMemo(() => {
+        if (orderBy === '') {
+            return props.files;
+        }
+        return [...props.files].sort((a, b) => {
+            return order === 'desc'
+                ? descendingComparator(a, b, orderBy)
+                : -descendingComparator(a, b, orderBy);
+        });
+    }, [props.files, orderBy, order]);
+
     const handleSort = (_event: React.MouseEvent<unknown>, property: keyof FileInfo) => {
         const isAsc = orderBy === property && order === 'asc';
-        const newOrder = isAsc ? 'desc' : 'asc';
         setOrderBy(property);
-        setOrder(newOrder);
-
-        const sorted = [...rows].sort((a, b) => {
-            return newOrder === 'desc'
-                ? descendingComparator(a, b, property)
-                : -descendingComparator(a, b, property);
-        });
-        setRows(sorted);
+        setOrder(isAsc ? 'desc' : 'asc');
     };
 
     const createSortHandler = (property: keyof FileInfo) => (event: React.MouseEvent<unknown>) => {
@@ -161,9 +169,7 @@ export default function FileListTable(props: FileListTableProps) {
                                 {!row.is_dir && `${humanFileSize(row.size)} · `}{formatModTime(row.mod_time)}
                             </Typography>
                         </Box>
-                        {props.allowDelete && (
-                            <MoreButton name={row.name} isDir={row.is_dir} allowDelete={props.allowDelete}/>
-                        )}
+                        <MoreButton name={row.name} isDir={row.is_dir} allowDelete={props.allowDelete} canWrite={props.canWrite} allowShare={props.allowShare} trash={props.trash} versions={props.versions}/>
                     </Box>
                 ))}
             </Box>
@@ -197,11 +203,9 @@ export default function FileListTable(props: FileListTableProps) {
                                 </TableSortLabel>
                             </TableCell>
                         ))}
-                        {props.allowDelete && (
-                            <TableCell key="action" align="right" sx={{width: 72}}>
-                                Action
-                            </TableCell>
-                        )}
+                        <TableCell key="action" align="right" sx={{width: 72}}>
+                            Action
+                        </TableCell>
                     </TableRow>
                 </TableHead>
                 <TableBody>
@@ -222,11 +226,9 @@ export default function FileListTable(props: FileListTableProps) {
                             <TableCell sx={{whiteSpace: 'nowrap', color: 'text.secondary'}}>
                                 {formatModTime(row.mod_time)}
                             </TableCell>
-                            {props.allowDelete && (
-                                <TableCell align="right">
-                                    <MoreButton name={row.name} isDir={row.is_dir} allowDelete={props.allowDelete}/>
-                                </TableCell>
-                            )}
+                            <TableCell align="right">
+                                <MoreButton name={row.name} isDir={row.is_dir} allowDelete={props.allowDelete} canWrite={props.canWrite} allowShare={props.allowShare} trash={props.trash} versions={props.versions}/>
+                            </TableCell>
                         </TableRow>
                     ))}
                 </TableBody>
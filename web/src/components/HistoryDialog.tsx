@@ -0,0 +1,137 @@
+import Button from "@mui/material/Button";
+import Dialog from "@mui/material/Dialog";
+import DialogActions from "@mui/material/DialogActions";
+import DialogContent from "@mui/material/DialogContent";
+import DialogContentText from "@mui/material/DialogContentText";
+import DialogTitle from "@mui/material/DialogTitle";
+import IconButton from "@mui/material/IconButton";
+import List from "@mui/material/List";
+import ListItem from "@mui/material/ListItem";
+import ListItemText from "@mui/material/ListItemText";
+import Alert from "@mui/material/Alert";
+import Tooltip from "@mui/material/Tooltip";
+import useMediaQuery from "@mui/material/useMediaQuery";
+import {useTheme} from "@mui/material/styles";
+import DownloadIcon from '@mui/icons-material/Download';
+import RestoreIcon from '@mui/icons-material/Restore';
+import {useEffect, useState} from "react";
+import axios from "axios";
+import {formatModTime, humanFileSize} from "../utils/humanize";
+
+export interface VersionInfo {
+    id: string
+    size: number
+    mod_time: string
+    saved: string
+}
+
+export interface HistoryDialogProps {
+    open: boolean
+    name: string
+    targetPath: string
+    canWrite: boolean
+    onClose: () => void
+    onSuccess: () => void
+}
+
+/** Lists the previous versions of a file, to download or restore them. */
+export default function HistoryDialog(props: HistoryDialogProps) {
+    const theme = useTheme()
+    const fullScreen = useMediaQuery(theme.breakpoints.down('sm'))
+    const [versions, setVersions] = useState<VersionInfo[] | null>(null)
+    const [restoring, setRestoring] = useState(false)
+    const [error, setError] = useState("")
+
+    useEffect(() => {
+        axios.get<VersionInfo[]>(props.targetPath + '?versions')
+            .then((res) => setVersions(res.data))
+            .catch((err) => setError(err.response?.data?.trim() || err.response?.statusText || "Failed to load the history"))
+    }, [props.targetPath])
+
+    const handleRestore = (version: VersionInfo) => {
+        setRestoring(true)
+        axios.post(`${props.targetPath}?action=restore&version=${version.id}`)
+            .then(() => props.onSuccess())
+            .catch((err) => {
+                setError(err.response?.data?.trim() || err.response?.statusText || "Failed to restore the version")
+                setRestoring(false)
+            })
+    }
+
+    return (
+        <Dialog
+            open={props.open}
+            fullWidth
+            maxWidth="sm"
+            fullScreen={fullScreen}
+            onClose={props.onClose}
+            PaperProps={{
+                sx: fullScreen
+                    ? {
+                        pt: 'max(12px, env(safe-area-inset-top))',
+                        pb: 'max(12px, env(safe-area-inset-bottom))',
+                    }
+                    : undefined,
+            }}
+        >
+            <DialogTitle sx={{wordBreak: 'break-all'}}>History of {props.name}</DialogTitle>
+            <DialogContent sx={{px: {xs: 2, sm: 3}}}>
+                {error && <Alert severity="error" sx={{mb: 1}}>{error}</Alert>}
+                {versions && versions.length === 0 && (
+                    <DialogContentText>No previous versions are kept for this file.</DialogContentText>
+                )}
+                {versions && versions.length > 0 && (
+                    <List dense disablePadding>
+                        {versions.map((version) => (
+                            <ListItem
+                                key={version.id}
+                                disableGutters
+                                secondaryAction={
+                                    <>
+                                        <Tooltip title="Download">
+                                            <IconButton
+                                                aria-label={`Download the version replaced ${formatModTime(version.saved)}`}
+                                                href={`${props.targetPath}?version=${version.id}`}
+                                            >
+                                                <DownloadIcon fontSize="small"/>
+                                            </IconButton>
+                                        </Tooltip>
+                                        {props.canWrite && (
+                                            <Tooltip title="Restore">
+                                                <IconButton
+                                                    aria-label={`Restore the version replaced ${formatModTime(version.saved)}`}
+                                                    edge="end"
+                                                    disabled={restoring}
+                                                    onClick={() => handleRestore(version)}
+                                                >
+                                                    <RestoreIcon fontSize="small"/>
+                                                </IconButton>
+                                            </Tooltip>
+                                        )}
+                                    </>
+                                }
+                                sx={{pr: 10}}
+                            >
+                                <ListItemText
+                                    primary={`Replaced ${formatModTime(version.saved)}`}
+                                    secondary={`Modified ${formatModTime(version.mod_time)} · ${humanFileSize(version.size)}`}
+                                />
+                            </ListItem>
+                        ))}
+                    </List>
+                )}
+            </DialogContent>
+            <DialogActions
+                sx={{
+                    px: {xs: 2, sm: 3},
+                    pb: {xs: 'max(16px, env(safe-area-inset-bottom))', sm: 2},
+                    pt: 1,
+                }}
+            >
+                <Button fullWidth={fullScreen} onClick={props.onClose} size="large">
+                    Close
+                </Button>
+            </DialogActions>
+        </Dialog>
+    )
+}
@@ -0,0 +1,77 @@
+import Alert from "@mui/material/Alert";
+import Box from "@mui/material/Box";
+import Button from "@mui/material/Button";
+import Paper from "@mui/material/Paper";
+import Stack from "@mui/material/Stack";
+import TextField from "@mui/material/TextField";
+import Typography from "@mui/material/Typography";
+
+export interface LoginPageProps {
+    failed: boolean
+}
+
+/**
+ * Sign-in form for the built-in login. It is a plain form post, so the
+ * server can set the session cookie and redirect back to `next`.
+ */
+export default function LoginPage(props: LoginPageProps) {
+    const next = new URLSearchParams(window.location.search).get('next') || '/'
+
+    return (
+        <Box
+            component="main"
+            sx={{
+                minHeight: '100vh',
+                bgcolor: 'background.default',
+                display: 'flex',
+                alignItems: 'center',
+                justifyContent: 'center',
+                px: 1.5,
+            }}
+        >
+            <Paper
+                elevation={0}
+                sx={{
+                    width: '100%',
+                    maxWidth: 380,
+                    p: {xs: 2.5, sm: 3},
+                    border: '1px solid',
+                    borderColor: 'divider',
+                    borderRadius: 2,
+                    boxShadow: '0 1px 3px rgba(15, 23, 42, 0.06)',
+                }}
+            >
+                <form method="post" action="/_auth/login">
+                    <Stack spacing={2}>
+                        <Typography variant="h5" component="h1">
+                            Sign in
+                        </Typography>
+                        {props.failed && (
+                            <Alert severity="error">Wrong username or password.</Alert>
+                        )}
+                        <input type="hidden" name="next" value={next}/>
+                        <TextField
+                            autoFocus
+                            required
+                            name="username"
+                            label="Username"
+                            autoComplete="username"
+                            fullWidth
+                        />
+                        <TextField
+                            required
+                            name="password"
+                            label="Password"
+                            type="password"
+                            autoComplete="current-password"
+                            fullWidth
+                        />
+                        <Button type="submit" variant="contained" size="large" fullWidth>
+                            Sign in
+                        </Button>
+                    </Stack>
+                </form>
+            </Paper>
+        </Box>
+    )
+}
@@ -1,5 +1,15 @@
 import IconButton from '@mui/material/IconButton';
+import Menu from '@mui/material/Menu';
+import MenuItem from '@mui/material/MenuItem';
+import ListItemIcon from '@mui/material/ListItemIcon';
+import ListItemText from '@mui/material/ListItemText';
+import MoreVertIcon from '@mui/icons-material/MoreVert';
 import DeleteIcon from '@mui/icons-material/Delete';
+import ArchiveOutlinedIcon from '@mui/icons-material/ArchiveOutlined';
+import DriveFileRenameOutlineIcon from '@mui/icons-material/DriveFileRenameOutline';
+import DriveFileMoveOutlinedIcon from '@mui/icons-material/DriveFileMoveOutlined';
+import ShareOutlinedIcon from '@mui/icons-material/ShareOutlined';
+import HistoryIcon from '@mui/icons-material/History';
 import Dialog from '@mui/material/Dialog';
 import DialogTitle from '@mui/material/DialogTitle';
 import DialogContent from '@mui/material/DialogContent';
@@ -12,21 +22,34 @@ import useMediaQuery from '@mui/material/useMediaQuery';
 import {useTheme} from '@mui/material/styles';
 import {useState} from "react";
 import axios from "axios";
+import MoveDialog from "./MoveDialog";
+import ShareDialog from "./ShareDialog";
+import HistoryDialog from "./HistoryDialog";
 
 export interface MoreButtonProps {
     name: string
     isDir: boolean
     allowDelete: boolean
+    canWrite: boolean
+    allowShare: boolean
+    /** Deletes go to the trash rather than being permanent. */
+    trash?: boolean
+    /** Files keep the versions uploads replaced. */
+    versions?: boolean
 }
 
 export default function MoreButton(props: MoreButtonProps) {
     const theme = useTheme()
     const fullScreen = useMediaQuery(theme.breakpoints.down('sm'))
+    const [anchorEl, setAnchorEl] = useState<HTMLElement | null>(null)
     const [confirmOpen, setConfirmOpen] = useState(false)
     const [deleting, setDeleting] = useState(false)
     const [errorMsg, setErrorMsg] = useState<string | null>(null)
+    const [moveMode, setMoveMode] = useState<'rename' | 'move' | null>(null)
+    const [shareOpen, setShareOpen] = useState(false)
+    const [historyOpen, setHistoryOpen] = useState(false)
 
-    if (!props.allowDelete) {
+    if (!props.isDir && !props.allowDelete && !props.canWrite && !props.allowShare && !props.versions) {
         return null
     }
 
@@ -34,6 +57,11 @@ export default function MoreButton(props: MoreButtonProps) {
         ? window.location.pathname + props.name + '/'
         : window.location.pathname + props.name
 
+    const handleDownloadZip = () => {
+        setAnchorEl(null)
+        window.location.href = targetPath + '?archive=zip'
+    }
+
     const handleDelete = () => {
         setDeleting(true)
         axios.delete(targetPath)
@@ -50,13 +78,83 @@ export default function MoreButton(props: MoreButtonProps) {
     return (
         <>
             <IconButton
-                aria-label={`Delete ${props.isDir ? 'folder' : 'file'} ${props.name}`}
+                aria-label={`More actions for ${props.name}`}
                 size="medium"
-                onClick={() => setConfirmOpen(true)}
-                sx={{flexShrink: 0, color: 'text.secondary', '&:hover': {color: 'error.main'}}}
+                onClick={(e) => setAnchorEl(e.currentTarget)}
+                sx={{flexShrink: 0, color: 'text.secondary'}}
             >
-                <DeleteIcon fontSize="small"/>
+                <MoreVertIcon fontSize="small"/>
             </IconButton>
+            <Menu
+                anchorEl={anchorEl}
+                open={!!anchorEl}
+                onClose={() => setAnchorEl(null)}
+                anchorOrigin={{vertical: 'bottom', horizontal: 'right'}}
+                transformOrigin={{vertical: 'top', horizontal: 'right'}}
+            >
+                {props.canWrite && (
+                    <MenuItem
+                        onClick={() => {
+                            setAnchorEl(null)
+                            setMoveMode('rename')
+                        }}
+                    >
+                        <ListItemIcon><DriveFileRenameOutlineIcon fontSize="small"/></ListItemIcon>
+                        <ListItemText>Rename</ListItemText>
+                    </MenuItem>
+                )}
+                {props.canWrite && (
+                    <MenuItem
+                        onClick={() => {
+                            setAnchorEl(null)
+                            setMoveMode('move')
+                        }}
+                    >
+                        <ListItemIcon><DriveFileMoveOutlinedIcon fontSize="small"/></ListItemIcon>
+                        <ListItemText>Move to…</ListItemText>
+                    </MenuItem>
+                )}
+                {props.allowShare && (
+                    <MenuItem
+                        onClick={() => {
+                            setAnchorEl(null)
+                            setShareOpen(true)
+                        }}
+                    >
+                        <ListItemIcon><ShareOutlinedIcon fontSize="small"/></ListItemIcon>
+                        <ListItemText>Share…</ListItemText>
+                    </MenuItem>
+                )}
+                {props.versions && !props.isDir && (
+                    <MenuItem
+                        onClick={() => {
+                            setAnchorEl(null)
+                            setHistoryOpen(true)
+                        }}
+                    >
+                        <ListItemIcon><HistoryIcon fontSize="small"/></ListItemIcon>
+                        <ListItemText>History</ListItemText>
+                    </MenuItem>
+                )}
+                {props.isDir && (
+                    <MenuItem onClick={handleDownloadZip}>
+                        <ListItemIcon><ArchiveOutlinedIcon fontSize="small"/></ListItemIcon>
+                        <ListItemText>Download as ZIP</ListItemText>
+                    </MenuItem>
+                )}
+                {props.allowDelete && (
+                    <MenuItem
+                        onClick={() => {
+                            setAnchorEl(null)
+                            setConfirmOpen(true)
+                        }}
+                        sx={{color: 'error.main'}}
+                    >
+                        <ListItemIcon><DeleteIcon fontSize="small" color="error"/></ListItemIcon>
+                        <ListItemText>Delete</ListItemText>
+                    </MenuItem>
+                )}
+            </Menu>
             <Dialog
                 open={confirmOpen}
                 fullScreen={fullScreen}
@@ -75,9 +173,9 @@ export default function MoreButton(props: MoreButtonProps) {
                 <DialogTitle>Delete {props.isDir ? 'folder' : 'file'}?</DialogTitle>
                 <DialogContent>
                     <DialogContentText component="div">
-                        This will permanently delete {props.isDir ? 'folder' : 'file'}{' '}
-                        <strong>{props.name}</strong>.
-                        {props.isDir && ' Everything inside will be removed.'}
+                        {props.trash ? 'This will move' : 'This will permanently delete'} {props.isDir ? 'folder' : 'file'}{' '}
+                        <strong>{props.name}</strong>{props.trash ? ' to the trash, from where it can be restored.' : '.'}
+                        {props.isDir && !props.trash && ' Everything inside will be removed.'}
                     </DialogContentText>
                 </DialogContent>
                 <DialogActions
@@ -104,6 +202,34 @@ export default function MoreButton(props: MoreButtonProps) {
                     </Button>
                 </DialogActions>
             </Dialog>
+            {moveMode && (
+                <MoveDialog
+                    open
+                    mode={moveMode}
+                    name={props.name}
+                    targetPath={targetPath}
+                    onClose={() => setMoveMode(null)}
+                    onSuccess={() => window.location.reload()}
+                />
+            )}
+            {shareOpen && (
+                <ShareDialog
+                    open
+                    name={props.name}
+                    path={decodeURIComponent(window.location.pathname) + props.name}
+                    onClose={() => setShareOpen(false)}
+                />
+            )}
+            {historyOpen && (
+                <HistoryDialog
+                    open
+                    name={props.name}
+                    targetPath={targetPath}
+                    canWrite={props.canWrite}
+                    onClose={() => setHistoryOpen(false)}
+                    onSuccess={() => window.location.reload()}
+                />
+            )}
             <Snackbar
                 open={!!errorMsg}
                 autoHideDuration={6000}
@@ -0,0 +1,119 @@
+import Button from "@mui/material/Button";
+import Dialog from "@mui/material/Dialog";
+import DialogActions from "@mui/material/DialogActions";
+import DialogContent from "@mui/material/DialogContent";
+import DialogTitle from "@mui/material/DialogTitle";
+import TextField from "@mui/material/TextField";
+import useMediaQuery from "@mui/material/useMediaQuery";
+import {useTheme} from "@mui/material/styles";
+import {useState} from "react";
+import axios from "axios";
+
+export interface MoveDialogProps {
+    open: boolean
+    mode: 'rename' | 'move'
+    name: string
+    targetPath: string
+    onClose: () => void
+    onSuccess: () => void
+}
+
+export default function MoveDialog(props: MoveDialogProps) {
+    const theme = useTheme()
+    const fullScreen = useMediaQuery(theme.breakpoints.down('sm'))
+    const currentDir = decodeURIComponent(window.location.pathname)
+    const [value, setValue] = useState(props.mode === 'rename' ? props.name : currentDir)
+    const [error, setError] = useState("")
+    const [loading, setLoading] = useState(false)
+
+    const handleSubmit = () => {
+        const input = value.trim()
+        if (!input) {
+            setError(props.mode === 'rename' ? "Name is required" : "Folder is required")
+            return
+        }
+        if (props.mode === 'rename' && input.includes('/')) {
+            setError("Name must not contain '/'")
+            return
+        }
+        setLoading(true)
+        setError("")
+
+        // A trailing slash asks the server to keep the name and move the
+        // entry into that folder.
+        const to = props.mode === 'rename'
+            ? currentDir + input
+            : '/' + input.replace(/^\/+|\/+$/g, '') + '/'
+        axios.post(`${props.targetPath}?action=move&to=${encodeURIComponent(to)}`)
+            .then(() => {
+                props.onSuccess()
+            })
+            .catch((err) => {
+                setError(err.response?.data?.trim() || err.response?.statusText || "Failed to move")
+                setLoading(false)
+            })
+    }
+
+    return (
+        <Dialog
+            open={props.open}
+            fullWidth
+            maxWidth="sm"
+            fullScreen={fullScreen}
+            onClose={() => !loading && props.onClose()}
+            PaperProps={{
+                sx: fullScreen
+                    ? {
+                        pt: 'max(12px, env(safe-area-inset-top))',
+                        pb: 'max(12px, env(safe-area-inset-bottom))',
+                    }
+                    : undefined,
+            }}
+        >
+            <DialogTitle>{props.mode === 'rename' ? 'Rename' : `Move ${props.name}`}</DialogTitle>
+            <DialogContent sx={{px: {xs: 2, sm: 3}}}>
+                <TextField
+                    autoFocus
+                    margin="dense"
+                    label={props.mode === 'rename' ? "New name" : "Destination folder"}
+                    fullWidth
+                    variant="outlined"
+                    size={fullScreen ? 'medium' : 'small'}
+                    value={value}
+                    onChange={(e) => {
+                        setValue(e.target.value)
+                        setError("")
+                    }}
+                    error={!!error}
+                    helperText={error}
+                    onKeyDown={(e) => {
+                        if (e.key === "Enter") handleSubmit()
+                    }}
+                />
+            </DialogContent>
+            <DialogActions
+                sx={{
+                    px: {xs: 2, sm: 3},
+                    pb: {xs: 'max(16px, env(safe-area-inset-bottom))', sm: 2},
+                    pt: 1,
+                    flexDirection: {xs: 'column-reverse', sm: 'row'},
+                    gap: 1,
+                    '& .MuiButton-root': {marginLeft: '0 !important'},
+                }}
+            >
+                <Button fullWidth={fullScreen} onClick={props.onClose} disabled={loading} size="large">
+                    Cancel
+                </Button>
+                <Button
+                    fullWidth={fullScreen}
+                    variant="contained"
+                    onClick={handleSubmit}
+                    disabled={loading || !value.trim()}
+                    size="large"
+                >
+                    {props.mode === 'rename' ? 'Rename' : 'Move'}
+                </Button>
+            </DialogActions>
+        </Dialog>
+    )
+}
@@ -0,0 +1,201 @@
+import Button from "@mui/material/Button";
+import Dialog from "@mui/material/Dialog";
+import DialogActions from "@mui/material/DialogActions";
+import DialogContent from "@mui/material/DialogContent";
+import DialogContentText from "@mui/material/DialogContentText";
+import DialogTitle from "@mui/material/DialogTitle";
+import MenuItem from "@mui/material/MenuItem";
+import Stack from "@mui/material/Stack";
+import TextField from "@mui/material/TextField";
+import Alert from "@mui/material/Alert";
+import useMediaQuery from "@mui/material/useMediaQuery";
+import {useTheme} from "@mui/material/styles";
+import {useState} from "react";
+import axios from "axios";
+
+/** A share link as returned by the /_shares API. */
+export interface ShareInfo {
+    id: string
+    path: string
+    url: string
+    is_dir: boolean
+    created: string
+    expires: string
+    max_downloads?: number
+    downloads: number
+    password: boolean
+}
+
+export const SHARES_ENDPOINT = '/_shares'
+
+const expiryOptions = [
+    {value: '1h', label: '1 hour'},
+    {value: '24h', label: '1 day'},
+    {value: '168h', label: '7 days'},
+    {value: '720h', label: '30 days'},
+]
+
+/** Absolute form of a share URL, ready to be sent to someone. */
+export function shareLink(share: ShareInfo): string {
+    return window.location.origin + share.url
+}
+
+export interface ShareDialogProps {
+    open: boolean
+    name: string
+    path: string
+    onClose: () => void
+}
+
+export default function ShareDialog(props: ShareDialogProps) {
+    const theme = useTheme()
+    const fullScreen = useMediaQuery(theme.breakpoints.down('sm'))
+    const [expiresIn, setExpiresIn] = useState('24h')
+    const [maxDownloads, setMaxDownloads] = useState('')
+    const [password, setPassword] = useState('')
+    const [error, setError] = useState("")
+    const [loading, setLoading] = useState(false)
+    const [share, setShare] = useState<ShareInfo | null>(null)
+    const [copied, setCopied] = useState(false)
+
+    const handleSubmit = () => {
+        const limit = maxDownloads.trim() === '' ? 0 : Number(maxDownloads)
+        if (!Number.isInteger(limit) || limit < 0) {
+            setError("Download limit must be a whole number")
+            return
+        }
+        setLoading(true)
+        setError("")
+        axios.post<ShareInfo>(SHARES_ENDPOINT, {
+            path: props.path,
+            expires_in: expiresIn,
+            max_downloads: limit,
+            password: password,
+        })
+            .then((res) => {
+                setShare(res.data)
+                setLoading(false)
+            })
+            .catch((err) => {
+                setError(err.response?.data?.trim() || err.response?.statusText || "Failed to create link")
+                setLoading(false)
+            })
+    }
+
+    const handleCopy = () => {
+        if (!share) {
+            return
+        }
+        navigator.clipboard.writeText(shareLink(share))
+            .then(() => setCopied(true))
+            .catch(() => setError("Copy failed, select the link and copy it manually"))
+    }
+
+    return (
+        <Dialog
+            open={props.open}
+            fullWidth
+            maxWidth="sm"
+            fullScreen={fullScreen}
+            onClose={() => !loading && props.onClose()}
+            PaperProps={{
+                sx: fullScreen
+                    ? {
+                        pt: 'max(12px, env(safe-area-inset-top))',
+                        pb: 'max(12px, env(safe-area-inset-bottom))',
+                    }
+                    : undefined,
+            }}
+        >
+            <DialogTitle>Share {props.name}</DialogTitle>
+            <DialogContent sx={{px: {xs: 2, sm: 3}}}>
+                {share ? (
+                    <Stack spacing={2} sx={{pt: 1}}>
+                        <DialogContentText>
+                            Anyone with this link can download <strong>{props.name}</strong> until{' '}
+                            {new Date(share.expires).toLocaleString()}
+                            {share.password && ', using the password you set'}.
+                        </DialogContentText>
+                        <TextField
+                            label="Link"
+                            fullWidth
+                            variant="outlined"
+                            size={fullScreen ? 'medium' : 'small'}
+                            value={shareLink(share)}
+                            InputProps={{readOnly: true}}
+                            onFocus={(e) => e.target.select()}
+                            helperText={copied ? "Copied to clipboard" : error}
+                            error={!!error}
+                        />
+                    </Stack>
+                ) : (
+                    <Stack spacing={2} sx={{pt: 1}}>
+                        <TextField
+                            select
+                            label="Expires after"
+                            fullWidth
+                            size={fullScreen ? 'medium' : 'small'}
+                            value={expiresIn}
+                            onChange={(e) => setExpiresIn(e.target.value)}
+                        >
+                            {expiryOptions.map((o) => (
+                                <MenuItem key={o.value} value={o.value}>{o.label}</MenuItem>
+                            ))}
+                        </TextField>
+                        <TextField
+                            label="Download limit (optional)"
+                            type="number"
+                            fullWidth
+                            size={fullScreen ? 'medium' : 'small'}
+                            value={maxDownloads}
+                            inputProps={{min: 1}}
+                            onChange={(e) => {
+                                setMaxDownloads(e.target.value)
+                                setError("")
+                            }}
+                        />
+                        <TextField
+                            label="Password (optional)"
+                            type="password"
+                            autoComplete="new-password"
+                            fullWidth
+                            size={fullScreen ? 'medium' : 'small'}
+                            value={password}
+                            onChange={(e) => setPassword(e.target.value)}
+                        />
+                        {error && <Alert severity="error">{error}</Alert>}
+                    </Stack>
+                )}
+            </DialogContent>
+            <DialogActions
+                sx={{
+                    px: {xs: 2, sm: 3},
+                    pb: {xs: 'max(16px, env(safe-area-inset-bottom))', sm: 2},
+                    pt: 1,
+                    flexDirection: {xs: 'column-reverse', sm: 'row'},
+                    gap: 1,
+                    '& .MuiButton-root': {marginLeft: '0 !important'},
+                }}
+            >
+                <Button fullWidth={fullScreen} onClick={props.onClose} disabled={loading} size="large">
+                    {share ? 'Done' : 'Cancel'}
+                </Button>
+                {share ? (
+                    <Button fullWidth={fullScreen} variant="contained" onClick={handleCopy} size="large">
+                        Copy link
+                    </Button>
+                ) : (
+                    <Button
+                        fullWidth={fullScreen}
+                        variant="contained"
+                        onClick={handleSubmit}
+                        disabled={loading}
+                        size="large"
+                    >
+                        Create link
+                    </Button>
+                )}
+            </DialogActions>
+        </Dialog>
+    )
+}
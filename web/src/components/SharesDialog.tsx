@@ -0,0 +1,134 @@
+import Button from "@mui/material/Button";
+import Dialog from "@mui/material/Dialog";
+import DialogActions from "@mui/material/DialogActions";
+import DialogContent from "@mui/material/DialogContent";
+import DialogContentText from "@mui/material/DialogContentText";
+import DialogTitle from "@mui/material/DialogTitle";
+import IconButton from "@mui/material/IconButton";
+import List from "@mui/material/List";
+import ListItem from "@mui/material/ListItem";
+import ListItemText from "@mui/material/ListItemText";
+import Alert from "@mui/material/Alert";
+import Tooltip from "@mui/material/Tooltip";
+import useMediaQuery from "@mui/material/useMediaQuery";
+import {useTheme} from "@mui/material/styles";
+import ContentCopyIcon from '@mui/icons-material/ContentCopy';
+import LinkOffIcon from '@mui/icons-material/LinkOff';
+import {useEffect, useState} from "react";
+import axios from "axios";
+import {formatModTime} from "../utils/humanize";
+import {SHARES_ENDPOINT, ShareInfo, shareLink} from "./ShareDialog";
+
+export interface SharesDialogProps {
+    open: boolean
+    onClose: () => void
+}
+
+function describe(share: ShareInfo): string {
+    const parts = [`Expires ${formatModTime(share.expires)}`]
+    if (share.max_downloads) {
+        parts.push(`${share.downloads}/${share.max_downloads} downloads`)
+    } else {
+        parts.push(`${share.downloads} downloads`)
+    }
+    if (share.password) {
+        parts.push('password')
+    }
+    return parts.join(' · ')
+}
+
+/** Lists the current user's active share links and lets them be revoked. */
+export default function SharesDialog(props: SharesDialogProps) {
+    const theme = useTheme()
+    const fullScreen = useMediaQuery(theme.breakpoints.down('sm'))
+    const [shares, setShares] = useState<ShareInfo[] | null>(null)
+    const [error, setError] = useState("")
+
+    useEffect(() => {
+        axios.get<ShareInfo[]>(SHARES_ENDPOINT)
+            .then((res) => setShares(res.data))
+            .catch((err) => setError(err.response?.data?.trim() || err.response?.statusText || "Failed to load links"))
+    }, [])
+
+    const handleRevoke = (share: ShareInfo) => {
+        axios.delete(`${SHARES_ENDPOINT}/${share.id}`)
+            .then(() => setShares((prev) => (prev || []).filter((s) => s.id !== share.id)))
+            .catch((err) => setError(err.response?.data?.trim() || err.response?.statusText || "Failed to revoke link"))
+    }
+
+    return (
+        <Dialog
+            open={props.open}
+            fullWidth
+            maxWidth="sm"
+            fullScreen={fullScreen}
+            onClose={props.onClose}
+            PaperProps={{
+                sx: fullScreen
+                    ? {
+                        pt: 'max(12px, env(safe-area-inset-top))',
+                        pb: 'max(12px, env(safe-area-inset-bottom))',
+                    }
+                    : undefined,
+            }}
+        >
+            <DialogTitle>Shared links</DialogTitle>
+            <DialogContent sx={{px: {xs: 2, sm: 3}}}>
+                {error && <Alert severity="error" sx={{mb: 1}}>{error}</Alert>}
+                {shares && shares.length === 0 && (
+                    <DialogContentText>You have no active shared links.</DialogContentText>
+                )}
+                {shares && shares.length > 0 && (
+                    <List dense disablePadding>
+                        {shares.map((share) => (
+                            <ListItem
+                                key={share.id}
+                                disableGutters
+                                secondaryAction={
+                                    <>
+                                        <Tooltip title="Copy link">
+                                            <IconButton
+                                                aria-label={`Copy link to ${share.path}`}
+                                                onClick={() => navigator.clipboard.writeText(shareLink(share))}
+                                            >
+                                                <ContentCopyIcon fontSize="small"/>
+                                            </IconButton>
+                                        </Tooltip>
+                                        <Tooltip title="Revoke">
+                                            <IconButton
+                                                aria-label={`Revoke link to ${share.path}`}
+                                                edge="end"
+                                                onClick={() => handleRevoke(share)}
+                                                sx={{color: 'error.main'}}
+                                            >
+                                                <LinkOffIcon fontSize="small"/>
+                                            </IconButton>
+                                        </Tooltip>
+                                    </>
+                                }
+                                sx={{pr: 10}}
+                            >
+                                <ListItemText
+                                    primary={share.path}
+                                    secondary={describe(share)}
+                                    primaryTypographyProps={{sx: {wordBreak: 'break-all'}}}
+                                />
+                            </ListItem>
+                        ))}
+                    </List>
+                )}
+            </DialogContent>
+            <DialogActions
+                sx={{
+                    px: {xs: 2, sm: 3},
+                    pb: {xs: 'max(16px, env(safe-area-inset-bottom))', sm: 2},
+                    pt: 1,
+                }}
+            >
+                <Button fullWidth={fullScreen} onClick={props.onClose} size="large">
+                    Close
+                </Button>
+            </DialogActions>
+        </Dialog>
+    )
+}
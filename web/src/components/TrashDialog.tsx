@@ -0,0 +1,163 @@
+import Button from "@mui/material/Button";
+import Dialog from "@mui/material/Dialog";
+import DialogActions from "@mui/material/DialogActions";
+import DialogContent from "@mui/material/DialogContent";
+import DialogContentText from "@mui/material/DialogContentText";
+import DialogTitle from "@mui/material/DialogTitle";
+import IconButton from "@mui/material/IconButton";
+import List from "@mui/material/List";
+import ListItem from "@mui/material/ListItem";
+import ListItemText from "@mui/material/ListItemText";
+import Alert from "@mui/material/Alert";
+import Tooltip from "@mui/material/Tooltip";
+import useMediaQuery from "@mui/material/useMediaQuery";
+import {useTheme} from "@mui/material/styles";
+import RestoreFromTrashIcon from '@mui/icons-material/RestoreFromTrash';
+import DeleteForeverIcon from '@mui/icons-material/DeleteForever';
+import {useEffect, useState} from "react";
+import axios from "axios";
+import {formatModTime, humanFileSize} from "../utils/humanize";
+
+export const TRASH_ENDPOINT = '/_trash'
+
+export interface TrashInfo {
+    id: string
+    path: string
+    is_dir: boolean
+    size: number
+    deleted_by: string
+    deleted: string
+}
+
+export interface TrashDialogProps {
+    open: boolean
+    /** Called with whether anything was restored. */
+    onClose: (restored: boolean) => void
+}
+
+function describe(item: TrashInfo): string {
+    return `Deleted ${formatModTime(item.deleted)} by ${item.deleted_by} · ${humanFileSize(item.size)}`
+}
+
+function errorMessage(err: any, fallback: string): string {
+    return err.response?.data?.trim() || err.response?.statusText || fallback
+}
+
+/** Lists the deleted files and folders the user may restore or purge. */
+export default function TrashDialog(props: TrashDialogProps) {
+    const theme = useTheme()
+    const fullScreen = useMediaQuery(theme.breakpoints.down('sm'))
+    const [items, setItems] = useState<TrashInfo[] | null>(null)
+    const [restored, setRestored] = useState(false)
+    const [error, setError] = useState("")
+
+    useEffect(() => {
+        axios.get<TrashInfo[]>(TRASH_ENDPOINT)
+            .then((res) => setItems(res.data))
+            .catch((err) => setError(errorMessage(err, "Failed to load the trash")))
+    }, [])
+
+    const remove = (item: TrashInfo) => setItems((prev) => (prev || []).filter((i) => i.id !== item.id))
+
+    const handleRestore = (item: TrashInfo) => {
+        axios.post(`${TRASH_ENDPOINT}/${item.id}?action=restore`)
+            .then(() => {
+                remove(item)
+                setRestored(true)
+            })
+            .catch((err) => setError(errorMessage(err, "Failed to restore " + item.path)))
+    }
+
+    const handlePurge = (item: TrashInfo) => {
+        axios.delete(`${TRASH_ENDPOINT}/${item.id}`)
+            .then(() => remove(item))
+            .catch((err) => setError(errorMessage(err, "Failed to delete " + item.path)))
+    }
+
+    const handleEmpty = () => {
+        axios.delete(TRASH_ENDPOINT)
+            .then(() => setItems([]))
+            .catch((err) => setError(errorMessage(err, "Failed to empty the trash")))
+    }
+
+    return (
+        <Dialog
+            open={props.open}
+            fullWidth
+            maxWidth="sm"
+            fullScreen={fullScreen}
+            onClose={() => props.onClose(restored)}
+            PaperProps={{
+                sx: fullScreen
+                    ? {
+                        pt: 'max(12px, env(safe-area-inset-top))',
+                        pb: 'max(12px, env(safe-area-inset-bottom))',
+                    }
+                    : undefined,
+            }}
+        >
+            <DialogTitle>Trash</DialogTitle>
+            <DialogContent sx={{px: {xs: 2, sm: 3}}}>
+                {error && <Alert severity="error" sx={{mb: 1}}>{error}</Alert>}
+                {items && items.length === 0 && (
+                    <DialogContentText>The trash is empty.</DialogContentText>
+                )}
+                {items && items.length > 0 && (
+                    <List dense disablePadding>
+                        {items.map((item) => (
+                            <ListItem
+                                key={item.id}
+                                disableGutters
+                                secondaryAction={
+                                    <>
+                                        <Tooltip title="Restore">
+                                            <IconButton
+                                                aria-label={`Restore ${item.path}`}
+                                                onClick={() => handleRestore(item)}
+                                            >
+                                                <RestoreFromTrashIcon fontSize="small"/>
+                                            </IconButton>
+                                        </Tooltip>
+                                        <Tooltip title="Delete forever">
+                                            <IconButton
+                                                aria-label={`Delete ${item.path} forever`}
+                                                edge="end"
+                                                onClick={() => handlePurge(item)}
+                                                sx={{color: 'error.main'}}
+                                            >
+                                                <DeleteForeverIcon fontSize="small"/>
+                                            </IconButton>
+                                        </Tooltip>
+                                    </>
+                                }
+                                sx={{pr: 10}}
+                            >
+                                <ListItemText
+                                    primary={item.is_dir ? item.path + '/' : item.path}
+                                    secondary={describe(item)}
+                                    primaryTypographyProps={{sx: {wordBreak: 'break-all'}}}
+                                />
+                            </ListItem>
+                        ))}
+                    </List>
+                )}
+            </DialogContent>
+            <DialogActions
+                sx={{
+                    px: {xs: 2, sm: 3},
+                    pb: {xs: 'max(16px, env(safe-area-inset-bottom))', sm: 2},
+                    pt: 1,
+                }}
+            >
+                {items && items.length > 0 && (
+                    <Button color="error" onClick={handleEmpty} size="large">
+                        Empty trash
+                    </Button>
+                )}
+                <Button fullWidth={fullScreen} onClick={() => props.onClose(restored)} size="large">
+                    Close
+                </Button>
+            </DialogActions>
+        </Dialog>
+    )
+}
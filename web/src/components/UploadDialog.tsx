@@ -14,6 +14,7 @@ import FilePreviewList from "./FilePreviewList";
 import {useState, useRef, useCallback} from "react";
 import axios, {CancelTokenSource} from "axios";
 import {humanFileSize} from "../utils/humanize";
+import {tusUpload} from "../utils/tus";
 
 export interface UploaderDialogProps {
     open: boolean
@@ -77,17 +78,14 @@ export default function UploadDialog(props: UploaderDialogProps) {
     }
 
     const doUpload = (index: number, file: File) => {
-        const data = new FormData()
-        data.append('file', file)
-
         const source = axios.CancelToken.source()
         cancelTokens.current[index] = source
 
-        axios.post(window.location.pathname, data, {
+        tusUpload(window.location.pathname, file, {
             cancelToken: source.token,
-            onUploadProgress: (p) => {
-                if (p.total) {
-                    updateProgress(index, (p.loaded / p.total) * 100)
+            onProgress: (loaded, total) => {
+                if (total) {
+                    updateProgress(index, (loaded / total) * 100)
                 }
             }
         }).then(() => {
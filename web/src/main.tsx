@@ -1,16 +1,26 @@
 import React from 'react'
+import axios from 'axios'
 import ReactDOM from 'react-dom'
 import {ThemeProvider} from '@mui/material/styles'
 import CssBaseline from '@mui/material/CssBaseline'
 import './index.less'
 import App from './App'
+import LoginPage from './components/LoginPage'
 import {appTheme} from './theme'
 
+const data = window.__INITIAL_DATA__
+
+// Uploads, new folders, moves, deletes and share changes made with a login
+// session must carry its CSRF token.
+if (data.csrf_token) {
+    axios.defaults.headers.common['X-CSRF-Token'] = data.csrf_token
+}
+
 ReactDOM.render(
     <React.StrictMode>
         <ThemeProvider theme={appTheme}>
             <CssBaseline/>
-            <App/>
+            {data.login ? <LoginPage failed={data.login.failed}/> : <App/>}
         </ThemeProvider>
     </React.StrictMode>,
     document.getElementById('root')
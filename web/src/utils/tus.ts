@@ -0,0 +1,94 @@
+import axios, {CancelToken} from "axios";
+
+const TUS_VERSION = '1.0.0'
+const CHUNK_SIZE = 8 * 1024 * 1024
+
+export interface TusUploadOptions {
+    cancelToken?: CancelToken
+    /** Called with the number of bytes the server has acknowledged so far. */
+    onProgress?: (loaded: number, total: number) => void
+}
+
+/** Base64-encode a string as UTF-8, as required by Upload-Metadata. */
+function encodeMetadata(value: string): string {
+    const bytes = new TextEncoder().encode(value)
+    let binary = ''
+    bytes.forEach(b => binary += String.fromCharCode(b))
+    return btoa(binary)
+}
+
+/**
+ * Key under which an unfinished upload's URL is remembered, so that picking
+ * the same file for the same directory after a reload resumes it.
+ */
+function fingerprint(endpoint: string, file: File): string {
+    return ['tus', endpoint, file.name, file.size, file.lastModified].join('::')
+}
+
+async function resumeOffset(url: string, cancelToken?: CancelToken): Promise<number | null> {
+    try {
+        const res = await axios.head(url, {
+            headers: {'Tus-Resumable': TUS_VERSION},
+            cancelToken,
+        })
+        return parseInt(res.headers['upload-offset'], 10)
+    } catch (err) {
+        if (axios.isCancel(err)) {
+            throw err
+        }
+        return null
+    }
+}
+
+async function create(endpoint: string, file: File, cancelToken?: CancelToken): Promise<string> {
+    const res = await axios.post(endpoint, null, {
+        headers: {
+            'Tus-Resumable': TUS_VERSION,
+            'Upload-Length': String(file.size),
+            'Upload-Metadata': `filename ${encodeMetadata(file.name)}`,
+        },
+        cancelToken,
+    })
+    return res.headers['location']
+}
+
+/**
+ * Upload a file to a directory using the tus resumable upload protocol.
+ * Data is sent in chunks; an interrupted upload continues from the last
+ * acknowledged chunk the next time the same file is uploaded.
+ */
+export async function tusUpload(endpoint: string, file: File, options: TusUploadOptions = {}) {
+    const {cancelToken, onProgress} = options
+    const key = fingerprint(endpoint, file)
+
+    let url = localStorage.getItem(key)
+    let offset: number | null = null
+    if (url) {
+        offset = await resumeOffset(url, cancelToken)
+    }
+    if (!url || offset === null) {
+        url = await create(endpoint, file, cancelToken)
+        offset = 0
+        if (file.size > 0) {
+            localStorage.setItem(key, url)
+        }
+    }
+    onProgress?.(offset, file.size)
+
+    while (offset < file.size) {
+        const chunk = file.slice(offset, offset + CHUNK_SIZE)
+        const start = offset
+        const res = await axios.patch(url, chunk, {
+            headers: {
+                'Tus-Resumable': TUS_VERSION,
+                'Upload-Offset': String(offset),
+                'Content-Type': 'application/offset+octet-stream',
+            },
+            cancelToken,
+            onUploadProgress: (p) => onProgress?.(start + p.loaded, file.size),
+        })
+        offset = parseInt(res.headers['upload-offset'], 10)
+    }
+
+    localStorage.removeItem(key)
+}